@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Feed connection tuning. The server answers pings automatically, so a
+// missing pong within wsPongWait means the link is dead even if TCP has
+// not noticed yet.
+const (
+	wsPingInterval = 15 * time.Second
+	wsPongWait     = 40 * time.Second
+	wsWriteWait    = 10 * time.Second
+	wsBackoffMin   = 1 * time.Second
+	wsBackoffMax   = 30 * time.Second
+	wsStableAfter  = time.Minute // a connection up this long resets the backoff
+)
+
+// wsWriteMu serialises data writes on the feed connection; gorilla allows
+// only one concurrent writer (control frames are exempt).
+var wsWriteMu sync.Mutex
+
+func wsWrite(c *websocket.Conn, messageType int, data []byte) error {
+	wsWriteMu.Lock()
+	defer wsWriteMu.Unlock()
+	return wsWriteLocked(c, messageType, data)
+}
+
+func wsWriteLocked(c *websocket.Conn, messageType int, data []byte) error {
+	_ = c.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.WriteMessage(messageType, data)
+}
+
+func wsMeta(clinic, patient string) []byte {
+	meta, _ := json.Marshal(map[string]string{
+		"clinic_name":  clinic,
+		"patient_name": patient,
+	})
+	return meta
+}
+
+// wsAnnounce tells the server which clinic/patient subsequent frames belong to.
+func wsAnnounce(c *websocket.Conn, clinic, patient string) error {
+	return wsWrite(c, websocket.TextMessage, wsMeta(clinic, patient))
+}
+
+// wsSendTagged writes the metadata and frame back to back so frames from
+// concurrent senders are never attributed to the wrong patient.
+func wsSendTagged(c *websocket.Conn, clinic, patient string, frame []byte) error {
+	wsWriteMu.Lock()
+	defer wsWriteMu.Unlock()
+	if err := wsWriteLocked(c, websocket.TextMessage, wsMeta(clinic, patient)); err != nil {
+		return err
+	}
+	return wsWriteLocked(c, websocket.BinaryMessage, frame)
+}
+
+// wsKeepAlive arms the read deadline and pings the server until ctx is done.
+// The caller's read loop fails once pongs stop arriving.
+func wsKeepAlive(ctx context.Context, c *websocket.Conn) {
+	_ = c.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// reconnectDelay returns an exponential backoff with full jitter for the
+// given (zero-based) attempt, capped at wsBackoffMax.
+func reconnectDelay(attempt int) time.Duration {
+	d := wsBackoffMin
+	for i := 0; i < attempt && d < wsBackoffMax; i++ {
+		d *= 2
+	}
+	if d > wsBackoffMax {
+		d = wsBackoffMax
+	}
+	return wsBackoffMin/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// Binary feed frames start with a kind byte so camera images and
+// stethoscope audio can share the connection.
+const (
+	frameKindVideo byte = 0x01
+	frameKindAudio byte = 0x02
+)
+
+// wsSendVideo sends one JPEG frame for the given patient.
+func wsSendVideo(c *websocket.Conn, clinic, patient string, jpegData []byte) error {
+	return wsSendTagged(c, clinic, patient, append([]byte{frameKindVideo}, jpegData...))
+}
+
+// wsSendAudio pushes a PCM chunk to the feed if it is connected. Audio is
+// best effort: chunks are dropped silently while the feed is down.
+func wsSendAudio(clinic, patient string, sampleRate int, samples []int16) error {
+	wsMu.Lock()
+	c := wsConn
+	wsMu.Unlock()
+	if c == nil {
+		return nil
+	}
+	frame := make([]byte, 5+2*len(samples))
+	frame[0] = frameKindAudio
+	binary.LittleEndian.PutUint32(frame[1:], uint32(sampleRate))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(frame[5+2*i:], uint16(s))
+	}
+	return wsSendTagged(c, clinic, patient, frame)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// The uploader logs through log/slog. Records go to stderr (text, or JSON
+// with MEDICART_LOG_FORMAT=json) and to the log area in the window, where
+// the level decides how the status line is coloured.
+
+// requestIDHeader matches the server, which logs and audits the ID.
+const requestIDHeader = "X-Request-ID"
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logLevelFromEnv reads MEDICART_LOG_LEVEL (debug, info, warn, error).
+func logLevelFromEnv() slog.Level {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(os.Getenv("MEDICART_LOG_LEVEL"))); err != nil {
+		return slog.LevelInfo
+	}
+	return lvl
+}
+
+func stderrHandler(level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if os.Getenv("MEDICART_LOG_FORMAT") == "json" {
+		return slog.NewJSONHandler(os.Stderr, opts)
+	}
+	return slog.NewTextHandler(os.Stderr, opts)
+}
+
+// uiHandler renders records as "[15:04:05] message key=value ..." for the
+// log area and hands them to show with their level.
+type uiHandler struct {
+	next   slog.Handler
+	level  slog.Level
+	show   func(level slog.Level, line, message string)
+	attrs  []slog.Attr
+	prefix string // open groups, "a.b."
+}
+
+func newUIHandler(level slog.Level, show func(level slog.Level, line, message string)) *uiHandler {
+	return &uiHandler{next: stderrHandler(level), level: level, show: show}
+}
+
+func (h *uiHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *uiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	for _, a := range h.attrs {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value.Resolve())
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		if !a.Equal(slog.Attr{}) {
+			fmt.Fprintf(&b, " %s%s=%v", h.prefix, a.Key, a.Value.Resolve())
+		}
+		return true
+	})
+	h.show(r.Level, fmt.Sprintf("[%s] %s", r.Time.Format("15:04:05"), b.String()), b.String())
+	return h.next.Handle(ctx, r)
+}
+
+func (h *uiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.next = h.next.WithAttrs(attrs)
+	c.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		c.attrs = append(c.attrs, slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+	}
+	return &c
+}
+
+func (h *uiHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.next = h.next.WithGroup(name)
+	c.prefix = h.prefix + name + "."
+	return &c
+}
@@ -8,12 +8,14 @@ import (
 	"fmt"
 	"image"
 	"image/jpeg"
+	"log/slog"
 	"net/http"
 	"os/exec"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"fyne.io/fyne/v2"
@@ -59,6 +61,100 @@ func main() {
 	urlEntry.SetPlaceHolder("http://your-server.com/api/ingest")
 	urlEntry.Text = "http://localhost:8080/api/data" // Default for testing
 
+	// API Key Input (issued with `web-server keys create`)
+	apiKeyLabel := widget.NewLabel("API Key:")
+	apiKeyEntry := widget.NewPasswordEntry()
+	apiKeyEntry.SetPlaceHolder("mk_...")
+
+	// More places to deliver readings to, e.g. the old and new server
+	// during a migration, or a local JSONL file.
+	destLabel := widget.NewLabel("Additional Destinations (one per line, optional):")
+	destEntry := widget.NewMultiLineEntry()
+	destEntry.SetPlaceHolder("https://new-server/api/ingest [api key]\nwss://new-server/ws/ingest [api key]\nfile:C:\\medicart\\readings.jsonl")
+	destEntry.SetMinRowsVisible(3)
+
+	// Batching for metered links: HTTP destinations get one gzip-compressed
+	// post per window instead of one post per reading.
+	batchCheck := widget.NewCheck("Batch HTTP uploads", nil)
+	batchWindowLabel := widget.NewLabel("Batch Window (seconds):")
+	batchWindowEntry := widget.NewEntry()
+	batchWindowEntry.SetText("5")
+	batchSizeLabel := widget.NewLabel("Max Readings per Batch:")
+	batchSizeEntry := widget.NewEntry()
+	batchSizeEntry.SetText("100")
+
+	batchOpen := false
+	batchBtn := widget.NewButton("Show Batching Options", nil)
+	batchContainer := container.NewVBox(batchCheck, batchWindowLabel, batchWindowEntry, batchSizeLabel, batchSizeEntry)
+	batchContainer.Hide()
+	batchBtn.OnTapped = func() {
+		batchOpen = !batchOpen
+		if batchOpen {
+			batchContainer.Show()
+			batchBtn.SetText("Hide Batching Options")
+		} else {
+			batchContainer.Hide()
+			batchBtn.SetText("Show Batching Options")
+		}
+	}
+
+	// TLS settings (PEM file paths). Leave empty to use the system roots.
+	tlsCALabel := widget.NewLabel("CA Bundle (optional):")
+	tlsCAEntry := widget.NewEntry()
+	tlsCAEntry.SetPlaceHolder("/path/to/ca.pem")
+	tlsCertLabel := widget.NewLabel("Client Certificate (optional):")
+	tlsCertEntry := widget.NewEntry()
+	tlsCertEntry.SetPlaceHolder("/path/to/desktop.crt")
+	tlsKeyLabel := widget.NewLabel("Client Key (optional):")
+	tlsKeyEntry := widget.NewEntry()
+	tlsKeyEntry.SetPlaceHolder("/path/to/desktop.key")
+
+	tlsOpen := false
+	tlsBtn := widget.NewButton("Show TLS Options", nil)
+	tlsContainer := container.NewVBox(tlsCALabel, tlsCAEntry, tlsCertLabel, tlsCertEntry, tlsKeyLabel, tlsKeyEntry)
+	tlsContainer.Hide()
+	tlsBtn.OnTapped = func() {
+		tlsOpen = !tlsOpen
+		if tlsOpen {
+			tlsContainer.Show()
+			tlsBtn.SetText("Hide TLS Options")
+		} else {
+			tlsContainer.Hide()
+			tlsBtn.SetText("Show TLS Options")
+		}
+	}
+
+	// MQTT publishing to a local broker, alongside (or instead of) HTTP
+	mqttEnableCheck := widget.NewCheck("Publish readings to MQTT", nil)
+	mqttURLLabel := widget.NewLabel("MQTT Broker:")
+	mqttURLEntry := widget.NewEntry()
+	mqttURLEntry.SetPlaceHolder("tcp://localhost:1883 or mqtts://broker:8883")
+	mqttUserLabel := widget.NewLabel("MQTT Username (optional):")
+	mqttUserEntry := widget.NewEntry()
+	mqttPassLabel := widget.NewLabel("MQTT Password (optional):")
+	mqttPassEntry := widget.NewPasswordEntry()
+	mqttQoSLabel := widget.NewLabel("MQTT QoS:")
+	mqttQoSSelect := widget.NewSelect([]string{"0", "1", "2"}, nil)
+	mqttQoSSelect.SetSelected("1")
+	mqttRetainCheck := widget.NewCheck("Retain last value per topic", nil)
+	mqttRetainCheck.SetChecked(true)
+
+	mqttOpen := false
+	mqttBtn := widget.NewButton("Show MQTT Options", nil)
+	mqttContainer := container.NewVBox(mqttEnableCheck, mqttURLLabel, mqttURLEntry, mqttUserLabel, mqttUserEntry,
+		mqttPassLabel, mqttPassEntry, mqttQoSLabel, mqttQoSSelect, mqttRetainCheck)
+	mqttContainer.Hide()
+	mqttBtn.OnTapped = func() {
+		mqttOpen = !mqttOpen
+		if mqttOpen {
+			mqttContainer.Show()
+			mqttBtn.SetText("Hide MQTT Options")
+		} else {
+			mqttContainer.Hide()
+			mqttBtn.SetText("Show MQTT Options")
+		}
+	}
+
 	// Patient Name Input
 	patientNameLabel := widget.NewLabel("Patient Name:")
 	patientNameEntry := widget.NewEntry()
@@ -74,6 +170,7 @@ func main() {
 	logArea := widget.NewMultiLineEntry()
 	logArea.Disable()
 	logArea.SetMinRowsVisible(10)
+	deliveryLabel := widget.NewLabel("")
 
 	// Camera Device Input (for ffmpeg dshow)
 	cameraLabel := widget.NewLabel("Camera Device (optional):")
@@ -106,35 +203,20 @@ func main() {
 	refreshButtons := []*widget.Button{}
 	buttonDefaults := map[*widget.Button]string{}
 
-	log := func(msg string) {
+	showLog := func(level slog.Level, line, msg string) {
 		fyne.Do(func() {
-			timestamp := time.Now().Format("15:04:05")
-			logArea.SetText(fmt.Sprintf("[%s] %s\n%s", timestamp, msg, logArea.Text))
-
-			statusText := "Status: " + msg
-			isError := strings.HasPrefix(msg, "Error") || strings.Contains(strings.ToLower(msg), "error")
-
-			if isError {
-				statusLabel.Segments = []widget.RichTextSegment{
-					&widget.TextSegment{
-						Text: statusText,
-						Style: widget.RichTextStyle{
-							ColorName: theme.ColorNameError,
-							Inline:    true,
-							TextStyle: fyne.TextStyle{Bold: true},
-						},
-					},
-				}
-			} else {
-				statusLabel.Segments = []widget.RichTextSegment{
-					&widget.TextSegment{
-						Text: statusText,
-						Style: widget.RichTextStyle{
-							ColorName: theme.ColorNameForeground,
-							Inline:    true,
-						},
-					},
-				}
+			logArea.SetText(line + "\n" + logArea.Text)
+
+			style := widget.RichTextStyle{ColorName: theme.ColorNameForeground, Inline: true}
+			switch {
+			case level >= slog.LevelError:
+				style.ColorName = theme.ColorNameError
+				style.TextStyle = fyne.TextStyle{Bold: true}
+			case level >= slog.LevelWarn:
+				style.ColorName = theme.ColorNameWarning
+			}
+			statusLabel.Segments = []widget.RichTextSegment{
+				&widget.TextSegment{Text: "Status: " + msg, Style: style},
 			}
 			statusLabel.Refresh()
 
@@ -151,6 +233,22 @@ func main() {
 			}
 		})
 	}
+	logger := slog.New(newUIHandler(logLevelFromEnv(), showLog))
+
+	// applyTLS loads the TLS settings before each connection so edited
+	// certificate paths take effect without a restart.
+	applyTLS := func() bool {
+		err := configureTLS(
+			strings.TrimSpace(tlsCAEntry.Text),
+			strings.TrimSpace(tlsCertEntry.Text),
+			strings.TrimSpace(tlsKeyEntry.Text),
+		)
+		if err != nil {
+			logger.Error("Invalid TLS settings", "err", err)
+			return false
+		}
+		return true
+	}
 
 	// Action Buttons
 	var stopBtn *widget.Button
@@ -159,31 +257,73 @@ func main() {
 		cmdMutex.Lock()
 		if currentCmd != nil {
 			cmdMutex.Unlock()
-			log("Error: A process is already running. Stop it first.")
+			logger.Error("A process is already running. Stop it first.")
 			return
 		}
 		cmdMutex.Unlock()
 
-		targetURL := urlEntry.Text
-		if targetURL == "" {
-			log("Error: Please enter a Web Server URL")
-			return
-		}
-
 		clinicName := clinicNameEntry.Text
 		if clinicName == "" {
-			log("Error: Please enter a Clinic Name")
+			logger.Error("Please enter a Clinic Name")
 			return
 		}
 
 		patientName := patientNameEntry.Text
 		if patientName == "" {
-			log("Error: Please enter a Patient Name")
+			logger.Error("Please enter a Patient Name")
+			return
+		}
+
+		apiKey := strings.TrimSpace(apiKeyEntry.Text)
+		if !applyTLS() {
 			return
 		}
 
+		var batch *batchOptions
+		if batchCheck.Checked {
+			secs, err := strconv.ParseFloat(strings.TrimSpace(batchWindowEntry.Text), 64)
+			size, serr := strconv.Atoi(strings.TrimSpace(batchSizeEntry.Text))
+			if err != nil || serr != nil || secs <= 0 || size <= 0 {
+				logger.Error("Batch window and size must be positive numbers")
+				return
+			}
+			batch = &batchOptions{window: time.Duration(secs * float64(time.Second)), maxItems: size}
+		}
+
+		var sinks []Sink
+		if targetURL := strings.TrimSpace(urlEntry.Text); targetURL != "" {
+			sinks = append(sinks, newHTTPSink(targetURL, apiKey, batch))
+		}
+		extra, err := parseSinks(destEntry.Text, apiKey, batch)
+		if err != nil {
+			logger.Error("Invalid destination", "err", err)
+			return
+		}
+		sinks = append(sinks, extra...)
+		if mqttEnableCheck.Checked {
+			qos, _ := strconv.Atoi(mqttQoSSelect.Selected)
+			mqtt, err := newMQTTClient(strings.TrimSpace(mqttURLEntry.Text), strings.TrimSpace(mqttUserEntry.Text),
+				mqttPassEntry.Text, byte(qos), mqttRetainCheck.Checked)
+			if err != nil {
+				closeSinks(sinks)
+				logger.Error("Invalid MQTT settings", "err", err)
+				return
+			}
+			sinks = append(sinks, mqttSink{mqtt})
+		}
+		if len(sinks) == 0 {
+			logger.Error("Please enter a Web Server URL or another destination")
+			return
+		}
+		out := newFanOut(sinks, func(summary string) {
+			fyne.Do(func() { deliveryLabel.SetText(summary) })
+		}, func(sink string, err error) {
+			logger.Error("Sending batch failed", "sink", sink, "err", err)
+		})
+		deliveryLabel.SetText(out.Summary())
+
 		stopBtn.Enable()
-		go runCLIAndSend(name, args, parser, targetURL, clinicName, patientName, log, func() {
+		go runCLIAndSend(name, args, parser, out, clinicName, patientName, logger, func() {
 			fyne.Do(func() {
 				stopBtn.Disable()
 			})
@@ -195,7 +335,7 @@ func main() {
 		defer cmdMutex.Unlock()
 		if cancelFunc != nil {
 			cancelFunc() // Cancel the context
-			log("Stopping process...")
+			logger.Info("Stopping process...")
 		}
 	})
 	stopBtn.Disable()
@@ -216,73 +356,89 @@ func main() {
 		startProcess("Temperature", []string{"-temperature"}, parseTemperatureLine)
 	})
 
-	// Stethoscope Buttons
-	var btnStethoscopeList *widget.Button
+	// Stethoscope discovery and connection
 	var stethMacEntry *widget.Entry
-
-	btnStethoscopeList = widget.NewButton("List Stethoscopes", func() {
-		startProcess("StethoscopeList", []string{"-list"}, parseStethoscopeLine)
-	})
-
-	stethMacEntry = widget.NewEntry()
-	stethMacEntry.SetPlaceHolder("Stethoscope MAC (AA:BB:CC:DD:EE:FF)")
-
-	btnStethoscopeConnect := widget.NewButton("Connect Stethoscope", func() {
-		mac := strings.TrimSpace(stethMacEntry.Text)
-		if mac == "" {
-			// If no MAC is entered, try to auto-detect if there's exactly one device
-			
-			cmdPath := "MinttiCLI.exe"
-			if _, err := exec.LookPath(cmdPath); err != nil {
-				cmdPath = "./MinttiCLI.exe"
+	var stethDevices []StethoscopeDevice
+	stethStatus := widget.NewLabel("Not scanned yet")
+	stethPicker := widget.NewRadioGroup(nil, func(sel string) {
+		for _, d := range stethDevices {
+			if d.String() == sel {
+				stethMacEntry.SetText(d.MAC)
+				return
 			}
+		}
+	})
 
-			// Run a quick scan to see if we can find exactly one device
-			go func() {
-				cmd := exec.Command(cmdPath, "-list")
-				output, err := cmd.CombinedOutput()
+	var btnStethoscopeScan *widget.Button
+	scanStethoscopes := func(onDone func([]StethoscopeDevice)) {
+		btnStethoscopeScan.Disable()
+		btnStethoscopeScan.SetText("Scanning...")
+		stethStatus.SetText("Scanning...")
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), stethoscopeScanTimeout)
+			defer cancel()
+			devices, err := discoverStethoscopes(ctx)
+			fyne.Do(func() {
+				btnStethoscopeScan.Enable()
+				btnStethoscopeScan.SetText("Rescan Stethoscopes")
 				if err != nil {
-					log(fmt.Sprintf("Auto-scan failed: %v", err))
+					stethStatus.SetText("Scan failed")
+					logger.Error("Stethoscope scan failed", "err", err)
 					return
 				}
-
-				lines := strings.Split(string(output), "\n")
-				var foundMacs []string
-				for _, line := range lines {
-					line = strings.TrimSpace(line)
-					if strings.Contains(line, "DATA:ITEM") {
-						// Simple extraction of mac="..."
-						if start := strings.Index(line, "mac=\""); start != -1 {
-							rest := line[start+len("mac=\""):]
-							if end := strings.Index(rest, "\""); end != -1 {
-								foundMacs = append(foundMacs, rest[:end])
-							}
-						}
+				stethDevices = devices
+				options := make([]string, len(devices))
+				selected := ""
+				for i, d := range devices {
+					options[i] = d.String()
+					if d.MAC == strings.ToUpper(strings.TrimSpace(stethMacEntry.Text)) {
+						selected = options[i]
 					}
 				}
-
-				if len(foundMacs) == 1 {
-					autoMac := foundMacs[0]
-					fyne.Do(func() {
-						stethMacEntry.SetText(autoMac)
-						log(fmt.Sprintf("Auto-detected single stethoscope: %s", autoMac))
-						// Start the process now that we have the MAC
-						startProcess("StethoscopeStream", []string{"-connect", "-mac", autoMac}, parseStethoscopeLine)
-					})
-				} else if len(foundMacs) > 1 {
-					log(fmt.Sprintf("Found %d devices. Please enter a MAC address manually.", len(foundMacs)))
-				} else {
-					log("No stethoscopes found. Ensure device is on and in range.")
+				stethPicker.Options = options
+				stethPicker.Selected = selected
+				stethPicker.Refresh()
+				stethStatus.SetText(fmt.Sprintf("%d stethoscope(s) found", len(devices)))
+				if onDone != nil {
+					onDone(devices)
 				}
-			}()
+			})
+		}()
+	}
+
+	btnStethoscopeScan = widget.NewButton("Scan for Stethoscopes", func() {
+		scanStethoscopes(nil)
+	})
+
+	stethMacEntry = widget.NewEntry()
+	stethMacEntry.SetPlaceHolder("Stethoscope MAC (AA:BB:CC:DD:EE:FF)")
+
+	btnStethoscopeConnect := widget.NewButton("Connect Stethoscope", func() {
+		mac := strings.TrimSpace(stethMacEntry.Text)
+		if mac != "" {
+			startProcess("StethoscopeStream", []string{"-connect", "-mac", mac}, parseStethoscopeLine)
 			return
 		}
-		startProcess("StethoscopeStream", []string{"-connect", "-mac", mac}, parseStethoscopeLine)
+		// No device chosen: scan, and connect straight away if exactly one is in range
+		scanStethoscopes(func(devices []StethoscopeDevice) {
+			switch len(devices) {
+			case 0:
+				logger.Warn("No stethoscopes found. Ensure device is on and in range.")
+			case 1:
+				autoMac := devices[0].MAC
+				stethMacEntry.SetText(autoMac)
+				stethPicker.SetSelected(devices[0].String())
+				logger.Info("Auto-detected single stethoscope", "mac", autoMac)
+				startProcess("StethoscopeStream", []string{"-connect", "-mac", autoMac}, parseStethoscopeLine)
+			default:
+				logger.Info("Multiple stethoscopes found. Please select one from the list.", "count", len(devices))
+			}
+		})
 	})
 
 	runCameraCommand := func(action string, args []string) {
 		go func() {
-			log(fmt.Sprintf("Camera: %s ...", action))
+			logger.Info("Camera command", "action", action)
 
 			cmdPath := "camera_cli.exe"
 			if _, err := exec.LookPath(cmdPath); err != nil {
@@ -294,20 +450,20 @@ func main() {
 			output := strings.TrimSpace(string(outputBytes))
 
 			if output != "" {
-				log(fmt.Sprintf("Camera output: %s", output))
+				logger.Info("Camera output", "action", action, "output", output)
 			}
 			if err != nil {
-				log(fmt.Sprintf("Error running camera %s: %v", action, err))
+				logger.Error("Camera command failed", "action", action, "err", err)
 				return
 			}
 
 			upper := strings.ToUpper(output)
 			if strings.HasPrefix(upper, "DATA:ERROR") {
-				log(fmt.Sprintf("Camera %s reported error: %s", action, output))
+				logger.Error("Camera reported an error", "action", action, "output", output)
 				return
 			}
 
-			log(fmt.Sprintf("Camera %s completed", action))
+			logger.Info("Camera command completed", "action", action)
 		}()
 	}
 
@@ -334,7 +490,7 @@ func main() {
 			}
 		}
 		if previewImage.Image == nil {
-			log("Preview flip toggled; will apply when preview shows an image.")
+			logger.Info("Preview flip toggled; will apply when preview shows an image.")
 		}
 		applyPreview()
 	})
@@ -347,7 +503,7 @@ func main() {
 			previewCancel()
 			previewCancel = nil
 			if logMsg != "" {
-				log(logMsg)
+				logger.Info(logMsg)
 			}
 		}
 		previewMu.Unlock()
@@ -358,9 +514,9 @@ func main() {
 		if device == "" {
 			if autoDevice, err := detectDefaultCameraDevice(); err == nil && autoDevice != "" {
 				device = autoDevice
-				log(fmt.Sprintf("Using detected camera: %s", device))
+				logger.Info("Using detected camera", "device", device)
 			} else {
-				log("Error: No camera device found. Set a device name (advanced options).")
+				logger.Error("No camera device found. Set a device name (advanced options).")
 				return
 			}
 		}
@@ -368,14 +524,14 @@ func main() {
 		previewMu.Lock()
 		if previewCancel != nil {
 			previewMu.Unlock()
-			log("Error: Preview already running")
+			logger.Error("Preview already running")
 			return
 		}
 		ctx, cancel := context.WithCancel(context.Background())
 		previewCancel = cancel
 		previewMu.Unlock()
 
-		log(fmt.Sprintf("Starting camera preview for %s", device))
+		logger.Info("Starting camera preview", "device", device)
 
 		go func() {
 			ticker := time.NewTicker(1 * time.Second)
@@ -385,9 +541,9 @@ func main() {
 				case <-ctx.Done():
 					return
 				case <-ticker.C:
-					img, err := captureSnapshot(ctx, device)
+					img, err := captureSnapshot(ctx, device, logger)
 					if err != nil {
-						log(fmt.Sprintf("Error capturing frame: %v", err))
+						logger.Error("Capturing frame failed", "err", err)
 						continue
 					}
 					// Avoid re-entering render loop while UI might be mid-refresh.
@@ -427,7 +583,7 @@ func main() {
 		if device == "" {
 			if autoDevice, err := detectDefaultCameraDevice(); err == nil && autoDevice != "" {
 				device = autoDevice
-				log(fmt.Sprintf("Using detected camera: %s", device))
+				logger.Info("Using detected camera", "device", device)
 			} else {
 				return "", fmt.Errorf("no camera device found")
 			}
@@ -440,31 +596,28 @@ func main() {
 		if streamCancel != nil {
 			streamCancel()
 			streamCancel = nil
-			log("Stream stopped")
+			logger.Info("Stream stopped")
 		}
 		wsMu.Unlock()
 	}
 
 	startStreaming := func() {
 		wsMu.Lock()
-		if wsConn == nil {
+		if wsCancel == nil {
 			wsMu.Unlock()
-			log("Error: WS not connected")
+			logger.Error("WS not connected")
 			return
 		}
-		wsMu.Unlock()
-
-		wsMu.Lock()
 		if streamCancel != nil {
 			wsMu.Unlock()
-			log("Error: Stream already running")
+			logger.Error("Stream already running")
 			return
 		}
 		wsMu.Unlock()
 
 		device, err := resolveDevice(cameraEntry.Selected)
 		if err != nil {
-			log(fmt.Sprintf("Error: %v", err))
+			logger.Error("No camera available", "err", err)
 			return
 		}
 
@@ -476,8 +629,11 @@ func main() {
 		streamCancel = cancel
 		wsMu.Unlock()
 
-		log(fmt.Sprintf("Starting stream for %s", device))
+		logger.Info("Starting stream", "device", device)
 
+		// The stream outlives individual connections: while the feed is
+		// reconnecting frames are dropped, and they flow again once it is back.
+		var paused atomic.Bool
 		go func() {
 			ticker := time.NewTicker(1 * time.Second)
 			defer ticker.Stop()
@@ -486,39 +642,37 @@ func main() {
 				case <-ctx.Done():
 					return
 				case <-ticker.C:
-					img, err := captureSnapshot(ctx, device)
+					img, err := captureSnapshot(ctx, device, logger)
 					if err != nil {
-						log(fmt.Sprintf("Error capturing frame: %v", err))
+						logger.Error("Capturing frame failed", "err", err)
 						continue
 					}
 					go func(img image.Image) {
-						// send metadata first once per stream? We'll send periodically
-						meta := map[string]string{
-							"clinic_name":  clinic,
-							"patient_name": patient,
-						}
-						metaJSON, _ := json.Marshal(meta)
-
 						var buf bytes.Buffer
 						if err := jpeg.Encode(&buf, img, nil); err != nil {
-							log(fmt.Sprintf("Encode error: %v", err))
+							logger.Error("Encoding frame failed", "err", err)
 							return
 						}
 						wsMu.Lock()
 						c := wsConn
 						wsMu.Unlock()
 						if c == nil {
-							log("WS disconnected during stream")
-							stopStreaming()
+							if !paused.Swap(true) {
+								logger.Warn("WS disconnected; stream paused until reconnect")
+							}
 							return
 						}
-						// send meta
-						_ = c.WriteMessage(websocket.TextMessage, metaJSON)
-						if err := c.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
-							log(fmt.Sprintf("WS send error: %v", err))
-							stopStreaming()
+						// Re-announce with every frame so a restarted server never
+						// files frames under the wrong patient.
+						if err := wsSendVideo(c, clinic, patient, buf.Bytes()); err != nil {
+							if !paused.Swap(true) {
+								logger.Warn("WS send failed; stream paused until reconnect", "err", err)
+							}
 							return
 						}
+						if paused.Swap(false) {
+							logger.Info("Stream resumed")
+						}
 					}(img)
 				}
 			}
@@ -530,76 +684,159 @@ func main() {
 	wsURLEntry := widget.NewEntry()
 	wsURLEntry.SetText("ws://localhost:8081/ws/feed")
 	wsStatus := widget.NewLabel("WS: Disconnected")
+	setWSStatus := func(s string) {
+		fyne.Do(func() { wsStatus.SetText(s) })
+	}
 
+	handleWSCommand := func(msg []byte) {
+		cmd := strings.ToLower(strings.TrimSpace(string(msg)))
+		switch cmd {
+		case "start":
+			logger.Info("WS command: start streaming")
+			fyne.Do(func() { startStreaming() })
+		case "stop":
+			logger.Info("WS command: stop streaming")
+			fyne.Do(func() { stopStreaming() })
+		case "move-left", "move-right", "move-up", "move-down":
+			logger.Info("WS camera command", "command", cmd)
+			runCameraCommand(cmd, []string{"-" + cmd})
+		case "flip":
+			fyne.Do(func() {
+				previewImageFlip = !previewImageFlip
+				logger.Info("WS camera command: flip preview")
+			})
+		default:
+			logger.Warn("WS unknown command", "command", cmd)
+		}
+	}
+
+	// connectWS keeps the feed connection up until disconnectWS is called,
+	// redialling with jittered backoff whenever the server goes away.
 	connectWS := func() {
 		wsMu.Lock()
-		if wsConn != nil {
+		if wsCancel != nil {
 			wsMu.Unlock()
-			log("Error: WS already connected")
+			logger.Error("WS already connected")
 			return
 		}
 		wsMu.Unlock()
 
 		u := strings.TrimSpace(wsURLEntry.Text)
 		if u == "" {
-			log("Error: Enter WS URL")
+			logger.Error("Enter WS URL")
 			return
 		}
-
-		ctx, cancel := context.WithCancel(context.Background())
-		c, _, err := websocket.DefaultDialer.DialContext(ctx, u, nil)
-		if err != nil {
-			log(fmt.Sprintf("WS connect error: %v", err))
-			cancel()
+		if !applyTLS() {
 			return
 		}
 
+		header := http.Header{}
+		if key := strings.TrimSpace(apiKeyEntry.Text); key != "" {
+			header.Set("X-API-Key", key)
+		}
+		// Widgets belong to the UI thread; the loop below works on copies.
+		clinic := strings.TrimSpace(clinicNameEntry.Text)
+		patient := strings.TrimSpace(patientNameEntry.Text)
+
+		ctx, cancel := context.WithCancel(context.Background())
 		wsMu.Lock()
-		wsConn = c
 		wsCancel = cancel
 		wsMu.Unlock()
-		wsStatus.SetText("WS: Connected")
-		log("WS connected")
+		wsStatus.SetText("WS: Connecting")
 
 		go func() {
 			defer func() {
 				wsMu.Lock()
-				if wsConn != nil {
-					wsConn.Close()
-				}
-				wsConn = nil
 				if wsCancel != nil {
 					wsCancel()
 				}
 				wsCancel = nil
 				wsMu.Unlock()
-				fyne.Do(func() { wsStatus.SetText("WS: Disconnected") })
+				setWSStatus("WS: Disconnected")
 			}()
 
+			attempt := 0
+			// backoff waits before the next dial; false means disconnectWS
+			// was called meanwhile.
+			backoff := func(connLog *slog.Logger, msg string, err error) bool {
+				delay := reconnectDelay(attempt)
+				attempt++
+				connLog.Warn(msg, "err", err, "retry_in", delay.Round(time.Second))
+				setWSStatus(fmt.Sprintf("WS: Reconnecting (attempt %d)", attempt))
+				select {
+				case <-ctx.Done():
+					return false
+				case <-time.After(delay):
+					return true
+				}
+			}
+
 			for {
-				_, msg, err := c.ReadMessage()
+				// One request ID per connection attempt ties the server's
+				// feed logs and audit entries to this connection.
+				reqID := newRequestID()
+				header.Set(requestIDHeader, reqID)
+				connLog := logger.With("request_id", reqID)
+				c, resp, err := currentWSDialer().DialContext(ctx, u, header)
 				if err != nil {
-					log(fmt.Sprintf("WS read error: %v", err))
+					if ctx.Err() != nil {
+						return
+					}
+					if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+						connLog.Error("WS rejected the API key")
+						return
+					}
+					if !backoff(connLog, "WS connect failed", err) {
+						return
+					}
+					continue
+				}
+				connectedAt := time.Now()
+
+				connCtx, connCancel := context.WithCancel(ctx)
+				wsKeepAlive(connCtx, c)
+
+				wsMu.Lock()
+				wsConn = c
+				wsMu.Unlock()
+				setWSStatus("WS: Connected")
+				connLog.Info("WS connected")
+
+				if err := wsAnnounce(c, clinic, patient); err != nil {
+					connLog.Error("WS announce failed", "err", err)
+				}
+
+				var readErr error
+				for {
+					_, msg, err := c.ReadMessage()
+					if err != nil {
+						readErr = err
+						break
+					}
+					_ = c.SetReadDeadline(time.Now().Add(wsPongWait))
+					handleWSCommand(msg)
+				}
+
+				connCancel()
+				wsMu.Lock()
+				if wsConn == c {
+					wsConn = nil
+				}
+				wsMu.Unlock()
+				c.Close()
+
+				if ctx.Err() != nil {
 					return
 				}
-				cmd := strings.ToLower(strings.TrimSpace(string(msg)))
-				switch cmd {
-				case "start":
-					log("WS command: start streaming")
-					fyne.Do(func() { startStreaming() })
-				case "stop":
-					log("WS command: stop streaming")
-					fyne.Do(func() { stopStreaming() })
-				case "move-left", "move-right", "move-up", "move-down":
-					log(fmt.Sprintf("WS camera command: %s", cmd))
-					runCameraCommand(cmd, []string{"-" + cmd})
-				case "flip":
-					fyne.Do(func() {
-						previewImageFlip = !previewImageFlip
-						log("WS camera command: flip preview")
-					})
-				default:
-					log(fmt.Sprintf("WS unknown command: %s", cmd))
+				// The server drops a feed when another desktop connects, so
+				// two uploaders would redial each other off in a tight loop
+				// without a pause here. Only a connection that stayed up
+				// resets the backoff.
+				if time.Since(connectedAt) >= wsStableAfter {
+					attempt = 0
+				}
+				if !backoff(connLog, "WS connection lost", readErr) {
+					return
 				}
 			}
 		}()
@@ -608,7 +845,7 @@ func main() {
 	disconnectWS := func() {
 		wsMu.Lock()
 		if wsConn != nil {
-			wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"))
+			wsWrite(wsConn, websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"))
 			wsConn.Close()
 		}
 		if wsCancel != nil {
@@ -617,6 +854,7 @@ func main() {
 		wsConn = nil
 		wsCancel = nil
 		wsMu.Unlock()
+		stopStreaming()
 		wsStatus.SetText("WS: Disconnected")
 	}
 
@@ -627,11 +865,11 @@ func main() {
 	refreshButtons = []*widget.Button{
 		stopBtn,
 		btnHeartRate, btnNIBP, btnGlucose, btnTemp,
-		btnStethoscopeList, btnStethoscopeConnect,
+		btnStethoscopeScan, btnStethoscopeConnect,
 		btnCamList, btnCamLeft, btnCamRight, btnCamUp, btnCamDown, btnCamFlip,
 		btnPreviewStart, btnPreviewStop,
 		wsConnectBtn, wsDisconnectBtn,
-		advancedBtn,
+		advancedBtn, tlsBtn, mqttBtn, batchBtn,
 	}
 	for _, b := range refreshButtons {
 		if b != nil {
@@ -643,6 +881,16 @@ func main() {
 		lightModeCheck,
 		urlLabel,
 		urlEntry,
+		apiKeyLabel,
+		apiKeyEntry,
+		destLabel,
+		destEntry,
+		batchBtn,
+		batchContainer,
+		tlsBtn,
+		tlsContainer,
+		mqttBtn,
+		mqttContainer,
 		clinicNameLabel,
 		clinicNameEntry,
 		patientNameLabel,
@@ -655,7 +903,9 @@ func main() {
 		btnTemp,
 		widget.NewSeparator(),
 		widget.NewLabel("Stethoscope:"),
-		btnStethoscopeList,
+		btnStethoscopeScan,
+		stethStatus,
+		stethPicker,
 		stethMacEntry,
 		btnStethoscopeConnect,
 		widget.NewSeparator(),
@@ -679,6 +929,7 @@ func main() {
 		widget.NewSeparator(),
 		stopBtn,
 		widget.NewSeparator(),
+		deliveryLabel,
 		statusLabel,
 		logArea,
 	)
@@ -688,8 +939,13 @@ func main() {
 	myWindow.ShowAndRun()
 }
 
-func runCLIAndSend(name string, args []string, parser LineParser, targetURL string, clinicName string, patientName string, log func(string), onFinish func()) {
+func runCLIAndSend(name string, args []string, parser LineParser, out *fanOut, clinicName string, patientName string, logger *slog.Logger, onFinish func()) {
 	defer onFinish()
+	defer func() {
+		if err := out.Close(); err != nil {
+			logger.Warn("Closing destinations failed", "err", err)
+		}
+	}()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	
@@ -705,19 +961,14 @@ func runCLIAndSend(name string, args []string, parser LineParser, targetURL stri
 	}()
 
 	cmdPath := "lepu_cli.exe"
-	if name == "StethoscopeList" || name == "StethoscopeStream" {
-		cmdPath = "MinttiCLI.exe"
-	}
-
 	if _, err := exec.LookPath(cmdPath); err != nil {
-		if name == "StethoscopeList" || name == "StethoscopeStream" {
-			cmdPath = "./MinttiCLI.exe"
-		} else {
-			cmdPath = "./lepu_cli.exe"
-		}
+		cmdPath = "./lepu_cli.exe"
+	}
+	if name == "StethoscopeStream" {
+		cmdPath = minttiPath()
 	}
 	
-	log(fmt.Sprintf("Starting %s (%s)...", name, cmdPath))
+	logger.Info("Starting process", "name", name, "path", cmdPath)
 
 	cmd := exec.CommandContext(ctx, cmdPath, args...)
 	
@@ -727,16 +978,23 @@ func runCLIAndSend(name string, args []string, parser LineParser, targetURL stri
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		log(fmt.Sprintf("Error creating stdout pipe: %v", err))
+		logger.Error("Creating stdout pipe failed", "err", err)
 		return
 	}
 
 	if err := cmd.Start(); err != nil {
-		log(fmt.Sprintf("Error starting process: %v", err))
+		logger.Error("Starting process failed", "name", name, "err", err)
 		return
 	}
 
+	// Each run is one session; the server uses session_id/seq to group
+	// stethoscope audio into a single recording and to order readings.
+	sessionID := fmt.Sprintf("%s-%s", strings.ToLower(name), time.Now().UTC().Format("20060102T150405Z"))
+	seq := 0
+
 	scanner := bufio.NewScanner(stdout)
+	// Stethoscope audio chunks arrive as long single lines.
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
 	for scanner.Scan() {
 		line := scanner.Text()
 		data, err := parser(line)
@@ -750,34 +1008,61 @@ func runCLIAndSend(name string, args []string, parser LineParser, targetURL stri
 			if dataMap, ok := data.(map[string]interface{}); ok {
 				dataMap["patient_name"] = patientName
 				dataMap["clinic_name"] = clinicName
+				dataMap["session_id"] = sessionID
+				dataMap["seq"] = seq
+				// When it was taken, since batches reach the server later
+				dataMap["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
+				seq++
+			}
+
+			// Stethoscope audio also goes live to remote listeners
+			if dataMap, ok := data.(map[string]interface{}); ok && dataMap["stream_type"] == "audio" {
+				if samples, ok := dataMap["data"].([]int16); ok {
+					rate, _ := dataMap["sample_rate"].(int)
+					if err := wsSendAudio(clinicName, patientName, rate, samples); err != nil {
+						logger.Warn("Streaming audio failed", "err", err)
+					}
+				}
 			}
 
-			// Send to server
-			log(fmt.Sprintf("Sending data: %v", data))
-			if err := sendData(targetURL, data); err != nil {
-				log(fmt.Sprintf("Error sending data: %v", err))
+			// Send to every destination
+			if dataMap, ok := data.(map[string]interface{}); ok {
+				reqID := newRequestID()
+				logger.Info("Sending data", "request_id", reqID, "data", data)
+				for sink, err := range out.Send(reqID, dataMap) {
+					logger.Error("Sending data failed", "sink", sink, "request_id", reqID, "err", err)
+				}
 			}
 		}
 	}
 
 	if err := cmd.Wait(); err != nil {
 		if ctx.Err() == context.Canceled {
-			log("Process stopped by user.")
+			logger.Info("Process stopped by user.")
 		} else {
-			log(fmt.Sprintf("Process finished with error: %v", err))
+			logger.Error("Process finished with error", "name", name, "err", err)
 		}
 	} else {
-		log("Process finished successfully.")
+		logger.Info("Process finished successfully.", "name", name)
 	}
 }
 
-func sendData(url string, data interface{}) error {
+func sendData(url string, apiKey string, requestID string, data interface{}) error {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(requestIDHeader, requestID)
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	resp, err := currentHTTPClient().Do(req)
 	if err != nil {
 		return err
 	}
@@ -790,12 +1075,12 @@ func sendData(url string, data interface{}) error {
 }
 
 // captureSnapshot uses ffmpeg (dshow) to grab a single JPEG frame from the given device name.
-func captureSnapshot(ctx context.Context, device string) (image.Image, error) {
+func captureSnapshot(ctx context.Context, device string, logger *slog.Logger) (image.Image, error) {
 	args := buildFFmpegArgsForSnapshot(device)
 
 	// Debug log the command being used (without context cancellation details)
 	logCmd := strings.Join(append([]string{"ffmpeg"}, args...), " ")
-	fmt.Printf("ffmpeg command: %s\n", logCmd)
+	logger.Debug("ffmpeg command", "cmd", logCmd)
 
 	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
 	var stdout, stderr bytes.Buffer
@@ -1053,6 +1338,9 @@ func parseTemperatureLine(line string) (interface{}, error) {
 }
 
 // Stethoscope
+// Audio is 16-bit mono PCM; MinttiCLI does not report the rate unless asked.
+const stethoscopeSampleRate = 8000
+
 func parseStethoscopeLine(line string) (interface{}, error) {
 	line = strings.TrimSpace(line)
 	if !strings.HasPrefix(line, "DATA:") {
@@ -1079,10 +1367,8 @@ func parseStethoscopeLine(line string) (interface{}, error) {
 		}, nil
 	}
 	if strings.HasPrefix(parts, "LIST") || strings.HasPrefix(parts, "ITEM") {
-		return map[string]interface{}{
-			"type": "discovery",
-			"msg":  parts,
-		}, nil
+		// Discovery output is handled by discoverStethoscopes, not ingested.
+		return nil, nil
 	}
 	if strings.HasPrefix(parts, "STREAM") {
 		// DATA:STREAM type=audio data=[...]
@@ -1107,10 +1393,17 @@ func parseStethoscopeLine(line string) (interface{}, error) {
 				} else {
 					res["value"] = v
 				}
+			} else if k == "rate" || k == "sample_rate" {
+				if val, err := strconv.Atoi(v); err == nil {
+					res["sample_rate"] = val
+				}
 			} else {
 				res[k] = v
 			}
 		}
+		if res["stream_type"] == "audio" && res["sample_rate"] == nil {
+			res["sample_rate"] = stethoscopeSampleRate
+		}
 		return res, nil
 	}
 
@@ -1,6 +1,6 @@
 "use client";
 
-import { useEffect, useState } from "react";
+import { useEffect, useRef, useState } from "react";
 
 type RecordEntry = {
   timestamp: string;
@@ -11,6 +11,9 @@ type RecordEntry = {
 
 export default function Home() {
   const [doctor, setDoctor] = useState("");
+  const [password, setPassword] = useState("");
+  const [token, setToken] = useState("");
+  const [authError, setAuthError] = useState("");
   const [clinics, setClinics] = useState<string[]>([]);
   const [clinic, setClinic] = useState("");
   const [patients, setPatients] = useState<string[]>([]);
@@ -22,12 +25,59 @@ export default function Home() {
   const [flip, setFlip] = useState(false);
   const [loadingPatients, setLoadingPatients] = useState(false);
   const [loadingData, setLoadingData] = useState(false);
+  const [listening, setListening] = useState(false);
+  const audioCtx = useRef<AudioContext | null>(null);
+  const audioNext = useRef(0);
+  const listeningRef = useRef(false);
 
   const API_BASE = process.env.NEXT_PUBLIC_API_BASE ?? "http://localhost:8081";
 
   useEffect(() => {
-    loadClinics();
-  }, []);
+    if (token) loadClinics();
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, [token]);
+
+  function authFetch(url: string, init: RequestInit = {}) {
+    const headers = new Headers(init.headers);
+    if (token) headers.set("Authorization", `Bearer ${token}`);
+    return fetch(url, { ...init, headers }).then((res) => {
+      if (res.status === 401) {
+        setToken("");
+        setAuthError("Session expired, please log in again");
+      }
+      return res;
+    });
+  }
+
+  async function login() {
+    setAuthError("");
+    try {
+      const base = (API_BASE || "").replace(/\/$/, "");
+      const res = await fetch(`${base}/api/auth/login`, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ username: doctor, password }),
+      });
+      if (!res.ok) {
+        setAuthError("Invalid username or password");
+        return;
+      }
+      const json = await res.json();
+      setToken(json.token || "");
+      setPassword("");
+    } catch {
+      setAuthError("Login failed");
+    }
+  }
+
+  function logout() {
+    disconnectStream();
+    setToken("");
+    setClinics([]);
+    setClinic("");
+    setPatients([]);
+    setPatient("");
+  }
 
   useEffect(() => {
     if (!clinic) return;
@@ -49,7 +99,7 @@ export default function Home() {
   async function loadClinics() {
     try {
       const base = (API_BASE || "").replace(/\/$/, "");
-      const res = await fetch(`${base}/api/clinics`);
+      const res = await authFetch(`${base}/api/clinics`);
       const json = await res.json();
       setClinics(Array.isArray(json) ? json : []);
     } catch {
@@ -60,7 +110,7 @@ export default function Home() {
   async function loadPatients(c: string) {
     setLoadingPatients(true);
     try {
-      const res = await fetch(`${API_BASE}/api/clinic/${c}/patients`);
+      const res = await authFetch(`${API_BASE}/api/clinic/${c}/patients`);
       const json = await res.json();
       setPatients(Array.isArray(json) ? json : []);
     } catch {
@@ -73,7 +123,7 @@ export default function Home() {
   async function loadPatientData(c: string, p: string) {
     setLoadingData(true);
     try {
-      const res = await fetch(`${API_BASE}/api/clinic/${c}/patient/${p}/data`);
+      const res = await authFetch(`${API_BASE}/api/clinic/${c}/patient/${p}/data`);
       const json = await res.json();
       setData(json || {});
     } catch {
@@ -85,7 +135,7 @@ export default function Home() {
 
   async function sendCameraControl(command: string) {
     const base = (API_BASE || "").replace(/\/$/, "");
-    await fetch(`${base}/api/camera/control`, {
+    await authFetch(`${base}/api/camera/control`, {
       method: "POST",
       headers: { "Content-Type": "application/json" },
       body: JSON.stringify({ command }),
@@ -95,7 +145,7 @@ export default function Home() {
   function connectStream(c: string, p: string) {
     disconnectStream();
     const base = (API_BASE || "").replace(/\/$/, "");
-    const httpUrl = `${base}/ws/stream?clinic=${encodeURIComponent(c)}&patient=${encodeURIComponent(p)}`;
+    const httpUrl = `${base}/ws/stream?clinic=${encodeURIComponent(c)}&patient=${encodeURIComponent(p)}&tagged=1&token=${encodeURIComponent(token)}`;
     const wsUrl = httpUrl.startsWith("ws") ? httpUrl : httpUrl.replace(/^http/, "ws");
     const sock = new WebSocket(wsUrl);
     sock.binaryType = "arraybuffer";
@@ -114,7 +164,13 @@ export default function Home() {
     };
     sock.onmessage = (ev) => {
       if (ev.data instanceof ArrayBuffer) {
-        const blob = new Blob([ev.data], { type: "image/jpeg" });
+        // Tagged frames: first byte 1 = JPEG, 2 = stethoscope PCM
+        const kind = new Uint8Array(ev.data, 0, 1)[0];
+        if (kind === 2) {
+          playAudio(ev.data.slice(1));
+          return;
+        }
+        const blob = new Blob([ev.data.slice(1)], { type: "image/jpeg" });
         const urlObj = URL.createObjectURL(blob);
         setCamSrc(urlObj);
         setCamStatus("Streaming");
@@ -125,6 +181,41 @@ export default function Home() {
     setWs(sock);
   }
 
+  // payload: uint32 LE sample rate, then 16-bit mono PCM
+  function playAudio(payload: ArrayBuffer) {
+    const ctx = audioCtx.current;
+    if (!listeningRef.current || !ctx || payload.byteLength < 6) return;
+    const view = new DataView(payload);
+    const rate = view.getUint32(0, true);
+    const count = (payload.byteLength - 4) >> 1;
+    const buf = ctx.createBuffer(1, count, rate);
+    const out = buf.getChannelData(0);
+    for (let i = 0; i < count; i++) {
+      out[i] = view.getInt16(4 + i * 2, true) / 32768;
+    }
+    const src = ctx.createBufferSource();
+    src.buffer = buf;
+    src.connect(ctx.destination);
+    const start = Math.max(ctx.currentTime, audioNext.current);
+    src.start(start);
+    audioNext.current = start + buf.duration;
+  }
+
+  function toggleListening() {
+    if (!audioCtx.current) {
+      audioCtx.current = new AudioContext();
+    }
+    const next = !listeningRef.current;
+    listeningRef.current = next;
+    audioNext.current = 0;
+    if (next) {
+      audioCtx.current.resume();
+    } else {
+      audioCtx.current.suspend();
+    }
+    setListening(next);
+  }
+
   function disconnectStream() {
     if (ws) {
       ws.close();
@@ -143,15 +234,41 @@ export default function Home() {
             </p>
           </div>
           <div className="flex items-center gap-3">
-            <input
-              value={doctor}
-              onChange={(e) => setDoctor(e.target.value)}
-              placeholder="Doctor name"
-              className="px-3 py-2 rounded border border-slate-200 text-sm focus:outline-none focus:ring focus:ring-indigo-200 bg-white"
-            />
-            <button className="px-4 py-2 rounded bg-indigo-600 text-white text-sm font-medium hover:bg-indigo-500">
-              Log In
-            </button>
+            {token ? (
+              <>
+                <span className="text-sm text-slate-600">Signed in as {doctor}</span>
+                <button
+                  onClick={logout}
+                  className="px-4 py-2 rounded bg-slate-200 text-slate-900 text-sm font-medium hover:bg-slate-300"
+                >
+                  Log Out
+                </button>
+              </>
+            ) : (
+              <>
+                {authError && <span className="text-sm text-red-600">{authError}</span>}
+                <input
+                  value={doctor}
+                  onChange={(e) => setDoctor(e.target.value)}
+                  placeholder="Username"
+                  className="px-3 py-2 rounded border border-slate-200 text-sm focus:outline-none focus:ring focus:ring-indigo-200 bg-white"
+                />
+                <input
+                  type="password"
+                  value={password}
+                  onChange={(e) => setPassword(e.target.value)}
+                  onKeyDown={(e) => e.key === "Enter" && login()}
+                  placeholder="Password"
+                  className="px-3 py-2 rounded border border-slate-200 text-sm focus:outline-none focus:ring focus:ring-indigo-200 bg-white"
+                />
+                <button
+                  onClick={login}
+                  className="px-4 py-2 rounded bg-indigo-600 text-white text-sm font-medium hover:bg-indigo-500"
+                >
+                  Log In
+                </button>
+              </>
+            )}
           </div>
         </header>
 
@@ -294,6 +411,12 @@ export default function Home() {
                 >
                   Flip View
                 </button>
+                <button
+                  onClick={toggleListening}
+                  className="px-3 py-2 rounded bg-slate-100 hover:bg-slate-200"
+                >
+                  {listening ? "Mute Stethoscope" : "Listen to Stethoscope"}
+                </button>
               </div>
               <div className="mt-3 border border-slate-200 rounded overflow-hidden bg-slate-100 min-h-[200px] flex items-center justify-center">
                 {camSrc ? (
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stethoscopeScanTimeout bounds a MinttiCLI -list run.
+const stethoscopeScanTimeout = 30 * time.Second
+
+// StethoscopeDevice is one Mintti stethoscope seen during a scan.
+type StethoscopeDevice struct {
+	Name    string
+	MAC     string
+	RSSI    int // dBm; 0 when not reported
+	Battery int // percent; -1 when not reported
+}
+
+func (d StethoscopeDevice) String() string {
+	name := d.Name
+	if name == "" {
+		name = "Stethoscope"
+	}
+	s := fmt.Sprintf("%s (%s)", name, d.MAC)
+	if d.RSSI != 0 {
+		s += fmt.Sprintf("  %d dBm", d.RSSI)
+	}
+	if d.Battery >= 0 {
+		s += fmt.Sprintf("  %d%%", d.Battery)
+	}
+	return s
+}
+
+// minttiPath prefers MinttiCLI.exe on PATH, falling back to the working directory.
+func minttiPath() string {
+	cmdPath := "MinttiCLI.exe"
+	if _, err := exec.LookPath(cmdPath); err != nil {
+		cmdPath = "./MinttiCLI.exe"
+	}
+	return cmdPath
+}
+
+// discoverStethoscopes runs a MinttiCLI scan and returns the devices found,
+// strongest signal first.
+func discoverStethoscopes(ctx context.Context) ([]StethoscopeDevice, error) {
+	cmd := exec.CommandContext(ctx, minttiPath(), "-list")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("scan failed: %w", err)
+	}
+
+	seen := map[string]bool{}
+	var devices []StethoscopeDevice
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		d, ok := parseMinttiDevice(scanner.Text())
+		if !ok || seen[d.MAC] {
+			continue
+		}
+		seen[d.MAC] = true
+		devices = append(devices, d)
+	}
+	sort.SliceStable(devices, func(i, j int) bool {
+		if devices[i].RSSI == 0 || devices[j].RSSI == 0 {
+			return devices[j].RSSI == 0 && devices[i].RSSI != 0
+		}
+		return devices[i].RSSI > devices[j].RSSI
+	})
+	return devices, nil
+}
+
+// parseMinttiDevice parses a discovery line such as
+// DATA:ITEM name="Smartho-D2" mac="AA:BB:CC:DD:EE:FF" rssi=-61 battery=80
+func parseMinttiDevice(line string) (StethoscopeDevice, bool) {
+	line = strings.TrimSpace(line)
+	idx := strings.Index(line, "DATA:ITEM")
+	if idx == -1 {
+		return StethoscopeDevice{}, false
+	}
+	kv := parseKVQuoted(line[idx+len("DATA:ITEM"):])
+
+	d := StethoscopeDevice{
+		Name:    kv["name"],
+		MAC:     strings.ToUpper(kv["mac"]),
+		Battery: -1,
+	}
+	if d.MAC == "" {
+		return StethoscopeDevice{}, false
+	}
+	if v, err := strconv.Atoi(kv["rssi"]); err == nil {
+		d.RSSI = v
+	}
+	for _, k := range []string{"battery", "bat"} {
+		if v, err := strconv.Atoi(strings.TrimSuffix(kv[k], "%")); err == nil {
+			d.Battery = v
+			break
+		}
+	}
+	return d, true
+}
+
+// parseKVQuoted parses space separated key=value pairs where values may be
+// double-quoted to contain spaces. Keys are lower-cased.
+func parseKVQuoted(input string) map[string]string {
+	result := make(map[string]string)
+	s := strings.TrimSpace(input)
+	for s != "" {
+		eq := strings.Index(s, "=")
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		if sp := strings.LastIndex(key, " "); sp != -1 {
+			key = key[sp+1:] // skip stray bare words
+		}
+		s = s[eq+1:]
+
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end == -1 {
+				val, s = s[1:], ""
+			} else {
+				val, s = s[1:end+1], s[end+2:]
+			}
+		} else if sp := strings.Index(s, " "); sp != -1 {
+			val, s = s[:sp], s[sp+1:]
+		} else {
+			val, s = s, ""
+		}
+		result[key] = val
+		s = strings.TrimSpace(s)
+	}
+	return result
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKVQuoted(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+	}{
+		{`name="Smartho D2" mac=aa:bb`, map[string]string{"name": "Smartho D2", "mac": "aa:bb"}},
+		{`NAME="x" Rssi=-61`, map[string]string{"name": "x", "rssi": "-61"}},
+		{`name="" bat=5%`, map[string]string{"name": "", "bat": "5%"}},
+		{`found name="a=b c" mac=1`, map[string]string{"name": "a=b c", "mac": "1"}},
+		{`name="unterminated mac=1`, map[string]string{"name": "unterminated mac=1"}},
+		{`  mac=1   rssi=2  `, map[string]string{"mac": "1", "rssi": "2"}},
+		{`no pairs here`, map[string]string{}},
+		{``, map[string]string{}},
+	}
+	for _, tc := range tests {
+		if got := parseKVQuoted(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseKVQuoted(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseMinttiDevice(t *testing.T) {
+	tests := []struct {
+		line string
+		want StethoscopeDevice
+		ok   bool
+	}{
+		{
+			`DATA:ITEM name="Smartho D2 Ward 3" mac="aa:bb:cc:dd:ee:ff" rssi=-61 battery=80`,
+			StethoscopeDevice{Name: "Smartho D2 Ward 3", MAC: "AA:BB:CC:DD:EE:FF", RSSI: -61, Battery: 80}, true,
+		},
+		{
+			`  [12:00:01] DATA:ITEM mac=AA:BB:CC:DD:EE:01 battery=75%`,
+			StethoscopeDevice{MAC: "AA:BB:CC:DD:EE:01", Battery: 75}, true,
+		},
+		{
+			`DATA:ITEM name=Smartho mac=AA:BB:CC:DD:EE:02 bat=40`,
+			StethoscopeDevice{Name: "Smartho", MAC: "AA:BB:CC:DD:EE:02", Battery: 40}, true,
+		},
+		{
+			`DATA:ITEM mac=AA:BB:CC:DD:EE:03 bat=9%`,
+			StethoscopeDevice{MAC: "AA:BB:CC:DD:EE:03", Battery: 9}, true,
+		},
+		// battery wins over bat; unreadable values are left unset
+		{
+			`DATA:ITEM mac=AA:BB:CC:DD:EE:04 bat=10 battery=90`,
+			StethoscopeDevice{MAC: "AA:BB:CC:DD:EE:04", Battery: 90}, true,
+		},
+		{
+			`DATA:ITEM mac=AA:BB:CC:DD:EE:05 rssi=weak battery=full bat=n/a`,
+			StethoscopeDevice{MAC: "AA:BB:CC:DD:EE:05", Battery: -1}, true,
+		},
+		{`DATA:ITEM name="No MAC" rssi=-40`, StethoscopeDevice{}, false},
+		{`Scanning for devices...`, StethoscopeDevice{}, false},
+		{``, StethoscopeDevice{}, false},
+	}
+	for _, tc := range tests {
+		got, ok := parseMinttiDevice(tc.line)
+		if ok != tc.ok || got != tc.want {
+			t.Errorf("parseMinttiDevice(%q) = %+v, %v; want %+v, %v", tc.line, got, ok, tc.want, tc.ok)
+		}
+	}
+}
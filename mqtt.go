@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// A small MQTT 3.1.1 publisher for sites whose nurse-station displays read
+// from a local broker. Each reading is published to
+// medicart/{clinic}/{patient}/{metric} as JSON. Publishing is synchronous:
+// QoS 1 waits for PUBACK, QoS 2 for PUBREC/PUBCOMP. The connection is
+// opened on first use and re-opened after an error.
+//
+// With QoS 2 the client keeps a persistent session (CleanSession=0) under
+// a client id derived from the host name, so the broker remembers packet
+// ids across a reconnect: a PUBLISH that is resent keeps its id and the
+// DUP flag, and once PUBREC has arrived only PUBREL is repeated. A reading
+// is then delivered once even if the connection drops mid-handshake.
+
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPubrec     = 5
+	mqttPubrel     = 6
+	mqttPubcomp    = 7
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+
+	mqttKeepAlive = 60 * time.Second
+	mqttTimeout   = 10 * time.Second
+)
+
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+type mqttClient struct {
+	addr     string // host:port
+	useTLS   bool
+	clientID string
+	username string
+	password string
+	qos      byte
+	retain   bool
+
+	mu         sync.Mutex
+	conn       net.Conn
+	r          *bufio.Reader
+	packetID   uint16
+	lastSent   time.Time
+	unreleased uint16 // QoS 2 packet id still owed a PUBREL, 0 if none
+}
+
+// mqttMessage is one PUBLISH in flight.
+type mqttMessage struct {
+	topic    string
+	payload  []byte
+	id       uint16 // 0 until sent with QoS > 0
+	sent     bool   // a resend sets DUP
+	received bool   // PUBREC arrived; only PUBREL is left
+}
+
+// newMQTTClient parses a broker URL: tcp:// or mqtt:// (port 1883), ssl://,
+// tls:// or mqtts:// (port 8883). TLS uses the uploader's TLS settings.
+func newMQTTClient(brokerURL, username, password string, qos byte, retain bool) (*mqttClient, error) {
+	if !strings.Contains(brokerURL, "://") {
+		brokerURL = "tcp://" + brokerURL
+	}
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, fmt.Errorf("MQTT broker URL: %w", err)
+	}
+	c := &mqttClient{
+		username: username,
+		password: password,
+		qos:      qos,
+		retain:   retain,
+		clientID: "medicart-" + newRequestID(),
+	}
+	if qos == 2 {
+		c.clientID = mqttSessionID()
+	}
+	port := "1883"
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		c.useTLS, port = true, "8883"
+	default:
+		return nil, fmt.Errorf("MQTT broker URL: unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("MQTT broker URL: missing host")
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	if qos > 2 {
+		return nil, fmt.Errorf("MQTT QoS must be 0, 1 or 2, not %d", qos)
+	}
+	c.addr = net.JoinHostPort(u.Hostname(), port)
+	return c, nil
+}
+
+// mqttSessionID is a client id that stays the same across restarts, so a
+// persistent session is picked up again. MQTT 3.1.1 brokers must accept
+// 23 characters.
+func mqttSessionID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "medicart-" + newRequestID()
+	}
+	id := "medicart-" + strings.Map(func(r rune) rune {
+		if r < 0x80 && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return -1
+	}, host)
+	if len(id) > 23 {
+		id = id[:23]
+	}
+	return id
+}
+
+// mqttTopicPart keeps names from adding levels or wildcards to a topic.
+func mqttTopicPart(s string) string {
+	s = strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(strings.TrimSpace(s))
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+func mqttTopic(clinic, patient, metric string) string {
+	return "medicart/" + mqttTopicPart(clinic) + "/" + mqttTopicPart(patient) + "/" + metric
+}
+
+// PublishReading sends one parsed reading. Audio chunks are not readings
+// and are skipped.
+func (c *mqttClient) PublishReading(data map[string]interface{}) error {
+	if data["stream_type"] == "audio" {
+		return nil
+	}
+	clinic, _ := data["clinic_name"].(string)
+	patient, _ := data["patient_name"].(string)
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return c.Publish(mqttTopic(clinic, patient, metricName(data)), payload)
+}
+
+// Publish sends payload with the client's QoS and retain flag, reconnecting
+// once if the connection turns out to be dead.
+func (c *mqttClient) Publish(topic string, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	msg := &mqttMessage{topic: topic, payload: payload}
+	err := c.publishLocked(msg)
+	if err != nil && c.conn != nil {
+		c.closeLocked()
+		err = c.publishLocked(msg)
+	}
+	if err != nil {
+		c.closeLocked()
+		if msg.received {
+			// The broker has the message; finish it on the next connection
+			c.unreleased = msg.id
+		}
+	}
+	return err
+}
+
+func (c *mqttClient) publishLocked(msg *mqttMessage) error {
+	if err := c.ensureConnected(); err != nil {
+		return err
+	}
+	if !msg.received {
+		flags := c.qos << 1
+		if c.retain {
+			flags |= 0x01
+		}
+		if msg.sent && c.qos > 0 {
+			flags |= 0x08
+		}
+		body := mqttString(msg.topic)
+		if c.qos > 0 {
+			if msg.id == 0 {
+				c.packetID++
+				if c.packetID == 0 {
+					c.packetID = 1
+				}
+				msg.id = c.packetID
+			}
+			body = binary.BigEndian.AppendUint16(body, msg.id)
+		}
+		body = append(body, msg.payload...)
+		if err := c.send(mqttPublish<<4|flags, body); err != nil {
+			return err
+		}
+		msg.sent = true
+
+		switch c.qos {
+		case 0:
+			return nil
+		case 1:
+			return c.await(mqttPuback, msg.id)
+		}
+		if err := c.await(mqttPubrec, msg.id); err != nil {
+			return err
+		}
+		msg.received = true
+	}
+	return c.release(msg.id)
+}
+
+// release completes a QoS 2 delivery: PUBREL, then wait for PUBCOMP.
+func (c *mqttClient) release(id uint16) error {
+	if err := c.send(mqttPubrel<<4|0x02, binary.BigEndian.AppendUint16(nil, id)); err != nil {
+		return err
+	}
+	return c.await(mqttPubcomp, id)
+}
+
+// ensureConnected dials if needed and, on an idle connection, checks with
+// a ping that the broker has not dropped it.
+func (c *mqttClient) ensureConnected() error {
+	if c.conn != nil {
+		if time.Since(c.lastSent) < mqttKeepAlive/2 {
+			return nil
+		}
+		if err := c.send(mqttPingreq<<4, nil); err == nil {
+			if err = c.await(mqttPingresp, 0); err == nil {
+				return nil
+			}
+		}
+		c.closeLocked()
+	}
+
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	var conn net.Conn
+	var err error
+	if c.useTLS {
+		cfg := currentTLSConfig()
+		cfg.ServerName, _, _ = net.SplitHostPort(c.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, cfg)
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+
+	var flags byte
+	if c.qos < 2 {
+		flags |= 0x02 // clean session
+	}
+	payload := mqttString(c.clientID)
+	if c.username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(c.username)...)
+		if c.password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(c.password)...)
+		}
+	}
+	body := append(mqttString("MQTT"), 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	if err := c.send(mqttConnect<<4, append(body, payload...)); err != nil {
+		return err
+	}
+	typ, ack, err := c.read()
+	if err != nil {
+		return fmt.Errorf("MQTT connect: %w", err)
+	}
+	if typ != mqttConnack || len(ack) < 2 {
+		return fmt.Errorf("MQTT connect: unexpected packet type %d", typ)
+	}
+	if ack[1] != 0 {
+		reason := mqttConnackErrors[ack[1]]
+		if reason == "" {
+			reason = fmt.Sprintf("code %d", ack[1])
+		}
+		return fmt.Errorf("MQTT connect refused: %s", reason)
+	}
+	if id := c.unreleased; id != 0 {
+		c.unreleased = 0
+		if ack[0]&0x01 == 0 {
+			return nil // the broker has no session, so nothing to release
+		}
+		if err := c.release(id); err != nil {
+			c.unreleased = id
+			return fmt.Errorf("MQTT resume: %w", err)
+		}
+	}
+	return nil
+}
+
+// await reads packets until one of type want (with packet id, if not 0)
+// arrives.
+func (c *mqttClient) await(want byte, id uint16) error {
+	for {
+		typ, body, err := c.read()
+		if err != nil {
+			return err
+		}
+		if typ != want {
+			continue // e.g. a late PINGRESP
+		}
+		if id == 0 || (len(body) >= 2 && binary.BigEndian.Uint16(body) == id) {
+			return nil
+		}
+	}
+}
+
+func (c *mqttClient) send(header byte, body []byte) error {
+	pkt := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		pkt = append(pkt, b)
+		if n == 0 {
+			break
+		}
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(mqttTimeout))
+	if _, err := c.conn.Write(append(pkt, body...)); err != nil {
+		return err
+	}
+	c.lastSent = time.Now()
+	return nil
+}
+
+func (c *mqttClient) read() (byte, []byte, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(mqttTimeout))
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, mult := 0, 1
+	for i := 0; ; i++ {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		if mult *= 128; i == 3 {
+			return 0, nil, errors.New("MQTT: malformed remaining length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
+
+func (c *mqttClient) closeLocked() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.r = nil, nil
+	}
+}
+
+// Close disconnects cleanly.
+func (c *mqttClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		_ = c.send(mqttDisconnect<<4, nil)
+		c.closeLocked()
+	}
+}
+
+func mqttString(s string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(s)))
+	return append(b, s...)
+}
+
+// metricName names the topic's metric level after the metric file the
+// server stores the reading in (metricFile in web-server/main.go), with the
+// same checks in the same order: a blood pressure result also has "pr", so
+// it goes to heart_rate like on the server.
+func metricName(data map[string]interface{}) string {
+	keys := map[string]bool{}
+	for k := range data {
+		keys[strings.ToLower(k)] = true
+	}
+	switch {
+	case keys["pr"] || keys["spo2"]:
+		return "heart_rate"
+	case keys["sys"] || keys["dia"] || keys["cuff_pressure"]:
+		return "bp"
+	case keys["glu"]:
+		return "glucose"
+	case keys["temp"]:
+		return "temperature"
+	case keys["type"] && data["type"] == "stream" && (data["stream_type"] == "audio" || data["stream_type"] == "heartrate"):
+		return "stethoscope"
+	}
+	return "misc"
+}
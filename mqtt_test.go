@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mqttPacket is a packet the fake broker received.
+type mqttPacket struct {
+	conn  int // connection number, from 1
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+func (p mqttPacket) packetID() uint16 {
+	if p.typ == mqttPublish {
+		n := int(binary.BigEndian.Uint16(p.body))
+		return binary.BigEndian.Uint16(p.body[2+n:])
+	}
+	return binary.BigEndian.Uint16(p.body)
+}
+
+// fakeBroker answers CONNECT, PUBLISH, PUBREL and PINGREQ on loopback and
+// records what it got. drop, if set, is asked before each answer whether
+// to close the connection instead.
+type fakeBroker struct {
+	ln          net.Listener
+	connackCode byte
+	drop        func(p mqttPacket) bool
+	closed      chan int // connection numbers, as they end
+
+	mu      sync.Mutex
+	packets []mqttPacket
+	conns   int
+	session map[uint16]bool // QoS 2 ids received and not yet released
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{ln: ln, closed: make(chan int, 16), session: map[uint16]bool{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns++
+			n := b.conns
+			b.mu.Unlock()
+			go b.serve(conn, n)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *fakeBroker) received() []mqttPacket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]mqttPacket(nil), b.packets...)
+}
+
+// waitClosed waits until n connections have ended, so that everything
+// the client sent has been recorded.
+func (b *fakeBroker) waitClosed(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-b.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d connections still open", n-i, n)
+		}
+	}
+}
+
+func (b *fakeBroker) serve(conn net.Conn, n int) {
+	defer func() { b.closed <- n }()
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		p, err := readTestPacket(r)
+		if err != nil {
+			return
+		}
+		p.conn = n
+		b.mu.Lock()
+		b.packets = append(b.packets, p)
+		drop := b.drop != nil && b.drop(p)
+		b.mu.Unlock()
+		if drop {
+			return
+		}
+
+		var reply []byte
+		switch p.typ {
+		case mqttConnect:
+			cleanSession := p.body[7]&0x02 != 0
+			b.mu.Lock()
+			if cleanSession {
+				b.session = map[uint16]bool{}
+			}
+			present := byte(0)
+			if !cleanSession && b.conns > 1 {
+				present = 1
+			}
+			b.mu.Unlock()
+			reply = []byte{mqttConnack << 4, 2, present, b.connackCode}
+		case mqttPublish:
+			switch qos := p.flags >> 1 & 0x03; qos {
+			case 1:
+				reply = binary.BigEndian.AppendUint16([]byte{mqttPuback << 4, 2}, p.packetID())
+			case 2:
+				b.mu.Lock()
+				b.session[p.packetID()] = true
+				b.mu.Unlock()
+				reply = binary.BigEndian.AppendUint16([]byte{mqttPubrec << 4, 2}, p.packetID())
+			}
+		case mqttPubrel:
+			b.mu.Lock()
+			delete(b.session, p.packetID())
+			b.mu.Unlock()
+			reply = binary.BigEndian.AppendUint16([]byte{mqttPubcomp << 4, 2}, p.packetID())
+		case mqttPingreq:
+			reply = []byte{mqttPingresp << 4, 0}
+		case mqttDisconnect:
+			return
+		}
+		if reply != nil {
+			if _, err := conn.Write(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readTestPacket(r *bufio.Reader) (mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+	n, mult := 0, 1
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		n += int(c&0x7f) * mult
+		mult *= 128
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return mqttPacket{}, err
+	}
+	return mqttPacket{typ: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+// publishes returns the topic and payload of each PUBLISH in packets.
+func publishes(packets []mqttPacket) (topics, payloads []string) {
+	for _, p := range packets {
+		if p.typ != mqttPublish {
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(p.body))
+		rest := p.body[2+n:]
+		if p.flags>>1&0x03 > 0 {
+			rest = rest[2:]
+		}
+		topics = append(topics, string(p.body[2:2+n]))
+		payloads = append(payloads, string(rest))
+	}
+	return topics, payloads
+}
+
+func types(packets []mqttPacket) []byte {
+	var out []byte
+	for _, p := range packets {
+		out = append(out, p.typ)
+	}
+	return out
+}
+
+func TestMQTTConnect(t *testing.T) {
+	b := newFakeBroker(t)
+	c, err := newMQTTClient(b.url(), "nurse", "s3cret", 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Publish("medicart/t", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := b.received()[0]
+	if p.typ != mqttConnect {
+		t.Fatalf("first packet is type %d, want CONNECT", p.typ)
+	}
+	body := p.body
+	if string(body[:6]) != "\x00\x04MQTT" || body[6] != 4 {
+		t.Fatalf("protocol %q level %d, want MQTT 4", body[:6], body[6])
+	}
+	if flags := body[7]; flags != 0x80|0x40|0x02 {
+		t.Fatalf("connect flags %#x, want user name, password and clean session", flags)
+	}
+	if keepAlive := binary.BigEndian.Uint16(body[8:]); keepAlive != 60 {
+		t.Fatalf("keep alive %d, want 60", keepAlive)
+	}
+	var fields []string
+	for rest := body[10:]; len(rest) >= 2; {
+		n := int(binary.BigEndian.Uint16(rest))
+		fields, rest = append(fields, string(rest[2:2+n])), rest[2+n:]
+	}
+	if len(fields) != 3 || !strings.HasPrefix(fields[0], "medicart-") || fields[1] != "nurse" || fields[2] != "s3cret" {
+		t.Fatalf("connect payload %q, want client id, user name and password", fields)
+	}
+}
+
+func TestMQTTConnectRefused(t *testing.T) {
+	b := newFakeBroker(t)
+	b.connackCode = 5
+	c, err := newMQTTClient(b.url(), "", "", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.Publish("medicart/t", []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Fatalf("Publish = %v, want a not authorized error", err)
+	}
+}
+
+func TestMQTTPublishQoS(t *testing.T) {
+	tests := []struct {
+		qos    byte
+		retain bool
+		want   []byte // packet types after CONNECT
+	}{
+		{0, false, []byte{mqttPublish}},
+		{1, true, []byte{mqttPublish}},
+		{2, true, []byte{mqttPublish, mqttPubrel}},
+	}
+	for _, tc := range tests {
+		t.Run(string('0'+tc.qos), func(t *testing.T) {
+			b := newFakeBroker(t)
+			c, err := newMQTTClient(b.url(), "", "", tc.qos, tc.retain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reading := map[string]interface{}{"clinic_name": "North/1", "patient_name": "Jane+Doe", "spo2": 97.0}
+			if err := c.PublishReading(reading); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Publish("medicart/x", []byte("second")); err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+			b.waitClosed(t, 1)
+
+			got := b.received()
+			clean := got[0].body[7]&0x02 != 0
+			if clean != (tc.qos < 2) {
+				t.Fatalf("clean session = %v with QoS %d", clean, tc.qos)
+			}
+			want := append([]byte{mqttConnect}, tc.want...)
+			want = append(append(want, tc.want...), mqttDisconnect)
+			if string(types(got)) != string(want) {
+				t.Fatalf("packet types %v, want %v", types(got), want)
+			}
+			pub := got[1]
+			if qos := pub.flags >> 1 & 0x03; qos != tc.qos {
+				t.Fatalf("PUBLISH QoS %d, want %d", qos, tc.qos)
+			}
+			if retain := pub.flags&0x01 != 0; retain != tc.retain {
+				t.Fatalf("retain = %v, want %v", retain, tc.retain)
+			}
+			if pub.flags&0x08 != 0 {
+				t.Fatal("first PUBLISH has DUP set")
+			}
+			topics, payloads := publishes(got)
+			if topics[0] != "medicart/North_1/Jane_Doe/heart_rate" || !strings.Contains(payloads[0], `"spo2":97`) {
+				t.Fatalf("published %q %q", topics[0], payloads[0])
+			}
+			if tc.qos > 0 {
+				second := got[1+len(tc.want)]
+				if pub.packetID() == 0 || second.packetID() == pub.packetID() {
+					t.Fatalf("packet ids %d and %d, want distinct non-zero ids", pub.packetID(), second.packetID())
+				}
+			}
+		})
+	}
+}
+
+func TestMQTTReconnectResendsPublish(t *testing.T) {
+	for _, qos := range []byte{1, 2} {
+		t.Run(string('0'+qos), func(t *testing.T) {
+			b := newFakeBroker(t)
+			// Lose the first PUBLISH's connection before the broker answers
+			b.drop = func(p mqttPacket) bool { return p.conn == 1 && p.typ == mqttPublish }
+			c, err := newMQTTClient(b.url(), "", "", qos, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if err := c.Publish("medicart/t", []byte("r1")); err != nil {
+				t.Fatal(err)
+			}
+
+			var pubs []mqttPacket
+			for _, p := range b.received() {
+				if p.typ == mqttPublish {
+					pubs = append(pubs, p)
+				}
+			}
+			if len(pubs) != 2 || pubs[1].conn != 2 {
+				t.Fatalf("got %d PUBLISH packets, want the original and a resend on a new connection", len(pubs))
+			}
+			if pubs[1].flags&0x08 == 0 {
+				t.Fatal("resent PUBLISH has no DUP flag")
+			}
+			if pubs[0].packetID() != pubs[1].packetID() {
+				t.Fatalf("resend has packet id %d, want %d", pubs[1].packetID(), pubs[0].packetID())
+			}
+		})
+	}
+}
+
+func TestMQTTQoS2ReconnectAfterPubrec(t *testing.T) {
+	b := newFakeBroker(t)
+	// The broker stored the message and sent PUBREC, then the link dropped
+	// before the PUBREL got through
+	b.drop = func(p mqttPacket) bool { return p.conn == 1 && p.typ == mqttPubrel }
+	c, err := newMQTTClient(b.url(), "", "", 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Publish("medicart/t", []byte("r1")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.received()
+	want := []byte{mqttConnect, mqttPublish, mqttPubrel, mqttConnect, mqttPubrel}
+	if string(types(got)) != string(want) {
+		t.Fatalf("packet types %v, want %v: the message must not be published twice", types(got), want)
+	}
+	if got[3].body[7]&0x02 != 0 {
+		t.Fatal("reconnect asked for a clean session")
+	}
+	if got[4].packetID() != got[1].packetID() {
+		t.Fatalf("PUBREL for %d, want %d", got[4].packetID(), got[1].packetID())
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.session) != 0 {
+		t.Fatalf("broker still holds %v", b.session)
+	}
+}
+
+func TestMQTTQoS2ReleasesOnNextConnection(t *testing.T) {
+	b := newFakeBroker(t)
+	// Both PUBRELs of the first Publish are lost
+	b.drop = func(p mqttPacket) bool { return p.conn <= 2 && p.typ == mqttPubrel }
+	c, err := newMQTTClient(b.url(), "", "", 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Publish("medicart/t", []byte("r1")); err == nil {
+		t.Fatal("Publish succeeded although no PUBCOMP arrived")
+	}
+	if err := c.Publish("medicart/t", []byte("r2")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := b.received()
+	want := []byte{mqttConnect, mqttPublish, mqttPubrel, mqttConnect, mqttPubrel,
+		mqttConnect, mqttPubrel, mqttPublish, mqttPubrel}
+	if string(types(got)) != string(want) {
+		t.Fatalf("packet types %v, want %v", types(got), want)
+	}
+	if got[6].packetID() != got[1].packetID() {
+		t.Fatalf("resumed PUBREL for %d, want %d", got[6].packetID(), got[1].packetID())
+	}
+	if _, payloads := publishes(got); len(payloads) != 2 || payloads[0] != "r1" || payloads[1] != "r2" {
+		t.Fatalf("published %q, want r1 once and r2", payloads)
+	}
+}
+
+func TestMQTTSessionID(t *testing.T) {
+	id := mqttSessionID()
+	if id != mqttSessionID() {
+		t.Fatal("session client id changes between calls")
+	}
+	if len(id) > 23 || !strings.HasPrefix(id, "medicart-") {
+		t.Fatalf("session client id %q", id)
+	}
+}
+
+func TestMetricName(t *testing.T) {
+	tests := []struct {
+		data map[string]interface{}
+		want string
+	}{
+		{map[string]interface{}{"spo2": 97.0, "pr": 70.0}, "heart_rate"},
+		// A blood pressure result carries the pulse, and the server keeps
+		// it in heart_rate.json
+		{map[string]interface{}{"sys": 120.0, "dia": 80.0, "pr": 64.0}, "heart_rate"},
+		{map[string]interface{}{"sys": 120.0, "dia": 80.0}, "bp"},
+		{map[string]interface{}{"cuff_pressure": 90.0}, "bp"},
+		{map[string]interface{}{"GLU": 95.0}, "glucose"},
+		{map[string]interface{}{"temp": 36.6}, "temperature"},
+		{map[string]interface{}{"type": "stream", "stream_type": "heartrate"}, "stethoscope"},
+		{map[string]interface{}{"type": "stream", "stream_type": "ecg"}, "misc"},
+		{map[string]interface{}{"note": "x"}, "misc"},
+	}
+	for _, tc := range tests {
+		if got := metricName(tc.data); got != tc.want {
+			t.Errorf("metricName(%v) = %q, want %q", tc.data, got, tc.want)
+		}
+	}
+}
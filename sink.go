@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A reading is delivered to every configured sink: the Web Server URL,
+// any additional destinations (more servers, a JSONL file, a WebSocket)
+// and the MQTT broker. Sinks are sent to in parallel and fail
+// independently; each keeps its own success/failure count for the UI.
+
+// Sink is one destination for readings.
+type Sink interface {
+	Name() string
+	Send(requestID string, data map[string]interface{}) error
+	Close() error
+}
+
+// --- HTTP ---
+
+type httpSink struct {
+	url    string
+	apiKey string
+}
+
+func (s *httpSink) Name() string { return s.url }
+
+func (s *httpSink) Send(requestID string, data map[string]interface{}) error {
+	return sendData(s.url, s.apiKey, requestID, data)
+}
+
+func (s *httpSink) Close() error { return nil }
+
+// batchOptions, when set, makes HTTP destinations batch their readings.
+type batchOptions struct {
+	window   time.Duration
+	maxItems int
+}
+
+func newHTTPSink(url, apiKey string, batch *batchOptions) Sink {
+	if batch != nil {
+		return newBatchSink(url, apiKey, batch.window, batch.maxItems)
+	}
+	return &httpSink{url: url, apiKey: apiKey}
+}
+
+// --- HTTP batches ---
+
+// batchSink collects readings and posts them gzip-compressed to the
+// server's {ingest URL}/batch every window, or sooner once maxItems or
+// batchMaxBytes have built up. Readings the server could not store (5xx)
+// or that never arrived are kept for the next batch, up to
+// batchPendingFactor batches' worth; beyond that the oldest are dropped.
+type batchSink struct {
+	url      string
+	apiKey   string
+	window   time.Duration
+	maxItems int
+
+	mu      sync.Mutex
+	items   []json.RawMessage
+	size    int
+	timer   *time.Timer
+	sending sync.Mutex // one post at a time, so batches stay in order
+	report  func(sent, failed int, err error)
+}
+
+const (
+	batchMaxBytes      = 256 << 10
+	batchPendingFactor = 10
+)
+
+func newBatchSink(ingestURL, apiKey string, window time.Duration, maxItems int) *batchSink {
+	return &batchSink{
+		url:      strings.TrimRight(ingestURL, "/") + "/batch",
+		apiKey:   apiKey,
+		window:   window,
+		maxItems: maxItems,
+	}
+}
+
+func (s *batchSink) Name() string { return s.url }
+
+func (s *batchSink) setReport(report func(sent, failed int, err error)) { s.report = report }
+
+// Send queues the reading; the outcome is reported when its batch is posted.
+func (s *batchSink) Send(_ string, data map[string]interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.items = append(s.items, b)
+	s.size += len(b)
+	full := len(s.items) >= s.maxItems || s.size >= batchMaxBytes
+	if !full && s.timer == nil {
+		s.timer = time.AfterFunc(s.window, func() { s.flush() })
+	}
+	s.mu.Unlock()
+	if full {
+		go s.flush()
+	}
+	return nil
+}
+
+// flush posts everything queued so far.
+func (s *batchSink) flush() {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+
+	s.mu.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	items := s.items
+	s.items, s.size = nil, 0
+	s.mu.Unlock()
+	if len(items) == 0 {
+		return
+	}
+
+	failed, retry, err := postBatch(s.url, s.apiKey, items)
+	sent := len(items) - failed - len(retry)
+
+	s.mu.Lock()
+	// Put retries back in front of whatever arrived meanwhile
+	s.items = append(retry, s.items...)
+	if limit := batchPendingFactor * s.maxItems; len(s.items) > limit {
+		drop := len(s.items) - limit
+		failed += drop
+		s.items = s.items[drop:]
+	}
+	s.size = 0
+	for _, it := range s.items {
+		s.size += len(it)
+	}
+	if len(s.items) > 0 && s.timer == nil {
+		s.timer = time.AfterFunc(s.window, func() { s.flush() })
+	}
+	s.mu.Unlock()
+
+	if s.report != nil {
+		s.report(sent, failed, err)
+	}
+}
+
+func (s *batchSink) Close() error {
+	s.flush()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if n := len(s.items); n > 0 {
+		s.items, s.size = nil, 0
+		if s.report != nil {
+			s.report(0, n, nil)
+		}
+		return fmt.Errorf("%d readings could not be delivered", n)
+	}
+	return nil
+}
+
+// postBatch sends items as one gzip-compressed JSON array. It returns how
+// many the server rejected and the items worth sending again: all of them
+// if the request failed outright, else those answered with a 5xx.
+func postBatch(url, apiKey string, items []json.RawMessage) (int, []json.RawMessage, error) {
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write([]byte("["))
+	for i, it := range items {
+		if i > 0 {
+			zw.Write([]byte(","))
+		}
+		zw.Write(it)
+	}
+	zw.Write([]byte("]"))
+	if err := zw.Close(); err != nil {
+		return len(items), nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, &body)
+	if err != nil {
+		return len(items), nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set(requestIDHeader, newRequestID())
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	resp, err := currentHTTPClient().Do(req)
+	if err != nil {
+		return 0, items, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return 0, items, fmt.Errorf("server returned status: %s", resp.Status)
+	}
+	if resp.StatusCode >= 400 {
+		return len(items), nil, fmt.Errorf("server returned status: %s", resp.Status)
+	}
+
+	var out struct {
+		Results []struct {
+			Index  int    `json:"index"`
+			Status int    `json:"status"`
+			Error  string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		// The batch was accepted; only the per-reading detail is lost
+		return 0, nil, fmt.Errorf("reading batch results: %w", err)
+	}
+	rejected := 0
+	var retry []json.RawMessage
+	var errs []error
+	for _, res := range out.Results {
+		if res.Status == http.StatusOK || res.Index < 0 || res.Index >= len(items) {
+			continue
+		}
+		if res.Status >= 500 {
+			retry = append(retry, items[res.Index])
+		} else {
+			rejected++
+		}
+		errs = append(errs, fmt.Errorf("reading %d: %d %s", res.Index, res.Status, res.Error))
+	}
+	return rejected, retry, errors.Join(errs...)
+}
+
+// --- File (JSON lines) ---
+
+type fileSink struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{path: path, f: f}, nil
+}
+
+func (s *fileSink) Name() string { return s.path }
+
+func (s *fileSink) Send(_ string, data map[string]interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.f.Write(append(b, '\n'))
+	return err
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// --- WebSocket ---
+
+// wsSink writes each reading as a JSON text message to the server's
+// /ws/ingest and waits for the result the server sends back for it. It
+// dials on first use and again after a failed write, so a restarted server
+// only costs the reading that found the connection dead.
+type wsSink struct {
+	url    string
+	apiKey string
+	mu     sync.Mutex
+	conn   *websocket.Conn
+}
+
+func (s *wsSink) Name() string { return s.url }
+
+func (s *wsSink) Send(requestID string, data map[string]interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		header := http.Header{}
+		header.Set(requestIDHeader, requestID)
+		if s.apiKey != "" {
+			header.Set("X-API-Key", s.apiKey)
+		}
+		c, _, err := currentWSDialer().Dial(s.url, header)
+		if err != nil {
+			return err
+		}
+		s.conn = c
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err := s.conn.WriteMessage(websocket.TextMessage, b); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	var res struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}
+	_ = s.conn.SetReadDeadline(time.Now().Add(wsWriteWait))
+	if err := s.conn.ReadJSON(&res); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("reading result: %w", err)
+	}
+	if res.Status != http.StatusOK {
+		return fmt.Errorf("server returned %d: %s", res.Status, res.Error)
+	}
+	return nil
+}
+
+func (s *wsSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	_ = s.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"), time.Now().Add(wsWriteWait))
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// --- MQTT ---
+
+type mqttSink struct{ c *mqttClient }
+
+func (s mqttSink) Name() string { return "mqtt://" + s.c.addr }
+
+func (s mqttSink) Send(_ string, data map[string]interface{}) error {
+	return s.c.PublishReading(data)
+}
+
+func (s mqttSink) Close() error {
+	s.c.Close()
+	return nil
+}
+
+// parseSinks reads the additional destinations, one per line: an http(s)://
+// or ws(s):// URL, optionally followed by an API key for that server
+// (default apiKey), or a JSONL file given as file:{path} or an absolute
+// path. Anything else is an error, so a mistyped URL does not quietly
+// become a file. Blank lines and lines starting with # are ignored.
+func parseSinks(text, apiKey string, batch *batchOptions) ([]Sink, error) {
+	var sinks []Sink
+	fail := func(err error) ([]Sink, error) {
+		closeSinks(sinks)
+		return nil, err
+	}
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		key := apiKey
+		if len(fields) > 1 {
+			key = fields[1]
+		}
+		switch u, err := url.Parse(fields[0]); {
+		case err == nil && (u.Scheme == "http" || u.Scheme == "https"):
+			sinks = append(sinks, newHTTPSink(fields[0], key, batch))
+		case err == nil && (u.Scheme == "ws" || u.Scheme == "wss"):
+			sinks = append(sinks, &wsSink{url: fields[0], apiKey: key})
+		case strings.HasPrefix(line, "file:") || filepath.IsAbs(line):
+			// The whole line, as paths may contain spaces
+			path := strings.TrimPrefix(strings.TrimPrefix(line, "file://"), "file:")
+			if path == "" {
+				return fail(fmt.Errorf("destination line %d: file: needs a path", i+1))
+			}
+			s, err := newFileSink(path)
+			if err != nil {
+				return fail(fmt.Errorf("destination line %d: %w", i+1, err))
+			}
+			sinks = append(sinks, s)
+		default:
+			return fail(fmt.Errorf("destination line %d: %q is not an http(s):// or ws(s):// URL, a file: path or an absolute path", i+1, fields[0]))
+		}
+	}
+	return sinks, nil
+}
+
+func closeSinks(sinks []Sink) error {
+	var errs []error
+	for _, s := range sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// --- Fan-out ---
+
+type sinkCount struct {
+	ok, failed int
+}
+
+// asyncSink is a sink that reports outcomes later, like batchSink once
+// a batch has been posted.
+type asyncSink interface {
+	Sink
+	setReport(func(sent, failed int, err error))
+}
+
+// fanOut sends each reading to all sinks and counts the outcomes.
+// onError receives failures that asynchronous sinks report later.
+type fanOut struct {
+	sinks   []Sink
+	mu      sync.Mutex
+	counts  []sinkCount
+	onCount func(summary string)
+}
+
+func newFanOut(sinks []Sink, onCount func(summary string), onError func(sink string, err error)) *fanOut {
+	f := &fanOut{sinks: sinks, counts: make([]sinkCount, len(sinks)), onCount: onCount}
+	for i, s := range sinks {
+		if as, ok := s.(asyncSink); ok {
+			i, name := i, s.Name()
+			as.setReport(func(sent, failed int, err error) {
+				if err != nil && onError != nil {
+					onError(name, err)
+				}
+				f.mu.Lock()
+				f.counts[i].ok += sent
+				f.counts[i].failed += failed
+				summary := f.summaryLocked()
+				f.mu.Unlock()
+				if f.onCount != nil {
+					f.onCount(summary)
+				}
+			})
+		}
+	}
+	return f
+}
+
+// Send delivers data everywhere and returns the failures by sink name.
+func (f *fanOut) Send(requestID string, data map[string]interface{}) map[string]error {
+	errs := make([]error, len(f.sinks))
+	var wg sync.WaitGroup
+	for i, s := range f.sinks {
+		wg.Add(1)
+		go func(i int, s Sink) {
+			defer wg.Done()
+			errs[i] = s.Send(requestID, data)
+		}(i, s)
+	}
+	wg.Wait()
+
+	failed := map[string]error{}
+	f.mu.Lock()
+	for i, err := range errs {
+		if _, async := f.sinks[i].(asyncSink); err != nil {
+			f.counts[i].failed++
+			failed[f.sinks[i].Name()] = err
+		} else if !async {
+			f.counts[i].ok++
+		}
+	}
+	summary := f.summaryLocked()
+	f.mu.Unlock()
+	if f.onCount != nil {
+		f.onCount(summary)
+	}
+	return failed
+}
+
+// Summary is one line per sink: "name: 12 sent, 1 failed".
+func (f *fanOut) Summary() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.summaryLocked()
+}
+
+func (f *fanOut) summaryLocked() string {
+	lines := make([]string, len(f.sinks))
+	for i, s := range f.sinks {
+		lines[i] = fmt.Sprintf("%s: %d sent, %d failed", s.Name(), f.counts[i].ok, f.counts[i].failed)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (f *fanOut) Close() error {
+	return closeSinks(f.sinks)
+}
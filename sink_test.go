@@ -0,0 +1,341 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIngest stands in for the server's /batch endpoint. answer writes the
+// response to each batch, given the readings it held.
+type fakeIngest struct {
+	srv    *httptest.Server
+	answer func(w http.ResponseWriter, items []json.RawMessage)
+
+	mu      sync.Mutex
+	batches [][]json.RawMessage
+}
+
+func newFakeIngest(t *testing.T, answer func(w http.ResponseWriter, items []json.RawMessage)) *fakeIngest {
+	t.Helper()
+	f := &fakeIngest{answer: answer}
+	f.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/ingest/batch" || r.Header.Get("Content-Encoding") != "gzip" || r.Header.Get("X-API-Key") != "mk_test" {
+			t.Errorf("unexpected request %s %s %v", r.Method, r.URL, r.Header)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("body is not gzip: %v", err)
+			return
+		}
+		var items []json.RawMessage
+		if err := json.NewDecoder(zr).Decode(&items); err != nil {
+			t.Errorf("body is not a JSON array: %v", err)
+			return
+		}
+		f.mu.Lock()
+		f.batches = append(f.batches, items)
+		f.mu.Unlock()
+		f.answer(w, items)
+	}))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeIngest) received() [][]json.RawMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]json.RawMessage(nil), f.batches...)
+}
+
+// results answers with one result per reading, 200 unless listed in status.
+func results(w http.ResponseWriter, items []json.RawMessage, status map[int]int) {
+	type result struct {
+		Index  int    `json:"index"`
+		Status int    `json:"status"`
+		Error  string `json:"error,omitempty"`
+	}
+	var out struct {
+		Results []result `json:"results"`
+	}
+	for i := range items {
+		res := result{Index: i, Status: http.StatusOK}
+		if s, ok := status[i]; ok {
+			res.Status, res.Error = s, http.StatusText(s)
+		}
+		out.Results = append(out.Results, res)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// batchReport is one outcome a batchSink reported.
+type batchReport struct {
+	sent, failed int
+	err          error
+}
+
+// newTestBatchSink returns a sink posting to f that only flushes when the
+// test says so, and the outcomes it reports.
+func newTestBatchSink(t *testing.T, f *fakeIngest, maxItems int) (*batchSink, *[]batchReport) {
+	t.Helper()
+	s := newBatchSink(f.srv.URL+"/api/ingest", "mk_test", time.Hour, maxItems)
+	var reports []batchReport
+	s.setReport(func(sent, failed int, err error) {
+		reports = append(reports, batchReport{sent, failed, err})
+	})
+	t.Cleanup(func() {
+		s.mu.Lock()
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		s.mu.Unlock()
+	})
+	return s, &reports
+}
+
+func reading(n int) map[string]interface{} {
+	return map[string]interface{}{"clinic_name": "North", "patient_name": "Ann", "seq": float64(n)}
+}
+
+func TestBatchSinkRetriesFailedBatch(t *testing.T) {
+	fail := true
+	f := newFakeIngest(t, func(w http.ResponseWriter, items []json.RawMessage) {
+		if fail {
+			http.Error(w, "storage unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		results(w, items, nil)
+	})
+	s, reports := newTestBatchSink(t, f, 100)
+	for i := 0; i < 3; i++ {
+		if err := s.Send("", reading(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.flush()
+	if len(*reports) != 1 || (*reports)[0].sent != 0 || (*reports)[0].failed != 0 || (*reports)[0].err == nil {
+		t.Fatalf("after a 503: %+v", *reports)
+	}
+	if len(s.items) != 3 || s.timer == nil {
+		t.Fatalf("%d readings queued for retry, timer %v", len(s.items), s.timer != nil)
+	}
+
+	// The retry goes ahead of what arrived meanwhile
+	fail = false
+	if err := s.Send("", reading(3)); err != nil {
+		t.Fatal(err)
+	}
+	s.flush()
+	if r := (*reports)[1]; r.sent != 4 || r.failed != 0 || r.err != nil {
+		t.Fatalf("retry: %+v", r)
+	}
+	batches := f.received()
+	if len(batches) != 2 || len(batches[1]) != 4 {
+		t.Fatalf("batches: %d", len(batches))
+	}
+	for i, it := range batches[1] {
+		var got map[string]interface{}
+		if err := json.Unmarshal(it, &got); err != nil || got["seq"] != float64(i) {
+			t.Fatalf("reading %d of the retry is %s", i, it)
+		}
+	}
+	if len(s.items) != 0 {
+		t.Fatalf("%d readings left after a good batch", len(s.items))
+	}
+}
+
+func TestBatchSinkCountsRejectedBatch(t *testing.T) {
+	f := newFakeIngest(t, func(w http.ResponseWriter, items []json.RawMessage) {
+		http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+	})
+	s, reports := newTestBatchSink(t, f, 100)
+	s.Send("", reading(0))
+	s.Send("", reading(1))
+	s.flush()
+	if len(*reports) != 1 || (*reports)[0].sent != 0 || (*reports)[0].failed != 2 || (*reports)[0].err == nil {
+		t.Fatalf("after a 413: %+v", *reports)
+	}
+	if len(s.items) != 0 {
+		t.Fatalf("%d rejected readings queued for retry", len(s.items))
+	}
+}
+
+func TestBatchSinkPerReadingResults(t *testing.T) {
+	f := newFakeIngest(t, func(w http.ResponseWriter, items []json.RawMessage) {
+		if len(items) == 3 {
+			results(w, items, map[int]int{1: http.StatusBadRequest, 2: http.StatusInternalServerError})
+			return
+		}
+		results(w, items, nil)
+	})
+	s, reports := newTestBatchSink(t, f, 100)
+	for i := 0; i < 3; i++ {
+		s.Send("", reading(i))
+	}
+	s.flush()
+	r := (*reports)[0]
+	if r.sent != 1 || r.failed != 1 || r.err == nil {
+		t.Fatalf("mixed results: %+v", r)
+	}
+	for _, want := range []string{"reading 1: 400", "reading 2: 500"} {
+		if !strings.Contains(r.err.Error(), want) {
+			t.Errorf("error %q does not mention %q", r.err, want)
+		}
+	}
+	if len(s.items) != 1 {
+		t.Fatalf("%d readings queued, want the one answered 500", len(s.items))
+	}
+
+	s.flush()
+	batches := f.received()
+	var got map[string]interface{}
+	if len(batches) != 2 || len(batches[1]) != 1 || json.Unmarshal(batches[1][0], &got) != nil || got["seq"] != 2.0 {
+		t.Fatalf("retried batch: %d batches, %v", len(batches), got)
+	}
+	if r := (*reports)[1]; r.sent != 1 || r.failed != 0 || r.err != nil {
+		t.Fatalf("retry: %+v", r)
+	}
+}
+
+func TestBatchSinkDropsOldestPastLimit(t *testing.T) {
+	f := newFakeIngest(t, func(w http.ResponseWriter, items []json.RawMessage) {
+		http.Error(w, "storage unavailable", http.StatusServiceUnavailable)
+	})
+	const maxItems = 2
+	s, reports := newTestBatchSink(t, f, maxItems)
+	// Queued directly, as Send would post in the background once full
+	limit := batchPendingFactor * maxItems
+	for i := 0; i < limit+5; i++ {
+		s.items = append(s.items, json.RawMessage(fmt.Sprint(i)))
+	}
+	s.flush()
+	if r := (*reports)[0]; r.sent != 0 || r.failed != 5 || r.err == nil {
+		t.Fatalf("report %+v, want the 5 oldest failed", r)
+	}
+	if len(s.items) != limit || string(s.items[0]) != "5" || string(s.items[limit-1]) != fmt.Sprint(limit+4) {
+		t.Fatalf("kept %d readings, %s to %s", len(s.items), s.items[0], s.items[len(s.items)-1])
+	}
+	size := 0
+	for _, it := range s.items {
+		size += len(it)
+	}
+	if s.size != size {
+		t.Fatalf("size %d, want %d", s.size, size)
+	}
+}
+
+// stubSink answers every reading with err.
+type stubSink struct {
+	name string
+	err  error
+}
+
+func (s *stubSink) Name() string                              { return s.name }
+func (s *stubSink) Send(string, map[string]interface{}) error { return s.err }
+func (s *stubSink) Close() error                              { return nil }
+
+func TestFanOutSend(t *testing.T) {
+	f := newFakeIngest(t, func(w http.ResponseWriter, items []json.RawMessage) {
+		results(w, items, map[int]int{1: http.StatusBadRequest})
+	})
+	batch, _ := newTestBatchSink(t, f, 100)
+	down := errors.New("connection refused")
+	sinks := []Sink{&stubSink{name: "good"}, &stubSink{name: "bad", err: down}, batch}
+
+	var summaries []string
+	var asyncErrs []string
+	out := newFanOut(sinks,
+		func(summary string) { summaries = append(summaries, summary) },
+		func(sink string, err error) { asyncErrs = append(asyncErrs, sink) })
+
+	for i := 0; i < 2; i++ {
+		failed := out.Send("req", reading(i))
+		if len(failed) != 1 || failed["bad"] != down {
+			t.Fatalf("failures: %v", failed)
+		}
+	}
+	// The batch sink counts nothing until its batch is posted
+	want := "good: 2 sent, 0 failed\nbad: 0 sent, 2 failed\n" + batch.Name() + ": 0 sent, 0 failed"
+	if got := out.Summary(); got != want {
+		t.Fatalf("summary before the batch:\n%s\nwant:\n%s", got, want)
+	}
+	batch.flush()
+	want = "good: 2 sent, 0 failed\nbad: 0 sent, 2 failed\n" + batch.Name() + ": 1 sent, 1 failed"
+	if got := out.Summary(); got != want {
+		t.Fatalf("summary after the batch:\n%s\nwant:\n%s", got, want)
+	}
+	if len(summaries) != 3 || summaries[2] != want {
+		t.Fatalf("onCount got %d summaries", len(summaries))
+	}
+	if len(asyncErrs) != 1 || asyncErrs[0] != batch.Name() {
+		t.Fatalf("onError got %v", asyncErrs)
+	}
+}
+
+func TestParseSinks(t *testing.T) {
+	dir := t.TempDir()
+	jsonl := filepath.Join(dir, "readings.jsonl")
+	text := strings.Join([]string{
+		"# extra destinations",
+		"",
+		"https://backup.example/api/ingest",
+		"http://other.example/api/ingest mk_other",
+		"wss://backup.example/ws/ingest",
+		"file:" + jsonl,
+		filepath.Join(dir, "with space.jsonl"),
+	}, "\n")
+	sinks, err := parseSinks(text, "mk_default", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSinks(sinks)
+	if len(sinks) != 5 {
+		t.Fatalf("%d sinks", len(sinks))
+	}
+	if s, ok := sinks[0].(*httpSink); !ok || s.apiKey != "mk_default" {
+		t.Fatalf("sink 0: %#v", sinks[0])
+	}
+	if s, ok := sinks[1].(*httpSink); !ok || s.apiKey != "mk_other" {
+		t.Fatalf("sink 1: %#v", sinks[1])
+	}
+	if s, ok := sinks[2].(*wsSink); !ok || s.url != "wss://backup.example/ws/ingest" {
+		t.Fatalf("sink 2: %#v", sinks[2])
+	}
+	if sinks[3].Name() != jsonl || sinks[4].Name() != filepath.Join(dir, "with space.jsonl") {
+		t.Fatalf("file sinks: %s, %s", sinks[3].Name(), sinks[4].Name())
+	}
+
+	batched, err := parseSinks("https://backup.example/api/ingest", "", &batchOptions{window: time.Second, maxItems: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSinks(batched)
+	if _, ok := batched[0].(*batchSink); !ok || batched[0].Name() != "https://backup.example/api/ingest/batch" {
+		t.Fatalf("batched sink: %#v", batched[0])
+	}
+
+	for _, bad := range []string{
+		"readings.jsonl",
+		"out/readings.jsonl",
+		"backup.example/api/ingest",
+		"htps://backup.example/api/ingest",
+		"file:",
+	} {
+		if sinks, err := parseSinks(bad, "", nil); err == nil {
+			closeSinks(sinks)
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// TLS settings shared by ingest posts, the feed connection and MQTT. With
+// no CA bundle the system roots are used; a client certificate is only sent
+// when the server asks for one (mutual TLS).
+var (
+	tlsMu      sync.Mutex
+	httpClient = http.DefaultClient
+	wsDialer   = websocket.DefaultDialer
+	tlsConfig  = &tls.Config{MinVersion: tls.VersionTLS12}
+)
+
+// configureTLS rebuilds the HTTP client and WS dialer from the given PEM
+// files. Empty paths fall back to the defaults.
+func configureTLS(caFile, certFile, keyFile string) error {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("CA bundle contains no certificates")
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return errors.New("client certificate and key must both be set")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	// Separate copies: the transport adds "h2" to its config's ALPN list,
+	// which would break the websocket handshake.
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = cfg.Clone()
+
+	tlsMu.Lock()
+	httpClient = &http.Client{Transport: transport}
+	wsDialer = &dialer
+	tlsConfig = cfg.Clone()
+	tlsMu.Unlock()
+	return nil
+}
+
+func currentHTTPClient() *http.Client {
+	tlsMu.Lock()
+	defer tlsMu.Unlock()
+	return httpClient
+}
+
+func currentWSDialer() *websocket.Dialer {
+	tlsMu.Lock()
+	defer tlsMu.Unlock()
+	return wsDialer
+}
+
+// currentTLSConfig returns a copy for raw TLS connections (mqtts://).
+func currentTLSConfig() *tls.Config {
+	tlsMu.Lock()
+	defer tlsMu.Unlock()
+	return tlsConfig.Clone()
+}
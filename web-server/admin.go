@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Admin CLI: `web-server <command> <subcommand> [flags]`. It edits the same
+// files the running server reads, so changes apply without a restart.
+
+const adminUsage = `usage:
+  web-server keys create -name NAME [-clinic CLINIC]
+  web-server keys list
+  web-server keys revoke ID
+  web-server users add -username NAME -role ROLE [-clinics A,B]
+                                           (password read from stdin)
+  web-server users set USERNAME [-role ROLE] [-clinics A,B]
+  web-server users passwd USERNAME         (password read from stdin)
+  web-server users list
+  web-server users remove USERNAME
+  web-server audit verify
+  web-server storage init-key              (writes storage.key_file)
+  web-server storage migrate               (encrypt a plaintext data/ tree)
+  web-server storage rotate-key [-prune]   (re-encrypt data/ with a new key)
+  web-server storage check [-fix]          (report damaged files; -fix quarantines them)
+  web-server retention report              (what the retention policy would remove now)
+`
+
+// runAdminCommand returns the process exit code.
+func runAdminCommand(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+	var err error
+	switch args[0] + " " + args[1] {
+	case "keys create":
+		err = adminKeysCreate(args[2:])
+	case "keys list":
+		err = adminKeysList()
+	case "keys revoke":
+		err = adminKeysRevoke(args[2:])
+	case "users add":
+		err = adminUsersAdd(args[2:])
+	case "users set":
+		err = adminUsersSet(args[2:])
+	case "users passwd":
+		err = adminUsersPasswd(args[2:])
+	case "users list":
+		err = adminUsersList()
+	case "users remove":
+		err = adminUsersRemove(args[2:])
+	case "audit verify":
+		err = adminAuditVerify()
+	case "storage init-key":
+		err = initKeyring()
+		if err == nil {
+			fmt.Printf("Wrote %s. Back it up: data cannot be read without it.\n", keyFile)
+		}
+	case "storage migrate":
+		err = adminStorageMigrate()
+	case "storage rotate-key":
+		err = adminStorageRotate(args[2:])
+	case "storage check":
+		err = adminStorageCheck(args[2:])
+	case "retention report":
+		err = adminRetentionReport()
+	default:
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func adminKeysCreate(args []string) error {
+	fs := flag.NewFlagSet("keys create", flag.ContinueOnError)
+	name := fs.String("name", "", "descriptive name, e.g. the desktop's host name")
+	clinic := fs.String("clinic", "", "restrict the key to one clinic")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return fmt.Errorf("-name is required")
+	}
+	if *clinic != "" && !validClinicName(*clinic) {
+		return fmt.Errorf("-clinic %q: names may not contain / or \\ or be . or ..", *clinic)
+	}
+	keys, err := apiKeys.load()
+	if err != nil {
+		return err
+	}
+	rec, key, err := newAPIKey(*name, *clinic)
+	if err != nil {
+		return err
+	}
+	if err := apiKeys.save(append(keys, rec)); err != nil {
+		return err
+	}
+	fmt.Printf("Created key %s for %q. Store it now; it cannot be shown again:\n%s\n", rec.ID, rec.Name, key)
+	return nil
+}
+
+func adminKeysList() error {
+	keys, err := apiKeys.load()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tCLINIC\tCREATED\tSTATUS")
+	for _, k := range keys {
+		status := "active"
+		if k.Revoked {
+			status = "revoked"
+		}
+		clinic := k.Clinic
+		if clinic == "" {
+			clinic = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, clinic, k.CreatedAt.Format(time.RFC3339), status)
+	}
+	return tw.Flush()
+}
+
+func adminKeysRevoke(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: keys revoke ID")
+	}
+	keys, err := apiKeys.load()
+	if err != nil {
+		return err
+	}
+	updated := append([]APIKey(nil), keys...)
+	for i := range updated {
+		if updated[i].ID == args[0] {
+			updated[i].Revoked = true
+			return apiKeys.save(updated)
+		}
+	}
+	return fmt.Errorf("no key with id %s", args[0])
+}
+
+func adminUsersAdd(args []string) error {
+	fs := flag.NewFlagSet("users add", flag.ContinueOnError)
+	username := fs.String("username", "", "login name")
+	role := fs.String("role", RoleViewer, "admin, clinician, nurse or viewer")
+	clinics := fs.String("clinics", "", "comma separated clinics the user may access (* for all)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *username == "" {
+		return fmt.Errorf("-username is required")
+	}
+	if err := checkUserRole(*role, parseClinics(*clinics)); err != nil {
+		return err
+	}
+	list, err := users.load()
+	if err != nil {
+		return err
+	}
+	for _, u := range list {
+		if u.Username == *username {
+			return fmt.Errorf("user %s already exists", *username)
+		}
+	}
+	hash, err := readPasswordHash()
+	if err != nil {
+		return err
+	}
+	u := User{
+		Username:     *username,
+		PasswordHash: hash,
+		Role:         *role,
+		Clinics:      parseClinics(*clinics),
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := users.save(append(list, u)); err != nil {
+		return err
+	}
+	fmt.Printf("Added %s %s\n", u.Role, u.Username)
+	return nil
+}
+
+func adminUsersSet(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: users set USERNAME [-role ROLE] [-clinics A,B]")
+	}
+	fs := flag.NewFlagSet("users set", flag.ContinueOnError)
+	role := fs.String("role", "", "new role")
+	clinics := fs.String("clinics", "", "new comma separated clinic list")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	list, err := users.load()
+	if err != nil {
+		return err
+	}
+	updated := append([]User(nil), list...)
+	for i := range updated {
+		u := &updated[i]
+		if u.Username != args[0] {
+			continue
+		}
+		if *role != "" {
+			u.Role = *role
+		}
+		if *clinics != "" {
+			u.Clinics = parseClinics(*clinics)
+		}
+		if err := checkUserRole(u.Role, u.Clinics); err != nil {
+			return err
+		}
+		return users.save(updated)
+	}
+	return fmt.Errorf("no user %s", args[0])
+}
+
+func adminUsersPasswd(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: users passwd USERNAME")
+	}
+	list, err := users.load()
+	if err != nil {
+		return err
+	}
+	updated := append([]User(nil), list...)
+	for i := range updated {
+		if updated[i].Username == args[0] {
+			hash, err := readPasswordHash()
+			if err != nil {
+				return err
+			}
+			updated[i].PasswordHash = hash
+			return users.save(updated)
+		}
+	}
+	return fmt.Errorf("no user %s", args[0])
+}
+
+func adminUsersList() error {
+	list, err := users.load()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USERNAME\tROLE\tCLINICS\tCREATED")
+	for _, u := range list {
+		role := u.Role
+		if role == "" {
+			role = RoleViewer
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", u.Username, role, strings.Join(u.Clinics, ","), u.CreatedAt.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func adminUsersRemove(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: users remove USERNAME")
+	}
+	list, err := users.load()
+	if err != nil {
+		return err
+	}
+	var kept []User
+	for _, u := range list {
+		if u.Username != args[0] {
+			kept = append(kept, u)
+		}
+	}
+	if len(kept) == len(list) {
+		return fmt.Errorf("no user %s", args[0])
+	}
+	return users.save(kept)
+}
+
+// readPasswordHash reads a password from the first line of stdin.
+func readPasswordHash() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading password: %w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if len(password) < 8 {
+		return "", fmt.Errorf("password must be at least 8 characters")
+	}
+	return hashPassword(password)
+}
+
+func adminAuditVerify() error {
+	key, err := loadAuditKey(false)
+	if err != nil {
+		return fmt.Errorf("audit key: %w", err)
+	}
+	res, err := verifyAuditLog(auditFile, key)
+	if err != nil {
+		return err
+	}
+	if !res.Valid {
+		return fmt.Errorf("chain broken at seq %d: %s (%d entries checked)", res.BrokenAt, res.Problem, res.Entries)
+	}
+	fmt.Printf("OK: %d entries, head %s\n", res.Entries, res.LastHash)
+	return nil
+}
+
+// Storage commands that rewrite files take the data directory lock, so they
+// fail while the server is running.
+
+func adminStorageMigrate() error {
+	if err := lockDataDir(); err != nil {
+		return err
+	}
+	n, err := migrateToEncrypted()
+	fmt.Printf("Encrypted %d files\n", n)
+	return err
+}
+
+func adminStorageRotate(args []string) error {
+	fs := flag.NewFlagSet("storage rotate-key", flag.ContinueOnError)
+	prune := fs.Bool("prune", false, "drop retired keys once everything is re-encrypted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := lockDataDir(); err != nil {
+		return err
+	}
+	n, err := rotateStorageKey(*prune)
+	fmt.Printf("Re-encrypted %d files\n", n)
+	return err
+}
+
+func adminStorageCheck(args []string) error {
+	fs := flag.NewFlagSet("storage check", flag.ContinueOnError)
+	fix := fs.Bool("fix", false, "move corrupt files to data/.quarantine")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *fix {
+		if err := lockDataDir(); err != nil {
+			return err
+		}
+	}
+	checked, problems := scanDataTree(*fix)
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", p.Path, p.Problem)
+	}
+	fmt.Printf("%d files checked, %d problems\n", checked, len(problems))
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check found problems")
+	}
+	return nil
+}
+
+// adminRetentionReport is a dry run; purging happens in the server so the
+// audit log has a single writer.
+func adminRetentionReport() error {
+	rep := runRetention(context.Background(), nil, true)
+	for _, it := range rep.Items {
+		fmt.Printf("%s/%s %s: %d records, %d files (%d bytes), oldest %s, cutoff %s\n",
+			it.Clinic, it.Patient, it.Metric, it.Records, it.Files, it.Bytes,
+			it.Oldest.Format(time.RFC3339), it.Cutoff.Format(time.RFC3339))
+	}
+	fmt.Printf("%d records and %d recordings would be removed (mode %s)\n", rep.Records, rep.Files, rep.Mode)
+	if len(rep.Errors) > 0 {
+		for _, e := range rep.Errors {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return fmt.Errorf("retention report found problems")
+	}
+	return nil
+}
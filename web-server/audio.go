@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stethoscope audio arrives as many small chunks of 16-bit mono PCM. Chunks
+// that share a session_id are appended to one WAV file per session under
+// data/{clinic}/{patient}/auscultation/. The seq of the last chunk appended
+// is kept next to it in {session}.wav.seq.
+
+const (
+	auscultationDir   = "auscultation"
+	defaultSampleRate = 8000
+	wavHeaderSize     = 44
+	seqSuffix         = ".seq"
+)
+
+// audioChunk extracts PCM samples from an ingested stethoscope stream
+// message. ok is false for anything that is not an audio chunk.
+func audioChunk(data map[string]interface{}) (samples []int16, sampleRate int, ok bool) {
+	if data["type"] != "stream" || data["stream_type"] != "audio" {
+		return nil, 0, false
+	}
+	raw, isArr := data["data"].([]interface{})
+	if !isArr {
+		return nil, 0, false
+	}
+	samples = make([]int16, 0, len(raw))
+	for _, v := range raw {
+		f, isNum := v.(float64)
+		if !isNum {
+			return nil, 0, false
+		}
+		samples = append(samples, int16(f))
+	}
+	sampleRate = defaultSampleRate
+	if f, isNum := data["sample_rate"].(float64); isNum && f > 0 {
+		sampleRate = int(f)
+	}
+	return samples, sampleRate, true
+}
+
+// sessionID returns a filesystem-safe recording id for the message. Older
+// uploaders do not send session_id, so their audio is grouped per day.
+func sessionID(data map[string]interface{}, now time.Time) string {
+	if s, ok := data["session_id"].(string); ok {
+		if id := sanitizeID(s); id != "" {
+			return id
+		}
+	}
+	return "day-" + now.Format("20060102")
+}
+
+func sanitizeID(s string) string {
+	var b strings.Builder
+	for _, r := range strings.TrimSpace(s) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// audioState is what appending to a recording needs to know: the seq of
+// the last chunk appended, so a chunk resent after a lost response (a
+// retried batch) is not appended twice, and for a sealed recording where
+// its next segment goes.
+type audioState struct {
+	seq    float64
+	hasSeq bool
+	end    int // 0 until known
+	used   time.Time
+}
+
+// audioStates caches the state of recordings in use, keyed by path.
+// Entries idle for audioStateIdle are dropped; both fields are recovered
+// from disk on next use. Guarded by fileMutex.
+var (
+	audioStates      = map[string]*audioState{}
+	audioStatePruned time.Time
+)
+
+const audioStateIdle = 10 * time.Minute
+
+// audioStateFor returns the state of the recording at path, reading the
+// last seq from its .seq file on first use. Call with fileMutex held.
+func audioStateFor(path string, now time.Time) (*audioState, error) {
+	if now.Sub(audioStatePruned) >= audioStateIdle {
+		for p, st := range audioStates {
+			if now.Sub(st.used) >= audioStateIdle {
+				delete(audioStates, p)
+			}
+		}
+		audioStatePruned = now
+	}
+	st := audioStates[path]
+	if st == nil {
+		st = &audioState{}
+		b, err := readDataFile(path + seqSuffix)
+		if err == nil {
+			st.seq, err = strconv.ParseFloat(string(b), 64)
+			if err != nil {
+				err = fmt.Errorf("%w: %v", errCorrupt, err)
+			}
+			st.hasSeq = err == nil
+		}
+		switch {
+		case errors.Is(err, errCorrupt):
+			// Resends may be appended twice, but audio keeps flowing
+			if err := quarantine(path+seqSuffix, err.Error()); err != nil {
+				return nil, err
+			}
+		case err != nil && !os.IsNotExist(err):
+			return nil, err
+		}
+		audioStates[path] = st
+	}
+	st.used = now
+	return st, nil
+}
+
+// audioSeq returns the chunk's seq; ok is false for uploaders that do not
+// number their chunks, whose audio cannot be checked for resends.
+func audioSeq(data map[string]interface{}) (seq float64, ok bool) {
+	if s, _ := data["session_id"].(string); sanitizeID(s) == "" {
+		return 0, false
+	}
+	seq, ok = data["seq"].(float64)
+	return seq, ok
+}
+
+// appendAudio appends samples to the session's recording. With hasSeq, a
+// chunk whose seq is not above the last one appended is skipped with
+// errDuplicate.
+func appendAudio(clinic, patient, session string, seq float64, hasSeq bool, sampleRate int, samples []int16) error {
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	pdir, err := ensurePatientDir(clinic, patient)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(pdir, auscultationDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, session+".wav")
+	st, err := audioStateFor(path, time.Now())
+	if err != nil {
+		return err
+	}
+	if hasSeq && st.hasSeq && seq <= st.seq {
+		return errDuplicate
+	}
+	if err := appendPCM(st, path, sampleRate, samples); err != nil {
+		return err
+	}
+	if !hasSeq {
+		return nil
+	}
+	// Written after the audio: a crash in between may let one resend
+	// through, but never drops a chunk that was not stored.
+	st.seq, st.hasSeq = seq, true
+	return writeDataFile(path+seqSuffix, []byte(formatFloat(seq)))
+}
+
+// appendPCM writes samples to the end of the recording at path. Call with
+// fileMutex held.
+func appendPCM(st *audioState, path string, sampleRate int, samples []int16) error {
+	pcm := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(s))
+	}
+
+	if kr, err := loadKeyring(); err != nil {
+		return err
+	} else if kr != nil {
+		return appendSealedAudio(kr, st, path, sampleRate, pcm)
+	}
+
+	// Patching sizes into a damaged header would hide the damage; set the
+	// file aside and start a new recording instead.
+	if err := quarantineBadWAV(path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	dataSize := info.Size() - wavHeaderSize
+	if info.Size() < wavHeaderSize {
+		dataSize = 0
+		if _, err := f.WriteAt(wavHeader(sampleRate, 0), 0); err != nil {
+			return err
+		}
+	}
+
+	if _, err := f.WriteAt(pcm, wavHeaderSize+dataSize); err != nil {
+		return err
+	}
+	dataSize += int64(len(pcm))
+
+	// Patch the RIFF and data chunk sizes so the file is playable at any point.
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(36+dataSize))
+	if _, err := f.WriteAt(size[:], 4); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(size[:], uint32(dataSize))
+	_, err = f.WriteAt(size[:], 40)
+	return err
+}
+
+// appendSealedAudio appends pcm to an encrypted recording as one new
+// segment. st.end remembers where the append left the file, so the next
+// chunk is appended without reading it again. Call with fileMutex held.
+func appendSealedAudio(kr *keyring, st *audioState, path string, sampleRate int, pcm []byte) error {
+	end, err := sealedAudioEnd(kr, st, path, sampleRate)
+	if err != nil {
+		return err
+	}
+	seg, err := kr.sealSegment(pcm, path, end)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(seg, int64(end))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		st.end = 0
+		return err
+	}
+	st.end = end + len(seg)
+	return nil
+}
+
+// sealedAudioEnd returns the offset for the next segment of the recording
+// at path. Unless the file is as the last append left it, it is checked
+// first: a segment cut short is trimmed, a damaged file quarantined, and a
+// new or whole-file sealed recording (as written by key rotation) rewritten
+// as segments.
+func sealedAudioEnd(kr *keyring, st *audioState, path string, sampleRate int) (int, error) {
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 && int64(st.end) == info.Size() {
+		return st.end, nil
+	}
+	st.end = 0
+
+	var wav []byte
+	raw, err := os.ReadFile(path)
+	if err == nil && bytes.HasPrefix(raw, segMagic) {
+		var end int
+		if wav, end, err = kr.openSegments(raw, path); err == nil {
+			if _, werr := readWAVInfo(bytes.NewReader(wav)); werr != nil {
+				err = fmt.Errorf("%w: %v", errCorrupt, werr)
+			} else if end < len(raw) {
+				err = os.Truncate(path, int64(end))
+			}
+			if err == nil {
+				st.end = end
+				return end, nil
+			}
+		}
+	} else if err == nil {
+		if wav, err = readDataFile(path); err == nil {
+			if _, werr := readWAVInfo(bytes.NewReader(wav)); werr != nil {
+				err = fmt.Errorf("%w: %v", errCorrupt, werr)
+			}
+		}
+	}
+	if errors.Is(err, errCorrupt) {
+		if err := quarantine(path, err.Error()); err != nil {
+			return 0, err
+		}
+		err = os.ErrNotExist
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		wav, err = wavHeader(sampleRate, 0), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// The header is the first segment, the samples so far the second
+	b := append([]byte(nil), segMagic...)
+	for _, part := range [][]byte{wav[:wavHeaderSize], wav[wavHeaderSize:]} {
+		if len(part) == 0 {
+			continue
+		}
+		seg, err := kr.sealSegment(part, path, len(b))
+		if err != nil {
+			return 0, err
+		}
+		b = append(b, seg...)
+	}
+	if err := writeFileAtomic(path, b, 0600); err != nil {
+		return 0, err
+	}
+	st.end = len(b)
+	return len(b), nil
+}
+
+// setWAVSizes fills in the RIFF and data chunk sizes of a WAV assembled
+// from segments. Other segmented files (archives) are returned unchanged.
+func setWAVSizes(b []byte) []byte {
+	if len(b) >= wavHeaderSize && string(b[:4]) == "RIFF" {
+		dataSize := uint32(len(b) - wavHeaderSize)
+		binary.LittleEndian.PutUint32(b[4:], 36+dataSize)
+		binary.LittleEndian.PutUint32(b[40:], dataSize)
+	}
+	return b
+}
+
+// quarantineBadWAV moves a plaintext recording with a damaged header aside
+// before more samples are appended to it. A missing or still header-less
+// file is left alone.
+func quarantineBadWAV(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil // nothing to check yet
+	}
+	st, err := f.Stat()
+	if err != nil || st.Size() < wavHeaderSize {
+		f.Close()
+		return nil
+	}
+	_, werr := readWAVInfo(f)
+	f.Close()
+	if werr == nil {
+		return nil
+	}
+	return quarantine(path, werr.Error())
+}
+
+// wavHeader builds a canonical 44-byte header for 16-bit mono PCM.
+func wavHeader(sampleRate int, dataSize uint32) []byte {
+	h := make([]byte, wavHeaderSize)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 36+dataSize)
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], 1) // mono
+	binary.LittleEndian.PutUint32(h[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(sampleRate*2))
+	binary.LittleEndian.PutUint16(h[32:], 2)
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], dataSize)
+	return h
+}
+
+type wavInfo struct {
+	SampleRate    int     `json:"sample_rate"`
+	Channels      int     `json:"channels"`
+	BitsPerSample int     `json:"bits_per_sample"`
+	Samples       int64   `json:"samples"`
+	Duration      float64 `json:"duration_seconds"`
+}
+
+func readWAVInfo(r io.ReaderAt) (wavInfo, error) {
+	h := make([]byte, wavHeaderSize)
+	if _, err := r.ReadAt(h, 0); err != nil {
+		return wavInfo{}, err
+	}
+	if string(h[0:4]) != "RIFF" || string(h[8:12]) != "WAVE" || string(h[36:40]) != "data" {
+		return wavInfo{}, fmt.Errorf("not a canonical WAV file")
+	}
+	info := wavInfo{
+		Channels:      int(binary.LittleEndian.Uint16(h[22:])),
+		SampleRate:    int(binary.LittleEndian.Uint32(h[24:])),
+		BitsPerSample: int(binary.LittleEndian.Uint16(h[34:])),
+	}
+	frameSize := info.Channels * info.BitsPerSample / 8
+	if frameSize == 0 || info.SampleRate == 0 {
+		return wavInfo{}, fmt.Errorf("invalid WAV format")
+	}
+	info.Samples = int64(binary.LittleEndian.Uint32(h[40:])) / int64(frameSize)
+	info.Duration = float64(info.Samples) / float64(info.SampleRate)
+	return info, nil
+}
+
+// --- Auscultation APIs ---
+
+type recording struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Size      int64     `json:"size"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	wavInfo
+}
+
+func handleAuscultations(w http.ResponseWriter, r *http.Request, clinic, patient string) {
+	if preflight(w, r) {
+		return
+	}
+	pdir, err := patientDir(clinic, patient)
+	if err != nil {
+		http.Error(w, "Failed to list recordings", http.StatusInternalServerError)
+		return
+	}
+	dir := filepath.Join(pdir, auscultationDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Failed to list recordings", http.StatusInternalServerError)
+		return
+	}
+	recs := []recording{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".wav") {
+			continue
+		}
+		f, size, modTime, err := openDataFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		info, err := readWAVInfo(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		id := strings.TrimSuffix(name, ".wav")
+		recs = append(recs, recording{
+			ID:        id,
+			URL:       fmt.Sprintf("/api/clinic/%s/patient/%s/auscultation/%s.wav", url.PathEscape(clinic), url.PathEscape(patient), id),
+			Size:      size,
+			StartedAt: modTime.Add(-time.Duration(info.Duration * float64(time.Second))),
+			UpdatedAt: modTime,
+			wavInfo:   info,
+		})
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].StartedAt.After(recs[j].StartedAt) })
+	audit(r, "list_recordings", clinic, patient, OutcomeOK, "")
+	writeJSON(w, recs)
+}
+
+// handleAuscultationAudio streams a recording; http.ServeContent handles
+// Range requests so browsers can seek.
+func handleAuscultationAudio(w http.ResponseWriter, r *http.Request, clinic, patient, name string) {
+	if preflight(w, r) {
+		return
+	}
+	id := sanitizeID(strings.TrimSuffix(name, ".wav"))
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+	pdir, err := patientDir(clinic, patient)
+	if err != nil {
+		http.Error(w, "Failed to read recording", http.StatusInternalServerError)
+		return
+	}
+	f, _, modTime, err := openDataFile(filepath.Join(pdir, auscultationDir, id+".wav"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	// Range requests while seeking would flood the log; record the first fetch only.
+	if rng := r.Header.Get("Range"); rng == "" || strings.HasPrefix(rng, "bytes=0-") {
+		audit(r, "play_recording", clinic, patient, OutcomeOK, id)
+	}
+	w.Header().Set("Content-Type", "audio/wav")
+	http.ServeContent(w, r, id+".wav", modTime, f)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAudioChunk(t *testing.T) {
+	samples, rate, ok := audioChunk(map[string]interface{}{
+		"type": "stream", "stream_type": "audio", "sample_rate": 4000.0,
+		"data": []interface{}{1.0, -2.0, 32767.0},
+	})
+	if !ok || rate != 4000 || len(samples) != 3 || samples[1] != -2 || samples[2] != 32767 {
+		t.Fatalf("got %v %d %v", samples, rate, ok)
+	}
+	if _, rate, _ := audioChunk(map[string]interface{}{"type": "stream", "stream_type": "audio", "data": []interface{}{}}); rate != defaultSampleRate {
+		t.Fatalf("rate without sample_rate = %d, want %d", rate, defaultSampleRate)
+	}
+	for _, data := range []map[string]interface{}{
+		{"type": "stream", "stream_type": "heartrate", "data": []interface{}{1.0}},
+		{"type": "stream", "stream_type": "audio", "data": []interface{}{"x"}},
+		{"type": "stream", "stream_type": "audio"},
+		{"spo2": 97.0},
+	} {
+		if _, _, ok := audioChunk(data); ok {
+			t.Errorf("audioChunk(%v) accepted", data)
+		}
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	day := time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC)
+	if got := sessionID(map[string]interface{}{"session_id": "../a b-1_2"}, day); got != "ab-1_2" {
+		t.Fatalf("sanitised session id = %q", got)
+	}
+	for _, data := range []map[string]interface{}{{}, {"session_id": "../"}} {
+		if got := sessionID(data, day); got != "day-20260301" {
+			t.Fatalf("sessionID(%v) = %q, want the day", data, got)
+		}
+	}
+}
+
+func TestAppendAudioWritesPlayableWAV(t *testing.T) {
+	setupIngestTest(t)
+	for _, chunk := range [][]int16{{1, 2, 3}, {-4, 5}} {
+		if err := appendAudio("North", "Ann", "s1", 0, false, 8000, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pdir, err := patientDir("North", "Ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(pdir, auscultationDir, "s1.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := readWAVInfo(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SampleRate != 8000 || info.Channels != 1 || info.BitsPerSample != 16 || info.Samples != 5 {
+		t.Fatalf("info = %+v", info)
+	}
+	if riff := binary.LittleEndian.Uint32(b[4:]); riff != uint32(len(b)-8) {
+		t.Fatalf("RIFF size %d, file is %d bytes", riff, len(b))
+	}
+	want := []int16{1, 2, 3, -4, 5}
+	for i, s := range want {
+		if got := int16(binary.LittleEndian.Uint16(b[wavHeaderSize+2*i:])); got != s {
+			t.Fatalf("sample %d = %d, want %d", i, got, s)
+		}
+	}
+}
+
+func TestAuscultationAPIs(t *testing.T) {
+	setupIngestTest(t)
+	samples := make([]int16, 8000) // one second
+	if err := appendAudio("North Clinic", "Ann", "s1", 0, false, 8000, samples); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handleAuscultations(w, httptest.NewRequest(http.MethodGet, "/", nil), "North Clinic", "Ann")
+	var recs []recording
+	if err := json.Unmarshal(w.Body.Bytes(), &recs); err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].ID != "s1" || recs[0].Duration != 1 || recs[0].Samples != 8000 {
+		t.Fatalf("recordings = %+v", recs)
+	}
+	if want := "/api/clinic/North%20Clinic/patient/Ann/auscultation/s1.wav"; recs[0].URL != want {
+		t.Fatalf("url = %q, want %q", recs[0].URL, want)
+	}
+
+	// Browsers seek with Range requests
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=0-3")
+	w = httptest.NewRecorder()
+	handleAuscultationAudio(w, r, "North Clinic", "Ann", "s1.wav")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "RIFF" {
+		t.Fatalf("range request: %d %q", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "audio/wav" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	for _, name := range []string{"missing.wav", "../s1.wav", ".wav"} {
+		w = httptest.NewRecorder()
+		handleAuscultationAudio(w, httptest.NewRequest(http.MethodGet, "/", nil), "North Clinic", "Ann", name)
+		if name == "../s1.wav" {
+			// Sanitised to s1, which exists: nothing outside the directory is reachable
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: status %d", name, w.Code)
+			}
+			continue
+		}
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", name, w.Code)
+		}
+	}
+}
+
+// forgetAudioState drops what the server knows about recordings in
+// memory, as a restart does.
+func forgetAudioState() {
+	fileMutex.Lock()
+	audioStates, audioStatePruned = map[string]*audioState{}, time.Time{}
+	fileMutex.Unlock()
+}
+
+func TestAppendAudioSkipsResendAfterRestart(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		setupIngestTest(t)
+		if encrypted {
+			useStorageKey(t)
+		}
+		chunk := []int16{1, 2}
+		for _, seq := range []float64{1, 2} {
+			if err := appendAudio("North", "Ann", "s1", seq, true, 8000, chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		forgetAudioState()
+		if err := appendAudio("North", "Ann", "s1", 2, true, 8000, chunk); !errors.Is(err, errDuplicate) {
+			t.Fatalf("encrypted %v: resend after restart: err = %v, want errDuplicate", encrypted, err)
+		}
+		forgetAudioState()
+		if err := appendAudio("North", "Ann", "s1", 3, true, 8000, chunk); err != nil {
+			t.Fatal(err)
+		}
+		pdir, _ := patientDir("North", "Ann")
+		wav, err := readDataFile(filepath.Join(pdir, auscultationDir, "s1.wav"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info, err := readWAVInfo(bytes.NewReader(wav)); err != nil || info.Samples != 6 {
+			t.Fatalf("encrypted %v: recording %+v, %v; want 6 samples", encrypted, info, err)
+		}
+	}
+}
+
+func TestAudioStateEvictsIdleRecordings(t *testing.T) {
+	setupIngestTest(t)
+	forgetAudioState()
+	t.Cleanup(forgetAudioState)
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+	start := time.Now()
+	dir := t.TempDir()
+	for _, name := range []string{"idle.wav", "busy.wav"} {
+		if _, err := audioStateFor(filepath.Join(dir, name), start); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := audioStateFor(filepath.Join(dir, "busy.wav"), start.Add(audioStateIdle/2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := audioStateFor(filepath.Join(dir, "new.wav"), start.Add(audioStateIdle)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := audioStates[filepath.Join(dir, "idle.wav")]; ok || len(audioStates) != 2 {
+		t.Fatalf("%d recordings cached, idle one kept: %v", len(audioStates), ok)
+	}
+}
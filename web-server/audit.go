@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The audit log is an append-only JSONL file. Each entry carries the hash of
+// the previous one, so editing or deleting any line breaks the chain from
+// that point on and is reported by verifyAuditLog. Hashes are HMAC-SHA256
+// under a key kept outside the log (MEDICART_AUDIT_KEY or
+// Config.AuditKeyFile), so the chain cannot be recomputed after an edit.
+// A signed head file next to the log ({audit_file}.head) records the last
+// entry written, which catches entries cut from the end. Every entry must
+// be keyed, and a log with entries needs a valid head file, so a chain
+// rebuilt without the key does not pass.
+
+var (
+	auditFile    string // Config.AuditFile
+	auditKeyFile string // Config.AuditKeyFile
+)
+
+const auditAlgHMAC = "hmac-sha256"
+
+const (
+	OutcomeOK     = "ok"
+	OutcomeDenied = "denied"
+	OutcomeError  = "error"
+)
+
+type AuditEntry struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	ActorKind string    `json:"actor_kind,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Action    string    `json:"action"`
+	Clinic    string    `json:"clinic,omitempty"`
+	Patient   string    `json:"patient,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Alg       string    `json:"alg"` // always auditAlgHMAC
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
+}
+
+// computeHash is the HMAC of the entry with its Hash field cleared.
+func (e AuditEntry) computeHash(key []byte) string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	return auditMAC(key, b)
+}
+
+func auditMAC(key, b []byte) string {
+	m := hmac.New(sha256.New, key)
+	m.Write(b)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+var (
+	auditMu       sync.Mutex
+	auditOut      *os.File
+	auditKey      []byte
+	auditSeq      uint64
+	auditLastHash string
+	auditDirty    bool          // written but not yet synced
+	auditStop     chan struct{} // ends the flusher
+)
+
+// Routine data traffic (one entry per reading, chunk or read) is synced by
+// the flusher every auditSyncInterval. Everything else, and any entry whose
+// outcome is not ok, is synced before audit returns.
+const auditSyncInterval = time.Second
+
+var auditDeferSync = map[string]bool{
+	"ingest": true, "read_patient_data": true, "read_stats": true, "read_series": true,
+	"read_camera_snapshot": true, "list_clinics": true, "list_patients": true,
+	"list_recordings": true, "play_recording": true, "stream_subscribe": true,
+	"stream_unsubscribe": true, "fhir_read": true, "fhir_search_patients": true,
+	"fhir_search_observations": true, "fhir_everything": true,
+}
+
+// loadAuditKey returns MEDICART_AUDIT_KEY, or the key in auditKeyFile. With
+// create, a missing file is filled with a new random key.
+func loadAuditKey(create bool) ([]byte, error) {
+	if s := os.Getenv("MEDICART_AUDIT_KEY"); s != "" {
+		return []byte(s), nil
+	}
+	b, err := os.ReadFile(auditKeyFile)
+	if err == nil && len(b) >= 32 {
+		return b, nil
+	}
+	if err == nil {
+		return nil, fmt.Errorf("%s: audit key must be at least 32 bytes", auditKeyFile)
+	}
+	if !os.IsNotExist(err) || !create {
+		return nil, err
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	b = []byte(hex.EncodeToString(raw))
+	return b, os.WriteFile(auditKeyFile, b, 0600)
+}
+
+// --- Head file ---
+
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+	MAC  string `json:"mac"`
+}
+
+func auditHeadFile() string { return auditFile + ".head" }
+
+func (h auditHead) mac(key []byte) string {
+	return auditMAC(key, []byte(strconv.FormatUint(h.Seq, 10)+":"+h.Hash))
+}
+
+// syncAuditLog flushes the log and then the head. Call with auditMu held.
+func syncAuditLog() {
+	if err := auditOut.Sync(); err != nil {
+		slog.Error("Syncing audit log failed", "err", err)
+		return
+	}
+	auditDirty = false
+	writeAuditHead()
+}
+
+func auditFlusher(stop chan struct{}) {
+	t := time.NewTicker(auditSyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			auditMu.Lock()
+			if auditOut != nil && auditDirty {
+				syncAuditLog()
+			}
+			auditMu.Unlock()
+		}
+	}
+}
+
+// writeAuditHead records the last entry. Call with auditMu held, after the
+// log itself is synced, so the head never runs ahead of the log on disk.
+func writeAuditHead() {
+	h := auditHead{Seq: auditSeq, Hash: auditLastHash}
+	h.MAC = h.mac(auditKey)
+	b, _ := json.Marshal(h)
+	if err := writeFileAtomic(auditHeadFile(), append(b, '\n'), 0600); err != nil {
+		slog.Error("Writing audit head failed", "err", err)
+	}
+}
+
+// openAuditLog verifies the existing chain and opens the log for appending.
+func openAuditLog() error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	key, err := loadAuditKey(true)
+	if err != nil {
+		return fmt.Errorf("audit key: %w", err)
+	}
+	auditKey = key
+	res, err := verifyAuditLog(auditFile, key)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !res.Valid {
+		// Keep appending, chained to the last line, so the break stays visible.
+		slog.Warn("Audit log chain broken", "seq", res.BrokenAt, "problem", res.Problem)
+	}
+	auditSeq, auditLastHash = res.LastSeq, res.LastHash
+
+	f, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	auditOut = f
+	auditStop = make(chan struct{})
+	go auditFlusher(auditStop)
+	return nil
+}
+
+// audit records one action by the request's principal. Failures to write
+// the audit trail are logged but never fail the request itself.
+func audit(r *http.Request, action, clinic, patient, outcome, detail string) {
+	e := AuditEntry{
+		Time:    time.Now().UTC(),
+		Actor:   "anonymous",
+		Action:  action,
+		Clinic:  clinic,
+		Patient: patient,
+		Outcome: outcome,
+		Detail:  detail,
+	}
+	if r != nil {
+		e.Remote = r.RemoteAddr
+		e.RequestID = requestIDFrom(r.Context())
+		if p, ok := principalFrom(r.Context()); ok {
+			e.Actor, e.ActorKind, e.Role = p.Name, p.Kind, p.Role
+		}
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditOut == nil {
+		return
+	}
+	e.Seq = auditSeq + 1
+	e.Alg = auditAlgHMAC
+	e.PrevHash = auditLastHash
+	e.Hash = e.computeHash(auditKey)
+	b, _ := json.Marshal(e)
+	if _, err := auditOut.Write(append(b, '\n')); err != nil {
+		slog.Error("Writing audit log failed", "err", err)
+		return
+	}
+	auditSeq, auditLastHash = e.Seq, e.Hash
+	if auditDeferSync[action] && outcome == OutcomeOK {
+		auditDirty = true
+		return
+	}
+	syncAuditLog()
+}
+
+// outcomeFor maps an error to an audit outcome.
+func outcomeFor(err error) string {
+	if err != nil {
+		return OutcomeError
+	}
+	return OutcomeOK
+}
+
+type auditVerifyResult struct {
+	Valid    bool   `json:"valid"`
+	Entries  uint64 `json:"entries"`
+	BrokenAt uint64 `json:"broken_at,omitempty"`
+	Problem  string `json:"problem,omitempty"`
+	LastSeq  uint64 `json:"last_seq"`
+	LastHash string `json:"last_hash"`
+	HeadSeq  uint64 `json:"head_seq"` // last entry recorded in the head file
+}
+
+// verifyAuditLog checks the chain in path with key, and that the log still
+// reaches the entry recorded in its head file.
+func verifyAuditLog(path string, key []byte) (auditVerifyResult, error) {
+	head, err := os.ReadFile(path + ".head")
+	if err != nil {
+		head = nil
+	}
+	return verifyAuditLogTo(path, key, head, 0)
+}
+
+// verifyAuditLogTo checks the chain in path up to entry upTo (0 for all of
+// it) against head, the contents of the head file or nil if there is none.
+// A running server passes the head and last seq it had when asked, so the
+// check does not hold up audit while it reads the file.
+func verifyAuditLogTo(path string, key, headFile []byte, upTo uint64) (auditVerifyResult, error) {
+	res := auditVerifyResult{Valid: true}
+	f, err := os.Open(path)
+	if err != nil {
+		return res, err
+	}
+	defer f.Close()
+
+	var head *auditHead
+	if headFile != nil {
+		head = &auditHead{}
+		if json.Unmarshal(headFile, head) != nil || !hmac.Equal([]byte(head.MAC), []byte(head.mac(key))) {
+			res.fail(0, "head file signature mismatch (modified, or a different audit key)")
+			head = nil
+		} else {
+			res.HeadSeq = head.Seq
+		}
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			res.fail(res.LastSeq+1, "unparseable entry")
+			continue
+		}
+		res.Entries++
+		switch {
+		case e.Seq != res.LastSeq+1:
+			res.fail(e.Seq, fmt.Sprintf("expected seq %d", res.LastSeq+1))
+		case e.PrevHash != res.LastHash:
+			res.fail(e.Seq, "prev_hash does not match previous entry")
+		case e.Alg != auditAlgHMAC:
+			res.fail(e.Seq, "entry is not keyed")
+		case e.computeHash(key) != e.Hash:
+			res.fail(e.Seq, "entry hash mismatch (modified, or a different audit key)")
+		case head != nil && e.Seq == head.Seq && e.Hash != head.Hash:
+			res.fail(e.Seq, "entry does not match the head file")
+		}
+		res.LastSeq, res.LastHash = e.Seq, e.Hash
+		if upTo > 0 && e.Seq >= upTo {
+			break // written after the check started
+		}
+	}
+	switch {
+	case head != nil && head.Seq > res.LastSeq:
+		res.fail(res.LastSeq+1, fmt.Sprintf("log ends at seq %d but the head file records seq %d (entries removed)", res.LastSeq, head.Seq))
+	case headFile == nil && res.Entries > 0:
+		res.fail(res.LastSeq, "head file missing")
+	}
+	return res, scanner.Err()
+}
+
+func (res *auditVerifyResult) fail(seq uint64, problem string) {
+	if res.Valid {
+		res.Valid, res.BrokenAt, res.Problem = false, seq, problem
+	}
+}
+
+// --- Admin: audit queries ---
+
+const maxAuditQueryLimit = 10000
+
+// handleAdminAudit returns matching entries, newest first. Filters: actor,
+// action, clinic, patient, outcome, from/to (RFC 3339) and limit (default
+// 500, at most maxAuditQueryLimit).
+func handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if preflight(w, r) {
+		return
+	}
+	if !authorize(w, r, PermAdmin, "") {
+		return
+	}
+	q := r.URL.Query()
+	from, err1 := parseTimeParam(q.Get("from"))
+	to, err2 := parseTimeParam(q.Get("to"))
+	if err1 != nil || err2 != nil {
+		http.Error(w, "from/to must be RFC 3339 timestamps", http.StatusBadRequest)
+		return
+	}
+	limit := 500
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 {
+		limit = min(v, maxAuditQueryLimit)
+	}
+	match := func(field, want string) bool { return want == "" || field == want }
+
+	f, err := os.Open(auditFile)
+	if err != nil {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// The last limit matches, in a ring: ring[n%limit] is the next to go
+	var (
+		ring []AuditEntry
+		n    int
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if !match(e.Actor, q.Get("actor")) || !match(e.Action, q.Get("action")) ||
+			!match(e.Clinic, q.Get("clinic")) || !match(e.Patient, q.Get("patient")) ||
+			!match(e.Outcome, q.Get("outcome")) {
+			continue
+		}
+		if (!from.IsZero() && e.Time.Before(from)) || (!to.IsZero() && e.Time.After(to)) {
+			continue
+		}
+		if len(ring) < limit {
+			ring = append(ring, e)
+		} else {
+			ring[n%limit] = e
+		}
+		n++
+	}
+	audit(r, "audit_query", q.Get("clinic"), q.Get("patient"), OutcomeOK, r.URL.RawQuery)
+
+	// Newest first
+	out := make([]AuditEntry, 0, len(ring))
+	for i := 1; i <= len(ring); i++ {
+		out = append(out, ring[(n-i)%limit])
+	}
+	writeJSON(w, out)
+}
+
+func handleAdminAuditVerify(w http.ResponseWriter, r *http.Request) {
+	if preflight(w, r) {
+		return
+	}
+	if !authorize(w, r, PermAdmin, "") {
+		return
+	}
+	// Only the snapshot is taken under auditMu, after a sync so the head
+	// file is current; the log is read without it.
+	auditMu.Lock()
+	if auditOut != nil && auditDirty {
+		syncAuditLog()
+	}
+	key, upTo := auditKey, auditSeq
+	head, err := os.ReadFile(auditHeadFile())
+	auditMu.Unlock()
+	if err != nil {
+		head = nil
+	}
+	res, err := verifyAuditLogTo(auditFile, key, head, upTo)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, res)
+}
+
+func parseTimeParam(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// closeAuditLog syncs and closes the log; later audit calls are dropped.
+func closeAuditLog() {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditOut == nil {
+		return
+	}
+	close(auditStop)
+	syncAuditLog()
+	auditOut.Close()
+	auditOut = nil
+}
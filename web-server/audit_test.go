@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testAuditKey = "0123456789abcdef0123456789abcdef"
+
+// setupAuditTest opens a fresh audit log keyed with testAuditKey. The log
+// is closed again when the test ends.
+func setupAuditTest(t *testing.T) {
+	t.Helper()
+	oldFile, oldKeyFile := auditFile, auditKeyFile
+	dir := t.TempDir()
+	auditFile = filepath.Join(dir, "audit.log")
+	auditKeyFile = filepath.Join(dir, "audit.key")
+	t.Setenv("MEDICART_AUDIT_KEY", testAuditKey)
+	if err := openAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		closeAuditLog()
+		auditFile, auditKeyFile = oldFile, oldKeyFile
+	})
+}
+
+func adminRequest(method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	return r.WithContext(withPrincipal(r.Context(), Principal{Kind: "user", Name: "root", Role: RoleAdmin}))
+}
+
+func TestAuditChainDetectsTampering(t *testing.T) {
+	setupAuditTest(t)
+	for i := 1; i <= 5; i++ {
+		audit(nil, "export", "North", "Ann", OutcomeOK, fmt.Sprintf("entry %d", i))
+	}
+	closeAuditLog()
+
+	log, err := os.ReadFile(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := os.ReadFile(auditHeadFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := verifyAuditLog(auditFile, []byte(testAuditKey))
+	if err != nil || !res.Valid || res.Entries != 5 || res.HeadSeq != 5 {
+		t.Fatalf("untouched log: %+v, %v", res, err)
+	}
+
+	lines := strings.SplitAfter(string(log), "\n")
+	lines = lines[:len(lines)-1] // after the final newline
+	tests := []struct {
+		name     string
+		log      string
+		head     []byte
+		key      string
+		brokenAt uint64
+		problem  string
+	}{
+		{"edited entry", strings.Join(lines[:2], "") + strings.Replace(lines[2], "entry 3", "entry 9", 1) + strings.Join(lines[3:], ""),
+			head, testAuditKey, 3, "hash mismatch"},
+		{"removed entry", strings.Join(lines[:2], "") + strings.Join(lines[3:], ""),
+			head, testAuditKey, 4, "expected seq 3"},
+		{"entries cut from the end", strings.Join(lines[:3], ""),
+			head, testAuditKey, 4, "head file records seq 5"},
+		{"head file edited", string(log),
+			bytes.Replace(head, []byte(`"seq":5`), []byte(`"seq":3`), 1), testAuditKey, 0, "signature mismatch"},
+		{"head file removed", string(log), nil, testAuditKey, 5, "head file missing"},
+		{"other key", string(log), head, strings.Repeat("x", 32), 0, "signature mismatch"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			if err := os.WriteFile(path, []byte(tc.log), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if tc.head != nil {
+				if err := os.WriteFile(path+".head", tc.head, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			res, err := verifyAuditLog(path, []byte(tc.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Valid || res.BrokenAt != tc.brokenAt || !strings.Contains(res.Problem, tc.problem) {
+				t.Fatalf("got %+v, want broken at %d with %q", res, tc.brokenAt, tc.problem)
+			}
+		})
+	}
+}
+
+func TestAdminAuditVerifyStopsAtSnapshot(t *testing.T) {
+	setupAuditTest(t)
+	// Routine entries are not synced right away; verify syncs them first
+	for i := 0; i < 3; i++ {
+		audit(nil, "ingest", "North", "Ann", OutcomeOK, "heart_rate.json")
+	}
+	w := httptest.NewRecorder()
+	handleAdminAuditVerify(w, adminRequest(http.MethodGet, "/api/admin/audit/verify"))
+	var res auditVerifyResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.Valid || res.LastSeq != 3 || res.HeadSeq != 3 {
+		t.Fatalf("verify = %+v, want valid up to seq 3", res)
+	}
+
+	// Entries written after the snapshot are not checked
+	key := []byte(testAuditKey)
+	head, _ := os.ReadFile(auditHeadFile())
+	audit(nil, "export", "North", "Ann", OutcomeOK, "")
+	res, err := verifyAuditLogTo(auditFile, key, head, 3)
+	if err != nil || !res.Valid || res.LastSeq != 3 {
+		t.Fatalf("verify to seq 3 = %+v, %v", res, err)
+	}
+}
+
+func TestAdminAuditQueryKeepsNewest(t *testing.T) {
+	setupAuditTest(t)
+	for i := 1; i <= 10; i++ {
+		action := "export"
+		if i%2 == 0 {
+			action = "camera_control"
+		}
+		audit(nil, action, "North", "Ann", OutcomeOK, fmt.Sprintf("entry %d", i))
+	}
+
+	query := func(q string) []string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handleAdminAudit(w, adminRequest(http.MethodGet, "/api/admin/audit?"+q))
+		var entries []AuditEntry
+		if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+			t.Fatalf("%s: %v (%s)", q, err, w.Body.String())
+		}
+		var details []string
+		for _, e := range entries {
+			details = append(details, e.Detail)
+		}
+		return details
+	}
+	if got := strings.Join(query("action=export&limit=3"), ","); got != "entry 9,entry 7,entry 5" {
+		t.Fatalf("limit 3 = %s", got)
+	}
+	if got := query("action=camera_control&limit=100"); len(got) != 5 || got[0] != "entry 10" || got[4] != "entry 2" {
+		t.Fatalf("limit above the matches = %v", got)
+	}
+}
+
+// An attacker without the key can rebuild the chain with plain hashes and
+// drop the head file; neither may pass.
+func TestAuditChainRejectsRebuiltLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	var log bytes.Buffer
+	prev := ""
+	for i := uint64(1); i <= 3; i++ {
+		e := AuditEntry{Seq: i, Actor: "root", Action: "export", Outcome: OutcomeOK, PrevHash: prev}
+		b, _ := json.Marshal(e)
+		sum := sha256.Sum256(b)
+		e.Hash = hex.EncodeToString(sum[:])
+		b, _ = json.Marshal(e)
+		log.Write(append(b, '\n'))
+		prev = e.Hash
+	}
+	if err := os.WriteFile(path, log.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	res, err := verifyAuditLog(path, []byte(testAuditKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Valid || res.BrokenAt != 1 || !strings.Contains(res.Problem, "not keyed") {
+		t.Fatalf("rebuilt log: %+v", res)
+	}
+
+	// An empty log needs no head file
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := verifyAuditLog(path, []byte(testAuditKey)); err != nil || !res.Valid {
+		t.Fatalf("empty log: %+v, %v", res, err)
+	}
+}
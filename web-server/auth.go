@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Desktops authenticate with API keys ("mk_<id>_<secret>"); dashboard users
+// log in with a password and receive a signed HS256 token. Both stores are
+// small JSON files managed with the admin CLI (see admin.go) and reloaded
+// when they change on disk, so keys can be revoked without a restart.
+
+// File locations and token lifetime come from Config.Auth.
+var (
+	apiKeysFile   string
+	usersFile     string
+	jwtSecretFile string
+	tokenTTL      time.Duration
+)
+
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Clinic    string    `json:"clinic,omitempty"` // empty: any clinic
+	Hash      string    `json:"hash"`             // sha256 of the full key
+	CreatedAt time.Time `json:"created_at"`
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+type User struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	Role         string    `json:"role"`
+	Clinics      []string  `json:"clinics,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Kind    string // "desktop" or "user"
+	Name    string
+	Clinic  string   // desktops: clinic the key is bound to, if any
+	Role    string   // users only
+	Clinics []string // users only
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+func principalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// --- JSON file stores ---
+
+// jsonStore caches a JSON file and reloads it when its mtime changes.
+type jsonStore[T any] struct {
+	mu      sync.Mutex
+	path    func() string
+	modTime time.Time
+	items   []T
+}
+
+func (s *jsonStore[T]) load() ([]T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, err := os.Stat(s.path())
+	if os.IsNotExist(err) {
+		s.items, s.modTime = nil, time.Time{}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if st.ModTime().Equal(s.modTime) && s.items != nil {
+		return s.items, nil
+	}
+	b, err := os.ReadFile(s.path())
+	if err != nil {
+		return nil, err
+	}
+	var items []T
+	if err := json.Unmarshal(b, &items); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path(), err)
+	}
+	s.items, s.modTime = items, st.ModTime()
+	return items, nil
+}
+
+func (s *jsonStore[T]) save(items []T) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path(), b, 0600); err != nil {
+		return err
+	}
+	s.items, s.modTime = nil, time.Time{}
+	return nil
+}
+
+var (
+	apiKeys = &jsonStore[APIKey]{path: func() string { return apiKeysFile }}
+	users   = &jsonStore[User]{path: func() string { return usersFile }}
+)
+
+// --- API keys ---
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey returns the record to store and the plaintext key, which is
+// only ever shown once.
+func newAPIKey(name, clinic string) (APIKey, string, error) {
+	id := make([]byte, 4)
+	secret := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return APIKey{}, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, "", err
+	}
+	rec := APIKey{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Clinic:    clinic,
+		CreatedAt: time.Now().UTC(),
+	}
+	key := "mk_" + rec.ID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	rec.Hash = hashKey(key)
+	return rec, key, nil
+}
+
+func authenticateAPIKey(key string) (Principal, error) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != "mk" {
+		return Principal{}, errors.New("malformed API key")
+	}
+	keys, err := apiKeys.load()
+	if err != nil {
+		return Principal{}, err
+	}
+	want := hashKey(key)
+	for _, k := range keys {
+		if k.ID != parts[1] {
+			continue
+		}
+		if k.Revoked || subtle.ConstantTimeCompare([]byte(k.Hash), []byte(want)) != 1 {
+			break
+		}
+		return Principal{Kind: "desktop", Name: k.Name, Clinic: k.Clinic}, nil
+	}
+	return Principal{}, errors.New("invalid API key")
+}
+
+// --- Passwords ---
+
+const pbkdf2Iterations = 210000
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	dk, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", pbkdf2Iterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(dk)), nil
+}
+
+func checkPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[2])
+	want, err2 := base64.RawStdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	dk, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(dk, want) == 1
+}
+
+func findUser(username string) (User, bool, error) {
+	list, err := users.load()
+	if err != nil {
+		return User{}, false, err
+	}
+	for _, u := range list {
+		if u.Username == username {
+			return u, true, nil
+		}
+	}
+	return User{}, false, nil
+}
+
+// --- Tokens ---
+
+var (
+	jwtSecretOnce sync.Once
+	jwtSecret     []byte
+	jwtSecretErr  error
+)
+
+// signingKey comes from MEDICART_JWT_SECRET, or a random secret persisted
+// next to the user store on first use.
+func signingKey() ([]byte, error) {
+	jwtSecretOnce.Do(func() {
+		if s := os.Getenv("MEDICART_JWT_SECRET"); s != "" {
+			jwtSecret = []byte(s)
+			return
+		}
+		if b, err := os.ReadFile(jwtSecretFile); err == nil && len(b) >= 32 {
+			jwtSecret = b
+			return
+		}
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			jwtSecretErr = err
+			return
+		}
+		jwtSecret = []byte(hex.EncodeToString(b))
+		jwtSecretErr = os.WriteFile(jwtSecretFile, jwtSecret, 0600)
+	})
+	return jwtSecret, jwtSecretErr
+}
+
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func issueToken(c tokenClaims) (string, error) {
+	key, err := signingKey()
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func parseToken(token string) (tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return tokenClaims{}, errors.New("malformed token")
+	}
+	key, err := signingKey()
+	if err != nil {
+		return tokenClaims{}, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return tokenClaims{}, errors.New("bad token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return tokenClaims{}, errors.New("malformed token")
+	}
+	var c tokenClaims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return tokenClaims{}, errors.New("malformed token")
+	}
+	if time.Now().Unix() >= c.ExpiresAt {
+		return tokenClaims{}, errors.New("token expired")
+	}
+	return c, nil
+}
+
+// authenticateUser validates a dashboard token. Browsers cannot set headers
+// on WebSocket requests, so the token may also come as ?token=.
+func authenticateUser(r *http.Request) (Principal, error) {
+	token := bearerToken(r)
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return Principal{}, errors.New("missing token")
+	}
+	c, err := parseToken(token)
+	if err != nil {
+		return Principal{}, err
+	}
+	// Role and clinic changes, and deleted users, take effect immediately
+	// rather than when the token expires.
+	u, ok, err := findUser(c.Subject)
+	if err != nil || !ok {
+		return Principal{}, errors.New("unknown user")
+	}
+	role := u.Role
+	if role == "" {
+		role = RoleViewer // accounts created before roles existed
+	}
+	return Principal{Kind: "user", Name: u.Username, Role: role, Clinics: u.Clinics}, nil
+}
+
+func authenticateDesktop(r *http.Request) (Principal, error) {
+	if err := requireClientCert(r); err != nil {
+		return Principal{}, err
+	}
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = bearerToken(r)
+	}
+	if key == "" {
+		key = r.URL.Query().Get("api_key")
+	}
+	if key == "" {
+		return Principal{}, errors.New("missing API key")
+	}
+	return authenticateAPIKey(key)
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// --- Middleware ---
+
+func requireAuth(authenticate func(*http.Request) (Principal, error), next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next(w, r) // CORS preflight carries no credentials
+			return
+		}
+		p, err := authenticate(r)
+		if err != nil {
+			audit(r, "auth_failed", "", "", OutcomeDenied, r.Method+" "+r.URL.Path+": "+err.Error())
+			setCORS(w, r)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="medicart"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(withPrincipal(r.Context(), p)))
+	}
+}
+
+func requireUser(next http.HandlerFunc) http.HandlerFunc {
+	return requireAuth(authenticateUser, next)
+}
+
+func requireDesktop(next http.HandlerFunc) http.HandlerFunc {
+	return requireAuth(authenticateDesktop, next)
+}
+
+// --- Login API ---
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if preflight(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil || json.Unmarshal(body, &req) != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	u, ok, err := findUser(req.Username)
+	if err != nil {
+		http.Error(w, "Failed to load users", http.StatusInternalServerError)
+		return
+	}
+	if !ok || !checkPassword(u.PasswordHash, req.Password) {
+		audit(r, "login", "", "", OutcomeDenied, req.Username)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	now := time.Now()
+	exp := now.Add(tokenTTL)
+	token, err := issueToken(tokenClaims{Subject: u.Username, IssuedAt: now.Unix(), ExpiresAt: exp.Unix()})
+	if err != nil {
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	audit(r.WithContext(withPrincipal(r.Context(), Principal{Kind: "user", Name: u.Username, Role: u.Role})),
+		"login", "", "", OutcomeOK, "")
+	writeJSON(w, map[string]interface{}{
+		"token":      token,
+		"expires_at": exp.UTC(),
+		"username":   u.Username,
+		"role":       u.Role,
+		"clinics":    u.Clinics,
+	})
+}
+
+func handleMe(w http.ResponseWriter, r *http.Request) {
+	if preflight(w, r) {
+		return
+	}
+	p, _ := principalFrom(r.Context())
+	writeJSON(w, map[string]interface{}{
+		"username": p.Name,
+		"role":     p.Role,
+		"clinics":  p.Clinics,
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "fedcba9876543210fedcba9876543210"
+
+// setupAuthTest points the key and user stores at empty files in a temp
+// directory and signs tokens with testJWTSecret.
+func setupAuthTest(t *testing.T) {
+	t.Helper()
+	oldKeys, oldUsers, oldSecret := apiKeysFile, usersFile, jwtSecretFile
+	dir := t.TempDir()
+	apiKeysFile = filepath.Join(dir, "api_keys.json")
+	usersFile = filepath.Join(dir, "users.json")
+	jwtSecretFile = filepath.Join(dir, "jwt_secret")
+	t.Setenv("MEDICART_JWT_SECRET", testJWTSecret)
+	jwtSecretOnce, jwtSecret, jwtSecretErr = sync.Once{}, nil, nil
+	t.Cleanup(func() {
+		apiKeysFile, usersFile, jwtSecretFile = oldKeys, oldUsers, oldSecret
+		jwtSecretOnce, jwtSecret, jwtSecretErr = sync.Once{}, nil, nil
+	})
+}
+
+func TestParseToken(t *testing.T) {
+	setupAuthTest(t)
+	now := time.Now()
+	valid, err := issueToken(tokenClaims{Subject: "ann", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := parseToken(valid); err != nil || c.Subject != "ann" {
+		t.Fatalf("valid token: %+v, %v", c, err)
+	}
+
+	expired, _ := issueToken(tokenClaims{Subject: "ann", IssuedAt: now.Add(-2 * time.Hour).Unix(), ExpiresAt: now.Add(-time.Hour).Unix()})
+	parts := strings.Split(valid, ".")
+	header := func(h string) string { return base64.RawURLEncoding.EncodeToString([]byte(h)) }
+	other := strings.Split(expired, ".")
+	tests := []struct {
+		name, token, want string
+	}{
+		{"expired", expired, "token expired"},
+		{"bad signature", parts[0] + "." + parts[1] + "." + other[2], "bad token signature"},
+		{"claims swapped", parts[0] + "." + other[1] + "." + parts[2], "bad token signature"},
+		// Only the exact HS256 header is accepted, whatever the signature
+		{"alg none", header(`{"alg":"none","typ":"JWT"}`) + "." + parts[1] + ".", "malformed token"},
+		{"alg RS256", header(`{"alg":"RS256","typ":"JWT"}`) + "." + parts[1] + "." + parts[2], "malformed token"},
+		{"two parts", parts[0] + "." + parts[1], "malformed token"},
+		{"empty", "", "malformed token"},
+	}
+	for _, tc := range tests {
+		if _, err := parseToken(tc.token); err == nil || err.Error() != tc.want {
+			t.Errorf("%s: err = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+
+	// A token signed with another secret
+	t.Setenv("MEDICART_JWT_SECRET", strings.Repeat("x", 32))
+	jwtSecretOnce, jwtSecret, jwtSecretErr = sync.Once{}, nil, nil
+	if _, err := parseToken(valid); err == nil || err.Error() != "bad token signature" {
+		t.Fatalf("other secret: err = %v", err)
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	setupAuthTest(t)
+	active, activeKey, err := newAPIKey("desk-1", "North")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedKey, err := newAPIKey("desk-2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked.Revoked = true
+	if err := apiKeys.save([]APIKey{active, revoked}); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := authenticateAPIKey(activeKey)
+	if err != nil || p.Kind != "desktop" || p.Name != "desk-1" || p.Clinic != "North" {
+		t.Fatalf("active key: %+v, %v", p, err)
+	}
+	tests := []struct {
+		name, key, want string
+	}{
+		{"revoked", revokedKey, "invalid API key"},
+		{"wrong secret", "mk_" + active.ID + "_" + strings.Repeat("A", 32), "invalid API key"},
+		{"unknown id", "mk_00000000_" + strings.Repeat("A", 32), "invalid API key"},
+		{"other key's secret", "mk_" + active.ID + "_" + strings.SplitN(revokedKey, "_", 3)[2], "invalid API key"},
+		{"no prefix", strings.TrimPrefix(activeKey, "mk_"), "malformed API key"},
+		{"wrong prefix", "xk" + strings.TrimPrefix(activeKey, "mk"), "malformed API key"},
+		{"no secret", "mk_" + active.ID, "malformed API key"},
+		{"empty", "", "malformed API key"},
+	}
+	for _, tc := range tests {
+		if _, err := authenticateAPIKey(tc.key); err == nil || err.Error() != tc.want {
+			t.Errorf("%s: err = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	encoded, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword(encoded, "correct horse") {
+		t.Fatal("right password rejected")
+	}
+	for _, pw := range []string{"correct horse ", "Correct horse", ""} {
+		if checkPassword(encoded, pw) {
+			t.Errorf("wrong password %q accepted", pw)
+		}
+	}
+	parts := strings.Split(encoded, "$")
+	for _, bad := range []string{
+		"",
+		"plain",
+		"bcrypt$" + strings.Join(parts[1:], "$"),
+		parts[0] + "$x$" + parts[2] + "$" + parts[3],
+		parts[0] + "$" + parts[1] + "$!!$" + parts[3],
+		strings.Join(parts[:3], "$"),
+	} {
+		if checkPassword(bad, "correct horse") {
+			t.Errorf("malformed hash %q accepted", bad)
+		}
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	setupAuthTest(t)
+	setupIngestTest(t)
+	hash, err := hashPassword("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.save([]User{{Username: "ann", PasswordHash: hash, Role: RoleClinician, Clinics: []string{"North"}}}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	token, _ := issueToken(tokenClaims{Subject: "ann", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+	expired, _ := issueToken(tokenClaims{Subject: "ann", IssuedAt: now.Add(-2 * time.Hour).Unix(), ExpiresAt: now.Add(-time.Hour).Unix()})
+	gone, _ := issueToken(tokenClaims{Subject: "bob", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+
+	var got Principal
+	h := requireUser(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = principalFrom(r.Context())
+	})
+	call := func(method, target, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"no token":      call(http.MethodGet, "/api/clinics", ""),
+		"expired":       call(http.MethodGet, "/api/clinics", "Bearer "+expired),
+		"tampered":      call(http.MethodGet, "/api/clinics", "Bearer "+token+"x"),
+		"deleted user":  call(http.MethodGet, "/api/clinics", "Bearer "+gone),
+		"not a bearer":  call(http.MethodGet, "/api/clinics", "Basic "+token),
+		"query expired": call(http.MethodGet, "/api/clinics?token="+expired, ""),
+	} {
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want 401", name, w.Code)
+		}
+		if a := w.Header().Get("WWW-Authenticate"); !strings.HasPrefix(a, "Bearer ") {
+			t.Errorf("%s: WWW-Authenticate = %q", name, a)
+		}
+	}
+
+	if w := call(http.MethodGet, "/api/clinics", "bearer "+token); w.Code != http.StatusOK || got.Name != "ann" || got.Role != RoleClinician {
+		t.Fatalf("valid token: %d, principal %+v", w.Code, got)
+	}
+	got = Principal{}
+	if w := call(http.MethodGet, "/ws?token="+token, ""); w.Code != http.StatusOK || got.Name != "ann" {
+		t.Fatalf("token in the query: %d, principal %+v", w.Code, got)
+	}
+	// CORS preflight carries no credentials and reaches the handler as is
+	got = Principal{Name: "unset"}
+	if w := call(http.MethodOptions, "/api/clinics", ""); w.Code != http.StatusOK || got.Name != "" {
+		t.Fatalf("preflight: %d, principal %+v", w.Code, got)
+	}
+}
+
+func TestRequireDesktop(t *testing.T) {
+	setupAuthTest(t)
+	setupIngestTest(t)
+	rec, key, err := newAPIKey("desk-1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := apiKeys.save([]APIKey{rec}); err != nil {
+		t.Fatal(err)
+	}
+	h := requireDesktop(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tc := range []struct {
+		name   string
+		header string
+		query  string
+		want   int
+	}{
+		{"X-API-Key", key, "", http.StatusOK},
+		{"query", "", "?api_key=" + key, http.StatusOK},
+		{"missing", "", "", http.StatusUnauthorized},
+		{"malformed", "not-a-key", "", http.StatusUnauthorized},
+		{"unknown", "mk_00000000_secret", "", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/ingest"+tc.query, nil)
+		if tc.header != "" {
+			r.Header.Set("X-API-Key", tc.header)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
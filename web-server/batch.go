@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// /api/ingest/batch takes many readings in one request, for uploaders on
+// metered links. The body is either a JSON array of readings or, with
+// Content-Type application/x-ndjson, one reading per line; either may be
+// gzip-compressed (Content-Encoding: gzip). Each reading is stored exactly
+// as a POST to /api/ingest would store it, and gets its own result:
+//
+//	{"index": 3, "status": 403, "error": "API key not valid for this clinic"}
+//
+// A JSON array is answered with {"accepted", "rejected", "results"} once
+// all readings are stored. NDJSON is answered with one result per line as
+// each reading is stored, so a client can stream a long upload.
+//
+// /ws/ingest does the same over a WebSocket that stays open: each text
+// message is one reading and is answered with a text message holding its
+// result, indexed from 0 per connection.
+
+const (
+	maxBatchItems = 5000
+	maxBatchBytes = 32 << 20 // after decompression
+	maxWSReading  = 4 << 20  // one message on /ws/ingest, like an NDJSON line
+	ingestWSWait  = 5 * time.Second
+)
+
+type batchResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+var errBatchTooLarge = errors.New("batch too large")
+
+// countingReader counts the bytes read through it and, with a limit, fails
+// once more than limit bytes have been read.
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if c.limit > 0 && c.n > c.limit {
+		return n, errBatchTooLarge
+	}
+	return n, err
+}
+
+func handleIngestBatch(w http.ResponseWriter, r *http.Request) {
+	if preflight(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	wire := &countingReader{r: r.Body}
+	defer func() { ingestBytes.add(float64(wire.n)) }()
+	var body io.Reader = wire
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(wire)
+		if err != nil {
+			http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+	body = &countingReader{r: body, limit: maxBatchBytes}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		ingestBatchesTotal.inc("ndjson")
+		ingestNDJSON(w, r, body)
+	default:
+		ingestBatchesTotal.inc("json")
+		ingestJSONArray(w, r, body)
+	}
+}
+
+// errReader returns err once its data is used up, so an error from
+// reading ahead surfaces where it happened.
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) {
+	if e.err == nil {
+		return 0, io.EOF
+	}
+	return 0, e.err
+}
+
+// batchItem decodes and stores one reading. Readings already stored (same
+// session_id and seq) are skipped and count as accepted, so a batch resent
+// after a lost response does not store them twice.
+func batchItem(r *http.Request, i int, raw []byte) batchResult {
+	var data map[string]interface{}
+	if err := json.Unmarshal(raw, &data); err != nil || data == nil {
+		ingestTotal.inc("unknown", "invalid")
+		return batchResult{Index: i, Status: http.StatusBadRequest, Error: "Invalid JSON"}
+	}
+	status, msg := ingestItem(r, data)
+	res := batchResult{Index: i, Status: status}
+	if status != http.StatusOK {
+		res.Error = msg
+	}
+	return res
+}
+
+func ingestJSONArray(w http.ResponseWriter, r *http.Request, body io.Reader) {
+	b, err := io.ReadAll(body)
+	if errors.Is(err, errBatchTooLarge) {
+		http.Error(w, "Batch too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(b, &items); err != nil {
+		http.Error(w, "Body must be a JSON array of readings", http.StatusBadRequest)
+		return
+	}
+	if len(items) > maxBatchItems {
+		http.Error(w, "Too many readings in one batch", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	out := struct {
+		Accepted int           `json:"accepted"`
+		Rejected int           `json:"rejected"`
+		Results  []batchResult `json:"results"`
+	}{Results: make([]batchResult, 0, len(items))}
+	for i, raw := range items {
+		res := batchItem(r, i, raw)
+		if res.Status == http.StatusOK {
+			out.Accepted++
+		} else {
+			out.Rejected++
+		}
+		out.Results = append(out.Results, res)
+	}
+	logFor(r).Info("Batch ingested", "accepted", out.Accepted, "rejected", out.Rejected)
+	writeJSON(w, out)
+}
+
+// ingestNDJSON answers line by line. Once the first result is written the
+// status is 200, so a body that turns out too large or unreadable ends with
+// a result for index -1 instead. Results are written while the body is
+// still being read, which HTTP/1.x only allows in full-duplex mode; where
+// that is unavailable the body is read in full first.
+func ingestNDJSON(w http.ResponseWriter, r *http.Request, body io.Reader) {
+	if err := http.NewResponseController(w).EnableFullDuplex(); err != nil && r.ProtoMajor < 2 {
+		b, err := io.ReadAll(body)
+		body = io.MultiReader(bytes.NewReader(b), errReader{err})
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	sc := bufio.NewScanner(body)
+	sc.Buffer(make([]byte, 64*1024), 4<<20)
+	accepted, rejected, i := 0, 0, 0
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var res batchResult
+		if i >= maxBatchItems {
+			res = batchResult{Index: i, Status: http.StatusRequestEntityTooLarge, Error: "Too many readings in one batch"}
+		} else {
+			res = batchItem(r, i, []byte(line))
+		}
+		i++
+		if res.Status == http.StatusOK {
+			accepted++
+		} else {
+			rejected++
+		}
+		_ = enc.Encode(res)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if res.Status == http.StatusRequestEntityTooLarge {
+			break
+		}
+	}
+	if err := sc.Err(); errors.Is(err, errBatchTooLarge) {
+		_ = enc.Encode(batchResult{Index: -1, Status: http.StatusRequestEntityTooLarge, Error: "Batch too large"})
+	} else if err != nil {
+		_ = enc.Encode(batchResult{Index: -1, Status: http.StatusBadRequest, Error: "Failed to read body: " + err.Error()})
+	}
+	logFor(r).Info("Batch ingested", "accepted", accepted, "rejected", rejected)
+}
+
+// --- WebSocket ---
+
+var (
+	ingestConnsMu sync.Mutex
+	ingestConns   = map[*websocket.Conn]bool{} // for shutdown
+)
+
+func handleIngestWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logFor(r).Warn("Ingest WS upgrade failed", "err", err)
+		return
+	}
+	conn.SetReadLimit(maxWSReading)
+	ingestConnsMu.Lock()
+	ingestConns[conn] = true
+	ingestConnsMu.Unlock()
+	defer func() {
+		ingestConnsMu.Lock()
+		delete(ingestConns, conn)
+		ingestConnsMu.Unlock()
+		conn.Close()
+	}()
+
+	p, _ := principalFrom(r.Context())
+	logFor(r).Info("Ingest WS connected", "desktop", p.Name)
+	ingestBatchesTotal.inc("websocket")
+	accepted, rejected := 0, 0
+	defer func() {
+		logFor(r).Info("Ingest WS disconnected", "desktop", p.Name, "accepted", accepted, "rejected", rejected)
+	}()
+
+	for i := 0; ; i++ {
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		ingestBytes.add(float64(len(msg)))
+		var res batchResult
+		if mt != websocket.TextMessage {
+			res = batchResult{Index: i, Status: http.StatusBadRequest, Error: "Readings must be text messages"}
+		} else {
+			res = batchItem(r, i, msg)
+		}
+		if res.Status == http.StatusOK {
+			accepted++
+		} else {
+			rejected++
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(ingestWSWait))
+		if err := conn.WriteJSON(res); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupIngestTest gives the test a fresh, unencrypted data directory and
+// the default configuration, restoring the globals afterwards.
+func setupIngestTest(t *testing.T) {
+	t.Helper()
+	oldConfig, oldDataDir := config, dataDir
+	t.Cleanup(func() { config, dataDir = oldConfig, oldDataDir })
+	t.Setenv("MEDICART_STORAGE_KEY", "")
+	config = defaultConfig()
+	dataDir = t.TempDir()
+}
+
+func postBatch(t *testing.T, body []byte, contentType string, gz bool) *httptest.ResponseRecorder {
+	t.Helper()
+	if gz {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		body = buf.Bytes()
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/ingest/batch", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if gz {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	rec := httptest.NewRecorder()
+	handleIngestBatch(rec, req)
+	return rec
+}
+
+type batchResponse struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Results  []batchResult `json:"results"`
+}
+
+func decodeBatch(t *testing.T, rec *httptest.ResponseRecorder) batchResponse {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	var out batchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	return out
+}
+
+func spo2Reading(seq int, value int) string {
+	return fmt.Sprintf(`{"clinic_name":"North","patient_name":"Ann","session_id":"s1","seq":%d,"spo2":%d,"pr":70}`, seq, value)
+}
+
+func TestIngestBatchGzipJSONArray(t *testing.T) {
+	setupIngestTest(t)
+	body := "[" + spo2Reading(1, 97) + "," + spo2Reading(2, 98) + `,"not a reading"]`
+	out := decodeBatch(t, postBatch(t, []byte(body), "application/json", true))
+	if out.Accepted != 2 || out.Rejected != 1 {
+		t.Fatalf("accepted %d rejected %d, want 2 and 1", out.Accepted, out.Rejected)
+	}
+	if r := out.Results[2]; r.Index != 2 || r.Status != http.StatusBadRequest {
+		t.Fatalf("result 2 = %+v, want index 2 status 400", r)
+	}
+	recs, err := readRecords("North", "Ann", "heart_rate.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("stored %d records, want 2", len(recs))
+	}
+}
+
+func TestIngestBatchNDJSON(t *testing.T) {
+	setupIngestTest(t)
+	body := spo2Reading(1, 97) + "\n\n{oops\n" + spo2Reading(2, 98) + "\n"
+	for _, gz := range []bool{false, true} {
+		rec := postBatch(t, []byte(body), "application/x-ndjson", gz)
+		if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Fatalf("Content-Type = %q", ct)
+		}
+		var results []batchResult
+		sc := bufio.NewScanner(rec.Body)
+		for sc.Scan() {
+			var res batchResult
+			if err := json.Unmarshal(sc.Bytes(), &res); err != nil {
+				t.Fatalf("line %q: %v", sc.Text(), err)
+			}
+			results = append(results, res)
+		}
+		// Blank lines are skipped without using up an index
+		want := []int{http.StatusOK, http.StatusBadRequest, http.StatusOK}
+		if len(results) != len(want) {
+			t.Fatalf("gzip %v: %d results, want %d: %+v", gz, len(results), len(want), results)
+		}
+		for i, res := range results {
+			if res.Index != i || res.Status != want[i] {
+				t.Fatalf("gzip %v: result %d = %+v, want status %d", gz, i, res, want[i])
+			}
+		}
+	}
+	// The second pass was a resend of the first
+	recs, err := readRecords("North", "Ann", "heart_rate.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("stored %d records, want 2", len(recs))
+	}
+}
+
+func TestIngestBatchResendSkipsStoredReadingsAndAudio(t *testing.T) {
+	setupIngestTest(t)
+	chunk := func(seq int) string {
+		return fmt.Sprintf(`{"clinic_name":"North","patient_name":"Ann","type":"stream","stream_type":"audio",`+
+			`"session_id":"s1","seq":%d,"sample_rate":8000,"data":[1,2,3,4]}`, seq)
+	}
+	body := []byte("[" + spo2Reading(1, 97) + "," + chunk(2) + "," + chunk(3) + "]")
+
+	for pass := 0; pass < 2; pass++ {
+		out := decodeBatch(t, postBatch(t, body, "application/json", false))
+		if out.Accepted != 3 || out.Rejected != 0 {
+			t.Fatalf("pass %d: accepted %d rejected %d, want 3 and 0", pass, out.Accepted, out.Rejected)
+		}
+	}
+
+	recs, err := readRecords("North", "Ann", "heart_rate.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 {
+		t.Fatalf("stored %d records, want 1", len(recs))
+	}
+	pdir, err := patientDir("North", "Ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(filepath.Join(pdir, auscultationDir, "s1.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(wavHeaderSize + 2*2*4); st.Size() != want {
+		t.Fatalf("recording is %d bytes, want %d (two chunks of four samples)", st.Size(), want)
+	}
+
+	// A later chunk of the same session is still appended
+	decodeBatch(t, postBatch(t, []byte("["+chunk(4)+"]"), "application/json", false))
+	st, err = os.Stat(filepath.Join(pdir, auscultationDir, "s1.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(wavHeaderSize + 3*2*4); st.Size() != want {
+		t.Fatalf("recording is %d bytes, want %d", st.Size(), want)
+	}
+}
+
+func TestIngestBatchLimits(t *testing.T) {
+	setupIngestTest(t)
+
+	items := strings.TrimSuffix(strings.Repeat("{},", maxBatchItems+1), ",")
+	rec := postBatch(t, []byte("["+items+"]"), "application/json", false)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("%d items: status = %d, want 413", maxBatchItems+1, rec.Code)
+	}
+
+	// The byte limit applies after decompression
+	huge := append([]byte("["), bytes.Repeat([]byte(" "), maxBatchBytes+1)...)
+	rec = postBatch(t, append(huge, ']'), "application/json", true)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized body: status = %d, want 413", rec.Code)
+	}
+
+	// Invalid lines, so the test does not store thousands of readings
+	lines := strings.Repeat("x\n", maxBatchItems+1)
+	rec = postBatch(t, []byte(lines), "application/x-ndjson", true)
+	sc := bufio.NewScanner(rec.Body)
+	var last batchResult
+	n := 0
+	for sc.Scan() {
+		if err := json.Unmarshal(sc.Bytes(), &last); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != maxBatchItems+1 || last.Status != http.StatusRequestEntityTooLarge || last.Index != maxBatchItems {
+		t.Fatalf("NDJSON over the item limit: %d results, last %+v", n, last)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/ingest/batch", strings.NewReader("[]"))
+	req.Header.Set("Content-Encoding", "br")
+	rec = httptest.NewRecorder()
+	handleIngestBatch(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("Content-Encoding br: status = %d, want 415", rec.Code)
+	}
+}
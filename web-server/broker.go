@@ -0,0 +1,222 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Each stream subscriber gets its own bounded queue and writer goroutine so
+// a slow viewer only ever delays (and drops) its own frames.
+const (
+	subscriberQueueSize      = 8
+	subscriberAudioQueueSize = 32
+	subscriberWriteWait      = 5 * time.Second
+)
+
+// Binary frames on the feed and on tagged stream subscriptions start with a
+// kind byte. Untagged subscribers (the original protocol) receive bare JPEGs.
+const (
+	frameKindVideo byte = 0x01
+	frameKindAudio byte = 0x02
+)
+
+// splitFrame separates a feed frame into its kind and payload. Desktops
+// predating tagged frames send bare JPEGs, which start with 0xFF.
+func splitFrame(msg []byte) (byte, []byte) {
+	if len(msg) == 0 || msg[0] == 0xFF {
+		return frameKindVideo, msg
+	}
+	return msg[0], msg[1:]
+}
+
+type queuedFrame struct {
+	data []byte
+	at   time.Time
+}
+
+type subscriber struct {
+	key         string
+	remote      string
+	conn        *websocket.Conn
+	tagged      bool // wants kind-tagged frames, including audio
+	send        chan queuedFrame
+	audio       chan queuedFrame
+	done        chan struct{}
+	connectedAt time.Time
+
+	framesSent    atomic.Uint64
+	framesDropped atomic.Uint64
+	lastLag       atomic.Int64 // ns between enqueue and write of the last frame sent
+}
+
+func newSubscriber(key string, conn *websocket.Conn, remote string, tagged bool) *subscriber {
+	return &subscriber{
+		key:         key,
+		remote:      remote,
+		conn:        conn,
+		tagged:      tagged,
+		send:        make(chan queuedFrame, subscriberQueueSize),
+		audio:       make(chan queuedFrame, subscriberAudioQueueSize),
+		done:        make(chan struct{}),
+		connectedAt: time.Now(),
+	}
+}
+
+// enqueue never blocks: when the queue is full the oldest frame is dropped
+// to make room, since a viewer only cares about the most recent image.
+func (s *subscriber) enqueue(frame []byte) {
+	s.push(s.send, frame)
+}
+
+// enqueueAudio uses a deeper queue than video; audio has already been
+// paced by the stream's jitter buffer.
+func (s *subscriber) enqueueAudio(frame []byte) {
+	s.push(s.audio, frame)
+}
+
+func (s *subscriber) push(q chan queuedFrame, frame []byte) {
+	f := queuedFrame{data: frame, at: time.Now()}
+	for {
+		select {
+		case q <- f:
+			return
+		default:
+		}
+		select {
+		case <-q:
+			s.framesDropped.Add(1)
+			streamFramesDropped.inc()
+		default:
+		}
+	}
+}
+
+func (s *subscriber) writeLoop() {
+	defer s.conn.Close()
+	for {
+		var f queuedFrame
+		select {
+		case <-s.done:
+			return
+		case f = <-s.audio:
+		case f = <-s.send:
+		}
+		_ = s.conn.SetWriteDeadline(time.Now().Add(subscriberWriteWait))
+		if err := s.conn.WriteMessage(websocket.BinaryMessage, f.data); err != nil {
+			slog.Info("Stream subscriber write failed", "stream", s.key, "remote", s.remote, "err", err)
+			return
+		}
+		s.framesSent.Add(1)
+		streamFramesSent.inc()
+		s.lastLag.Store(int64(time.Since(f.at)))
+	}
+}
+
+func (s *subscriber) close() {
+	close(s.done)
+}
+
+func addSubscriber(s *subscriber) {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	if streams[s.key] == nil {
+		streams[s.key] = make(map[*subscriber]bool)
+	}
+	streams[s.key][s] = true
+}
+
+// removeSubscriber unregisters s and reports how many subscribers remain
+// across all streams.
+func removeSubscriber(s *subscriber) int {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	if m := streams[s.key]; m != nil {
+		delete(m, s)
+		if len(m) == 0 {
+			delete(streams, s.key)
+		}
+	}
+	remaining := 0
+	for _, m := range streams {
+		remaining += len(m)
+	}
+	return remaining
+}
+
+// broadcastFrame relays one JPEG to every viewer of the stream.
+func broadcastFrame(key string, frame []byte) {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	var tagged []byte
+	for s := range streams[key] {
+		if !s.tagged {
+			s.enqueue(frame)
+			continue
+		}
+		if tagged == nil {
+			tagged = append([]byte{frameKindVideo}, frame...)
+		}
+		s.enqueue(tagged)
+	}
+}
+
+// broadcastAudio relays an already tagged audio frame to tagged viewers.
+func broadcastAudio(key string, frame []byte) {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	for s := range streams[key] {
+		if s.tagged {
+			s.enqueueAudio(frame)
+		}
+	}
+}
+
+// --- Admin: subscriber stats ---
+
+type subscriberStats struct {
+	Stream        string    `json:"stream"`
+	Remote        string    `json:"remote"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	FramesSent    uint64    `json:"frames_sent"`
+	FramesDropped uint64    `json:"frames_dropped"`
+	Queued        int       `json:"queued"`
+	LagMillis     int64     `json:"lag_ms"`
+}
+
+func handleAdminStreams(w http.ResponseWriter, r *http.Request) {
+	if preflight(w, r) {
+		return
+	}
+	if !authorize(w, r, PermAdmin, "") {
+		return
+	}
+	streamsMu.Lock()
+	stats := []subscriberStats{}
+	for key, m := range streams {
+		for s := range m {
+			stats = append(stats, subscriberStats{
+				Stream:        key,
+				Remote:        s.remote,
+				ConnectedAt:   s.connectedAt,
+				FramesSent:    s.framesSent.Load(),
+				FramesDropped: s.framesDropped.Load(),
+				Queued:        len(s.send) + len(s.audio),
+				LagMillis:     time.Duration(s.lastLag.Load()).Milliseconds(),
+			})
+		}
+	}
+	streamsMu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Stream != stats[j].Stream {
+			return stats[i].Stream < stats[j].Stream
+		}
+		return stats[i].ConnectedAt.Before(stats[j].ConnectedAt)
+	})
+	writeJSON(w, stats)
+}
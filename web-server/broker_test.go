@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSlowSubscriberDropsOldestFrames(t *testing.T) {
+	const key = "North|broker-slow"
+	slow := newSubscriber(key, nil, "slow", false)
+	fast := newSubscriber(key, nil, "fast", false)
+	addSubscriber(slow)
+	addSubscriber(fast)
+	defer removeSubscriber(slow)
+	defer removeSubscriber(fast)
+
+	total := subscriberQueueSize + 5
+	for i := 0; i < total; i++ {
+		// fast keeps up: its writer takes every frame as it comes
+		broadcastFrame(key, []byte{0xFF, byte(i)})
+		if f := <-fast.send; f.data[1] != byte(i) {
+			t.Fatalf("fast subscriber got frame %d, want %d", f.data[1], i)
+		}
+	}
+
+	if len(slow.send) != subscriberQueueSize {
+		t.Fatalf("slow queue holds %d frames, want %d", len(slow.send), subscriberQueueSize)
+	}
+	if got := slow.framesDropped.Load(); got != 5 {
+		t.Fatalf("slow subscriber dropped %d frames, want 5", got)
+	}
+	// What is left is the most recent frames, in order
+	for i := total - subscriberQueueSize; i < total; i++ {
+		if f := <-slow.send; f.data[1] != byte(i) {
+			t.Fatalf("slow subscriber got frame %d, want %d", f.data[1], i)
+		}
+	}
+	if fast.framesDropped.Load() != 0 {
+		t.Fatal("fast subscriber lost frames to the slow one")
+	}
+}
+
+func TestBroadcastTagsFramesForTaggedSubscribers(t *testing.T) {
+	const key = "North|broker-tagged"
+	plain := newSubscriber(key, nil, "plain", false)
+	tagged := newSubscriber(key, nil, "tagged", true)
+	other := newSubscriber("South|broker-tagged", nil, "other", true)
+	for _, s := range []*subscriber{plain, tagged, other} {
+		addSubscriber(s)
+		defer removeSubscriber(s)
+	}
+
+	jpeg := []byte{0xFF, 0xD8, 0x01}
+	broadcastFrame(key, jpeg)
+	audio := []byte{frameKindAudio, 0x40, 0x1F, 0, 0}
+	broadcastAudio(key, audio)
+
+	if f := <-plain.send; !bytes.Equal(f.data, jpeg) {
+		t.Fatalf("untagged subscriber got % x, want the bare JPEG", f.data)
+	}
+	if len(plain.audio) != 0 {
+		t.Fatal("untagged subscriber was sent audio")
+	}
+	if f := <-tagged.send; !bytes.Equal(f.data, append([]byte{frameKindVideo}, jpeg...)) {
+		t.Fatalf("tagged subscriber got % x, want a video-tagged JPEG", f.data)
+	}
+	if f := <-tagged.audio; !bytes.Equal(f.data, audio) {
+		t.Fatalf("tagged subscriber got audio % x", f.data)
+	}
+	if len(other.send)+len(other.audio) != 0 {
+		t.Fatal("subscriber of another stream got frames")
+	}
+}
+
+func TestSplitFrame(t *testing.T) {
+	tests := []struct {
+		msg  []byte
+		kind byte
+		rest []byte
+	}{
+		{[]byte{0xFF, 0xD8}, frameKindVideo, []byte{0xFF, 0xD8}}, // legacy bare JPEG
+		{[]byte{frameKindVideo, 0xFF, 0xD8}, frameKindVideo, []byte{0xFF, 0xD8}},
+		{[]byte{frameKindAudio, 1, 2}, frameKindAudio, []byte{1, 2}},
+		{nil, frameKindVideo, nil},
+	}
+	for _, tc := range tests {
+		kind, rest := splitFrame(tc.msg)
+		if kind != tc.kind || !bytes.Equal(rest, tc.rest) {
+			t.Errorf("splitFrame(% x) = %d, % x; want %d, % x", tc.msg, kind, rest, tc.kind, tc.rest)
+		}
+	}
+}
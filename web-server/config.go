@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Settings come from, in increasing priority: built-in defaults, a JSON
+// config file (-config or MEDICART_CONFIG), MEDICART_* environment variables
+// and command-line flags. Secrets (MEDICART_JWT_SECRET, MEDICART_STORAGE_KEY,
+// MEDICART_AUDIT_KEY) stay environment-only so they never end up in a
+// printed config.
+
+type Config struct {
+	Listen          string          `json:"listen"`
+	AllowedOrigins  []string        `json:"allowed_origins"` // empty: same origin only; "*" allows any
+	Storage         StorageConfig   `json:"storage"`
+	TLS             TLSConfig       `json:"tls"`
+	Auth            AuthConfig      `json:"auth"`
+	AuditFile       string          `json:"audit_file"`
+	AuditKeyFile    string          `json:"audit_key_file"`   // chain key; MEDICART_AUDIT_KEY overrides
+	ShutdownTimeout Duration        `json:"shutdown_timeout"` // drain time on SIGINT/SIGTERM
+	LogFormat       string          `json:"log_format"`       // text or json
+	LogLevel        string          `json:"log_level"`        // debug, info, warn or error
+	Retention       RetentionConfig `json:"retention"`
+	Alerts          AlertThresholds `json:"alerts"`
+	Outbox          OutboxConfig    `json:"outbox"`
+	FHIR            FHIRConfig      `json:"fhir"`
+	HL7             HL7Config       `json:"hl7"`
+}
+
+type StorageConfig struct {
+	Backend string `json:"backend"` // only "fs" for now
+	Path    string `json:"path"`
+	KeyFile string `json:"key_file,omitempty"` // enables encryption at rest
+}
+
+type TLSConfig struct {
+	Cert     string `json:"cert,omitempty"`
+	Key      string `json:"key,omitempty"`
+	ClientCA string `json:"client_ca,omitempty"`
+}
+
+type AuthConfig struct {
+	APIKeysFile   string   `json:"api_keys_file"`
+	UsersFile     string   `json:"users_file"`
+	JWTSecretFile string   `json:"jwt_secret_file"`
+	TokenTTL      Duration `json:"token_ttl"`
+}
+
+// RetentionConfig maps a metric ("heart_rate", "bp", "glucose",
+// "temperature", "stethoscope", "auscultation", "misc") to the number of
+// days to keep it. Missing or 0 means keep forever.
+type RetentionConfig struct {
+	Days     map[string]int            `json:"days,omitempty"`
+	Clinics  map[string]map[string]int `json:"clinics,omitempty"` // per-clinic overrides
+	Mode     string                    `json:"mode"`              // archive or delete expired data
+	Interval Duration                  `json:"interval"`          // between purge runs
+}
+
+// AlertThresholds mark a reading as abnormal when it falls outside
+// [min, max]. Glucose is in mg/dL, temperature in °C.
+type AlertThresholds struct {
+	SpO2Min      float64 `json:"spo2_min"`
+	PulseMin     float64 `json:"pulse_min"`
+	PulseMax     float64 `json:"pulse_max"`
+	SystolicMin  float64 `json:"systolic_min"`
+	SystolicMax  float64 `json:"systolic_max"`
+	DiastolicMin float64 `json:"diastolic_min"`
+	DiastolicMax float64 `json:"diastolic_max"`
+	GlucoseMin   float64 `json:"glucose_min"`
+	GlucoseMax   float64 `json:"glucose_max"`
+	TempMin      float64 `json:"temp_min"`
+	TempMax      float64 `json:"temp_max"`
+}
+
+// OutboxConfig controls retries of outbound deliveries (FHIR push, ...).
+type OutboxConfig struct {
+	MaxAttempts int      `json:"max_attempts"` // then the job is marked failed
+	RetryMin    Duration `json:"retry_min"`
+	RetryMax    Duration `json:"retry_max"`
+}
+
+// FHIRConfig enables pushing new readings to a FHIR server.
+type FHIRConfig struct {
+	URL       string   `json:"url,omitempty"`        // base URL; empty disables push
+	TokenFile string   `json:"token_file,omitempty"` // bearer token, re-read per request
+	CAFile    string   `json:"ca_file,omitempty"`    // private CA for the server's certificate
+	Timeout   Duration `json:"timeout"`
+	Clinics   []string `json:"clinics,omitempty"` // only these clinics; empty means all
+}
+
+// HL7Config sends ORU^R01 messages over MLLP to per-clinic destinations.
+type HL7Config struct {
+	SendingApplication string           `json:"sending_application"` // MSH-3
+	SendingFacility    string           `json:"sending_facility"`    // MSH-4
+	Destinations       []HL7Destination `json:"destinations,omitempty"`
+}
+
+type HL7Destination struct {
+	Name                 string   `json:"name"`    // outbox sink "hl7-{name}"
+	Clinics              []string `json:"clinics"` // clinics whose readings go here
+	Addr                 string   `json:"addr"`    // host:port of the MLLP listener
+	ReceivingApplication string   `json:"receiving_application,omitempty"`
+	ReceivingFacility    string   `json:"receiving_facility,omitempty"`
+	TLS                  bool     `json:"tls,omitempty"`
+	CAFile               string   `json:"ca_file,omitempty"`
+	Timeout              Duration `json:"timeout,omitempty"` // per message incl. ACK; default 10s
+}
+
+// Duration reads and prints as a Go duration string ("12h").
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// retentionMetrics are the metric names retention settings may refer to.
+var retentionMetrics = map[string]bool{
+	"heart_rate": true, "bp": true, "glucose": true, "temperature": true,
+	"stethoscope": true, "auscultation": true, "misc": true,
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Listen:         ":8081",
+		AllowedOrigins: []string{},
+		Storage:        StorageConfig{Backend: "fs", Path: "data"},
+		Auth: AuthConfig{
+			APIKeysFile:   "api_keys.json",
+			UsersFile:     "users.json",
+			JWTSecretFile: "jwt_secret",
+			TokenTTL:      Duration(12 * time.Hour),
+		},
+		AuditFile:       "audit.log",
+		AuditKeyFile:    "audit_key",
+		ShutdownTimeout: Duration(15 * time.Second),
+		LogFormat:       "text",
+		LogLevel:        "info",
+		Retention:       RetentionConfig{Mode: "archive", Interval: Duration(24 * time.Hour)},
+		Alerts: AlertThresholds{
+			SpO2Min:  92,
+			PulseMin: 50, PulseMax: 120,
+			SystolicMin: 90, SystolicMax: 180,
+			DiastolicMin: 50, DiastolicMax: 110,
+			GlucoseMin: 70, GlucoseMax: 180,
+			TempMin: 35.5, TempMax: 38.0,
+		},
+		Outbox: OutboxConfig{
+			MaxAttempts: 10,
+			RetryMin:    Duration(5 * time.Second),
+			RetryMax:    Duration(10 * time.Minute),
+		},
+		FHIR: FHIRConfig{Timeout: Duration(10 * time.Second)},
+		HL7:  HL7Config{SendingApplication: "MEDICART", SendingFacility: "MEDICART"},
+	}
+}
+
+// loadConfig builds the configuration from args (os.Args[1:]) and returns
+// the arguments left after the flags, which name an admin command if any.
+func loadConfig(args []string) (Config, []string, bool, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("web-server", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("MEDICART_CONFIG"), "JSON config file")
+	printOnly := fs.Bool("print-config", false, "print the effective configuration and exit")
+	listen := fs.String("listen", "", "listen address, e.g. :8081")
+	dataPath := fs.String("data", "", "data directory")
+	origins := fs.String("allowed-origins", "", "comma-separated dashboard origins, or *")
+	keyFilePath := fs.String("keyfile", "", "encryption keyring file")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate (PEM)")
+	tlsKey := fs.String("tls-key", "", "TLS private key (PEM)")
+	tlsClientCA := fs.String("tls-client-ca", "", "CA for desktop client certificates (PEM)")
+	auditPath := fs.String("audit-file", "", "audit log file")
+	logFormat := fs.String("log-format", "", "text or json")
+	logLevel := fs.String("log-level", "", "debug, info, warn or error")
+	fhirURL := fs.String("fhir-url", "", "FHIR server base URL to push readings to")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: web-server [flags] [admin command]\n\nflags:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nadmin commands:\n%s", strings.TrimPrefix(adminUsage, "usage:\n"))
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, false, err
+	}
+
+	if *configPath != "" {
+		b, err := os.ReadFile(*configPath)
+		if err != nil {
+			return cfg, nil, false, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return cfg, nil, false, fmt.Errorf("%s: %w", *configPath, err)
+		}
+	}
+
+	// Environment, then flags
+	setString := func(dst *string, env, flagVal string) {
+		if v := os.Getenv(env); v != "" {
+			*dst = v
+		}
+		if flagVal != "" {
+			*dst = flagVal
+		}
+	}
+	setString(&cfg.Listen, "MEDICART_LISTEN", *listen)
+	setString(&cfg.Storage.Path, "MEDICART_DATA_DIR", *dataPath)
+	setString(&cfg.Storage.KeyFile, "MEDICART_KEYFILE", *keyFilePath)
+	setString(&cfg.TLS.Cert, "MEDICART_TLS_CERT", *tlsCert)
+	setString(&cfg.TLS.Key, "MEDICART_TLS_KEY", *tlsKey)
+	setString(&cfg.TLS.ClientCA, "MEDICART_TLS_CLIENT_CA", *tlsClientCA)
+	setString(&cfg.AuditFile, "MEDICART_AUDIT_FILE", *auditPath)
+	setString(&cfg.LogFormat, "MEDICART_LOG_FORMAT", *logFormat)
+	setString(&cfg.LogLevel, "MEDICART_LOG_LEVEL", *logLevel)
+	setString(&cfg.FHIR.URL, "MEDICART_FHIR_URL", *fhirURL)
+	var originList string
+	setString(&originList, "MEDICART_ALLOWED_ORIGINS", *origins)
+	if originList != "" {
+		cfg.AllowedOrigins = parseClinics(originList)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return cfg, nil, false, err
+	}
+	return cfg, fs.Args(), *printOnly, nil
+}
+
+func (c Config) validate() error {
+	var errs []error
+	if c.Listen == "" {
+		errs = append(errs, errors.New("listen must not be empty"))
+	}
+	if c.Storage.Backend != "fs" {
+		errs = append(errs, fmt.Errorf("storage.backend %q is not supported (use \"fs\")", c.Storage.Backend))
+	}
+	if c.Storage.Path == "" {
+		errs = append(errs, errors.New("storage.path must not be empty"))
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			continue
+		}
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			errs = append(errs, fmt.Errorf("allowed_origins: %q is not an origin like https://host[:port]", o))
+		}
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		errs = append(errs, errors.New("tls.cert and tls.key must be set together"))
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		errs = append(errs, errors.New("tls.client_ca requires tls.cert and tls.key"))
+	}
+	if c.Auth.APIKeysFile == "" || c.Auth.UsersFile == "" || c.Auth.JWTSecretFile == "" {
+		errs = append(errs, errors.New("auth file paths must not be empty"))
+	}
+	if c.Auth.TokenTTL < Duration(time.Minute) {
+		errs = append(errs, errors.New("auth.token_ttl must be at least 1m"))
+	}
+	if c.AuditFile == "" || c.AuditKeyFile == "" {
+		errs = append(errs, errors.New("audit_file and audit_key_file must not be empty"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("log_format %q must be text or json", c.LogFormat))
+	}
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("log_level %q must be debug, info, warn or error", c.LogLevel))
+	}
+	checkRetention := func(prefix string, days map[string]int) {
+		for m, d := range days {
+			if !retentionMetrics[m] {
+				errs = append(errs, fmt.Errorf("%s: unknown metric %q", prefix, m))
+			}
+			if d < 0 {
+				errs = append(errs, fmt.Errorf("%s.%s: days must not be negative", prefix, m))
+			}
+		}
+	}
+	checkRetention("retention.days", c.Retention.Days)
+	for clinic, days := range c.Retention.Clinics {
+		checkRetention("retention.clinics."+clinic, days)
+	}
+	if c.Retention.Mode != "archive" && c.Retention.Mode != "delete" {
+		errs = append(errs, fmt.Errorf("retention.mode %q must be archive or delete", c.Retention.Mode))
+	}
+	if c.Retention.Interval < Duration(time.Minute) {
+		errs = append(errs, errors.New("retention.interval must be at least 1m"))
+	}
+	a := c.Alerts
+	for _, r := range []struct {
+		name     string
+		min, max float64
+	}{
+		{"pulse", a.PulseMin, a.PulseMax},
+		{"systolic", a.SystolicMin, a.SystolicMax},
+		{"diastolic", a.DiastolicMin, a.DiastolicMax},
+		{"glucose", a.GlucoseMin, a.GlucoseMax},
+		{"temp", a.TempMin, a.TempMax},
+	} {
+		if r.min >= r.max {
+			errs = append(errs, fmt.Errorf("alerts: %s_min must be below %s_max", r.name, r.name))
+		}
+	}
+	if a.SpO2Min <= 0 || a.SpO2Min > 100 {
+		errs = append(errs, errors.New("alerts.spo2_min must be between 0 and 100"))
+	}
+	if c.Outbox.MaxAttempts < 1 {
+		errs = append(errs, errors.New("outbox.max_attempts must be at least 1"))
+	}
+	if c.Outbox.RetryMin <= 0 || c.Outbox.RetryMax < c.Outbox.RetryMin {
+		errs = append(errs, errors.New("outbox: need 0 < retry_min <= retry_max"))
+	}
+	if c.FHIR.URL != "" {
+		if u, err := url.Parse(c.FHIR.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("fhir.url: %q is not an http(s) URL", c.FHIR.URL))
+		}
+		if c.FHIR.Timeout <= 0 {
+			errs = append(errs, errors.New("fhir.timeout must be positive"))
+		}
+	}
+	names := map[string]bool{}
+	for i, d := range c.HL7.Destinations {
+		prefix := fmt.Sprintf("hl7.destinations[%d]", i)
+		if d.Name == "" || sanitizeID(d.Name) != d.Name || names[d.Name] {
+			errs = append(errs, fmt.Errorf("%s: name %q must be unique and use only letters, digits, - and _", prefix, d.Name))
+		}
+		names[d.Name] = true
+		if _, _, err := net.SplitHostPort(d.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("%s: addr %q must be host:port", prefix, d.Addr))
+		}
+		if len(d.Clinics) == 0 {
+			errs = append(errs, fmt.Errorf("%s: clinics must not be empty", prefix))
+		}
+		if d.CAFile != "" && !d.TLS {
+			errs = append(errs, fmt.Errorf("%s: ca_file needs tls", prefix))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// applyConfig points the package-level settings at the loaded config.
+func applyConfig(c Config) {
+	config = c
+	dataDir = c.Storage.Path
+	keyFile = c.Storage.KeyFile
+	tlsCertFile, tlsKeyFile, tlsClientCAFile = c.TLS.Cert, c.TLS.Key, c.TLS.ClientCA
+	apiKeysFile = c.Auth.APIKeysFile
+	usersFile = c.Auth.UsersFile
+	jwtSecretFile = c.Auth.JWTSecretFile
+	tokenTTL = time.Duration(c.Auth.TokenTTL)
+	auditFile = c.AuditFile
+	auditKeyFile = c.AuditKeyFile
+}
+
+func printConfig(c Config) {
+	b, _ := json.MarshalIndent(c, "", "  ")
+	fmt.Println(string(b))
+}
+
+// --- Origins ---
+
+func originAllowed(origin string) bool {
+	for _, o := range config.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin lets non-browser clients (no Origin header, e.g. desktops)
+// and pages served by this host through, and holds other browsers to the
+// allowed origins.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || originAllowed(origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Encryption at rest is enabled by pointing MEDICART_KEYFILE at a keyring
+// (created with `web-server storage init-key`), or by setting
+// MEDICART_STORAGE_KEY to a base64 32-byte key. Encrypted files are
+//
+//	"MCE1" | len(key id) | key id | 12-byte nonce | AES-256-GCM ciphertext
+//
+// with the file's path under data/ as additional data, so a file cannot be
+// moved to another patient's directory and still decrypt.
+//
+// Recordings grow a chunk at a time, so rather than re-sealing the whole
+// file per chunk they are stored as sealed segments, as are retention
+// archives, which are written as they are built:
+//
+//	"MCS1" | (uint32 length | sealed segment)...
+//
+// Each segment is sealed as above with the path and the segment's offset
+// as additional data, so segments cannot be moved, reordered or dropped
+// from the middle. A segment cut short by a crash ends the file.
+
+var keyFile string // Config.Storage.KeyFile
+
+var (
+	encMagic = []byte("MCE1")
+	segMagic = []byte("MCS1")
+)
+
+// errCorrupt marks data that is damaged, as opposed to unreadable because
+// of configuration (missing or unknown key).
+var errCorrupt = errors.New("corrupt data")
+
+type keyring struct {
+	Active string            `json:"active"`
+	IDKey  string            `json:"id_key"` // HMAC key for opaque directory ids; never rotated
+	Keys   map[string]string `json:"keys"`   // id -> base64 AES-256 key
+}
+
+var (
+	keyringMu      sync.Mutex
+	keyringCache   *keyring
+	keyringModTime time.Time
+)
+
+// loadKeyring returns the current keyring, or nil when encryption is off.
+// The keyfile is re-read when it changes so a rotation done with the admin
+// CLI is picked up by a running server.
+func loadKeyring() (*keyring, error) {
+	if env := os.Getenv("MEDICART_STORAGE_KEY"); env != "" && keyFile == "" {
+		keyringMu.Lock()
+		defer keyringMu.Unlock()
+		if keyringCache == nil {
+			raw, err := base64.StdEncoding.DecodeString(env)
+			if err != nil || len(raw) != 32 {
+				return nil, errors.New("MEDICART_STORAGE_KEY must be a base64 encoded 32-byte key")
+			}
+			mac := hmac.New(sha256.New, raw)
+			mac.Write([]byte("medicart directory ids"))
+			keyringCache = &keyring{
+				Active: "env",
+				IDKey:  base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+				Keys:   map[string]string{"env": env},
+			}
+		}
+		return keyringCache, nil
+	}
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	st, err := os.Stat(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("keyfile: %w", err)
+	}
+	if keyringCache != nil && st.ModTime().Equal(keyringModTime) {
+		return keyringCache, nil
+	}
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("keyfile: %w", err)
+	}
+	var kr keyring
+	if err := json.Unmarshal(b, &kr); err != nil {
+		return nil, fmt.Errorf("keyfile: %w", err)
+	}
+	if _, ok := kr.Keys[kr.Active]; !ok || kr.IDKey == "" {
+		return nil, errors.New("keyfile: active key or id_key missing")
+	}
+	keyringCache, keyringModTime = &kr, st.ModTime()
+	return keyringCache, nil
+}
+
+func saveKeyring(kr *keyring) error {
+	b, err := json.MarshalIndent(kr, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(keyFile, b, 0600); err != nil {
+		return err
+	}
+	keyringMu.Lock()
+	keyringCache = nil
+	keyringMu.Unlock()
+	return nil
+}
+
+func encryptionEnabled() bool {
+	kr, err := loadKeyring()
+	return err == nil && kr != nil
+}
+
+func randomKey() (string, error) {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(k), nil
+}
+
+// newKeyID names a data key after its creation time plus random bytes, so
+// keys created within the same second still get distinct ids.
+func newKeyID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "k" + time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b), nil
+}
+
+func (kr *keyring) aead(id string) (cipher.AEAD, error) {
+	enc, ok := kr.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", id)
+	}
+	raw, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("encryption key %q is not a 32-byte key", id)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (kr *keyring) encrypt(plaintext []byte, aad string) ([]byte, error) {
+	gcm, err := kr.aead(kr.Active)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(encMagic)
+	buf.WriteByte(byte(len(kr.Active)))
+	buf.WriteString(kr.Active)
+	buf.Write(nonce)
+	return gcm.Seal(buf.Bytes(), nonce, plaintext, []byte(aad)), nil
+}
+
+func isEncrypted(b []byte) bool {
+	return bytes.HasPrefix(b, encMagic) || bytes.HasPrefix(b, segMagic)
+}
+
+func segmentAAD(path string, off int) string {
+	return aadFor(path) + "@" + strconv.Itoa(off)
+}
+
+// sealSegment returns a length-prefixed segment to be written at offset off
+// of the segmented file at path.
+func (kr *keyring) sealSegment(plaintext []byte, path string, off int) ([]byte, error) {
+	sealed, err := kr.encrypt(plaintext, segmentAAD(path, off))
+	if err != nil {
+		return nil, err
+	}
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(sealed)))
+	return append(out, sealed...), nil
+}
+
+// segmentWriter seals what is written to it as segments of the file at
+// path, archiveSegmentSize bytes at a time, writing them to f. Close seals
+// the remainder; it does not close f.
+type segmentWriter struct {
+	kr   *keyring
+	f    io.Writer
+	path string
+	off  int
+	buf  []byte
+}
+
+const archiveSegmentSize = 1 << 20
+
+func newSegmentWriter(kr *keyring, f io.Writer, path string) (*segmentWriter, error) {
+	if _, err := f.Write(segMagic); err != nil {
+		return nil, err
+	}
+	return &segmentWriter{kr: kr, f: f, path: path, off: len(segMagic)}, nil
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= archiveSegmentSize {
+		if err := w.seal(archiveSegmentSize); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *segmentWriter) seal(n int) error {
+	seg, err := w.kr.sealSegment(w.buf[:n], w.path, w.off)
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Write(seg); err != nil {
+		return err
+	}
+	w.off += len(seg)
+	w.buf = append(w.buf[:0], w.buf[n:]...)
+	return nil
+}
+
+func (w *segmentWriter) Close() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	return w.seal(len(w.buf))
+}
+
+// openSegments decrypts a segmented file and returns the joined plaintext
+// and the offset just past the last complete segment.
+func (kr *keyring) openSegments(b []byte, path string) ([]byte, int, error) {
+	var out []byte
+	off := len(segMagic)
+	for off+4 <= len(b) {
+		n := int(binary.LittleEndian.Uint32(b[off:]))
+		if off+4+n > len(b) {
+			break // cut short
+		}
+		pt, err := kr.decrypt(b[off+4:off+4+n], segmentAAD(path, off))
+		if err != nil {
+			return nil, 0, err
+		}
+		out = append(out, pt...)
+		off += 4 + n
+	}
+	return out, off, nil
+}
+
+// sealedKeyIDs returns the ids of the keys a sealed file was written with,
+// as far as its headers can be read.
+func sealedKeyIDs(b []byte) []string {
+	id := func(sealed []byte) (string, bool) {
+		if len(sealed) < len(encMagic)+1 || !bytes.HasPrefix(sealed, encMagic) {
+			return "", false
+		}
+		n := int(sealed[len(encMagic)])
+		if len(sealed) < len(encMagic)+1+n {
+			return "", false
+		}
+		return string(sealed[len(encMagic)+1 : len(encMagic)+1+n]), true
+	}
+	if !bytes.HasPrefix(b, segMagic) {
+		if k, ok := id(b); ok {
+			return []string{k}
+		}
+		return nil
+	}
+	var ids []string
+	for off := len(segMagic); off+4 <= len(b); {
+		n := int(binary.LittleEndian.Uint32(b[off:]))
+		if off+4+n > len(b) {
+			break
+		}
+		if k, ok := id(b[off+4 : off+4+n]); ok {
+			ids = append(ids, k)
+		}
+		off += 4 + n
+	}
+	return ids
+}
+
+func (kr *keyring) decrypt(b []byte, aad string) ([]byte, error) {
+	if len(b) < len(encMagic)+1 {
+		return nil, fmt.Errorf("%w: truncated encrypted file", errCorrupt)
+	}
+	rest := b[len(encMagic):]
+	idLen := int(rest[0])
+	if len(rest) < 1+idLen {
+		return nil, fmt.Errorf("%w: truncated encrypted file", errCorrupt)
+	}
+	id := string(rest[1 : 1+idLen])
+	rest = rest[1+idLen:]
+	gcm, err := kr.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < gcm.NonceSize() {
+		return nil, fmt.Errorf("%w: truncated encrypted file", errCorrupt)
+	}
+	pt, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], []byte(aad))
+	if err != nil {
+		return nil, fmt.Errorf("%w: decrypt: %v", errCorrupt, err)
+	}
+	return pt, nil
+}
+
+// opaqueID maps a clinic or patient name to a stable directory name that
+// does not reveal the name.
+func (kr *keyring) opaqueID(kind, name string) string {
+	key, _ := base64.StdEncoding.DecodeString(kr.IDKey)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(kind + ":" + name))
+	return kind[:1] + "_" + hex.EncodeToString(mac.Sum(nil))[:24]
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useKeyFile turns encryption on with a fresh keyfile for the test.
+func useKeyFile(t *testing.T) {
+	t.Helper()
+	old := keyFile
+	keyFile = filepath.Join(t.TempDir(), "storage.key")
+	t.Cleanup(func() {
+		keyFile = old
+		keyringMu.Lock()
+		keyringCache = nil
+		keyringMu.Unlock()
+	})
+	if err := initKeyring(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sealedKeyID returns the id of the key a whole-file sealed file was
+// written with.
+func sealedKeyID(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, encMagic) {
+		t.Fatalf("%s is not sealed", path)
+	}
+	n := int(b[len(encMagic)])
+	return string(b[len(encMagic)+1 : len(encMagic)+1+n])
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	setupIngestTest(t)
+	useStorageKey(t)
+	storeReading(t, 0, map[string]interface{}{"temp": 37.2})
+
+	pdir, err := patientDir("North", "Ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(pdir) == "Ann" || filepath.Base(filepath.Dir(pdir)) == "North" {
+		t.Fatalf("directory %s reveals the names", pdir)
+	}
+	path := filepath.Join(pdir, "temperature.json")
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncrypted(raw) || bytes.Contains(raw, []byte("37.2")) {
+		t.Fatal("record stored in the clear")
+	}
+	recs, err := readRecords("North", "Ann", "temperature.json")
+	if err != nil || len(recs) != 1 || recs[0].RawData["temp"] != 37.2 {
+		t.Fatalf("read back %v, %v", recs, err)
+	}
+	if clinics, _ := listClinics(); len(clinics) != 1 || clinics[0] != "North" {
+		t.Fatalf("clinics = %v", clinics)
+	}
+
+	// The path is bound in: the same file under another patient fails
+	other, err := ensurePatientDir("North", "Bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := filepath.Join(other, "temperature.json")
+	if err := os.WriteFile(moved, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readDataFile(moved); !errors.Is(err, errCorrupt) {
+		t.Fatalf("moved file: err = %v, want errCorrupt", err)
+	}
+}
+
+func TestSegmentedFiles(t *testing.T) {
+	setupIngestTest(t)
+	useStorageKey(t)
+	kr, err := loadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dataDir, "archive.zip")
+	plain := bytes.Repeat([]byte("0123456789"), archiveSegmentSize/5) // two segments
+
+	var buf bytes.Buffer
+	w, err := newSegmentWriter(kr, &buf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(plain); i += 4096 {
+		if _, err := w.Write(plain[i:min(i+4096, len(plain))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	got, end, err := kr.openSegments(b, path)
+	if err != nil || end != len(b) || !bytes.Equal(got, plain) {
+		t.Fatalf("openSegments: %d of %d bytes, end %d of %d, %v", len(got), len(plain), end, len(b), err)
+	}
+
+	// A segment cut short by a crash ends the file
+	got, end, err = kr.openSegments(b[:len(b)-10], path)
+	if err != nil || len(got) != archiveSegmentSize || end >= len(b)-10 {
+		t.Fatalf("cut short: %d bytes, end %d, %v", len(got), end, err)
+	}
+	// Segments are bound to their path and offset
+	if _, _, err := kr.openSegments(b, path+".moved"); !errors.Is(err, errCorrupt) {
+		t.Fatalf("moved: err = %v, want errCorrupt", err)
+	}
+	first := 4 + int(binary.LittleEndian.Uint32(b[len(segMagic):]))
+	swapped := append(append(append([]byte{}, segMagic...), b[len(segMagic)+first:]...), b[len(segMagic):len(segMagic)+first]...)
+	if _, _, err := kr.openSegments(swapped, path); !errors.Is(err, errCorrupt) {
+		t.Fatalf("reordered: err = %v, want errCorrupt", err)
+	}
+}
+
+func TestRotateStorageKey(t *testing.T) {
+	setupIngestTest(t)
+	useKeyFile(t)
+	storeReading(t, 0, map[string]interface{}{"temp": 36.8})
+	if err := appendAudio("North", "Ann", "s1", 0, false, 8000, []int16{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := loadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdir, err := patientDir("North", "Ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(pdir, "temperature.json")
+	if id := sealedKeyID(t, path); id != before.Active {
+		t.Fatalf("sealed with %s, want %s", id, before.Active)
+	}
+
+	n, err := rotateStorageKey(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("no files re-encrypted")
+	}
+	after, err := loadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Active == before.Active || len(after.Keys) != 2 || after.IDKey != before.IDKey {
+		t.Fatalf("keyring after rotation: active %s (was %s), %d keys", after.Active, before.Active, len(after.Keys))
+	}
+	if id := sealedKeyID(t, path); id != after.Active {
+		t.Fatalf("sealed with %s after rotation, want %s", id, after.Active)
+	}
+	// Directory ids do not change, and everything still reads
+	if d, _ := patientDir("North", "Ann"); d != pdir {
+		t.Fatalf("patient directory moved to %s", d)
+	}
+	recs, err := readRecords("North", "Ann", "temperature.json")
+	if err != nil || len(recs) != 1 || recs[0].RawData["temp"] != 36.8 {
+		t.Fatalf("read back %v, %v", recs, err)
+	}
+	wav, err := readDataFile(filepath.Join(pdir, auscultationDir, "s1.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := readWAVInfo(bytes.NewReader(wav)); err != nil || info.Samples != 3 {
+		t.Fatalf("recording after rotation: %+v, %v", info, err)
+	}
+
+	if _, err := rotateStorageKey(true); err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := loadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned.Keys) != 1 || pruned.Keys[pruned.Active] == "" {
+		t.Fatalf("pruned keyring keeps %d keys", len(pruned.Keys))
+	}
+	if recs, err := readRecords("North", "Ann", "temperature.json"); err != nil || len(recs) != 1 {
+		t.Fatalf("read after prune: %v, %v", recs, err)
+	}
+}
+
+func TestMigrateToEncrypted(t *testing.T) {
+	setupIngestTest(t)
+	storeReading(t, 0, map[string]interface{}{"temp": 36.5})
+	plainDir := filepath.Join(dataDir, "North")
+
+	useStorageKey(t)
+	if n, err := migrateToEncrypted(); err != nil || n == 0 {
+		t.Fatalf("migrated %d files: %v", n, err)
+	}
+	if _, err := os.Stat(plainDir); !os.IsNotExist(err) {
+		t.Fatalf("plaintext directory left behind: %v", err)
+	}
+	recs, err := readRecords("North", "Ann", "temperature.json")
+	if err != nil || len(recs) != 1 || recs[0].RawData["temp"] != 36.5 {
+		t.Fatalf("read back %v, %v", recs, err)
+	}
+	if patients, _ := listPatients("North"); len(patients) != 1 || patients[0] != "Ann" {
+		t.Fatalf("patients = %v", patients)
+	}
+}
+
+func TestRotatePruneKeepsQuarantineKeys(t *testing.T) {
+	setupIngestTest(t)
+	useKeyFile(t)
+	storeReading(t, 0, map[string]interface{}{"temp": 36.8})
+	storeReading(t, 0, map[string]interface{}{"glu": 95.0})
+	old, err := loadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdir, err := patientDir("North", "Ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(pdir, "glucose.json")
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := quarantine(path, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rotateStorageKey(true); err != nil {
+		t.Fatal(err)
+	}
+	kr, err := loadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kr.Keys) != 2 || kr.Keys[old.Active] == "" {
+		t.Fatalf("pruned keyring dropped the quarantined file's key: %d keys", len(kr.Keys))
+	}
+	// The quarantined copy still opens with its original path
+	if b, err := kr.decrypt(sealed, aadFor(path)); err != nil || !bytes.Contains(b, []byte("95")) {
+		t.Fatalf("quarantined file: %v", err)
+	}
+}
+
+func TestMigrateRefusesStrayClinicFiles(t *testing.T) {
+	setupIngestTest(t)
+	storeReading(t, 0, map[string]interface{}{"temp": 36.5})
+	stray := filepath.Join(dataDir, "North", "notes.txt")
+	if err := os.WriteFile(stray, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	useStorageKey(t)
+	if n, err := migrateToEncrypted(); err == nil || n != 0 {
+		t.Fatalf("migrated %d files with a stray file present: %v", n, err)
+	}
+	if b, err := os.ReadFile(stray); err != nil || string(b) != "keep me" {
+		t.Fatalf("stray file: %q, %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "North", "Ann", "temperature.json")); err != nil {
+		t.Fatal("patient data moved despite the refusal")
+	}
+}
+
+func TestRemoveEmptyDirsKeepsFiles(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "North")
+	if err := os.MkdirAll(filepath.Join(root, "Ann", "auscultation"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "Ann", "left.json"), []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeEmptyDirs(root); err == nil {
+		t.Fatal("removed a directory that holds a file")
+	}
+	if _, err := os.Stat(filepath.Join(root, "Ann", "left.json")); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(root, "Ann", "left.json"))
+	if err := removeEmptyDirs(root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Fatalf("empty tree left behind: %v", err)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spreadsheet exports. /api/clinic/{clinic}/patient/{patient}/export
+// returns one flat CSV for ?metric=, or a zip with a CSV per metric;
+// /api/clinic/{clinic}/export returns a zip with {patient}/{metric}.csv for
+// every patient. Both take from/to (RFC 3339, or a YYYY-MM-DD date in UTC).
+// Values come from the same mapping as the FHIR Observations, and the
+// flags (L/H/N) from Config.Alerts. Files start with a UTF-8 BOM and use
+// "YYYY-MM-DD hh:mm:ss" UTC times so Excel opens them as they are.
+
+type exportMetric struct {
+	name    string   // ?metric= value and file name
+	kind    string   // as named by observationsFor
+	unit    string   // as shown to people
+	columns []string // one per value or component
+}
+
+var exportMetrics = []exportMetric{
+	{"spo2", "spo2", "%", []string{"spo2"}},
+	{"pulse", "pulse", "beats/minute", []string{"pulse"}},
+	{"bp", "bp", "mmHg", []string{"systolic", "diastolic"}},
+	{"glucose", "glu", "mg/dL", []string{"glucose"}},
+	{"temperature", "temp", "°C", []string{"temperature"}},
+}
+
+func findExportMetric(name string) (exportMetric, bool) {
+	for _, m := range exportMetrics {
+		if m.name == name {
+			return m, true
+		}
+	}
+	return exportMetric{}, false
+}
+
+// parseRange reads ?from= and ?to=. A date as "to" includes that whole day.
+func parseRange(q url.Values) (from, to time.Time, err error) {
+	parse := func(s string, end bool) (time.Time, error) {
+		if t, err := time.Parse("2006-01-02", s); err == nil {
+			if end {
+				t = t.Add(24*time.Hour - time.Nanosecond)
+			}
+			return t, nil
+		}
+		return parseTimeParam(s)
+	}
+	if from, err = parse(q.Get("from"), false); err != nil {
+		return
+	}
+	to, err = parse(q.Get("to"), true)
+	return
+}
+
+// patientRecords returns the patient's vitals records between from and to
+// (zero for open ends), oldest first.
+func patientRecords(clinic, patient string, from, to time.Time) ([]Record, error) {
+	var out []Record
+	for file := range observationFiles {
+		recs, err := readRecords(clinic, patient, file)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range recs {
+			if (!from.IsZero() && rec.Timestamp.Before(from)) || (!to.IsZero() && rec.Timestamp.After(to)) {
+				continue
+			}
+			rec.ClinicName, rec.PatientName = clinic, patient
+			out = append(out, rec)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Timestamp.Before(out[j].Timestamp) })
+	return out, nil
+}
+
+// obsKind is the kind observationsFor put at the end of the identifier.
+func obsKind(o fhirObservation) string {
+	v := o.Identifier[0].Value
+	return v[strings.LastIndex(v, "/")+1:]
+}
+
+// obsValues returns the quantities of an Observation with the code each is
+// flagged against: the value, or the components in order.
+func obsValues(o fhirObservation) ([]fhirQuantity, []string) {
+	last := func(c fhirCodeableConcept) string { return c.Coding[len(c.Coding)-1].Code }
+	if o.ValueQuantity != nil {
+		return []fhirQuantity{*o.ValueQuantity}, []string{last(o.Code)}
+	}
+	var qs []fhirQuantity
+	var codes []string
+	for _, c := range o.Component {
+		qs = append(qs, c.ValueQuantity)
+		codes = append(codes, last(c.Code))
+	}
+	return qs, codes
+}
+
+// csvCell keeps text from being read as a formula by spreadsheets.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// writeMetricCSV writes a header and one row per reading of the metric.
+func writeMetricCSV(w io.Writer, m exportMetric, recs []Record) error {
+	if _, err := io.WriteString(w, "\ufeff"); err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	header := append([]string{"timestamp_utc", "session_id", "seq"}, m.columns...)
+	header = append(header, "unit")
+	for _, c := range m.columns {
+		header = append(header, c+"_flag")
+	}
+	_ = cw.Write(header)
+
+	for _, rec := range recs {
+		for _, o := range observationsFor("", rec) {
+			if obsKind(o) != m.kind {
+				continue
+			}
+			qs, codes := obsValues(o)
+			if len(qs) != len(m.columns) {
+				continue
+			}
+			session, _ := rec.RawData["session_id"].(string)
+			seq := ""
+			if v, ok := numField(rec.RawData, "seq"); ok {
+				seq = formatFloat(v)
+			}
+			row := []string{rec.Timestamp.UTC().Format("2006-01-02 15:04:05"), csvCell(session), seq}
+			for _, q := range qs {
+				row = append(row, formatFloat(q.Value))
+			}
+			row = append(row, qs[0].Unit)
+			for i, q := range qs {
+				row = append(row, abnormalFlag(codes[i], q.Value))
+			}
+			_ = cw.Write(row)
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func attachment(w http.ResponseWriter, contentType, filename string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+}
+
+// exportParams validates the query shared by both exports: metricParams
+// plus the format, which only csv is.
+func exportParams(w http.ResponseWriter, r *http.Request) (metrics []exportMetric, from, to time.Time, ok bool) {
+	if f := r.URL.Query().Get("format"); f != "" && f != "csv" {
+		http.Error(w, "Unsupported format (use csv)", http.StatusBadRequest)
+		return nil, from, to, false
+	}
+	return metricParams(w, r)
+}
+
+// metricParams reads metric, from and to, as taken by the exports and the
+// stats and series APIs. metrics is the requested metric, or all of them.
+func metricParams(w http.ResponseWriter, r *http.Request) (metrics []exportMetric, from, to time.Time, ok bool) {
+	q := r.URL.Query()
+	from, to, err := parseRange(q)
+	if err != nil {
+		http.Error(w, "from/to must be RFC 3339 timestamps or YYYY-MM-DD dates", http.StatusBadRequest)
+		return nil, from, to, false
+	}
+	metrics = exportMetrics
+	if name := q.Get("metric"); name != "" {
+		m, found := findExportMetric(name)
+		if !found {
+			http.Error(w, "Unknown metric (spo2, pulse, bp, glucose, temperature)", http.StatusBadRequest)
+			return nil, from, to, false
+		}
+		metrics = []exportMetric{m}
+	}
+	return metrics, from, to, true
+}
+
+// exportZip adds {prefix}{metric}.csv for each metric.
+func exportZip(zw *zip.Writer, prefix string, metrics []exportMetric, recs []Record) error {
+	for _, m := range metrics {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: prefix + m.name + ".csv", Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		if err := writeMetricCSV(f, m, recs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func handlePatientExport(w http.ResponseWriter, r *http.Request, clinic, patient string) {
+	if preflight(w, r) {
+		return
+	}
+	metrics, from, to, ok := exportParams(w, r)
+	if !ok {
+		return
+	}
+	recs, err := patientRecords(clinic, patient, from, to)
+	if err != nil {
+		audit(r, "export", clinic, patient, OutcomeError, err.Error())
+		http.Error(w, "Failed to read patient data", http.StatusInternalServerError)
+		return
+	}
+	audit(r, "export", clinic, patient, OutcomeOK, r.URL.RawQuery)
+
+	base := safePathName(patient)
+	if len(metrics) == 1 {
+		attachment(w, "text/csv; charset=utf-8", base+"_"+metrics[0].name+".csv")
+		if err := writeMetricCSV(w, metrics[0], recs); err != nil {
+			logFor(r).Warn("Writing export failed", "err", err)
+		}
+		return
+	}
+	attachment(w, "application/zip", base+".zip")
+	zw := zip.NewWriter(w)
+	err = exportZip(zw, "", metrics, recs)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		logFor(r).Warn("Writing export failed", "err", err)
+	}
+}
+
+func handleClinicExport(w http.ResponseWriter, r *http.Request, clinic string) {
+	if preflight(w, r) {
+		return
+	}
+	metrics, from, to, ok := exportParams(w, r)
+	if !ok {
+		return
+	}
+	patients, err := listPatients(clinic)
+	if err != nil {
+		audit(r, "export", clinic, "", OutcomeError, err.Error())
+		http.Error(w, "Failed to list patients", http.StatusInternalServerError)
+		return
+	}
+
+	attachment(w, "application/zip", safePathName(clinic)+".zip")
+	zw := zip.NewWriter(w)
+	// A patient whose data cannot be read is left out and listed in
+	// errors.txt; the others are still exported.
+	var skipped []string
+	for _, p := range patients {
+		recs, err := patientRecords(clinic, p, from, to)
+		if err != nil {
+			logFor(r).Error("Reading patient for clinic export failed", "patient", p, "err", err)
+			skipped = append(skipped, p)
+			continue
+		}
+		if err := exportZip(zw, safePathName(p)+"/", metrics, recs); err != nil {
+			// Headers are gone; a truncated zip tells the client something broke
+			logFor(r).Error("Writing clinic export failed", "patient", p, "err", err)
+			audit(r, "export", clinic, "", OutcomeError, err.Error())
+			return
+		}
+	}
+	outcome, detail := OutcomeOK, strconv.Itoa(len(patients))+" patients "+r.URL.RawQuery
+	if len(skipped) > 0 {
+		outcome = OutcomeError
+		detail += "; unreadable: " + strings.Join(skipped, ", ")
+		err = writeExportErrors(zw, skipped)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		logFor(r).Warn("Writing export failed", "err", err)
+	}
+	audit(r, "export", clinic, "", outcome, detail)
+}
+
+// writeExportErrors adds errors.txt naming the patients left out.
+func writeExportErrors(zw *zip.Writer, patients []string) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "errors.txt", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	for _, p := range patients {
+		if _, err := io.WriteString(f, p+": data could not be read; see the server log\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readCSV parses an export, which must start with a UTF-8 BOM.
+func readCSV(t *testing.T, b []byte) [][]string {
+	t.Helper()
+	rest, ok := bytes.CutPrefix(b, []byte("\ufeff"))
+	if !ok {
+		t.Fatal("export does not start with a BOM")
+	}
+	rows, err := csv.NewReader(bytes.NewReader(rest)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestCSVCellEscapesFormulas(t *testing.T) {
+	tests := map[string]string{
+		"=HYPERLINK(\"x\")": "'=HYPERLINK(\"x\")",
+		"+1":                "'+1",
+		"-2+3":              "'-2+3",
+		"@SUM(A1)":          "'@SUM(A1)",
+		"\tcmd":             "'\tcmd",
+		"\rcmd":             "'\rcmd",
+		"ward-3":            "ward-3",
+		"s1":                "s1",
+		"":                  "",
+	}
+	for in, want := range tests {
+		if got := csvCell(in); got != want {
+			t.Errorf("csvCell(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestWriteMetricCSV(t *testing.T) {
+	setupIngestTest(t) // default alert thresholds
+	at := time.Date(2026, 3, 1, 9, 30, 5, 0, time.FixedZone("CET", 3600))
+	recs := []Record{
+		{Timestamp: at, RawData: map[string]interface{}{"sys": 190.0, "dia": 80.0, "pr": 70.0, "session_id": "=cmd", "seq": 3.0}},
+		{Timestamp: at.Add(time.Minute), RawData: map[string]interface{}{"sys": 85.0}}, // no diastolic: not a BP reading
+		{Timestamp: at.Add(2 * time.Minute), RawData: map[string]interface{}{"temp": 37.0}},
+	}
+	bp, _ := findExportMetric("bp")
+	var buf bytes.Buffer
+	if err := writeMetricCSV(&buf, bp, recs); err != nil {
+		t.Fatal(err)
+	}
+	rows := readCSV(t, buf.Bytes())
+	want := [][]string{
+		{"timestamp_utc", "session_id", "seq", "systolic", "diastolic", "unit", "systolic_flag", "diastolic_flag"},
+		{"2026-03-01 08:30:05", "'=cmd", "3", "190", "80", "mmHg", "H", "N"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("rows = %q", rows)
+	}
+	for i := range want {
+		if strings.Join(rows[i], ",") != strings.Join(want[i], ",") {
+			t.Fatalf("row %d = %q, want %q", i, rows[i], want[i])
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	from, to, err := parseRange(url.Values{"from": {"2026-03-01"}, "to": {"2026-03-02"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !from.Equal(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("from = %v", from)
+	}
+	// A date as "to" takes in that whole day
+	if want := time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond); !to.Equal(want) {
+		t.Fatalf("to = %v, want %v", to, want)
+	}
+	from, to, err = parseRange(url.Values{"from": {"2026-03-01T10:00:00+01:00"}})
+	if err != nil || !from.Equal(time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)) || !to.IsZero() {
+		t.Fatalf("RFC 3339 from: %v %v %v", from, to, err)
+	}
+	if _, _, err := parseRange(url.Values{"to": {"01/03/2026"}}); err == nil {
+		t.Fatal("accepted a date in another format")
+	}
+}
+
+func TestPatientExport(t *testing.T) {
+	setupIngestTest(t)
+	at := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	for i, data := range []map[string]interface{}{
+		{"spo2": 97.0, "pr": 70.0},
+		{"temp": 36.6},
+		{"spo2": 90.0, "pr": 72.0},
+	} {
+		rec := Record{Timestamp: at.Add(time.Duration(i) * 24 * time.Hour), ClinicName: "North", PatientName: "Ann", RawData: data}
+		if err := saveRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	export := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handlePatientExport(w, httptest.NewRequest(http.MethodGet, "/export?"+query, nil), "North", "Ann")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d %s", query, w.Code, w.Body)
+		}
+		return w
+	}
+
+	// One metric is a flat CSV, limited to the range
+	w := export("metric=spo2&to=2026-03-01")
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, "Ann_spo2.csv") {
+		t.Fatalf("Content-Disposition = %q", cd)
+	}
+	if rows := readCSV(t, w.Body.Bytes()); len(rows) != 2 || rows[1][3] != "97" || rows[1][5] != "N" {
+		t.Fatalf("spo2 rows = %q", rows)
+	}
+
+	// Otherwise a zip with a CSV per metric
+	w = export("")
+	if ct := w.Header().Get("Content-Type"); ct != "application/zip" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][][]string{}
+	var names []string
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = readCSV(t, b)
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, ","); got != "bp.csv,glucose.csv,pulse.csv,spo2.csv,temperature.csv" {
+		t.Fatalf("zip holds %s", got)
+	}
+	if rows := files["spo2.csv"]; len(rows) != 3 || rows[2][3] != "90" || rows[2][5] != "L" {
+		t.Fatalf("spo2 rows = %q", rows)
+	}
+	if rows := files["bp.csv"]; len(rows) != 1 {
+		t.Fatalf("bp rows = %q", rows)
+	}
+}
+
+func TestClinicExportSkipsUnreadablePatient(t *testing.T) {
+	setupIngestTest(t)
+	setupAuditTest(t)
+	at := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	for _, patient := range []string{"Ann", "Bob", "Cy"} {
+		rec := Record{Timestamp: at, ClinicName: "North", PatientName: patient, RawData: map[string]interface{}{"temp": 36.6}}
+		if err := saveRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pdir, err := patientDir("North", "Bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pdir, "temperature.json"), []byte("[{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handleClinicExport(w, adminRequest(http.MethodGet, "/export?metric=temperature"), "North")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d %s", w.Code, w.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(b)
+	}
+	if files["Ann/temperature.csv"] == "" || files["Cy/temperature.csv"] == "" {
+		t.Fatalf("patients after the unreadable one are missing: %v", keysOf(files))
+	}
+	if _, ok := files["Bob/temperature.csv"]; ok {
+		t.Fatal("unreadable patient exported")
+	}
+	if !strings.HasPrefix(files["errors.txt"], "Bob: ") {
+		t.Fatalf("errors.txt = %q", files["errors.txt"])
+	}
+
+	closeAuditLog()
+	log, err := os.ReadFile(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	var e AuditEntry
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Action != "export" || e.Outcome != OutcomeError || !strings.Contains(e.Detail, "Bob") {
+		t.Fatalf("audit entry %+v", e)
+	}
+}
+
+func keysOf(m map[string]string) []string {
+	var out []string
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A read-only FHIR R4 view of the stored records. Each patient directory is
+// a Patient and each reading an Observation coded with LOINC, by field:
+//
+//	spo2      SpO2 (59408-5)
+//	pr        pulse (8867-4)
+//	sys, dia  blood pressure panel (85354-9) with systolic (8480-6) and
+//	          diastolic (8462-4) components; cuff updates are skipped
+//	glu       blood glucose (2339-0) in mg/dL
+//	temp      body temperature (8310-5) in °C
+//
+// Patient ids are derived from the stored names and Observation ids from
+// the reading (see readingKey), so they stay the same across restarts, key
+// rotations and retention purges. Routes (GET, dashboard login required):
+//
+//	/fhir/metadata
+//	/fhir/Patient
+//	/fhir/Patient/{id}
+//	/fhir/Patient/{id}/$everything
+//	/fhir/Observation?patient={id}
+//	/fhir/Observation/{id}
+
+const (
+	fhirContentType = "application/fhir+json"
+	loincSystem     = "http://loinc.org"
+	ucumSystem      = "http://unitsofmeasure.org"
+	categorySystem  = "http://terminology.hl7.org/CodeSystem/observation-category"
+	patientIDSystem = "urn:medicart:patient" // identifier value: clinic/patient
+	readingIDSystem = "urn:medicart:reading" // identifier value: see readingKey
+)
+
+type fhirCoding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code"`
+	Display string `json:"display,omitempty"`
+}
+
+type fhirCodeableConcept struct {
+	Coding []fhirCoding `json:"coding,omitempty"`
+	Text   string       `json:"text,omitempty"`
+}
+
+type fhirQuantity struct {
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit"`
+	System string  `json:"system"`
+	Code   string  `json:"code"`
+}
+
+type fhirReference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+type fhirIdentifier struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+}
+
+type fhirPatient struct {
+	ResourceType         string           `json:"resourceType"`
+	ID                   string           `json:"id,omitempty"`
+	Identifier           []fhirIdentifier `json:"identifier"`
+	Name                 []fhirHumanName  `json:"name"`
+	ManagingOrganization *fhirReference   `json:"managingOrganization,omitempty"`
+}
+
+type fhirHumanName struct {
+	Text string `json:"text"`
+}
+
+type fhirObservation struct {
+	ResourceType      string                `json:"resourceType"`
+	ID                string                `json:"id,omitempty"`
+	Identifier        []fhirIdentifier      `json:"identifier,omitempty"`
+	Status            string                `json:"status"`
+	Category          []fhirCodeableConcept `json:"category"`
+	Code              fhirCodeableConcept   `json:"code"`
+	Subject           fhirReference         `json:"subject"`
+	EffectiveDateTime string                `json:"effectiveDateTime"`
+	ValueQuantity     *fhirQuantity         `json:"valueQuantity,omitempty"`
+	Component         []fhirComponent       `json:"component,omitempty"`
+}
+
+type fhirComponent struct {
+	Code          fhirCodeableConcept `json:"code"`
+	ValueQuantity fhirQuantity        `json:"valueQuantity"`
+}
+
+type fhirBundle struct {
+	ResourceType string            `json:"resourceType"`
+	Type         string            `json:"type"`
+	Total        *int              `json:"total,omitempty"`
+	Entry        []fhirBundleEntry `json:"entry"`
+}
+
+type fhirBundleEntry struct {
+	FullURL  string       `json:"fullUrl,omitempty"`
+	Resource interface{}  `json:"resource,omitempty"`
+	Search   *fhirSearch  `json:"search,omitempty"`
+	Request  *fhirRequest `json:"request,omitempty"`
+}
+
+type fhirRequest struct {
+	Method      string `json:"method"`
+	URL         string `json:"url"`
+	IfNoneExist string `json:"ifNoneExist,omitempty"`
+}
+
+type fhirSearch struct {
+	Mode string `json:"mode"`
+}
+
+// --- Mapping ---
+
+// fhirPatientID is a stable, opaque id for a clinic/patient pair.
+func fhirPatientID(clinic, patient string) string {
+	sum := sha256.Sum256([]byte(safe(clinic) + "/" + safe(patient)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func newFHIRPatient(clinic, patient string) fhirPatient {
+	return fhirPatient{
+		ResourceType:         "Patient",
+		ID:                   fhirPatientID(clinic, patient),
+		Identifier:           []fhirIdentifier{{System: patientIDSystem, Value: safe(clinic) + "/" + safe(patient)}},
+		Name:                 []fhirHumanName{{Text: patient}},
+		ManagingOrganization: &fhirReference{Display: clinic},
+	}
+}
+
+func loinc(code, display string) fhirCodeableConcept {
+	return fhirCodeableConcept{Coding: []fhirCoding{{System: loincSystem, Code: code, Display: display}}, Text: display}
+}
+
+func category(code, display string) []fhirCodeableConcept {
+	return []fhirCodeableConcept{{Coding: []fhirCoding{{System: categorySystem, Code: code, Display: display}}}}
+}
+
+func quantity(v float64, unit, code string) fhirQuantity {
+	return fhirQuantity{Value: v, Unit: unit, System: ucumSystem, Code: code}
+}
+
+var (
+	vitalSigns = category("vital-signs", "Vital Signs")
+	laboratory = category("laboratory", "Laboratory")
+
+	// The vital signs profile wants 2708-6 alongside the pulse oximetry code.
+	spo2Code = fhirCodeableConcept{Coding: []fhirCoding{
+		{System: loincSystem, Code: "2708-6", Display: "Oxygen saturation in Arterial blood"},
+		{System: loincSystem, Code: "59408-5", Display: "Oxygen saturation in Arterial blood by Pulse oximetry"},
+	}, Text: "SpO2"}
+	pulseCode     = loinc("8867-4", "Heart rate")
+	bpCode        = loinc("85354-9", "Blood pressure panel with all children optional")
+	systolicCode  = loinc("8480-6", "Systolic blood pressure")
+	diastolicCode = loinc("8462-4", "Diastolic blood pressure")
+	glucoseCode   = loinc("2339-0", "Glucose [Mass/volume] in Blood")
+	tempCode      = loinc("8310-5", "Body temperature")
+)
+
+// numField reads a numeric field, matching the key case-insensitively
+// like metricFile does.
+func numField(data map[string]interface{}, key string) (float64, bool) {
+	for k, v := range data {
+		if strings.EqualFold(k, key) {
+			f, ok := v.(float64)
+			return f, ok
+		}
+	}
+	return 0, false
+}
+
+// readingKey identifies the reading a record came from: the uploader's
+// session_id and seq when present, otherwise the time it was stored.
+func readingKey(rec Record) string {
+	key := fhirPatientID(rec.ClinicName, rec.PatientName)
+	if hasReadingID(rec) {
+		session := sanitizeID(rec.RawData["session_id"].(string))
+		seq := rec.RawData["seq"].(float64)
+		return key + "/" + session + "/" + strconv.FormatFloat(seq, 'f', -1, 64)
+	}
+	return key + "/" + rec.Timestamp.UTC().Format(time.RFC3339Nano)
+}
+
+// hasReadingID reports whether the uploader numbered the reading
+// (session_id and seq), so a resend of it can be recognised.
+func hasReadingID(rec Record) bool {
+	session, _ := rec.RawData["session_id"].(string)
+	_, hasSeq := rec.RawData["seq"].(float64)
+	return sanitizeID(session) != "" && hasSeq
+}
+
+// observationsFor maps one record to Observations by the fields it
+// carries: a blood pressure result also has "pr", so it is stored in
+// heart_rate.json and yields both a panel and a pulse. Ids are
+// {idPrefix}-{kind}; with an empty idPrefix the Observations have no id.
+// The urn:medicart:reading identifier is {readingKey}/{kind} either way.
+func observationsFor(idPrefix string, rec Record) []fhirObservation {
+	pid := fhirPatientID(rec.ClinicName, rec.PatientName)
+	key := readingKey(rec)
+	obs := func(kind string, cat []fhirCodeableConcept, code fhirCodeableConcept) fhirObservation {
+		o := fhirObservation{
+			ResourceType:      "Observation",
+			Identifier:        []fhirIdentifier{{System: readingIDSystem, Value: key + "/" + kind}},
+			Status:            "final",
+			Category:          cat,
+			Code:              code,
+			Subject:           fhirReference{Reference: "Patient/" + pid, Display: rec.PatientName},
+			EffectiveDateTime: rec.Timestamp.UTC().Format(time.RFC3339),
+		}
+		if idPrefix != "" {
+			o.ID = idPrefix + "-" + kind
+		}
+		return o
+	}
+	value := func(kind string, cat []fhirCodeableConcept, code fhirCodeableConcept, q fhirQuantity) fhirObservation {
+		o := obs(kind, cat, code)
+		o.ValueQuantity = &q
+		return o
+	}
+
+	var out []fhirObservation
+	d := rec.RawData
+	if v, ok := numField(d, "spo2"); ok {
+		out = append(out, value("spo2", vitalSigns, spo2Code, quantity(v, "%", "%")))
+	}
+	if v, ok := numField(d, "pr"); ok {
+		out = append(out, value("pulse", vitalSigns, pulseCode, quantity(v, "beats/minute", "/min")))
+	}
+	sys, ok1 := numField(d, "sys")
+	dia, ok2 := numField(d, "dia")
+	if ok1 && ok2 {
+		o := obs("bp", vitalSigns, bpCode)
+		o.Component = []fhirComponent{
+			{Code: systolicCode, ValueQuantity: quantity(sys, "mmHg", "mm[Hg]")},
+			{Code: diastolicCode, ValueQuantity: quantity(dia, "mmHg", "mm[Hg]")},
+		}
+		out = append(out, o)
+	}
+	if v, ok := numField(d, "glu"); ok {
+		out = append(out, value("glu", laboratory, glucoseCode, quantity(v, "mg/dL", "mg/dL")))
+	}
+	if v, ok := numField(d, "temp"); ok {
+		out = append(out, value("temp", vitalSigns, tempCode, quantity(v, "°C", "Cel")))
+	}
+	return out
+}
+
+// observationFiles are the metric files that hold Observations, with the
+// short name used in Observation ids.
+var observationFiles = map[string]string{
+	"heart_rate.json":  "hr",
+	"bp.json":          "bp",
+	"glucose.json":     "glu",
+	"temperature.json": "temp",
+}
+
+// observationPrefix is the id prefix for a stored record's Observations:
+// {patient id}-{file}-{hash of readingKey}, e.g.
+// 1a2b3c4d5e6f7a8b-hr-0c1d2e3f4a5b6c7d, which observationsFor completes
+// with the kind. Ids stay within FHIR's 64 characters.
+func observationPrefix(file string, rec Record) string {
+	sum := sha256.Sum256([]byte(readingKey(rec)))
+	return fhirPatientID(rec.ClinicName, rec.PatientName) + "-" + observationFiles[file] + "-" + hex.EncodeToString(sum[:8])
+}
+
+// patientObservations returns all Observations for a patient, oldest first.
+func patientObservations(clinic, patient string) ([]fhirObservation, error) {
+	var out []fhirObservation
+	for file := range observationFiles {
+		recs, err := readRecords(clinic, patient, file)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range recs {
+			rec.ClinicName, rec.PatientName = clinic, patient
+			out = append(out, observationsFor(observationPrefix(file, rec), rec)...)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].EffectiveDateTime != out[j].EffectiveDateTime {
+			return out[i].EffectiveDateTime < out[j].EffectiveDateTime
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+// findFHIRPatient resolves a Patient id among the clinics p may read.
+func findFHIRPatient(p Principal, id string) (clinic, patient string, ok bool) {
+	clinics, _ := listClinics()
+	for _, c := range clinics {
+		if !p.canAccessClinic(c) {
+			continue
+		}
+		patients, _ := listPatients(c)
+		for _, pt := range patients {
+			if fhirPatientID(c, pt) == id {
+				return c, pt, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// --- HTTP ---
+
+func writeFHIR(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", fhirContentType)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// fhirError answers with an OperationOutcome.
+func fhirError(w http.ResponseWriter, status int, code, diagnostics string) {
+	writeFHIR(w, status, map[string]interface{}{
+		"resourceType": "OperationOutcome",
+		"issue": []map[string]interface{}{
+			{"severity": "error", "code": code, "diagnostics": diagnostics},
+		},
+	})
+}
+
+// fhirBase is the absolute URL of the FHIR endpoint, for fullUrl.
+func fhirBase(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/fhir/"
+}
+
+func searchBundle(r *http.Request, resources []interface{}, types []string, ids []string) fhirBundle {
+	total := len(resources)
+	b := fhirBundle{ResourceType: "Bundle", Type: "searchset", Total: &total, Entry: []fhirBundleEntry{}}
+	for i, res := range resources {
+		b.Entry = append(b.Entry, fhirBundleEntry{
+			FullURL:  fhirBase(r) + types[i] + "/" + ids[i],
+			Resource: res,
+			Search:   &fhirSearch{Mode: "match"},
+		})
+	}
+	return b
+}
+
+func handleFHIR(w http.ResponseWriter, r *http.Request) {
+	if preflight(w, r) {
+		return
+	}
+	if !authorize(w, r, PermReadData, "") {
+		return
+	}
+	if r.Method != http.MethodGet {
+		fhirError(w, http.StatusMethodNotAllowed, "not-supported", "only GET is supported")
+		return
+	}
+	p, _ := principalFrom(r.Context())
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/fhir/"), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "metadata":
+		writeFHIR(w, http.StatusOK, capabilityStatement())
+
+	case len(parts) == 1 && parts[0] == "Patient":
+		var res []interface{}
+		var types, ids []string
+		clinics, _ := listClinics()
+		for _, c := range clinics {
+			if !p.canAccessClinic(c) {
+				continue
+			}
+			patients, _ := listPatients(c)
+			for _, pt := range patients {
+				fp := newFHIRPatient(c, pt)
+				res, types, ids = append(res, fp), append(types, "Patient"), append(ids, fp.ID)
+			}
+		}
+		audit(r, "fhir_search_patients", "", "", OutcomeOK, "")
+		writeFHIR(w, http.StatusOK, searchBundle(r, res, types, ids))
+
+	case len(parts) == 2 && parts[0] == "Patient":
+		clinic, patient, ok := findFHIRPatient(p, parts[1])
+		if !ok {
+			fhirError(w, http.StatusNotFound, "not-found", "Patient/"+parts[1]+" not found")
+			return
+		}
+		audit(r, "fhir_read", clinic, patient, OutcomeOK, r.URL.Path)
+		writeFHIR(w, http.StatusOK, newFHIRPatient(clinic, patient))
+
+	case len(parts) == 3 && parts[0] == "Patient" && parts[2] == "$everything":
+		clinic, patient, ok := findFHIRPatient(p, parts[1])
+		if !ok {
+			fhirError(w, http.StatusNotFound, "not-found", "Patient/"+parts[1]+" not found")
+			return
+		}
+		obs, err := patientObservations(clinic, patient)
+		audit(r, "fhir_everything", clinic, patient, outcomeFor(err), "")
+		if err != nil {
+			logFor(r).Error("Building FHIR bundle failed", "err", err)
+			fhirError(w, http.StatusInternalServerError, "exception", "failed to read patient records")
+			return
+		}
+		fp := newFHIRPatient(clinic, patient)
+		res, types, ids := []interface{}{fp}, []string{"Patient"}, []string{fp.ID}
+		for _, o := range obs {
+			res, types, ids = append(res, o), append(types, "Observation"), append(ids, o.ID)
+		}
+		writeFHIR(w, http.StatusOK, searchBundle(r, res, types, ids))
+
+	case len(parts) == 1 && parts[0] == "Observation":
+		id := strings.TrimPrefix(r.URL.Query().Get("patient"), "Patient/")
+		if id == "" {
+			fhirError(w, http.StatusBadRequest, "required", "the patient search parameter is required")
+			return
+		}
+		clinic, patient, ok := findFHIRPatient(p, id)
+		if !ok {
+			writeFHIR(w, http.StatusOK, searchBundle(r, nil, nil, nil))
+			return
+		}
+		obs, err := patientObservations(clinic, patient)
+		audit(r, "fhir_search_observations", clinic, patient, outcomeFor(err), "")
+		if err != nil {
+			logFor(r).Error("Searching FHIR observations failed", "err", err)
+			fhirError(w, http.StatusInternalServerError, "exception", "failed to read patient records")
+			return
+		}
+		var res []interface{}
+		var types, ids []string
+		for _, o := range obs {
+			res, types, ids = append(res, o), append(types, "Observation"), append(ids, o.ID)
+		}
+		writeFHIR(w, http.StatusOK, searchBundle(r, res, types, ids))
+
+	case len(parts) == 2 && parts[0] == "Observation":
+		// Observation ids start with the patient id; see observationPrefix
+		pid, _, _ := strings.Cut(parts[1], "-")
+		clinic, patient, ok := findFHIRPatient(p, pid)
+		if !ok {
+			fhirError(w, http.StatusNotFound, "not-found", "Observation/"+parts[1]+" not found")
+			return
+		}
+		obs, err := patientObservations(clinic, patient)
+		if err != nil {
+			logFor(r).Error("Reading FHIR observation failed", "err", err)
+			fhirError(w, http.StatusInternalServerError, "exception", "failed to read patient records")
+			return
+		}
+		for _, o := range obs {
+			if o.ID == parts[1] {
+				audit(r, "fhir_read", clinic, patient, OutcomeOK, r.URL.Path)
+				writeFHIR(w, http.StatusOK, o)
+				return
+			}
+		}
+		fhirError(w, http.StatusNotFound, "not-found", "Observation/"+parts[1]+" not found")
+
+	default:
+		fhirError(w, http.StatusNotFound, "not-supported", "unsupported FHIR request "+r.URL.Path)
+	}
+}
+
+func capabilityStatement() map[string]interface{} {
+	read := []map[string]string{{"code": "read"}, {"code": "search-type"}}
+	return map[string]interface{}{
+		"resourceType": "CapabilityStatement",
+		"status":       "active",
+		"date":         startTime.UTC().Format(time.RFC3339),
+		"kind":         "instance",
+		"fhirVersion":  "4.0.1",
+		"format":       []string{"json"},
+		"rest": []map[string]interface{}{{
+			"mode": "server",
+			"resource": []map[string]interface{}{
+				{"type": "Patient", "interaction": read,
+					"operation": []map[string]string{{"name": "everything", "definition": "http://hl7.org/fhir/OperationDefinition/Patient-everything"}}},
+				{"type": "Observation", "interaction": read,
+					"searchParam": []map[string]string{{"name": "patient", "type": "reference"}}},
+			},
+		}},
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// New readings are pushed to an external FHIR server (Config.FHIR) as
+// transaction Bundles through the outbox. Every entry is a conditional
+// create (ifNoneExist on its identifier), so a Bundle that is delivered
+// twice, e.g. when the response was lost, does not duplicate anything:
+// the Patient is keyed on urn:medicart:patient and each Observation on
+// urn:medicart:reading (session_id/seq of the reading).
+
+const fhirSink = "fhir"
+
+var fhirClient *http.Client // nil when push is off
+
+// setupFHIRPush registers the sink when a FHIR URL is configured.
+func setupFHIRPush(c FHIRConfig) error {
+	if c.URL == "" {
+		return nil
+	}
+	tlsCfg, err := clientTLSConfig(c.CAFile)
+	if err != nil {
+		return fmt.Errorf("fhir: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	fhirClient = &http.Client{Timeout: time.Duration(c.Timeout), Transport: transport}
+	registerSink(fhirSink, deliverFHIR)
+	return nil
+}
+
+// queueFHIRPush queues a Bundle for a stored record, if it maps to any
+// Observations and its clinic is pushed.
+func queueFHIRPush(rec Record) error {
+	if fhirClient == nil || !clinicListed(config.FHIR.Clinics, rec.ClinicName) {
+		return nil
+	}
+	b := fhirTransaction(rec)
+	if b == nil {
+		return nil
+	}
+	return enqueue(fhirSink, rec.ClinicName, rec.PatientName, b)
+}
+
+// clinicListed reports whether clinic is in list, matched as storage matches
+// clinic names; an empty list means all.
+func clinicListed(list []string, clinic string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, c := range list {
+		if sameClinic(c, clinic) {
+			return true
+		}
+	}
+	return false
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func ifNoneExist(system, value string) string {
+	return url.Values{"identifier": {system + "|" + value}}.Encode()
+}
+
+// fhirTransaction builds the Bundle for one record, or nil if it holds no
+// vitals. Observations refer to the Patient entry by its urn:uuid, which
+// the server resolves to the existing or newly created Patient.
+func fhirTransaction(rec Record) *fhirBundle {
+	obs := observationsFor("", rec)
+	if len(obs) == 0 {
+		return nil
+	}
+	patient := newFHIRPatient(rec.ClinicName, rec.PatientName)
+	patient.ID = ""
+	patientURL := "urn:uuid:" + newUUID()
+
+	b := &fhirBundle{ResourceType: "Bundle", Type: "transaction"}
+	b.Entry = append(b.Entry, fhirBundleEntry{
+		FullURL:  patientURL,
+		Resource: patient,
+		Request: &fhirRequest{Method: "POST", URL: "Patient",
+			IfNoneExist: ifNoneExist(patientIDSystem, patient.Identifier[0].Value)},
+	})
+	for _, o := range obs {
+		o.Subject.Reference = patientURL
+		b.Entry = append(b.Entry, fhirBundleEntry{
+			FullURL:  "urn:uuid:" + newUUID(),
+			Resource: o,
+			Request: &fhirRequest{Method: "POST", URL: "Observation",
+				IfNoneExist: ifNoneExist(readingIDSystem, o.Identifier[0].Value)},
+		})
+	}
+	return b
+}
+
+// deliverFHIR posts a queued Bundle to the server's base URL. Timeouts,
+// 408, 429 and 5xx are retried; other 4xx answers are permanent.
+func deliverFHIR(ctx context.Context, job outboxJob) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(config.FHIR.URL, "/"), bytes.NewReader(job.Payload))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	req.Header.Set("Content-Type", fhirContentType)
+	req.Header.Set("Accept", fhirContentType)
+	if config.FHIR.TokenFile != "" {
+		// Read on every delivery so a renewed token is picked up
+		tok, err := os.ReadFile(config.FHIR.TokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(tok)))
+	}
+	resp, err := fhirClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	default:
+		return fmt.Errorf("%w: HTTP %d: %s", errPermanent, resp.StatusCode, bytes.TrimSpace(body))
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFHIR is a FHIR server that answers with the queued statuses, then
+// 200, and records the Bundles it was sent.
+type fakeFHIR struct {
+	mu       sync.Mutex
+	statuses []int
+	bundles  []map[string]interface{}
+	auth     []string
+}
+
+func (f *fakeFHIR) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var b map[string]interface{}
+	_ = json.Unmarshal(body, &b)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bundles = append(f.bundles, b)
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	status := http.StatusOK
+	if len(f.statuses) > 0 {
+		status, f.statuses = f.statuses[0], f.statuses[1:]
+	}
+	w.Header().Set("Content-Type", fhirContentType)
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, `{"resourceType":"Bundle","type":"transaction-response"}`)
+}
+
+func (f *fakeFHIR) requests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.bundles)
+}
+
+// setupFHIRPushTest points the push at a fake server with a fresh data
+// directory and short retry delays, restoring the globals afterwards.
+func setupFHIRPushTest(t *testing.T, statuses ...int) (*fakeFHIR, *outboxSink) {
+	t.Helper()
+	fake := &fakeFHIR{statuses: statuses}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	oldConfig, oldDataDir, oldSinks, oldClient := config, dataDir, outboxSinks, fhirClient
+	t.Cleanup(func() {
+		config, dataDir, outboxSinks, fhirClient = oldConfig, oldDataDir, oldSinks, oldClient
+	})
+	t.Setenv("MEDICART_STORAGE_KEY", "")
+	config = defaultConfig()
+	config.Outbox.MaxAttempts = 3
+	config.Outbox.RetryMin = Duration(time.Millisecond)
+	config.Outbox.RetryMax = Duration(time.Millisecond)
+	config.FHIR = FHIRConfig{URL: srv.URL + "/fhir/", Timeout: Duration(5 * time.Second)}
+	dataDir = t.TempDir()
+	outboxSinks = map[string]*outboxSink{}
+	if err := setupFHIRPush(config.FHIR); err != nil {
+		t.Fatal(err)
+	}
+	return fake, outboxSinks[fhirSink]
+}
+
+func testRecord() Record {
+	return Record{
+		Timestamp:   time.Date(2026, 3, 1, 9, 30, 0, 0, time.UTC),
+		ClinicName:  "North",
+		PatientName: "Jane Doe",
+		RawData: map[string]interface{}{
+			"session_id": "s1", "seq": float64(7),
+			"sys": float64(120), "dia": float64(80), "pr": float64(64),
+		},
+	}
+}
+
+// drain runs sink passes until no job is due, waiting out the retry delay.
+func drain(t *testing.T, s *outboxSink) {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		s.pass(context.Background())
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func sinkJobs(t *testing.T) []outboxJob {
+	t.Helper()
+	jobs, err := loadJobs(fhirSink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+func TestFHIRPushBundle(t *testing.T) {
+	fake, s := setupFHIRPushTest(t)
+	config.FHIR.TokenFile = filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(config.FHIR.TokenFile, []byte("tok123\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := queueFHIRPush(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+	s.pass(context.Background())
+	if fake.requests() != 1 {
+		t.Fatalf("server got %d requests, want 1", fake.requests())
+	}
+	if fake.auth[0] != "Bearer tok123" {
+		t.Fatalf("Authorization = %q, want the token file's bearer token", fake.auth[0])
+	}
+	if jobs := sinkJobs(t); len(jobs) != 0 {
+		t.Fatalf("%d jobs left after delivery", len(jobs))
+	}
+
+	b := fake.bundles[0]
+	if b["resourceType"] != "Bundle" || b["type"] != "transaction" {
+		t.Fatalf("got %v/%v, want a transaction Bundle", b["resourceType"], b["type"])
+	}
+	entries, _ := b["entry"].([]interface{})
+	// Patient, pulse, blood pressure
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	var patientURL string
+	for i, e := range entries {
+		entry := e.(map[string]interface{})
+		res := entry["resource"].(map[string]interface{})
+		req := entry["request"].(map[string]interface{})
+		fullURL, _ := entry["fullUrl"].(string)
+		if !strings.HasPrefix(fullURL, "urn:uuid:") {
+			t.Errorf("entry %d: fullUrl %q is not a urn:uuid", i, fullURL)
+		}
+		if _, ok := res["id"]; ok {
+			t.Errorf("entry %d: resource has an id", i)
+		}
+		ident := res["identifier"].([]interface{})[0].(map[string]interface{})
+		cond, err := url.ParseQuery(req["ifNoneExist"].(string))
+		if err != nil {
+			t.Fatalf("entry %d: ifNoneExist: %v", i, err)
+		}
+		if want := ident["system"].(string) + "|" + ident["value"].(string); cond.Get("identifier") != want {
+			t.Errorf("entry %d: ifNoneExist identifier = %q, want %q", i, cond.Get("identifier"), want)
+		}
+		if req["method"] != "POST" || req["url"] != res["resourceType"] {
+			t.Errorf("entry %d: request %v %v for a %v", i, req["method"], req["url"], res["resourceType"])
+		}
+
+		if i == 0 {
+			if res["resourceType"] != "Patient" || ident["system"] != patientIDSystem || ident["value"] != "North/Jane Doe" {
+				t.Fatalf("first entry is %v %v, want the Patient", res["resourceType"], ident)
+			}
+			patientURL = fullURL
+			continue
+		}
+		if res["resourceType"] != "Observation" || ident["system"] != readingIDSystem {
+			t.Fatalf("entry %d is %v %v, want an Observation", i, res["resourceType"], ident)
+		}
+		if !strings.Contains(ident["value"].(string), "/s1/7/") {
+			t.Errorf("entry %d: reading identifier %q lacks session and seq", i, ident["value"])
+		}
+		if ref := res["subject"].(map[string]interface{})["reference"]; ref != patientURL {
+			t.Errorf("entry %d: subject %v, want %s", i, ref, patientURL)
+		}
+	}
+}
+
+func TestFHIRPushSkipsRecordsWithoutVitals(t *testing.T) {
+	_, _ = setupFHIRPushTest(t)
+	rec := testRecord()
+	rec.RawData = map[string]interface{}{"note": "cuff inflating"}
+	if err := queueFHIRPush(rec); err != nil {
+		t.Fatal(err)
+	}
+	if jobs := sinkJobs(t); len(jobs) != 0 {
+		t.Fatalf("queued %d jobs for a record without vitals", len(jobs))
+	}
+}
+
+func TestClinicListedMatchesAsStorage(t *testing.T) {
+	list := []string{"North"}
+	for clinic, want := range map[string]bool{"North": true, "North ": true, " North": true, "north": false, "South": false} {
+		if got := clinicListed(list, clinic); got != want {
+			t.Errorf("clinicListed(%q) = %v, want %v", clinic, got, want)
+		}
+	}
+	if !clinicListed(nil, "anything") {
+		t.Error("an empty list does not select every clinic")
+	}
+}
+
+func TestFHIRPushRetries(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusRequestTimeout} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			fake, s := setupFHIRPushTest(t, status, status)
+			if err := queueFHIRPush(testRecord()); err != nil {
+				t.Fatal(err)
+			}
+
+			s.pass(context.Background())
+			jobs := sinkJobs(t)
+			if len(jobs) != 1 || jobs[0].Failed || jobs[0].Attempts != 1 || jobs[0].LastError == "" {
+				t.Fatalf("after one failure: %+v, want one pending job with 1 attempt", jobs)
+			}
+
+			drain(t, s)
+			if fake.requests() != 3 {
+				t.Fatalf("server got %d requests, want 3", fake.requests())
+			}
+			if jobs := sinkJobs(t); len(jobs) != 0 {
+				t.Fatalf("%d jobs left after the retry succeeded", len(jobs))
+			}
+		})
+	}
+}
+
+func TestFHIRPushGivesUpAfterMaxAttempts(t *testing.T) {
+	fake, s := setupFHIRPushTest(t, 502, 502, 502, 502, 502)
+	if err := queueFHIRPush(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+	drain(t, s)
+	if fake.requests() != config.Outbox.MaxAttempts {
+		t.Fatalf("server got %d requests, want %d", fake.requests(), config.Outbox.MaxAttempts)
+	}
+	jobs := sinkJobs(t)
+	if len(jobs) != 1 || !jobs[0].Failed {
+		t.Fatalf("got %+v, want one failed job", jobs)
+	}
+}
+
+func TestFHIRPushPermanentFailure(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusUnprocessableEntity} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			fake, s := setupFHIRPushTest(t, status)
+			if err := queueFHIRPush(testRecord()); err != nil {
+				t.Fatal(err)
+			}
+			drain(t, s)
+			if fake.requests() != 1 {
+				t.Fatalf("server got %d requests, want 1", fake.requests())
+			}
+			jobs := sinkJobs(t)
+			if len(jobs) != 1 || !jobs[0].Failed || jobs[0].Attempts != 1 {
+				t.Fatalf("got %+v, want one failed job after 1 attempt", jobs)
+			}
+			if !strings.Contains(jobs[0].LastError, "rejected") {
+				t.Fatalf("last error %q does not say it was rejected", jobs[0].LastError)
+			}
+		})
+	}
+}
+
+func TestOutboxAdminRetry(t *testing.T) {
+	fake, s := setupFHIRPushTest(t, http.StatusBadRequest, http.StatusBadRequest)
+	for i := 0; i < 2; i++ {
+		if err := queueFHIRPush(testRecord()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	drain(t, s)
+	jobs := sinkJobs(t)
+	if len(jobs) != 2 || !jobs[0].Failed || !jobs[1].Failed {
+		t.Fatalf("got %+v, want two failed jobs", jobs)
+	}
+
+	retry := func(p Principal, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/admin/outbox/retry", strings.NewReader(body))
+		r = r.WithContext(withPrincipal(r.Context(), p))
+		w := httptest.NewRecorder()
+		handleAdminOutboxRetry(w, r)
+		return w
+	}
+	admin := Principal{Kind: "user", Name: "root", Role: RoleAdmin}
+
+	if w := retry(Principal{Kind: "user", Name: "c", Role: RoleClinician, Clinics: []string{"*"}}, `{"sink":"fhir"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("clinician retry: status %d, want 403", w.Code)
+	}
+	if w := retry(admin, `{"sink":"hl7"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown sink: status %d, want 400", w.Code)
+	}
+
+	// One job by id
+	w := retry(admin, `{"sink":"fhir","id":"`+jobs[0].ID+`"}`)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"requeued":1}` {
+		t.Fatalf("retry one: %d %s", w.Code, w.Body)
+	}
+	drain(t, s)
+	left := sinkJobs(t)
+	if len(left) != 1 || left[0].ID != jobs[1].ID || !left[0].Failed {
+		t.Fatalf("after retrying one: %+v, want only the other failed job", left)
+	}
+
+	// The rest of the sink
+	w = retry(admin, `{"sink":"fhir"}`)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"requeued":1}` {
+		t.Fatalf("retry all: %d %s", w.Code, w.Body)
+	}
+	drain(t, s)
+	if left := sinkJobs(t); len(left) != 0 {
+		t.Fatalf("%d jobs left after retrying all", len(left))
+	}
+	if fake.requests() != 4 {
+		t.Fatalf("server got %d requests, want 4", fake.requests())
+	}
+}
+
+func TestOutboxPassReadsOnlyDueJobs(t *testing.T) {
+	fake, s := setupFHIRPushTest(t, http.StatusServiceUnavailable)
+	config.Outbox.RetryMin = Duration(time.Hour)
+	config.Outbox.RetryMax = Duration(time.Hour)
+	if err := queueFHIRPush(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+	s.pass(context.Background())
+	waiting := sinkJobs(t)
+	if len(waiting) != 1 || waiting[0].Attempts != 1 {
+		t.Fatalf("got %+v, want one job waiting to retry", waiting)
+	}
+
+	// A pass must not open a job that is not due: if it did, it would
+	// quarantine this one.
+	path := filepath.Join(sinkDir(fhirSink), waiting[0].ID+".json")
+	if err := os.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := queueFHIRPush(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+	if wait := s.pass(context.Background()); wait != time.Minute {
+		t.Fatalf("pass sleeps %v, want the full minute with nothing due", wait)
+	}
+	if fake.requests() != 2 {
+		t.Fatalf("server got %d requests, want 2", fake.requests())
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "not json" {
+		t.Fatalf("job that is not due was touched: %q, %v", b, err)
+	}
+}
+
+func TestOutboxEnqueueWakesOnlyASleepingWorker(t *testing.T) {
+	_, s := setupFHIRPushTest(t)
+	// Working: the pass picks the job up itself
+	if err := queueFHIRPush(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.wake) != 0 {
+		t.Fatal("enqueue woke a worker that is not asleep")
+	}
+	s.pass(context.Background())
+
+	outboxMu.Lock()
+	s.sleep(time.Hour)
+	outboxMu.Unlock()
+	if err := queueFHIRPush(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.wake) != 1 {
+		t.Fatal("enqueue did not wake a worker sleeping past the new job")
+	}
+}
+
+func TestOutboxRetryWaitsForDelivery(t *testing.T) {
+	_, _ = setupFHIRPushTest(t)
+	delivering, release := make(chan struct{}), make(chan struct{})
+	registerSink("slow", func(ctx context.Context, job outboxJob) error {
+		close(delivering)
+		<-release
+		return nil
+	})
+	s := outboxSinks["slow"]
+	if err := enqueue("slow", "North", "Jane Doe", map[string]string{"k": "v"}); err != nil {
+		t.Fatal(err)
+	}
+	outboxMu.Lock()
+	ids, _ := s.dueJobs()
+	outboxMu.Unlock()
+
+	passDone := make(chan struct{})
+	go func() {
+		s.pass(context.Background())
+		close(passDone)
+	}()
+	<-delivering
+
+	type result struct {
+		ok  bool
+		err error
+	}
+	requeued := make(chan result, 1)
+	go func() {
+		ok, err := s.requeue(ids[0])
+		requeued <- result{ok, err}
+	}()
+	select {
+	case <-requeued:
+		t.Fatal("admin retry ran while the job was being delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-passDone
+	if res := <-requeued; res.ok || res.err != nil {
+		t.Fatalf("retry of a delivered job = %v, %v; want nothing requeued", res.ok, res.err)
+	}
+}
@@ -1,5 +1,5 @@
 module github.com/Ahmad-Selim59/medicart/web-server
 
-go 1.23
+go 1.24
 
 require github.com/gorilla/websocket v1.5.3
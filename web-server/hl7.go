@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// New readings can also go out as HL7 v2.5.1 ORU^R01 messages over MLLP to
+// the destinations in Config.HL7, each serving a set of clinics. A message
+// has MSH, PID, one OBR for the reading and an OBX per value, built from the
+// same mapping as the FHIR Observations (LOINC codes, UCUM units). Reference
+// ranges and abnormal flags come from Config.Alerts. Messages are queued in
+// the outbox (sink "hl7-{name}") and resent with the same control id until
+// the receiver answers AA/CA; AE/CE is a permanent failure, AR/CR and
+// network errors are retried.
+
+const (
+	mllpStart = 0x0b
+	mllpEnd   = 0x1c
+	mllpCR    = 0x0d
+)
+
+// hl7Destinations maps sink names to their settings.
+var hl7Destinations = map[string]HL7Destination{}
+
+func setupHL7(c HL7Config) {
+	for _, d := range c.Destinations {
+		sink := "hl7-" + d.Name
+		hl7Destinations[sink] = d
+		registerSink(sink, func(ctx context.Context, job outboxJob) error {
+			return deliverHL7(ctx, d, job)
+		})
+	}
+}
+
+// queueHL7 queues an ORU^R01 for each destination serving the record's
+// clinic.
+func queueHL7(rec Record) error {
+	var errs []error
+	for sink, d := range hl7Destinations {
+		if !clinicListed(d.Clinics, rec.ClinicName) {
+			continue
+		}
+		if msg := buildORU(d, rec, time.Now()); msg != "" {
+			errs = append(errs, enqueue(sink, rec.ClinicName, rec.PatientName, msg))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// --- Message ---
+
+var hl7Escaper = strings.NewReplacer(
+	`\`, `\E\`, "|", `\F\`, "^", `\S\`, "&", `\T\`, "~", `\R\`, "\r", " ", "\n", " ")
+
+func hl7Escape(s string) string {
+	return hl7Escaper.Replace(s)
+}
+
+func hl7Time(t time.Time) string {
+	return t.UTC().Format("20060102150405") + "+0000"
+}
+
+// hl7Name splits a free-text name into XPN family^given, taking the last
+// word as the family name.
+func hl7Name(name string) string {
+	name = strings.TrimSpace(name)
+	i := strings.LastIndex(name, " ")
+	if i < 0 {
+		return hl7Escape(name)
+	}
+	return hl7Escape(name[i+1:]) + "^" + hl7Escape(name[:i])
+}
+
+// referenceRange returns the configured normal range for a LOINC code.
+func referenceRange(code string) (lo, hi float64, ok bool) {
+	a := config.Alerts
+	switch code {
+	case "59408-5", "2708-6":
+		return a.SpO2Min, 100, true
+	case "8867-4":
+		return a.PulseMin, a.PulseMax, true
+	case "8480-6":
+		return a.SystolicMin, a.SystolicMax, true
+	case "8462-4":
+		return a.DiastolicMin, a.DiastolicMax, true
+	case "2339-0":
+		return a.GlucoseMin, a.GlucoseMax, true
+	case "8310-5":
+		return a.TempMin, a.TempMax, true
+	}
+	return 0, 0, false
+}
+
+// abnormalFlag is the HL7 interpretation code: L, H or N.
+func abnormalFlag(code string, v float64) string {
+	lo, hi, ok := referenceRange(code)
+	switch {
+	case !ok:
+		return ""
+	case v < lo:
+		return "L"
+	case v > hi:
+		return "H"
+	}
+	return "N"
+}
+
+// buildORU returns the message for one record, or "" if the record holds
+// no vitals. Segments end in CR as HL7 requires.
+func buildORU(d HL7Destination, rec Record, now time.Time) string {
+	obs := observationsFor("", rec)
+	if len(obs) == 0 {
+		return ""
+	}
+	app, facility := config.HL7.SendingApplication, config.HL7.SendingFacility
+	controlID := strconv.FormatInt(now.UnixNano(), 36)
+	effective := hl7Time(rec.Timestamp)
+
+	var b strings.Builder
+	seg := func(fields ...string) {
+		b.WriteString(strings.Join(fields, "|"))
+		b.WriteByte(mllpCR)
+	}
+	seg("MSH", `^~\&`, hl7Escape(app), hl7Escape(facility), hl7Escape(d.ReceivingApplication),
+		hl7Escape(d.ReceivingFacility), hl7Time(now), "", "ORU^R01^ORU_R01", controlID, "P", "2.5.1")
+	seg("PID", "1", "", fhirPatientID(rec.ClinicName, rec.PatientName)+"^^^"+hl7Escape(app)+"^MR", "",
+		hl7Name(rec.PatientName))
+	obr := make([]string, 26)
+	obr[0], obr[1] = "OBR", "1"
+	obr[3] = hl7Escape(readingKey(rec)) // filler order number
+	obr[4] = "85353-1^Vital signs panel^LN"
+	obr[7] = effective
+	obr[25] = "F" // result status
+	seg(obr...)
+
+	n := 0
+	obx := func(code fhirCodeableConcept, q fhirQuantity) {
+		c := code.Coding[len(code.Coding)-1] // the most specific code
+		rng := ""
+		if lo, hi, ok := referenceRange(c.Code); ok {
+			rng = formatFloat(lo) + "-" + formatFloat(hi)
+		}
+		n++
+		seg("OBX", strconv.Itoa(n), "NM", c.Code+"^"+hl7Escape(c.Display)+"^LN", "", formatFloat(q.Value),
+			hl7Escape(q.Code)+"^"+hl7Escape(q.Unit)+"^UCUM", rng, abnormalFlag(c.Code, q.Value),
+			"", "", "F", "", "", effective)
+	}
+	for _, o := range obs {
+		if o.ValueQuantity != nil {
+			obx(o.Code, *o.ValueQuantity)
+		}
+		for _, comp := range o.Component {
+			obx(comp.Code, comp.ValueQuantity)
+		}
+	}
+	return b.String()
+}
+
+// --- MLLP ---
+
+// deliverHL7 sends one queued message and waits for its ACK.
+func deliverHL7(ctx context.Context, d HL7Destination, job outboxJob) error {
+	var msg string
+	if err := json.Unmarshal(job.Payload, &msg); err != nil {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	timeout := time.Duration(d.Timeout)
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if d.TLS {
+		cfg, cerr := clientTLSConfig(d.CAFile)
+		if cerr != nil {
+			return cerr
+		}
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: cfg}).DialContext(ctx, "tcp", d.Addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", d.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	frame := append([]byte{mllpStart}, msg...)
+	frame = append(frame, mllpEnd, mllpCR)
+	if _, err := conn.Write(frame); err != nil {
+		return err
+	}
+	ack, err := readMLLP(bufio.NewReader(conn))
+	if err != nil {
+		return fmt.Errorf("reading ACK: %w", err)
+	}
+	return checkACK(ack, controlIDOf(msg))
+}
+
+// readMLLP reads one framed message.
+func readMLLP(r *bufio.Reader) ([]byte, error) {
+	if _, err := r.ReadBytes(mllpStart); err != nil {
+		return nil, err
+	}
+	var msg []byte
+	for {
+		chunk, err := r.ReadBytes(mllpEnd)
+		if err != nil {
+			return nil, err
+		}
+		msg = append(msg, chunk[:len(chunk)-1]...)
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == mllpCR {
+			return msg, nil
+		}
+		msg = append(msg, mllpEnd, c) // not the end marker after all
+	}
+}
+
+func controlIDOf(msg string) string {
+	msh, _, _ := strings.Cut(msg, "\r")
+	if f := strings.Split(msh, "|"); len(f) > 9 {
+		return f[9]
+	}
+	return ""
+}
+
+// checkACK reads MSA-1 (acknowledgment code) and MSA-2 (control id).
+func checkACK(ack []byte, controlID string) error {
+	for _, seg := range bytes.Split(ack, []byte{mllpCR}) {
+		f := strings.Split(strings.TrimSpace(string(seg)), "|")
+		if f[0] != "MSA" {
+			continue
+		}
+		if len(f) < 3 || f[2] != controlID {
+			return fmt.Errorf("ACK for another message (MSA %q)", string(seg))
+		}
+		text := ""
+		if len(f) > 3 {
+			text = f[3]
+		}
+		switch f[1] {
+		case "AA", "CA":
+			return nil
+		case "AE", "CE":
+			return fmt.Errorf("%w: %s %s", errPermanent, f[1], text)
+		default:
+			return fmt.Errorf("negative ACK: %s %s", f[1], text)
+		}
+	}
+	return errors.New("ACK without MSA segment")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mllpFrame(msg string) string {
+	return "\x0b" + msg + "\x1c\r"
+}
+
+func TestReadMLLP(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []string // messages in order
+		wantErr bool     // after them
+	}{
+		{"one frame", mllpFrame("MSH|a\rMSA|AA|1\r"), []string{"MSH|a\rMSA|AA|1\r"}, false},
+		{"bytes before start", "junk\r\n" + mllpFrame("MSH|a"), []string{"MSH|a"}, false},
+		{"end byte inside message", mllpFrame("MSH|a\x1cb"), []string{"MSH|a\x1cb"}, false},
+		{"two frames", mllpFrame("MSH|1") + mllpFrame("MSH|2"), []string{"MSH|1", "MSH|2"}, false},
+		{"no start", "MSH|a\x1c\r", nil, true},
+		{"truncated", "\x0bMSH|a", nil, true},
+		{"end without CR", "\x0bMSH|a\x1c", nil, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go func() {
+				_, _ = server.Write([]byte(tc.in))
+				server.Close()
+			}()
+			defer client.Close()
+			r := bufio.NewReader(client)
+			for i, want := range tc.want {
+				got, err := readMLLP(r)
+				if err != nil {
+					t.Fatalf("message %d: %v", i, err)
+				}
+				if string(got) != want {
+					t.Fatalf("message %d = %q, want %q", i, got, want)
+				}
+			}
+			if tc.wantErr {
+				if _, err := readMLLP(r); err == nil {
+					t.Fatal("readMLLP succeeded, want an error")
+				}
+			}
+		})
+	}
+}
+
+func TestCheckACK(t *testing.T) {
+	const msh = "MSH|^~\\&|RCV|FAC|medicart|Clinic|20260301093000+0000||ACK^R01^ACK|ack1|P|2.5.1\r"
+	tests := []struct {
+		name      string
+		ack       string
+		ok        bool
+		permanent bool
+	}{
+		{"AA", msh + "MSA|AA|c1\r", true, false},
+		{"CA", msh + "MSA|CA|c1\r", true, false},
+		{"AA with text", msh + "MSA|AA|c1|Message accepted\r", true, false},
+		{"AE", msh + "MSA|AE|c1|Unknown patient\r", false, true},
+		{"CE", msh + "MSA|CE|c1\r", false, true},
+		{"AR", msh + "MSA|AR|c1|Try later\r", false, false},
+		{"CR", msh + "MSA|CR|c1\r", false, false},
+		{"other control id", msh + "MSA|AA|c2\r", false, false},
+		{"no control id", msh + "MSA|AA\r", false, false},
+		{"no MSA", msh, false, false},
+		{"LF line ends", strings.ReplaceAll(msh, "\r", "\n") + "MSA|AA|c1\n", false, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkACK([]byte(tc.ack), "c1")
+			if tc.ok {
+				if err != nil {
+					t.Fatalf("checkACK = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("checkACK = nil, want an error")
+			}
+			if got := errors.Is(err, errPermanent); got != tc.permanent {
+				t.Fatalf("permanent = %v, want %v (%v)", got, tc.permanent, err)
+			}
+		})
+	}
+}
+
+// hl7Unescaper reverses hl7Escape for the delimiters.
+var hl7Unescaper = strings.NewReplacer(`\F\`, "|", `\S\`, "^", `\T\`, "&", `\R\`, "~", `\E\`, `\`)
+
+func TestBuildORUEscaping(t *testing.T) {
+	oldConfig := config
+	t.Cleanup(func() { config = oldConfig })
+	config = defaultConfig()
+	config.HL7.SendingApplication = `Medi|Cart^1`
+	config.HL7.SendingFacility = `North & South~\`
+	d := HL7Destination{Name: "lab", ReceivingApplication: "LIS", ReceivingFacility: "Lab^Main"}
+
+	rec := testRecord()
+	rec.PatientName = `Ann|Marie^Jo O&Brien~\x`
+	msg := buildORU(d, rec, time.Date(2026, 3, 1, 9, 31, 0, 0, time.UTC))
+
+	segs := strings.Split(strings.TrimSuffix(msg, "\r"), "\r")
+	byName := map[string][][]string{}
+	for _, s := range segs {
+		f := strings.Split(s, "|")
+		byName[f[0]] = append(byName[f[0]], f)
+	}
+	msh, pid := byName["MSH"][0], byName["PID"][0]
+	if len(msh) != 12 {
+		t.Fatalf("MSH has %d fields, want 12: %q", len(msh), segs[0])
+	}
+	if msh[1] != `^~\&` {
+		t.Fatalf("MSH-2 = %q", msh[1])
+	}
+	checks := []struct {
+		field, got, want string
+	}{
+		{"MSH-3", msh[2], `Medi\F\Cart\S\1`},
+		{"MSH-4", msh[3], `North \T\ South\R\\E\`},
+		{"MSH-6", msh[5], `Lab\S\Main`},
+		{"PID-5", pid[5], `O\T\Brien\R\\E\x^Ann\F\Marie\S\Jo`},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s = %q, want %q", c.field, c.got, c.want)
+		}
+	}
+	family, given, _ := strings.Cut(pid[5], "^")
+	if got := hl7Unescaper.Replace(given) + " " + hl7Unescaper.Replace(family); got != rec.PatientName {
+		t.Errorf("PID-5 unescapes to %q, want %q", got, rec.PatientName)
+	}
+	if len(pid) != 6 {
+		t.Errorf("PID has %d fields, want 6: %q", len(pid), strings.Join(pid, "|"))
+	}
+	if len(byName["OBR"]) != 1 || len(byName["OBR"][0]) != 26 {
+		t.Errorf("want one OBR with 26 fields, got %q", byName["OBR"])
+	}
+	// Pulse, systolic, diastolic
+	if len(byName["OBX"]) != 3 {
+		t.Fatalf("got %d OBX segments, want 3", len(byName["OBX"]))
+	}
+	for _, obx := range byName["OBX"] {
+		if len(obx) != 15 {
+			t.Errorf("OBX has %d fields, want 15: %q", len(obx), strings.Join(obx, "|"))
+		}
+	}
+	if controlIDOf(msg) != msh[9] || msh[9] == "" {
+		t.Errorf("controlIDOf = %q, MSH-10 = %q", controlIDOf(msg), msh[9])
+	}
+
+	rec.RawData = map[string]interface{}{"note": `a|b`}
+	if msg := buildORU(d, rec, time.Now()); msg != "" {
+		t.Errorf("record without vitals built %q", msg)
+	}
+}
+
+// fakeReceiver accepts one MLLP connection on loopback and answers the
+// message it reads with MSA code and the message's control id, or with
+// controlID if set.
+func fakeReceiver(t *testing.T, code, controlID string) (addr string, got <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msg, err := readMLLP(bufio.NewReader(conn))
+		if err != nil {
+			ch <- ""
+			return
+		}
+		ch <- string(msg)
+		id := controlID
+		if id == "" {
+			id = controlIDOf(string(msg))
+		}
+		_, _ = conn.Write([]byte(mllpFrame("MSH|^~\\&|LIS|Lab|||20260301093000+0000||ACK|a1|P|2.5.1\rMSA|" + code + "|" + id + "\r")))
+	}()
+	return ln.Addr().String(), ch
+}
+
+func TestDeliverHL7(t *testing.T) {
+	oldConfig := config
+	t.Cleanup(func() { config = oldConfig })
+	config = defaultConfig()
+
+	tests := []struct {
+		name, code, controlID string
+		ok, permanent         bool
+	}{
+		{"accepted", "AA", "", true, false},
+		{"error", "AE", "", false, true},
+		{"rejected", "AR", "", false, false},
+		{"other message", "AA", "nope", false, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, got := fakeReceiver(t, tc.code, tc.controlID)
+			d := HL7Destination{Name: "lab", Addr: addr, Timeout: Duration(5 * time.Second)}
+			msg := buildORU(d, testRecord(), time.Now())
+			payload, _ := json.Marshal(msg)
+
+			err := deliverHL7(context.Background(), d, outboxJob{ID: "j1", Sink: "hl7-lab", Payload: payload})
+			if sent := <-got; sent != msg {
+				t.Fatalf("receiver got %q, want %q", sent, msg)
+			}
+			if tc.ok != (err == nil) || errors.Is(err, errPermanent) != tc.permanent {
+				t.Fatalf("deliverHL7 = %v, want ok %v, permanent %v", err, tc.ok, tc.permanent)
+			}
+		})
+	}
+
+	t.Run("refused", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+		payload, _ := json.Marshal("MSH|^~\\&")
+		err = deliverHL7(context.Background(), HL7Destination{Addr: addr}, outboxJob{Payload: payload})
+		if err == nil || errors.Is(err, errPermanent) {
+			t.Fatalf("deliverHL7 = %v, want a retryable error", err)
+		}
+	})
+}
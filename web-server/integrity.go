@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Damaged files are never overwritten. They are moved under
+// data/.quarantine/{time}/ with their path relative to data/ preserved, so an
+// encrypted file can still be decrypted with its original path as AAD (key
+// rotation leaves quarantined files alone). A ".reason" file records why.
+
+const quarantineDir = ".quarantine"
+
+func quarantine(path, reason string) error {
+	rel, err := filepath.Rel(dataDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("quarantine: %s is outside %s", path, dataDir)
+	}
+	dst := filepath.Join(dataDir, quarantineDir, time.Now().UTC().Format("20060102T150405.000Z"), rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(path, dst); err != nil {
+		return err
+	}
+	_ = os.WriteFile(dst+".reason", []byte(reason+"\n"), 0600)
+	quarantinedTotal.inc()
+	slog.Warn("Quarantined corrupt file", "path", path, "moved_to", dst, "reason", reason)
+	return nil
+}
+
+// --- Integrity scan ---
+
+type integrityProblem struct {
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+}
+
+// scanDataTree checks every file under dataDir: metric files must decrypt
+// and parse, recordings must have a valid WAV header, and with encryption
+// on every clinic/patient directory needs a readable name. Temp files left
+// by an interrupted write are removed. With fix, corrupt files are
+// quarantined.
+func scanDataTree(fix bool) (checked int, problems []integrityProblem) {
+	report := func(path, format string, args ...interface{}) {
+		problems = append(problems, integrityProblem{Path: path, Problem: fmt.Sprintf(format, args...)})
+	}
+	encrypted := encryptionEnabled()
+
+	err := filepath.WalkDir(dataDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			report(path, "%v", err)
+			return nil
+		}
+		rel, _ := filepath.Rel(dataDir, path)
+		depth := len(strings.Split(filepath.ToSlash(rel), "/"))
+		if d.IsDir() {
+			if d.Name() == quarantineDir || d.Name() == outboxDir || d.Name() == archiveDir {
+				return filepath.SkipDir // not metric files; the outbox checks its own
+			}
+			if encrypted && rel != "." && depth <= 2 && !strings.HasPrefix(d.Name(), ".") {
+				if _, err := readDataFile(filepath.Join(path, nameFile)); err != nil {
+					report(path, "directory name unreadable: %v", err)
+				}
+			}
+			return nil
+		}
+
+		name := d.Name()
+		if rel == lockName {
+			return nil
+		}
+		if strings.HasPrefix(name, ".") && strings.Contains(name, tmpMarker) {
+			// Recent ones may belong to a write that is still running.
+			if info, err := d.Info(); err != nil || time.Since(info.ModTime()) < time.Minute {
+				return nil
+			}
+			if err := os.Remove(path); err != nil {
+				report(path, "leftover temp file: %v", err)
+			} else {
+				report(path, "removed temp file left by an interrupted write")
+			}
+			return nil
+		}
+		checked++
+
+		if raw, err := os.ReadFile(path); err == nil && encrypted && !isEncrypted(raw) {
+			report(path, "not encrypted")
+		}
+		b, err := readDataFile(path)
+		if err == nil {
+			switch {
+			case strings.HasSuffix(name, ".json"):
+				var recs []Record
+				if jerr := json.Unmarshal(b, &recs); jerr != nil {
+					err = fmt.Errorf("%w: %v", errCorrupt, jerr)
+				}
+			case strings.HasSuffix(name, ".wav"):
+				if _, werr := readWAVInfo(bytes.NewReader(b)); werr != nil {
+					err = fmt.Errorf("%w: %v", errCorrupt, werr)
+				}
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		if fix && errors.Is(err, errCorrupt) {
+			if qerr := quarantine(path, err.Error()); qerr != nil {
+				report(path, "%v (quarantine failed: %v)", err, qerr)
+			} else {
+				report(path, "%v (quarantined)", err)
+			}
+			return nil
+		}
+		report(path, "%v", err)
+		return nil
+	})
+	if err != nil {
+		report(dataDir, "%v", err)
+	}
+	return checked, problems
+}
+
+// logIntegrityScan runs at startup; problems are reported, not fixed.
+func logIntegrityScan() {
+	start := time.Now()
+	checked, problems := scanDataTree(false)
+	for _, p := range problems {
+		slog.Warn("Integrity problem", "path", p.Path, "problem", p.Problem)
+	}
+	slog.Info("Integrity scan finished", "checked", checked, "problems", len(problems), "duration", time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// quarantined returns the quarantined copies of rel, a path under dataDir.
+func quarantined(t *testing.T, rel string) []string {
+	t.Helper()
+	found, err := filepath.Glob(filepath.Join(dataDir, quarantineDir, "*", rel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "heart_rate.json")
+	for _, data := range []string{"[1]", "[1,2]"} {
+		if err := writeFileAtomic(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := os.ReadFile(path); string(b) != data {
+			t.Fatalf("contents %q, want %q", b, data)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("mode %v, %v", info.Mode(), err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("temp files left behind: %d entries", len(entries))
+	}
+
+	// A failed write leaves the original alone and no temp file
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "x.json"), []byte("[]"), 0600); err == nil {
+		t.Fatal("write into a missing directory succeeded")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("failed write left %d entries", len(entries))
+	}
+}
+
+func TestSaveRecordQuarantinesDamagedFile(t *testing.T) {
+	setupIngestTest(t)
+	pdir, err := ensurePatientDir("North", "Ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(pdir, "temperature.json")
+	damaged := []byte(`[{"timestamp": "2026-03-01T09:00:00Z", "raw`)
+	if err := os.WriteFile(path, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	storeReading(t, 0, map[string]interface{}{"temp": 36.9})
+	recs, err := readRecords("North", "Ann", "temperature.json")
+	if err != nil || len(recs) != 1 || recs[0].RawData["temp"] != 36.9 {
+		t.Fatalf("new file: %v, %v", recs, err)
+	}
+	found := quarantined(t, filepath.Join("North", "Ann", "temperature.json"))
+	if len(found) != 1 {
+		t.Fatalf("quarantined copies: %v", found)
+	}
+	if b, _ := os.ReadFile(found[0]); !bytes.Equal(b, damaged) {
+		t.Fatal("quarantined copy differs from the damaged file")
+	}
+	if reason, err := os.ReadFile(found[0] + ".reason"); err != nil || len(reason) == 0 {
+		t.Fatalf("reason: %q, %v", reason, err)
+	}
+}
+
+func TestAppendAudioQuarantinesDamagedRecording(t *testing.T) {
+	setupIngestTest(t)
+	pdir, err := ensurePatientDir("North", "Ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(pdir, auscultationDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "s1.wav")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("x"), wavHeaderSize+10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendAudio("North", "Ann", "s1", 0, false, 8000, []int16{7}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if info, err := readWAVInfo(f); err != nil || info.Samples != 1 {
+		t.Fatalf("new recording: %+v, %v", info, err)
+	}
+	if found := quarantined(t, filepath.Join("North", "Ann", auscultationDir, "s1.wav")); len(found) != 1 {
+		t.Fatalf("quarantined copies: %v", found)
+	}
+}
+
+func TestScanDataTree(t *testing.T) {
+	setupIngestTest(t)
+	storeReading(t, 0, map[string]interface{}{"temp": 36.9})
+	pdir, err := patientDir("North", "Ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(pdir, "heart_rate.json")
+	if err := os.WriteFile(bad, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldTmp := filepath.Join(pdir, ".temperature.json"+tmpMarker+"1")
+	newTmp := filepath.Join(pdir, ".temperature.json"+tmpMarker+"2")
+	for _, p := range []string{oldTmp, newTmp} {
+		if err := os.WriteFile(p, []byte("[]"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(oldTmp, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	checked, problems := scanDataTree(false)
+	if checked != 2 || len(problems) != 2 {
+		t.Fatalf("checked %d, problems %+v", checked, problems)
+	}
+	if _, err := os.Stat(bad); err != nil {
+		t.Fatal("scan without fix moved the damaged file")
+	}
+	if _, err := os.Stat(oldTmp); !os.IsNotExist(err) {
+		t.Fatal("temp file of an interrupted write left behind")
+	}
+	if _, err := os.Stat(newTmp); err != nil {
+		t.Fatal("temp file of a running write removed")
+	}
+
+	_, problems = scanDataTree(true)
+	if len(problems) != 1 || problems[0].Path != bad || !strings.HasSuffix(problems[0].Problem, "(quarantined)") {
+		t.Fatalf("problems %+v", problems)
+	}
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Fatal("damaged file not quarantined")
+	}
+	if _, problems = scanDataTree(false); len(problems) != 0 {
+		t.Fatalf("problems after fix: %+v", problems)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Live stethoscope audio is relayed through a small per-stream jitter
+// buffer: chunks are held until jitterTarget worth of audio is queued and
+// then released at playback speed, smoothing out bursty uplinks.
+const (
+	jitterTarget = 200 * time.Millisecond
+	jitterMax    = time.Second
+)
+
+// jitterIdle is how long a stream may go without audio before its buffer
+// flushes whatever is left and retires. A variable so tests can shorten it.
+var jitterIdle = 10 * time.Second
+
+type audioFrame struct {
+	frame []byte // kind-tagged, as sent to subscribers
+	dur   time.Duration
+}
+
+type jitterBuffer struct {
+	key string
+	in  chan audioFrame
+}
+
+var (
+	jitters   = make(map[string]*jitterBuffer) // key: clinic|patient
+	jittersMu sync.Mutex
+)
+
+// relayAudio accepts an audio payload from the feed: a little-endian uint32
+// sample rate followed by 16-bit mono PCM.
+func relayAudio(key string, payload []byte) {
+	if len(payload) < 4 {
+		return
+	}
+	rate := binary.LittleEndian.Uint32(payload)
+	if rate == 0 {
+		return
+	}
+	samples := (len(payload) - 4) / 2
+	f := audioFrame{
+		frame: append([]byte{frameKindAudio}, payload...),
+		dur:   time.Duration(samples) * time.Second / time.Duration(rate),
+	}
+
+	// Lookup and send share the lock so the idle teardown in run cannot
+	// retire the buffer in between; the send never blocks.
+	jittersMu.Lock()
+	defer jittersMu.Unlock()
+	j := jitters[key]
+	if j == nil {
+		j = &jitterBuffer{key: key, in: make(chan audioFrame, 64)}
+		jitters[key] = j
+		go j.run()
+	}
+	select {
+	case j.in <- f:
+	default:
+		slog.Warn("Audio jitter buffer full, dropping chunk", "stream", key)
+	}
+}
+
+func (j *jitterBuffer) run() {
+	var (
+		queue    []audioFrame
+		buffered time.Duration
+		playing  bool
+		next     time.Time
+		lastIn   = time.Now()
+	)
+	idle := time.NewTicker(jitterIdle / 10)
+	defer idle.Stop()
+
+	for {
+		var release <-chan time.Time
+		if playing {
+			release = time.After(time.Until(next))
+		}
+		select {
+		case f := <-j.in:
+			lastIn = time.Now()
+			queue = append(queue, f)
+			buffered += f.dur
+			for buffered > jitterMax && len(queue) > 1 {
+				buffered -= queue[0].dur
+				queue = queue[1:]
+			}
+			if !playing && buffered >= jitterTarget {
+				playing = true
+				next = time.Now()
+			}
+		case <-release:
+			f := queue[0]
+			queue = queue[1:]
+			buffered -= f.dur
+			broadcastAudio(j.key, f.frame)
+			next = next.Add(f.dur)
+			if len(queue) == 0 {
+				// Underrun: rebuild the cushion before playing again.
+				playing = false
+				buffered = 0
+			}
+		case <-idle.C:
+			if time.Since(lastIn) < jitterIdle {
+				continue
+			}
+			// The session has ended. A tail shorter than jitterTarget never
+			// started playing; send it now rather than letting it leak into
+			// the next session for this patient.
+			for _, f := range queue {
+				broadcastAudio(j.key, f.frame)
+			}
+			queue, buffered, playing = nil, 0, false
+			jittersMu.Lock()
+			if len(j.in) > 0 {
+				jittersMu.Unlock()
+				continue
+			}
+			delete(jitters, j.key)
+			jittersMu.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// pcmPayload builds a feed audio payload of the given length at 8 kHz.
+func pcmPayload(d time.Duration, fill byte) []byte {
+	const rate = 8000
+	samples := int(d * rate / time.Second)
+	p := make([]byte, 4+2*samples)
+	binary.LittleEndian.PutUint32(p, rate)
+	for i := 4; i < len(p); i++ {
+		p[i] = fill
+	}
+	return p
+}
+
+func TestJitterBufferFlushesShortTailAndRetires(t *testing.T) {
+	defer func(d time.Duration) { jitterIdle = d }(jitterIdle)
+	jitterIdle = 50 * time.Millisecond
+
+	const key = "North|jitter-tail"
+	s := newSubscriber(key, nil, "test", true)
+	addSubscriber(s)
+	defer removeSubscriber(s)
+
+	// Well under jitterTarget, so playback never starts on its own.
+	payload := pcmPayload(jitterTarget/4, 0x11)
+	relayAudio(key, payload)
+
+	waitJitterRetired(t, key)
+
+	select {
+	case f := <-s.audio:
+		want := append([]byte{frameKindAudio}, payload...)
+		if !bytes.Equal(f.data, want) {
+			t.Fatalf("flushed frame = % x, want % x", f.data[:8], want[:8])
+		}
+	default:
+		t.Fatal("short final chunk was never sent to the subscriber")
+	}
+
+	// A new session starts from an empty buffer: nothing from the old one
+	// is waiting to be played.
+	relayAudio(key, pcmPayload(jitterTarget/4, 0x22))
+	time.Sleep(jitterIdle / 2)
+	select {
+	case f := <-s.audio:
+		t.Fatalf("unexpected frame before the new session filled its cushion: % x", f.data[:8])
+	default:
+	}
+	waitJitterRetired(t, key)
+}
+
+func waitJitterRetired(t *testing.T, key string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		jittersMu.Lock()
+		_, live := jitters[key]
+		jittersMu.Unlock()
+		if !live {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("jitter buffer was not retired after the stream went idle")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
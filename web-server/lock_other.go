@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package main
+
+import "os"
+
+// lockFile is a no-op where the platform has no file locks.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -1,24 +1,26 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-type DataStorage struct {
-	Records []Record `json:"records"`
-}
-
 type Record struct {
 	Timestamp   time.Time              `json:"timestamp"`
 	PatientName string                 `json:"patient_name"`
@@ -27,51 +29,146 @@ type Record struct {
 }
 
 var (
-	storageFile = "data.json"
-	fileMutex   sync.Mutex
+	fileMutex sync.Mutex
 
-	feedConn *websocket.Conn
-	wsMutex  sync.Mutex
+	feedConn   *websocket.Conn
+	feedClinic string // clinic last announced by the connected desktop
+	wsMutex    sync.Mutex
 
-	streams   = make(map[string]map[*websocket.Conn]bool) // key: clinic|patient
+	streams   = make(map[string]map[*subscriber]bool) // key: clinic|patient
 	streamsMu sync.Mutex
 )
 
 func main() {
-	ensureStorageFile()
-	ensureDataDir()
+	cfg, command, printOnly, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		os.Exit(2)
+	}
+	applyConfig(cfg)
+	if err := setupLogging(cfg.LogFormat, cfg.LogLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		os.Exit(2)
+	}
+	if printOnly {
+		printConfig(cfg)
+		return
+	}
+	if len(command) > 0 {
+		os.Exit(runAdminCommand(command))
+	}
+	if originAllowed("*") {
+		slog.Warn(`allowed_origins includes "*"; any website can call this API`)
+	}
 
-	http.HandleFunc("/api/ingest", handleIngest)
-	http.HandleFunc("/ws/feed", handleFeedWS)
-	http.HandleFunc("/ws/stream", handleStreamWS) // clinic & patient query params
-	http.HandleFunc("/api/feed/start", handleFeedStart)
-	http.HandleFunc("/api/feed/stop", handleFeedStop)
-	http.HandleFunc("/api/clinics", handleClinics)
-	http.HandleFunc("/clinics", handleClinics) // simple alias
-	http.HandleFunc("/api/camera/control", handleCameraControl)
-	http.HandleFunc("/api/clinic/", handleClinicRoutes)
-
-	port := ":8081"
-	fmt.Printf("Web Server starting on port %s...\n", port)
-	if err := http.ListenAndServe(port, nil); err != nil {
-		log.Fatal(err)
+	ensureDataDir()
+	if err := lockDataDir(); err != nil {
+		slog.Error("Locking data directory failed", "err", err)
+		os.Exit(1)
+	}
+	warnPlaintextData()
+	go logIntegrityScan()
+	if err := openAuditLog(); err != nil {
+		slog.Error("Opening audit log failed", "err", err)
+		os.Exit(1)
+	}
+	if err := setupFHIRPush(cfg.FHIR); err != nil {
+		slog.Error("FHIR push configuration", "err", err)
+		os.Exit(1)
+	}
+	setupHL7(cfg.HL7)
+	startOutbox()
+	startRetention()
+
+	// Desktops authenticate with an API key
+	http.HandleFunc("/api/ingest", requireDesktop(handleIngest))
+	http.HandleFunc("/api/ingest/batch", requireDesktop(handleIngestBatch))
+	http.HandleFunc("/ws/feed", trackWS(requireDesktop(handleFeedWS)))
+	http.HandleFunc("/ws/ingest", trackWS(requireDesktop(handleIngestWS)))
+
+	// Health and metrics are unauthenticated and carry no patient data
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	http.HandleFunc("/metrics", handleMetrics)
+
+	// Dashboard users authenticate with a login token
+	http.HandleFunc("/api/auth/login", handleLogin)
+	http.HandleFunc("/api/auth/me", requireUser(handleMe))
+	http.HandleFunc("/ws/stream", trackWS(requireUser(handleStreamWS))) // clinic & patient query params
+	http.HandleFunc("/api/feed/start", requireUser(handleFeedStart))
+	http.HandleFunc("/api/feed/stop", requireUser(handleFeedStop))
+	http.HandleFunc("/api/clinics", requireUser(handleClinics))
+	http.HandleFunc("/clinics", requireUser(handleClinics)) // simple alias
+	http.HandleFunc("/api/camera/control", requireUser(handleCameraControl))
+	http.HandleFunc("/api/clinic/", requireUser(handleClinicRoutes))
+	http.HandleFunc("/api/admin/streams", requireUser(handleAdminStreams))
+	http.HandleFunc("/api/admin/audit", requireUser(handleAdminAudit))
+	http.HandleFunc("/api/admin/audit/verify", requireUser(handleAdminAuditVerify))
+	http.HandleFunc("/api/admin/outbox", requireUser(handleAdminOutbox))
+	http.HandleFunc("/api/admin/outbox/retry", requireUser(handleAdminOutboxRetry))
+	http.HandleFunc("/api/admin/retention", requireUser(handleAdminRetention))
+	http.HandleFunc("/api/admin/retention/run", requireUser(handleAdminRetentionRun))
+	http.HandleFunc("/fhir/", requireUser(handleFHIR))
+
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		slog.Error("TLS configuration", "err", err)
+		os.Exit(1)
 	}
+
+	port := cfg.Listen
+	srv := &http.Server{Addr: port, TLSConfig: tlsConfig, Handler: withRequestID(http.DefaultServeMux)}
+	serveErr := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			slog.Info("Web Server starting", "addr", port, "tls", true)
+			serveErr <- srv.ListenAndServeTLS("", "")
+		} else {
+			slog.Info("Web Server starting", "addr", port, "tls", false)
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+
+	sig, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serveErr:
+		slog.Error("Server stopped", "err", err)
+		os.Exit(1)
+	case <-sig.Done():
+	}
+	stop() // a second signal kills the process immediately
+	slog.Info("Shutting down", "timeout", time.Duration(cfg.ShutdownTimeout))
+	shutdown(srv, time.Duration(cfg.ShutdownTimeout))
 }
 
 // --- CORS helpers ---
-func setCORS(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+func setCORS(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	switch {
+	case originAllowed("*"):
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	case origin != "" && originAllowed(origin):
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	default:
+		return // browsers block the response; non-browser clients ignore CORS
+	}
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Encoding, Authorization, X-API-Key, X-Request-ID")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 }
 
 func preflight(w http.ResponseWriter, r *http.Request) bool {
 	if r.Method == http.MethodOptions {
-		setCORS(w)
+		setCORS(w, r)
 		w.WriteHeader(http.StatusOK)
 		return true
 	}
-	setCORS(w)
+	setCORS(w, r)
 	return false
 }
 
@@ -90,12 +187,30 @@ func handleIngest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	ingestBytes.add(float64(len(body)))
 
 	var data map[string]interface{}
 	if err := json.Unmarshal(body, &data); err != nil {
+		ingestTotal.inc("unknown", "invalid")
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	status, msg := ingestItem(r, data)
+	if status != http.StatusOK {
+		http.Error(w, msg, status)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, msg)
+}
+
+// ingestItem stores one reading (or audio chunk) and returns the HTTP
+// status and message for it. Shared by /api/ingest and /api/ingest/batch.
+func ingestItem(r *http.Request, data map[string]interface{}) (int, string) {
+	metric := strings.TrimSuffix(metricFile(data), ".json")
+	if _, _, ok := audioChunk(data); ok {
+		metric = auscultationDir
+	}
 
 	patientName := "Unknown"
 	if name, ok := data["patient_name"].(string); ok {
@@ -105,38 +220,94 @@ func handleIngest(w http.ResponseWriter, r *http.Request) {
 	if name, ok := data["clinic_name"].(string); ok {
 		clinicName = name
 	}
+	if !validClinicName(clinicName) {
+		ingestTotal.inc(metric, "invalid")
+		return http.StatusBadRequest, "Invalid clinic name"
+	}
+	// A key issued to one clinic cannot write into another clinic's records
+	if p, ok := principalFrom(r.Context()); ok && p.Clinic != "" {
+		if _, given := data["clinic_name"].(string); !given {
+			clinicName = p.Clinic
+		} else if !sameClinic(clinicName, p.Clinic) {
+			audit(r, "ingest", clinicName, patientName, OutcomeDenied, "key bound to "+p.Clinic)
+			ingestTotal.inc(metric, OutcomeDenied)
+			return http.StatusForbidden, "API key not valid for this clinic"
+		}
+	}
+
+	if samples, rate, ok := audioChunk(data); ok {
+		session := sessionID(data, time.Now())
+		seq, hasSeq := audioSeq(data)
+		start := time.Now()
+		err := appendAudio(clinicName, patientName, session, seq, hasSeq, rate, samples)
+		storageSeconds.observe(time.Since(start).Seconds(), "audio")
+		if errors.Is(err, errDuplicate) {
+			ingestTotal.inc(metric, "duplicate")
+			logFor(r).Debug("Duplicate audio chunk skipped", "session", session)
+			return http.StatusOK, "Duplicate reading ignored"
+		}
+		ingestTotal.inc(metric, outcomeFor(err))
+		audit(r, "ingest", clinicName, patientName, outcomeFor(err), "auscultation/"+session+".wav")
+		if err != nil {
+			logFor(r).Error("Saving audio failed", "err", err)
+			return http.StatusInternalServerError, "Failed to save audio"
+		}
+		return http.StatusOK, "Data received successfully"
+	}
 
 	record := Record{
-		Timestamp:   time.Now(),
+		Timestamp:   readingTime(data, time.Now()),
 		PatientName: patientName,
 		ClinicName:  clinicName,
 		RawData:     data,
 	}
 
-	if err := saveRecord(record); err != nil {
-		log.Printf("Error saving record: %v", err)
-		http.Error(w, "Failed to save data", http.StatusInternalServerError)
-		return
+	start := time.Now()
+	err := saveRecord(record)
+	storageSeconds.observe(time.Since(start).Seconds(), "record")
+	if errors.Is(err, errDuplicate) {
+		// A resend, e.g. a batch retried after a lost response
+		ingestTotal.inc(metric, "duplicate")
+		logFor(r).Debug("Duplicate reading skipped", "metric", metric)
+		return http.StatusOK, "Duplicate reading ignored"
+	}
+	ingestTotal.inc(metric, outcomeFor(err))
+	audit(r, "ingest", clinicName, patientName, outcomeFor(err), metricFile(data))
+	if err != nil {
+		logFor(r).Error("Saving record failed", "err", err)
+		return http.StatusInternalServerError, "Failed to save data"
 	}
 
-	log.Printf("Received data for patient: %s", patientName)
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Data received successfully")
+	logFor(r).Debug("Record saved", "metric", metric)
+	queueOutbound(r, record)
+	return http.StatusOK, "Data received successfully"
 }
 
-func ensureStorageFile() {
-	fileMutex.Lock()
-	defer fileMutex.Unlock()
-
-	// no-op legacy
+// readingTime is when the reading was taken: the uploader's "timestamp"
+// (RFC 3339) if it sent one, which matters for batched uploads, else now.
+// Times in the future are not trusted.
+func readingTime(data map[string]interface{}, now time.Time) time.Time {
+	s, _ := data["timestamp"].(string)
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil || t.After(now.Add(time.Minute)) {
+		return now
+	}
+	return t
 }
 
+// errDuplicate means the reading is already stored: a record with the same
+// session_id and seq is in the file, or an audio chunk no later than the
+// last one appended to its recording.
+var errDuplicate = errors.New("duplicate reading")
+
+// saveRecord appends record to its metric file, unless a record with the
+// same session_id and seq is already there (errDuplicate).
 func saveRecord(record Record) error {
 	fileMutex.Lock()
 	defer fileMutex.Unlock()
 
-	dir := filepath.Join("data", safe(record.ClinicName), safe(record.PatientName))
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	dir, err := ensurePatientDir(record.ClinicName, record.PatientName)
+	if err != nil {
 		return err
 	}
 
@@ -147,8 +318,29 @@ func saveRecord(record Record) error {
 	path := filepath.Join(dir, filename)
 
 	var existing []Record
-	if b, err := os.ReadFile(path); err == nil && len(b) > 0 {
-		_ = json.Unmarshal(b, &existing)
+	b, err := readDataFile(path)
+	if err == nil && len(b) > 0 {
+		if jerr := json.Unmarshal(b, &existing); jerr != nil {
+			err = fmt.Errorf("%w: %v", errCorrupt, jerr)
+		}
+	}
+	if errors.Is(err, errCorrupt) {
+		// Keep the damaged file for inspection rather than overwrite it.
+		if err := quarantine(path, err.Error()); err != nil {
+			return err
+		}
+		existing, err = nil, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if hasReadingID(record) {
+		key := readingKey(record)
+		for _, rec := range existing {
+			if readingKey(rec) == key {
+				return errDuplicate
+			}
+		}
 	}
 	existing = append(existing, record)
 
@@ -156,25 +348,29 @@ func saveRecord(record Record) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0644)
+	return writeDataFile(path, data)
 }
 
 func ensureDataDir() {
-	_ = os.MkdirAll("data", 0755)
+	_ = os.MkdirAll(dataDir, 0755)
 }
 
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin: checkOrigin,
 }
 
 func handleFeedWS(w http.ResponseWriter, r *http.Request) {
 	var currentClinic = "Unknown"
 	var currentPatient = "Unknown"
+	p, _ := principalFrom(r.Context())
+	if p.Clinic != "" {
+		currentClinic = p.Clinic
+	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WS upgrade error: %v", err)
+		logFor(r).Warn("Feed WS upgrade failed", "err", err)
 		return
 	}
 	wsMutex.Lock()
@@ -182,19 +378,31 @@ func handleFeedWS(w http.ResponseWriter, r *http.Request) {
 		feedConn.Close()
 	}
 	feedConn = conn
+	feedClinic = currentClinic
 	wsMutex.Unlock()
 
-	log.Printf("Feed WS connected")
+	logFor(r).Info("Feed WS connected", "desktop", p.Name)
+	feedConnectionsTotal.inc()
+	audit(r, "feed_connect", p.Clinic, "", OutcomeOK, "")
 
 	for {
 		mt, msg, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("WS read error: %v", err)
+			logFor(r).Info("Feed WS disconnected", "desktop", p.Name, "err", err)
 			break
 		}
 		if mt == websocket.BinaryMessage {
 			key := streamKey(currentClinic, currentPatient)
-			broadcastFrame(key, msg)
+			switch kind, payload := splitFrame(msg); kind {
+			case frameKindVideo:
+				feedFramesTotal.inc("video")
+				broadcastFrame(key, payload)
+			case frameKindAudio:
+				feedFramesTotal.inc("audio")
+				relayAudio(key, payload)
+			default:
+				logFor(r).Warn("Feed WS unknown frame kind", "kind", kind)
+			}
 		} else {
 			// Expect JSON metadata: {"clinic_name": "...", "patient_name": "..."}
 			var meta struct {
@@ -202,14 +410,19 @@ func handleFeedWS(w http.ResponseWriter, r *http.Request) {
 				Patient string `json:"patient_name"`
 			}
 			if err := json.Unmarshal(msg, &meta); err == nil {
-				if meta.Clinic != "" {
+				if meta.Clinic != "" && validClinicName(meta.Clinic) && (p.Clinic == "" || sameClinic(meta.Clinic, p.Clinic)) {
 					currentClinic = meta.Clinic
+					wsMutex.Lock()
+					if feedConn == conn {
+						feedClinic = currentClinic
+					}
+					wsMutex.Unlock()
 				}
 				if meta.Patient != "" {
 					currentPatient = meta.Patient
 				}
 			} else {
-				log.Printf("WS text: %s", string(msg))
+				logFor(r).Warn("Feed WS unexpected text message", "bytes", len(msg))
 			}
 		}
 	}
@@ -217,15 +430,40 @@ func handleFeedWS(w http.ResponseWriter, r *http.Request) {
 	wsMutex.Lock()
 	if feedConn == conn {
 		feedConn = nil
+		feedClinic = ""
 	}
 	wsMutex.Unlock()
+	audit(r, "feed_disconnect", currentClinic, "", OutcomeOK, "")
+}
+
+// authorizeFeed checks that the caller may drive the connected desktop,
+// which belongs to whichever clinic it last announced. With no desktop
+// connected only the role is checked; sendControl then reports the 503.
+func authorizeFeed(w http.ResponseWriter, r *http.Request) bool {
+	wsMutex.Lock()
+	clinic := feedClinic
+	wsMutex.Unlock()
+	return authorize(w, r, PermControlCamera, clinic)
+}
+
+// sendControlAudited sends cmd to the desktop and records it in the audit log.
+func sendControlAudited(r *http.Request, action, cmd string) error {
+	wsMutex.Lock()
+	clinic := feedClinic
+	wsMutex.Unlock()
+	err := sendControl(cmd)
+	audit(r, action, clinic, "", outcomeFor(err), cmd)
+	return err
 }
 
 func handleFeedStart(w http.ResponseWriter, r *http.Request) {
 	if preflight(w, r) {
 		return
 	}
-	if err := sendControl("start"); err != nil {
+	if !authorizeFeed(w, r) {
+		return
+	}
+	if err := sendControlAudited(r, "feed_start", "start"); err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
@@ -237,7 +475,10 @@ func handleFeedStop(w http.ResponseWriter, r *http.Request) {
 	if preflight(w, r) {
 		return
 	}
-	if err := sendControl("stop"); err != nil {
+	if !authorizeFeed(w, r) {
+		return
+	}
+	if err := sendControlAudited(r, "feed_stop", "stop"); err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
@@ -267,6 +508,9 @@ func handleCameraControl(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if !authorizeFeed(w, r) {
+		return
+	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Failed to read body", http.StatusBadRequest)
@@ -280,7 +524,7 @@ func handleCameraControl(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid payload", http.StatusBadRequest)
 		return
 	}
-	if err := sendControl(req.Command); err != nil {
+	if err := sendControlAudited(r, "camera_command", req.Command); err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
@@ -293,25 +537,6 @@ func streamKey(clinic, patient string) string {
 	return safe(clinic) + "|" + safe(patient)
 }
 
-func broadcastFrame(key string, frame []byte) {
-	streamsMu.Lock()
-	conns := streams[key]
-	if len(conns) == 0 {
-		streamsMu.Unlock()
-		return // drop if no subscribers
-	}
-	for c := range conns {
-		if err := c.WriteMessage(websocket.BinaryMessage, frame); err != nil {
-			c.Close()
-			delete(conns, c)
-		}
-	}
-	if len(conns) == 0 {
-		delete(streams, key)
-	}
-	streamsMu.Unlock()
-}
-
 func handleStreamWS(w http.ResponseWriter, r *http.Request) {
 	clinic := r.URL.Query().Get("clinic")
 	patient := r.URL.Query().Get("patient")
@@ -319,26 +544,29 @@ func handleStreamWS(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "clinic and patient required", http.StatusBadRequest)
 		return
 	}
+	if !authorize(w, r, PermViewStream, clinic) {
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WS stream upgrade error: %v", err)
+		logFor(r).Warn("Stream WS upgrade failed", "err", err)
 		return
 	}
 	key := streamKey(clinic, patient)
 
-	streamsMu.Lock()
-	if streams[key] == nil {
-		streams[key] = make(map[*websocket.Conn]bool)
-	}
-	streams[key][conn] = true
-	streamsMu.Unlock()
+	// tagged=1 opts into kind-tagged frames and live stethoscope audio
+	tagged := r.URL.Query().Get("tagged") == "1"
+	sub := newSubscriber(key, conn, r.RemoteAddr, tagged)
+	addSubscriber(sub)
+	go sub.writeLoop()
 
 	// Attempt to start feed when a subscriber connects
 	if err := sendControl("start"); err != nil {
-		log.Printf("feed start error (ignored): %v", err)
+		logFor(r).Debug("Feed start not sent", "err", err)
 	}
 
-	log.Printf("Stream subscriber connected: %s", key)
+	logFor(r).Info("Stream subscriber connected", "stream", key)
+	audit(r, "stream_subscribe", clinic, patient, OutcomeOK, "")
 
 	for {
 		if _, _, err := conn.ReadMessage(); err != nil {
@@ -346,30 +574,18 @@ func handleStreamWS(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	streamsMu.Lock()
-	if m := streams[key]; m != nil {
-		delete(m, conn)
-		if len(m) == 0 {
-			delete(streams, key)
-		}
-	}
-	streamsMu.Unlock()
-	conn.Close()
+	remaining := removeSubscriber(sub)
+	sub.close()
 
 	// If no subscribers remain at all, try stopping feed
-	streamsMu.Lock()
-	remaining := 0
-	for _, m := range streams {
-		remaining += len(m)
-	}
-	streamsMu.Unlock()
 	if remaining == 0 {
 		if err := sendControl("stop"); err != nil {
-			log.Printf("feed stop error (ignored): %v", err)
+			logFor(r).Debug("Feed stop not sent", "err", err)
 		}
 	}
 
-	log.Printf("Stream subscriber disconnected: %s", key)
+	logFor(r).Info("Stream subscriber disconnected", "stream", key)
+	audit(r, "stream_unsubscribe", clinic, patient, OutcomeOK, "")
 }
 
 func metricFile(data map[string]interface{}) string {
@@ -406,24 +622,35 @@ func handleClinics(w http.ResponseWriter, r *http.Request) {
 	if preflight(w, r) {
 		return
 	}
-	entries, err := os.ReadDir("data")
+	if !authorize(w, r, PermReadData, "") {
+		return
+	}
+	names, err := listClinics()
 	if err != nil {
 		http.Error(w, "Failed to list clinics", http.StatusInternalServerError)
 		return
 	}
+	p, _ := principalFrom(r.Context())
 	var clinics []string
-	for _, e := range entries {
-		if e.IsDir() {
-			clinics = append(clinics, e.Name())
+	for _, name := range names {
+		if p.canAccessClinic(name) {
+			clinics = append(clinics, name)
 		}
 	}
+	audit(r, "list_clinics", "", "", OutcomeOK, "")
 	writeJSON(w, clinics)
 }
 
 // Routes under /api/clinic/{clinic}/...
 func handleClinicRoutes(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/api/clinic/")
+	// Split the escaped path so names containing "/" (sent as %2F) stay whole
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/api/clinic/")
 	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if s, err := url.PathUnescape(p); err == nil {
+			parts[i] = s
+		}
+	}
 	if len(parts) == 0 || parts[0] == "" {
 		http.NotFound(w, r)
 		return
@@ -433,16 +660,36 @@ func handleClinicRoutes(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	if r.Method != http.MethodOptions && !authorize(w, r, PermReadData, clinic) {
+		return
+	}
 	switch parts[1] {
 	case "patients":
 		handlePatients(w, r, clinic)
+	case "export":
+		handleClinicExport(w, r, clinic)
 	case "patient":
 		if len(parts) >= 4 && parts[3] == "data" {
 			patient := parts[2]
 			handlePatientData(w, r, clinic, patient)
+		} else if len(parts) >= 4 && parts[3] == "export" {
+			handlePatientExport(w, r, clinic, parts[2])
+		} else if len(parts) >= 4 && parts[3] == "report" {
+			handlePatientReport(w, r, clinic, parts[2])
+		} else if len(parts) >= 4 && parts[3] == "stats" {
+			handlePatientStats(w, r, clinic, parts[2])
+		} else if len(parts) >= 4 && parts[3] == "series" {
+			handlePatientSeries(w, r, clinic, parts[2])
 		} else if len(parts) >= 4 && parts[3] == "camera" {
 			patient := parts[2]
 			handlePatientCamera(w, r, clinic, patient)
+		} else if len(parts) >= 4 && parts[3] == "auscultation" {
+			patient := parts[2]
+			if len(parts) >= 5 && parts[4] != "" {
+				handleAuscultationAudio(w, r, clinic, patient, parts[4])
+			} else {
+				handleAuscultations(w, r, clinic, patient)
+			}
 		} else {
 			http.NotFound(w, r)
 		}
@@ -455,18 +702,12 @@ func handlePatients(w http.ResponseWriter, r *http.Request, clinic string) {
 	if preflight(w, r) {
 		return
 	}
-	dir := filepath.Join("data", clinic)
-	entries, err := os.ReadDir(dir)
+	patients, err := listPatients(clinic)
 	if err != nil {
 		http.Error(w, "Failed to list patients", http.StatusInternalServerError)
 		return
 	}
-	var patients []string
-	for _, e := range entries {
-		if e.IsDir() {
-			patients = append(patients, e.Name())
-		}
-	}
+	audit(r, "list_patients", clinic, "", OutcomeOK, "")
 	writeJSON(w, patients)
 }
 
@@ -474,9 +715,14 @@ func handlePatientData(w http.ResponseWriter, r *http.Request, clinic, patient s
 	if preflight(w, r) {
 		return
 	}
-	dir := filepath.Join("data", clinic, patient)
+	dir, err := patientDir(clinic, patient)
+	if err != nil {
+		http.Error(w, "Failed to read patient data", http.StatusInternalServerError)
+		return
+	}
 	files, err := os.ReadDir(dir)
 	if err != nil {
+		audit(r, "read_patient_data", clinic, patient, OutcomeError, err.Error())
 		http.Error(w, "Failed to read patient data", http.StatusInternalServerError)
 		return
 	}
@@ -487,7 +733,7 @@ func handlePatientData(w http.ResponseWriter, r *http.Request, clinic, patient s
 		}
 		name := f.Name()
 		if strings.HasSuffix(name, ".json") {
-			b, err := os.ReadFile(filepath.Join(dir, name))
+			b, err := readDataFile(filepath.Join(dir, name))
 			if err != nil {
 				continue
 			}
@@ -497,6 +743,7 @@ func handlePatientData(w http.ResponseWriter, r *http.Request, clinic, patient s
 			}
 		}
 	}
+	audit(r, "read_patient_data", clinic, patient, OutcomeOK, "")
 	writeJSON(w, result)
 }
 
@@ -504,8 +751,19 @@ func handlePatientCamera(w http.ResponseWriter, r *http.Request, clinic, patient
 	if preflight(w, r) {
 		return
 	}
-	path := filepath.Join("data", clinic, patient, "camera.jpg")
-	http.ServeFile(w, r, path)
+	dir, err := patientDir(clinic, patient)
+	if err != nil {
+		http.Error(w, "Failed to read snapshot", http.StatusInternalServerError)
+		return
+	}
+	f, _, modTime, err := openDataFile(filepath.Join(dir, "camera.jpg"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	audit(r, "read_camera_snapshot", clinic, patient, OutcomeOK, "")
+	http.ServeContent(w, r, "camera.jpg", modTime, f)
 }
 
 func writeJSON(w http.ResponseWriter, v interface{}) {
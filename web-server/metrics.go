@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal Prometheus text-format registry. Labels never carry clinic or
+// patient names, so /metrics can be scraped without a login.
+
+type metricKind string
+
+const (
+	kindCounter   metricKind = "counter"
+	kindGauge     metricKind = "gauge"
+	kindHistogram metricKind = "histogram"
+)
+
+type metric struct {
+	name, help string
+	kind       metricKind
+	labels     []string
+	buckets    []float64      // histograms only
+	fn         func() float64 // gauges computed at scrape time
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64 // per bucket, not cumulative
+	sum         float64
+	count       uint64
+}
+
+var (
+	metricsMu sync.Mutex
+	registry  []*metric
+)
+
+func register(m *metric) *metric {
+	m.series = make(map[string]*series)
+	metricsMu.Lock()
+	registry = append(registry, m)
+	metricsMu.Unlock()
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return register(&metric{name: name, help: help, kind: kindCounter, labels: labels})
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *metric {
+	return register(&metric{name: name, help: help, kind: kindGauge, fn: fn})
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	return register(&metric{name: name, help: help, kind: kindHistogram, labels: labels, buckets: buckets})
+}
+
+func (m *metric) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s := m.series[key]
+	if s == nil {
+		s = &series{labelValues: labelValues}
+		if m.kind == kindHistogram {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metric) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	m.get(labelValues).value += v
+	m.mu.Unlock()
+}
+
+func (m *metric) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	s := m.get(labelValues)
+	for i, b := range m.buckets {
+		if v <= b {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+	m.mu.Unlock()
+}
+
+func (m *metric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if m.fn != nil {
+		fmt.Fprintf(w, "%s %s\n", m.name, formatFloat(m.fn()))
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.labels) == 0 {
+		m.get(nil) // unlabeled series are reported from zero
+	}
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != kindHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labelString(m.labels, s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		var cum uint64
+		for i, b := range m.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelString(m.labels, s.labelValues, formatFloat(b)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelString(m.labels, s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labelString(m.labels, s.labelValues, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labelString(m.labels, s.labelValues, ""), s.count)
+	}
+}
+
+// labelEscaper escapes label values as the text format wants: only
+// backslash, double quote and newline.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelString(names, values []string, le string) string {
+	var parts []string
+	for i, n := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, n, labelEscaper.Replace(values[i])))
+	}
+	if le != "" {
+		parts = append(parts, fmt.Sprintf("le=%q", le))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// --- Server metrics ---
+
+var startTime = time.Now()
+
+var storageBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+var (
+	ingestTotal = newCounter("medicart_ingest_requests_total",
+		"Ingest requests by metric and outcome (ok, error, denied, invalid, duplicate).", "metric", "outcome")
+	ingestBytes = newCounter("medicart_ingest_bytes_total",
+		"Bytes of ingest request bodies received.")
+	ingestBatchesTotal = newCounter("medicart_ingest_batches_total",
+		"Batch ingest requests by body format (json, ndjson), and /ws/ingest connections (websocket).", "format")
+	storageSeconds = newHistogram("medicart_storage_write_seconds",
+		"Time to persist one ingest, by kind (record, audio).", storageBuckets, "kind")
+	quarantinedTotal = newCounter("medicart_storage_quarantined_files_total",
+		"Corrupt files moved to the quarantine directory.")
+	_ = newGaugeFunc("medicart_audit_last_seq",
+		"Sequence number of the last audit entry; it never goes down.", func() float64 {
+			auditMu.Lock()
+			defer auditMu.Unlock()
+			return float64(auditSeq)
+		})
+
+	feedConnectionsTotal = newCounter("medicart_feed_connections_total",
+		"Desktop feed WebSocket connections accepted.")
+	feedFramesTotal = newCounter("medicart_feed_frames_received_total",
+		"Binary frames received from the desktop feed, by kind (video, audio).", "kind")
+	_ = newGaugeFunc("medicart_feed_connected",
+		"Whether a desktop feed is connected (1) or not (0).", func() float64 {
+			wsMutex.Lock()
+			defer wsMutex.Unlock()
+			if feedConn != nil {
+				return 1
+			}
+			return 0
+		})
+
+	_ = newGaugeFunc("medicart_stream_subscribers",
+		"Dashboard viewers currently subscribed to a live stream.", func() float64 {
+			streamsMu.Lock()
+			defer streamsMu.Unlock()
+			n := 0
+			for _, m := range streams {
+				n += len(m)
+			}
+			return float64(n)
+		})
+	streamFramesSent = newCounter("medicart_stream_frames_sent_total",
+		"Frames written to stream subscribers.")
+	streamFramesDropped = newCounter("medicart_stream_frames_dropped_total",
+		"Frames dropped because a subscriber's queue was full.")
+
+	outboxDeliveries = newCounter("medicart_outbox_deliveries_total",
+		"Outbound delivery attempts by sink and outcome (ok, retry, failed).", "sink", "outcome")
+	retentionRemoved = newCounter("medicart_retention_removed_total",
+		"Expired records and recordings removed by retention, by metric and mode (archive, delete).", "metric", "mode")
+
+	_ = newGaugeFunc("medicart_uptime_seconds", "Seconds since the server started.", func() float64 {
+		return time.Since(startTime).Seconds()
+	})
+	_ = newGaugeFunc("go_goroutines", "Number of goroutines.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+)
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metricsMu.Lock()
+	ms := append([]*metric(nil), registry...)
+	metricsMu.Unlock()
+	for _, m := range ms {
+		m.write(w)
+	}
+}
+
+// --- Health ---
+
+// handleHealthz reports that the process is up.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether the server can take traffic: not shutting
+// down, storage writable, keys loadable and the audit log open.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+	check := func(name string, err error) {
+		if err != nil {
+			checks[name] = err.Error()
+			ready = false
+			return
+		}
+		checks[name] = "ok"
+	}
+
+	if shuttingDown.Load() {
+		check("shutdown", fmt.Errorf("shutting down"))
+	}
+	check("storage", storageWritable())
+	_, err := loadKeyring()
+	check("keyring", err)
+	auditMu.Lock()
+	if auditOut == nil {
+		err = fmt.Errorf("audit log not open")
+	} else {
+		err = nil
+	}
+	auditMu.Unlock()
+	check("audit_log", err)
+
+	status := "ready"
+	if !ready {
+		status = "not ready"
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, map[string]interface{}{"status": status, "checks": checks})
+}
+
+func storageWritable() error {
+	f, err := os.CreateTemp(dataDir, ".readyz"+tmpMarker+"*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// unregistered builds a metric the way register does, without adding it
+// to /metrics.
+func unregistered(m *metric) *metric {
+	m.series = make(map[string]*series)
+	return m
+}
+
+func TestHistogramWrite(t *testing.T) {
+	m := unregistered(&metric{name: "t_seconds", help: "Test.", kind: kindHistogram, labels: []string{"kind"}, buckets: []float64{.1, 1}})
+	for _, v := range []float64{.05, .1, .5, 3} {
+		m.observe(v, "record")
+	}
+	var buf bytes.Buffer
+	m.write(&buf)
+	want := `# HELP t_seconds Test.
+# TYPE t_seconds histogram
+t_seconds_bucket{kind="record",le="0.1"} 2
+t_seconds_bucket{kind="record",le="1"} 3
+t_seconds_bucket{kind="record",le="+Inf"} 4
+t_seconds_sum{kind="record"} 3.65
+t_seconds_count{kind="record"} 4
+`
+	if buf.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestCounterWrite(t *testing.T) {
+	plain := unregistered(&metric{name: "t_total", help: "Test.", kind: kindCounter})
+	var buf bytes.Buffer
+	plain.write(&buf)
+	if !strings.HasSuffix(buf.String(), "\nt_total 0\n") {
+		t.Fatalf("unlabeled counter before any add:\n%s", buf.String())
+	}
+
+	m := unregistered(&metric{name: "t_total", help: "Test.", kind: kindCounter, labels: []string{"outcome"}})
+	m.inc("ok")
+	m.add(2, "ok")
+	// Only backslash, quote and newline are escaped; other bytes pass as is
+	m.inc("a \"b\"\\\né\t")
+	buf.Reset()
+	m.write(&buf)
+	want := "# HELP t_total Test.\n# TYPE t_total counter\n" +
+		`t_total{outcome="a \"b\"\\\n` + "é\t" + `"} 1` + "\n" +
+		`t_total{outcome="ok"} 3` + "\n"
+	if buf.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deliveries to external systems go through an outbox: each one is a job
+// file under data/.outbox/{sink}/ (encrypted like any other data file), so
+// nothing is lost when the target is down or the server restarts. A worker
+// per sink delivers jobs oldest first. Retryable errors back off
+// exponentially between Config.Outbox.RetryMin and RetryMax; after
+// MaxAttempts, or on an errPermanent error, the job is marked failed and
+// kept until an admin retries it.
+
+const outboxDir = ".outbox"
+
+// errPermanent marks a delivery error that retrying will not fix, such as
+// the target rejecting the message.
+var errPermanent = errors.New("rejected")
+
+type outboxJob struct {
+	ID          string          `json:"id"`
+	Sink        string          `json:"sink"`
+	Clinic      string          `json:"clinic"`
+	Patient     string          `json:"patient"`
+	Created     time.Time       `json:"created"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+	Failed      bool            `json:"failed"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+}
+
+type outboxSink struct {
+	name    string
+	deliver func(ctx context.Context, job outboxJob) error
+	wake    chan struct{}
+
+	// Guarded by outboxMu. due indexes the pending jobs by id with their
+	// next attempt, so a pass only reads the job files that are due.
+	due     map[string]time.Time
+	indexed bool      // due has been filled from the job files
+	next    time.Time // when the worker wakes on its own; zero while it works
+	locks   map[string]*jobLock
+}
+
+// jobLock serialises a delivery and an admin retry of the same job, so
+// neither overwrites the other's update of the job file.
+type jobLock struct {
+	sync.Mutex
+	refs int // guarded by outboxMu
+}
+
+var (
+	outboxMu     sync.Mutex // job files and the sinks' indexes
+	outboxSinks  = map[string]*outboxSink{}
+	outboxCancel context.CancelFunc
+	outboxWG     sync.WaitGroup
+)
+
+// registerSink adds a delivery target. Call before startOutbox.
+func registerSink(name string, deliver func(ctx context.Context, job outboxJob) error) {
+	outboxSinks[name] = &outboxSink{
+		name:    name,
+		deliver: deliver,
+		wake:    make(chan struct{}, 1),
+		due:     map[string]time.Time{},
+		locks:   map[string]*jobLock{},
+	}
+}
+
+// lockJob takes the job's lock and returns the function that releases it.
+func (s *outboxSink) lockJob(id string) (unlock func()) {
+	outboxMu.Lock()
+	l := s.locks[id]
+	if l == nil {
+		l = &jobLock{}
+		s.locks[id] = l
+	}
+	l.refs++
+	outboxMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		outboxMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(s.locks, id)
+		}
+		outboxMu.Unlock()
+	}
+}
+
+// schedule records when job is next due, or forgets it once it is
+// delivered or has failed. Call with outboxMu held. The worker is woken if
+// it would otherwise sleep past the job.
+func (s *outboxSink) schedule(job outboxJob, done bool) {
+	if done || job.Failed {
+		delete(s.due, job.ID)
+		return
+	}
+	s.due[job.ID] = job.NextAttempt
+	if !s.next.IsZero() && job.NextAttempt.Before(s.next) {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func sinkDir(sink string) string {
+	return filepath.Join(dataDir, outboxDir, sink)
+}
+
+// enqueue stores a new job for sink; payload is marshalled to JSON.
+func enqueue(sink, clinic, patient string, payload interface{}) error {
+	s := outboxSinks[sink]
+	if s == nil {
+		return fmt.Errorf("outbox: unknown sink %q", sink)
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	job := outboxJob{
+		// Names sort by creation time
+		ID:          fmt.Sprintf("%d-%s", now.UnixNano(), hex.EncodeToString(suffix)),
+		Sink:        sink,
+		Clinic:      clinic,
+		Patient:     patient,
+		Created:     now,
+		NextAttempt: now,
+		Payload:     b,
+	}
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+	if err := saveJob(job); err != nil {
+		return err
+	}
+	s.schedule(job, false)
+	return nil
+}
+
+func saveJob(job outboxJob) error {
+	if err := os.MkdirAll(sinkDir(job.Sink), 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return writeDataFile(filepath.Join(sinkDir(job.Sink), job.ID+".json"), b)
+}
+
+// loadJobs returns the jobs of a sink, oldest first. Unreadable job files
+// are quarantined.
+func loadJobs(sink string) ([]outboxJob, error) {
+	entries, err := os.ReadDir(sinkDir(sink))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var jobs []outboxJob
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		path := filepath.Join(sinkDir(sink), name)
+		var job outboxJob
+		b, err := readDataFile(path)
+		if err == nil {
+			if jerr := json.Unmarshal(b, &job); jerr != nil {
+				err = fmt.Errorf("%w: %v", errCorrupt, jerr)
+			}
+		}
+		if errors.Is(err, errCorrupt) {
+			_ = quarantine(path, err.Error())
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs, nil
+}
+
+// loadJob reads one job file; ok is false once the job is gone.
+func loadJob(sink, id string) (job outboxJob, ok bool, err error) {
+	b, err := readDataFile(filepath.Join(sinkDir(sink), id+".json"))
+	if os.IsNotExist(err) {
+		return job, false, nil
+	}
+	if err == nil {
+		if jerr := json.Unmarshal(b, &job); jerr != nil {
+			err = fmt.Errorf("%w: %v", errCorrupt, jerr)
+		}
+	}
+	return job, err == nil, err
+}
+
+func removeJob(job outboxJob) error {
+	err := os.Remove(filepath.Join(sinkDir(job.Sink), job.ID+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// retryDelay doubles from RetryMin up to RetryMax.
+func retryDelay(attempts int) time.Duration {
+	d := time.Duration(config.Outbox.RetryMin)
+	for i := 1; i < attempts && d < time.Duration(config.Outbox.RetryMax); i++ {
+		d *= 2
+	}
+	if max := time.Duration(config.Outbox.RetryMax); d > max {
+		d = max
+	}
+	return d
+}
+
+// startOutbox starts one worker per registered sink.
+func startOutbox() {
+	ctx, cancel := context.WithCancel(context.Background())
+	outboxCancel = cancel
+	for _, s := range outboxSinks {
+		outboxWG.Add(1)
+		go func(s *outboxSink) {
+			defer outboxWG.Done()
+			s.run(ctx)
+		}(s)
+	}
+}
+
+// stopOutbox stops the workers. A delivery cut short is retried on the
+// next start.
+func stopOutbox() {
+	if outboxCancel == nil {
+		return
+	}
+	outboxCancel()
+	outboxWG.Wait()
+}
+
+func (s *outboxSink) run(ctx context.Context) {
+	for {
+		wait := s.pass(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-time.After(wait):
+		}
+		outboxMu.Lock()
+		s.next = time.Time{}
+		outboxMu.Unlock()
+	}
+}
+
+// index fills the due index from the job files, once. Call with outboxMu
+// held.
+func (s *outboxSink) index() error {
+	if s.indexed {
+		return nil
+	}
+	jobs, err := loadJobs(s.name)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if !job.Failed {
+			s.due[job.ID] = job.NextAttempt
+		}
+	}
+	s.indexed = true
+	return nil
+}
+
+// dueJobs returns the ids of the jobs due now, oldest first, and how long
+// until the next of the others. Call with outboxMu held.
+func (s *outboxSink) dueJobs() ([]string, time.Duration) {
+	wait := time.Minute
+	var ids []string
+	for id, at := range s.due {
+		if d := time.Until(at); d > 0 {
+			wait = min(wait, d)
+		} else {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, wait
+}
+
+// sleep records when the worker will next wake on its own, so an enqueue
+// from then on wakes it if the new job is due sooner. Call with outboxMu
+// held.
+func (s *outboxSink) sleep(wait time.Duration) time.Duration {
+	s.next = time.Now().Add(wait)
+	return wait
+}
+
+// pass delivers the jobs that are due and returns how long to sleep.
+// A retryable error ends the pass: the target is probably down, and the
+// remaining jobs would fail the same way.
+func (s *outboxSink) pass(ctx context.Context) time.Duration {
+	outboxMu.Lock()
+	if err := s.index(); err != nil {
+		outboxMu.Unlock()
+		slog.Error("Reading outbox failed", "sink", s.name, "err", err)
+		return time.Minute
+	}
+	ids, _ := s.dueJobs()
+	outboxMu.Unlock()
+
+	for _, id := range ids {
+		retry, stop := s.attempt(ctx, id)
+		if stop {
+			outboxMu.Lock()
+			defer outboxMu.Unlock()
+			_, wait := s.dueJobs()
+			return s.sleep(min(wait, retry))
+		}
+	}
+	// Jobs enqueued during the pass are due already
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+	due, wait := s.dueJobs()
+	if len(due) > 0 {
+		wait = 0
+	}
+	return s.sleep(wait)
+}
+
+// attempt delivers one job under its lock. stop ends the pass, after a
+// retryable error (with the delay before the retry) or on shutdown.
+func (s *outboxSink) attempt(ctx context.Context, id string) (retry time.Duration, stop bool) {
+	unlock := s.lockJob(id)
+	defer unlock()
+
+	// The file is the current state: an admin retry may have changed it
+	outboxMu.Lock()
+	job, ok, err := loadJob(s.name, id)
+	if errors.Is(err, errCorrupt) {
+		_ = quarantine(filepath.Join(sinkDir(s.name), id+".json"), err.Error())
+		ok, err = false, nil
+	}
+	if err != nil || !ok || job.Failed || time.Now().Before(job.NextAttempt) {
+		if err != nil {
+			slog.Error("Reading outbox job failed", "sink", s.name, "job", id, "err", err)
+		} else {
+			s.schedule(job, !ok)
+		}
+		outboxMu.Unlock()
+		return 0, false
+	}
+	outboxMu.Unlock()
+
+	err = s.deliver(ctx, job)
+	if ctx.Err() != nil {
+		return 0, true
+	}
+
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+	if err == nil {
+		if err := removeJob(job); err != nil {
+			slog.Error("Removing delivered outbox job failed", "sink", s.name, "job", job.ID, "err", err)
+		}
+		s.schedule(job, true)
+		outboxDeliveries.inc(s.name, "ok")
+		return 0, false
+	}
+	job.Attempts++
+	job.LastError = err.Error()
+	permanent := errors.Is(err, errPermanent)
+	if permanent || job.Attempts >= config.Outbox.MaxAttempts {
+		job.Failed = true
+	} else {
+		job.NextAttempt = time.Now().UTC().Add(retryDelay(job.Attempts))
+	}
+	if serr := saveJob(job); serr != nil {
+		slog.Error("Updating outbox job failed", "sink", s.name, "job", job.ID, "err", serr)
+	}
+	s.schedule(job, false)
+
+	if job.Failed {
+		outboxDeliveries.inc(s.name, "failed")
+		slog.Error("Delivery failed; giving up", "sink", s.name, "job", job.ID,
+			"clinic", job.Clinic, "attempts", job.Attempts, "err", err)
+		if permanent {
+			return 0, false
+		}
+	} else {
+		outboxDeliveries.inc(s.name, "retry")
+		slog.Warn("Delivery failed; will retry", "sink", s.name, "job", job.ID,
+			"attempts", job.Attempts, "retry_at", job.NextAttempt, "err", err)
+	}
+	return retryDelay(job.Attempts), true
+}
+
+// queueOutbound hands a stored record to the configured integrations.
+// Failing to queue is logged; the ingest itself has already succeeded.
+func queueOutbound(r *http.Request, rec Record) {
+	if err := queueFHIRPush(rec); err != nil {
+		logFor(r).Error("Queueing FHIR push failed", "err", err)
+	}
+	if err := queueHL7(rec); err != nil {
+		logFor(r).Error("Queueing HL7 message failed", "err", err)
+	}
+}
+
+// --- Admin: outbox status ---
+
+type outboxStatus struct {
+	Sink    string      `json:"sink"`
+	Pending int         `json:"pending"`
+	Failed  int         `json:"failed"`
+	Jobs    []outboxJob `json:"jobs"` // without payloads
+}
+
+// handleAdminOutbox lists the jobs of each sink: the failed ones by
+// default, or all with ?state=all. ?sink= limits it to one sink.
+func handleAdminOutbox(w http.ResponseWriter, r *http.Request) {
+	if preflight(w, r) {
+		return
+	}
+	if !authorize(w, r, PermAdmin, "") {
+		return
+	}
+	q := r.URL.Query()
+	out := []outboxStatus{}
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+	for name := range outboxSinks {
+		if q.Get("sink") != "" && q.Get("sink") != name {
+			continue
+		}
+		jobs, err := loadJobs(name)
+		if err != nil {
+			http.Error(w, "Failed to read outbox", http.StatusInternalServerError)
+			return
+		}
+		st := outboxStatus{Sink: name, Jobs: []outboxJob{}}
+		for _, job := range jobs {
+			if job.Failed {
+				st.Failed++
+			} else {
+				st.Pending++
+			}
+			if job.Failed || q.Get("state") == "all" {
+				job.Payload = nil
+				st.Jobs = append(st.Jobs, job)
+			}
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Sink < out[j].Sink })
+	audit(r, "outbox_status", "", "", OutcomeOK, r.URL.RawQuery)
+	writeJSON(w, out)
+}
+
+// handleAdminOutboxRetry requeues failed jobs: {"sink": "fhir", "id": "..."}
+// retries one job, without "id" every failed job of the sink.
+func handleAdminOutboxRetry(w http.ResponseWriter, r *http.Request) {
+	if preflight(w, r) {
+		return
+	}
+	if !authorize(w, r, PermAdmin, "") {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Sink string `json:"sink"`
+		ID   string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || outboxSinks[req.Sink] == nil {
+		http.Error(w, "Body must name a configured sink", http.StatusBadRequest)
+		return
+	}
+
+	s := outboxSinks[req.Sink]
+	outboxMu.Lock()
+	jobs, err := loadJobs(req.Sink)
+	outboxMu.Unlock()
+	n := 0
+	for _, job := range jobs {
+		if err != nil {
+			break
+		}
+		if !job.Failed || (req.ID != "" && job.ID != req.ID) {
+			continue
+		}
+		var ok bool
+		if ok, err = s.requeue(job.ID); ok {
+			n++
+		}
+	}
+	audit(r, "outbox_retry", "", "", outcomeFor(err), fmt.Sprintf("%s %s: %d jobs", req.Sink, req.ID, n))
+	if err != nil {
+		http.Error(w, "Failed to update outbox", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int{"requeued": n})
+}
+
+// requeue resets a failed job for immediate delivery, under its lock so it
+// cannot cross a delivery of the same job. ok is false if the job is no
+// longer failed.
+func (s *outboxSink) requeue(id string) (ok bool, err error) {
+	unlock := s.lockJob(id)
+	defer unlock()
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+	job, found, err := loadJob(s.name, id)
+	if err != nil || !found || !job.Failed {
+		return false, err
+	}
+	job.Failed, job.Attempts, job.NextAttempt = false, 0, time.Now().UTC()
+	if err := saveJob(job); err != nil {
+		return false, err
+	}
+	s.schedule(job, false)
+	return true, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A minimal PDF 1.4 writer for the patient report: A4 pages with text in
+// the standard Helvetica fonts (WinAnsi encoding, so Latin-1 text prints
+// as is), lines, rectangles and polylines. Coordinates are in points from
+// the top-left corner; the writer flips them for PDF.
+
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+)
+
+type pdfDoc struct {
+	pages []*bytes.Buffer
+	cur   *bytes.Buffer
+}
+
+func newPDF() *pdfDoc {
+	d := &pdfDoc{}
+	d.addPage()
+	return d
+}
+
+func (d *pdfDoc) addPage() {
+	d.cur = &bytes.Buffer{}
+	d.pages = append(d.pages, d.cur)
+}
+
+func pdfNum(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// pdfText encodes s as a PDF string in WinAnsi; other characters become '?'.
+func pdfText(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '–':
+			b.WriteString(`\226`)
+		case r == '—':
+			b.WriteString(`\227`)
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		case r >= 160 && r < 256:
+			fmt.Fprintf(&b, `\%03o`, r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// textWidth estimates the width of s in Helvetica; good enough to right-
+// align numbers and centre labels.
+func textWidth(s string, size float64) float64 {
+	w := 0.0
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune("il.,:;|'!", r):
+			w += 0.25
+		case strings.ContainsRune("mwMW", r):
+			w += 0.85
+		case r >= 'A' && r <= 'Z':
+			w += 0.66
+		default:
+			w += 0.54
+		}
+	}
+	return w * size
+}
+
+func (d *pdfDoc) Text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.cur, "BT /%s %s Tf %s %s Td %s Tj ET\n", font, pdfNum(size), pdfNum(x), pdfNum(pdfPageHeight-y), pdfText(s))
+}
+
+// TextRight draws s ending at x.
+func (d *pdfDoc) TextRight(x, y, size float64, bold bool, s string) {
+	d.Text(x-textWidth(s, size), y, size, bold, s)
+}
+
+func (d *pdfDoc) SetStroke(r, g, b float64) {
+	fmt.Fprintf(d.cur, "%s %s %s RG\n", pdfNum(r), pdfNum(g), pdfNum(b))
+}
+
+func (d *pdfDoc) SetFill(r, g, b float64) {
+	fmt.Fprintf(d.cur, "%s %s %s rg\n", pdfNum(r), pdfNum(g), pdfNum(b))
+}
+
+func (d *pdfDoc) SetLineWidth(w float64) {
+	fmt.Fprintf(d.cur, "%s w\n", pdfNum(w))
+}
+
+// SetDash sets a dash pattern; no arguments for solid lines.
+func (d *pdfDoc) SetDash(pattern ...float64) {
+	parts := make([]string, len(pattern))
+	for i, p := range pattern {
+		parts[i] = pdfNum(p)
+	}
+	fmt.Fprintf(d.cur, "[%s] 0 d\n", strings.Join(parts, " "))
+}
+
+func (d *pdfDoc) Line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(d.cur, "%s %s m %s %s l S\n", pdfNum(x1), pdfNum(pdfPageHeight-y1), pdfNum(x2), pdfNum(pdfPageHeight-y2))
+}
+
+// Rect strokes, or with fill fills, a rectangle whose top-left is x, y.
+func (d *pdfDoc) Rect(x, y, w, h float64, fill bool) {
+	op := "S"
+	if fill {
+		op = "f"
+	}
+	fmt.Fprintf(d.cur, "%s %s %s %s re %s\n", pdfNum(x), pdfNum(pdfPageHeight-y-h), pdfNum(w), pdfNum(h), op)
+}
+
+func (d *pdfDoc) Polyline(xs, ys []float64) {
+	for i := range xs {
+		op := "l"
+		if i == 0 {
+			op = "m"
+		}
+		fmt.Fprintf(d.cur, "%s %s %s ", pdfNum(xs[i]), pdfNum(pdfPageHeight-ys[i]), op)
+	}
+	d.cur.WriteString("S\n")
+}
+
+// WriteTo writes the document: catalog, page tree, the two fonts, then a
+// page and a compressed content stream per page, and the xref table.
+func (d *pdfDoc) WriteTo(w io.Writer) (int64, error) {
+	var out bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, p := range d.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfNum(pdfPageWidth), pdfNum(pdfPageHeight), 6+2*i))
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		zw.Write(p.Bytes())
+		zw.Close()
+		obj(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", z.Len(), z.Bytes()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.WriteTo(w)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPDFText(t *testing.T) {
+	tests := map[string]string{
+		"a (b) \\c":  `(a \(b\) \\c)`,
+		"09:00 – 10": `(09:00 \226 10)`,
+		"Ann — ok":   `(Ann \227 ok)`,
+		"37 °C":      `(37 \260C)`,
+		"Zoë":        `(Zo\353)`,
+		"→ ☺":        `(? ?)`,
+	}
+	for in, want := range tests {
+		if got := pdfText(in); got != want {
+			t.Errorf("pdfText(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+// checkPDF follows startxref to the xref table and checks that every entry
+// points at its object, and returns the page count of the page tree.
+func checkPDF(t *testing.T, b []byte) int {
+	t.Helper()
+	if !bytes.HasPrefix(b, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(b, []byte("%%EOF\n")) {
+		t.Fatal("missing header or trailer")
+	}
+	m := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(b)
+	if m == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	lines := strings.Split(string(b[xref:]), "\n")
+	if lines[0] != "xref" {
+		t.Fatalf("startxref %d points at %q", xref, lines[0])
+	}
+	var first, count int
+	if _, err := fmt.Sscan(lines[1], &first, &count); err != nil || first != 0 {
+		t.Fatalf("xref subsection %q", lines[1])
+	}
+	if lines[2] != "0000000000 65535 f " {
+		t.Fatalf("free entry %q", lines[2])
+	}
+	for i := 1; i < count; i++ {
+		entry := lines[2+i]
+		if len(entry) != 19 || !strings.HasSuffix(entry, " 00000 n ") {
+			t.Fatalf("xref entry %d %q is not 20 bytes", i, entry)
+		}
+		off, _ := strconv.Atoi(entry[:10])
+		if want := strconv.Itoa(i) + " 0 obj\n"; !bytes.HasPrefix(b[off:], []byte(want)) {
+			t.Fatalf("xref entry %d points at %q", i, b[off:min(off+12, len(b))])
+		}
+	}
+	if !bytes.Contains(b, []byte("/Size "+strconv.Itoa(count)+" ")) {
+		t.Fatalf("trailer /Size does not match %d xref entries", count)
+	}
+
+	kids := regexp.MustCompile(`/Kids \[([^\]]*)\] /Count (\d+)`).FindSubmatch(b)
+	if kids == nil {
+		t.Fatal("no page tree")
+	}
+	pages, _ := strconv.Atoi(string(kids[2]))
+	if n := len(strings.Fields(string(kids[1]))) / 3; n != pages {
+		t.Fatalf("/Count %d but %d kids", pages, n)
+	}
+	if n := bytes.Count(b, []byte("/Type /Page /Parent")); n != pages {
+		t.Fatalf("/Count %d but %d page objects", pages, n)
+	}
+	return pages
+}
+
+func TestPDFWriteTo(t *testing.T) {
+	d := newPDF()
+	d.Text(40, 40, 12, true, "Page one")
+	d.addPage()
+	d.Line(0, 0, 100, 100)
+	d.addPage()
+	d.Rect(10, 10, 50, 20, true)
+	var buf bytes.Buffer
+	n, err := d.WriteTo(&buf)
+	if err != nil || n != int64(buf.Len()) {
+		t.Fatalf("wrote %d of %d bytes: %v", n, buf.Len(), err)
+	}
+	if pages := checkPDF(t, buf.Bytes()); pages != 3 {
+		t.Fatalf("%d pages, want 3", pages)
+	}
+}
+
+func TestReportPDF(t *testing.T) {
+	setupIngestTest(t)
+	at := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	var recs []Record
+	for i := 0; i < 200; i++ {
+		recs = append(recs, Record{Timestamp: at.Add(time.Duration(i) * 30 * time.Minute), ClinicName: "North", PatientName: "Ann",
+			RawData: map[string]interface{}{"spo2": 88.0 + float64(i%10), "pr": 45.0 + float64(i%100), "temp": 36.5}})
+	}
+	doc := buildReport("North", "Ann", at, at.Add(100*time.Hour), recs, at.Add(101*time.Hour))
+	var buf bytes.Buffer
+	if _, err := doc.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if pages := checkPDF(t, buf.Bytes()); pages != len(doc.pages) || pages < 2 {
+		t.Fatalf("%d pages in the file, %d laid out", pages, len(doc.pages))
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Dashboard users have one role and a list of clinics they may see.
+// Admins see every clinic; "*" in Clinics grants the same scope to other
+// roles (e.g. a regional clinician).
+
+const (
+	RoleAdmin     = "admin"
+	RoleClinician = "clinician"
+	RoleNurse     = "nurse"
+	RoleViewer    = "viewer"
+)
+
+type Permission int
+
+const (
+	PermReadData      Permission = iota // listings, vitals, recordings, snapshots
+	PermViewStream                      // live camera/stethoscope feed
+	PermControlCamera                   // camera moves, feed start/stop
+	PermAdmin                           // admin endpoints
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleAdmin:     {PermReadData, PermViewStream, PermControlCamera, PermAdmin},
+	RoleClinician: {PermReadData, PermViewStream, PermControlCamera},
+	RoleNurse:     {PermReadData, PermViewStream},
+	RoleViewer:    {PermReadData},
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func (p Principal) can(perm Permission) bool {
+	for _, have := range rolePermissions[p.Role] {
+		if have == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessClinic compares names as storage does, so a name that only
+// differs in surrounding space selects the same clinic. Names storage would
+// fold into another clinic's directory are refused outright.
+func (p Principal) canAccessClinic(clinic string) bool {
+	if !validClinicName(clinic) {
+		return false
+	}
+	if p.Role == RoleAdmin {
+		return true
+	}
+	for _, c := range p.Clinics {
+		if c == "*" || sameClinic(c, clinic) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameClinic reports whether two clinic names select the same directory.
+func sameClinic(a, b string) bool {
+	return safePathName(a) == safePathName(b)
+}
+
+// validClinicName rejects names that safePathName changes beyond trimming:
+// "A/B" would share the directory A_B with the clinic "A_B".
+func validClinicName(name string) bool {
+	return safePathName(name) == safe(name)
+}
+
+// authorize checks the request's principal for perm and, when clinic is not
+// empty, for access to that clinic. It writes a 403 and returns false if
+// either check fails.
+func authorize(w http.ResponseWriter, r *http.Request, perm Permission, clinic string) bool {
+	setCORS(w, r)
+	p, ok := principalFrom(r.Context())
+	if !ok || !p.can(perm) {
+		audit(r, "access_denied", clinic, "", OutcomeDenied, r.Method+" "+r.URL.Path)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	if clinic != "" && !p.canAccessClinic(clinic) {
+		audit(r, "access_denied", clinic, "", OutcomeDenied, r.Method+" "+r.URL.Path)
+		http.Error(w, "Forbidden: no access to this clinic", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// parseClinics splits a comma separated -clinics flag value.
+func parseClinics(s string) []string {
+	var out []string
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func checkUserRole(role string, clinics []string) error {
+	if !validRole(role) {
+		return fmt.Errorf("unknown role %q (want admin, clinician, nurse or viewer)", role)
+	}
+	if role != RoleAdmin && len(clinics) == 0 {
+		return fmt.Errorf("role %s needs at least one clinic (-clinics)", role)
+	}
+	for _, c := range clinics {
+		if c != "*" && !validClinicName(c) {
+			return fmt.Errorf("clinic %q: names may not contain / or \\ or be . or ..", c)
+		}
+	}
+	return nil
+}
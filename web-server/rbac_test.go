@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizePermissions(t *testing.T) {
+	perms := []struct {
+		name string
+		perm Permission
+	}{
+		{"read", PermReadData},
+		{"stream", PermViewStream},
+		{"camera", PermControlCamera},
+		{"admin", PermAdmin},
+	}
+	// Allowed permissions per role, in the order of perms
+	roles := []struct {
+		role    string
+		allowed [4]bool
+	}{
+		{RoleAdmin, [4]bool{true, true, true, true}},
+		{RoleClinician, [4]bool{true, true, true, false}},
+		{RoleNurse, [4]bool{true, true, false, false}},
+		{RoleViewer, [4]bool{true, false, false, false}},
+		{"unknown", [4]bool{false, false, false, false}},
+	}
+	for _, rc := range roles {
+		for i, pc := range perms {
+			t.Run(rc.role+"/"+pc.name, func(t *testing.T) {
+				p := Principal{Kind: "user", Name: "u", Role: rc.role, Clinics: []string{"North"}}
+				got, code := runAuthorize(p, pc.perm, "")
+				if got != rc.allowed[i] {
+					t.Fatalf("authorize = %v (status %d), want %v", got, code, rc.allowed[i])
+				}
+				if !got && code != http.StatusForbidden {
+					t.Fatalf("status = %d, want 403", code)
+				}
+			})
+		}
+	}
+}
+
+func TestAuthorizeClinicScope(t *testing.T) {
+	tests := []struct {
+		name    string
+		role    string
+		clinics []string
+		clinic  string
+		want    bool
+	}{
+		{"admin any clinic", RoleAdmin, nil, "South", true},
+		{"clinician own clinic", RoleClinician, []string{"North"}, "North", true},
+		{"clinician other clinic", RoleClinician, []string{"North"}, "South", false},
+		{"nurse second clinic", RoleNurse, []string{"North", "East"}, "East", true},
+		{"nurse other clinic", RoleNurse, []string{"North", "East"}, "South", false},
+		{"viewer own clinic", RoleViewer, []string{"South"}, "South", true},
+		{"viewer other clinic", RoleViewer, []string{"South"}, "North", false},
+		{"viewer no clinics", RoleViewer, nil, "North", false},
+		{"wildcard", RoleViewer, []string{"*"}, "North", true},
+		{"case differs", RoleClinician, []string{"north"}, "North", false},
+		{"no clinic asked", RoleViewer, []string{"South"}, "", true},
+		{"surrounding space", RoleClinician, []string{"North"}, " North ", true},
+		{"grant with space", RoleClinician, []string{"North "}, "North", true},
+		{"slash shares a directory", RoleClinician, []string{"A_B"}, "A/B", false},
+		{"backslash shares a directory", RoleViewer, []string{"*"}, `A\B`, false},
+		{"admin slash", RoleAdmin, nil, "A/B", false},
+		{"dot dot", RoleAdmin, nil, "..", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := Principal{Kind: "user", Name: "u", Role: tc.role, Clinics: tc.clinics}
+			got, code := runAuthorize(p, PermReadData, tc.clinic)
+			if got != tc.want {
+				t.Fatalf("authorize = %v (status %d), want %v", got, code, tc.want)
+			}
+			if !got && code != http.StatusForbidden {
+				t.Fatalf("status = %d, want 403", code)
+			}
+		})
+	}
+}
+
+func TestAuthorizeWithoutPrincipal(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/clinics", nil)
+	w := httptest.NewRecorder()
+	if authorize(w, r, PermReadData, "") {
+		t.Fatal("authorize allowed a request without a principal")
+	}
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", w.Code)
+	}
+}
+
+func runAuthorize(p Principal, perm Permission, clinic string) (bool, int) {
+	r := httptest.NewRequest(http.MethodGet, "/api/clinic/x/patients", nil)
+	r = r.WithContext(withPrincipal(r.Context(), p))
+	w := httptest.NewRecorder()
+	ok := authorize(w, r, perm, clinic)
+	return ok, w.Code
+}
+
+func TestCheckUserRoleRejectsFoldedClinicNames(t *testing.T) {
+	if err := checkUserRole(RoleNurse, []string{"North", "*"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"A/B", `A\B`, ".", ".."} {
+		if err := checkUserRole(RoleNurse, []string{"North", c}); err == nil {
+			t.Errorf("clinic %q accepted", c)
+		}
+	}
+}
+
+func TestIngestClinicNames(t *testing.T) {
+	setupIngestTest(t)
+	ingest := func(p *Principal, clinic string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/ingest", nil)
+		if p != nil {
+			r = r.WithContext(withPrincipal(r.Context(), *p))
+		}
+		status, _ := ingestItem(r, map[string]interface{}{"clinic_name": clinic, "patient_name": "Ann", "temp": 36.6})
+		return status
+	}
+	bound := &Principal{Kind: "desktop", Name: "d1", Clinic: "North"}
+	if got := ingest(bound, " North"); got != http.StatusOK {
+		t.Fatalf("bound key, same clinic with a space: status %d", got)
+	}
+	if got := ingest(bound, "South"); got != http.StatusForbidden {
+		t.Fatalf("bound key, other clinic: status %d", got)
+	}
+	if got := ingest(nil, "North/South"); got != http.StatusBadRequest {
+		t.Fatalf("clinic with a slash: status %d", got)
+	}
+}
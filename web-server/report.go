@@ -0,0 +1,554 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// /api/clinic/{clinic}/patient/{patient}/report?from=&to= renders a PDF
+// for referrals: patient details, latest vitals, min/max/mean per
+// measurement, trend charts, the readings outside Config.Alerts and NEWS2
+// scores per hour. Readings are taken through the same mapping as the FHIR
+// Observations and the CSV export.
+
+const (
+	reportMargin    = 40.0
+	reportMaxAlerts = 40
+	reportMaxNEWS2  = 36
+)
+
+type reportPoint struct {
+	t time.Time
+	v float64
+}
+
+type reportSeries struct {
+	label  string
+	code   string // LOINC, for reference ranges and flags
+	unit   string
+	rgb    [3]float64
+	points []reportPoint
+}
+
+// reportData collects each measurement's readings, oldest first.
+func reportData(recs []Record) []*reportSeries {
+	series := []*reportSeries{
+		{label: "SpO2", code: "59408-5", unit: "%", rgb: [3]float64{0.1, 0.4, 0.8}},
+		{label: "Pulse", code: "8867-4", unit: "/min", rgb: [3]float64{0.8, 0.3, 0.1}},
+		{label: "Systolic", code: "8480-6", unit: "mmHg", rgb: [3]float64{0.8, 0.1, 0.1}},
+		{label: "Diastolic", code: "8462-4", unit: "mmHg", rgb: [3]float64{0.1, 0.3, 0.8}},
+		{label: "Glucose", code: "2339-0", unit: "mg/dL", rgb: [3]float64{0.5, 0.2, 0.6}},
+		{label: "Temperature", code: "8310-5", unit: "°C", rgb: [3]float64{0.8, 0.5, 0.0}},
+	}
+	byCode := map[string]*reportSeries{"2708-6": series[0]}
+	for _, s := range series {
+		byCode[s.code] = s
+	}
+	for _, rec := range recs {
+		for _, o := range observationsFor("", rec) {
+			qs, codes := obsValues(o)
+			for i, q := range qs {
+				if s := byCode[codes[i]]; s != nil {
+					s.points = append(s.points, reportPoint{rec.Timestamp, q.Value})
+				}
+			}
+		}
+	}
+	return series
+}
+
+func seriesByLabel(series []*reportSeries, label string) *reportSeries {
+	for _, s := range series {
+		if s.label == label {
+			return s
+		}
+	}
+	return nil
+}
+
+func reportTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04")
+}
+
+func round1(v float64) string {
+	return formatFloat(math.Round(v*10) / 10)
+}
+
+// --- NEWS2 ---
+
+// NEWS2 sub-scores (Royal College of Physicians, 2017), SpO2 scale 1.
+func news2SpO2(v float64) int {
+	switch {
+	case v <= 91:
+		return 3
+	case v <= 93:
+		return 2
+	case v <= 95:
+		return 1
+	}
+	return 0
+}
+
+func news2Systolic(v float64) int {
+	switch {
+	case v <= 90:
+		return 3
+	case v <= 100:
+		return 2
+	case v <= 110:
+		return 1
+	case v >= 220:
+		return 3
+	}
+	return 0
+}
+
+func news2Pulse(v float64) int {
+	switch {
+	case v <= 40:
+		return 3
+	case v <= 50:
+		return 1
+	case v <= 90:
+		return 0
+	case v <= 110:
+		return 1
+	case v <= 130:
+		return 2
+	}
+	return 3
+}
+
+func news2Temp(v float64) int {
+	switch {
+	case v <= 35.0:
+		return 3
+	case v <= 36.0:
+		return 1
+	case v <= 38.0:
+		return 0
+	case v <= 39.0:
+		return 1
+	}
+	return 2
+}
+
+func news2Risk(total int, anyThree bool) string {
+	switch {
+	case total >= 7:
+		return "High"
+	case total >= 5:
+		return "Medium"
+	case anyThree:
+		return "Low-medium"
+	}
+	return "Low"
+}
+
+type news2Row struct {
+	hour                       time.Time
+	spo2, pulse, systolic, tmp *float64
+	score                      int
+	risk                       string
+}
+
+// news2Hourly scores each hour with readings from the last value of each
+// parameter in that hour. Respiration rate and consciousness are not
+// measured and count as 0, and room air is assumed.
+func news2Hourly(series []*reportSeries) []news2Row {
+	rows := map[time.Time]*news2Row{}
+	fields := map[string]func(r *news2Row) **float64{
+		"SpO2":        func(r *news2Row) **float64 { return &r.spo2 },
+		"Pulse":       func(r *news2Row) **float64 { return &r.pulse },
+		"Systolic":    func(r *news2Row) **float64 { return &r.systolic },
+		"Temperature": func(r *news2Row) **float64 { return &r.tmp },
+	}
+	for label, field := range fields {
+		for _, p := range seriesByLabel(series, label).points {
+			h := p.t.UTC().Truncate(time.Hour)
+			if rows[h] == nil {
+				rows[h] = &news2Row{hour: h}
+			}
+			v := p.v
+			*field(rows[h]) = &v // points are oldest first, so the last wins
+		}
+	}
+
+	var out []news2Row
+	for _, r := range rows {
+		anyThree := false
+		add := func(v *float64, score func(float64) int) {
+			if v != nil {
+				s := score(*v)
+				r.score += s
+				anyThree = anyThree || s == 3
+			}
+		}
+		add(r.spo2, news2SpO2)
+		add(r.pulse, news2Pulse)
+		add(r.systolic, news2Systolic)
+		add(r.tmp, news2Temp)
+		r.risk = news2Risk(r.score, anyThree)
+		out = append(out, *r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].hour.Before(out[j].hour) })
+	return out
+}
+
+// --- Layout ---
+
+type reportWriter struct {
+	*pdfDoc
+	y float64
+}
+
+// need starts a new page unless h more points fit on this one.
+func (rw *reportWriter) need(h float64) {
+	if rw.y+h > pdfPageHeight-reportMargin {
+		rw.addPage()
+		rw.y = reportMargin
+	}
+}
+
+func (rw *reportWriter) heading(s string) {
+	rw.need(40)
+	rw.y += 12
+	rw.Text(reportMargin, rw.y, 13, true, s)
+	rw.y += 6
+	rw.SetStroke(0.6, 0.6, 0.6)
+	rw.Line(reportMargin, rw.y, pdfPageWidth-reportMargin, rw.y)
+	rw.y += 14
+}
+
+func (rw *reportWriter) para(s string) {
+	rw.need(14)
+	rw.Text(reportMargin, rw.y, 9, false, s)
+	rw.y += 13
+}
+
+type reportCol struct {
+	title string
+	x     float64 // left edge, or right edge when right is set
+	right bool
+}
+
+func (rw *reportWriter) table(cols []reportCol, rows [][]string) {
+	header := func() {
+		for _, c := range cols {
+			if c.right {
+				rw.TextRight(c.x, rw.y, 9, true, c.title)
+			} else {
+				rw.Text(c.x, rw.y, 9, true, c.title)
+			}
+		}
+		rw.y += 13
+	}
+	rw.need(26)
+	header()
+	for i, row := range rows {
+		if rw.y+13 > pdfPageHeight-reportMargin {
+			rw.need(26)
+			header()
+		}
+		if i%2 == 0 {
+			rw.SetFill(0.94, 0.95, 0.97)
+			rw.Rect(reportMargin-4, rw.y-9, pdfPageWidth-2*reportMargin+8, 12, true)
+			rw.SetFill(0, 0, 0)
+		}
+		for j, c := range cols {
+			if c.right {
+				rw.TextRight(c.x, rw.y, 9, false, row[j])
+			} else {
+				rw.Text(c.x, rw.y, 9, false, row[j])
+			}
+		}
+		rw.y += 12
+	}
+	rw.y += 6
+}
+
+// chart draws one or more series over [t0, t1] with dashed lines at the
+// normal range of each.
+func (rw *reportWriter) chart(title string, t0, t1 time.Time, series ...*reportSeries) {
+	const h, labelW = 110.0, 40.0
+	rw.need(h + 48)
+	rw.Text(reportMargin, rw.y, 10, true, title)
+	legendX := reportMargin + textWidth(title, 10) + 16
+	for _, s := range series {
+		if len(series) > 1 {
+			rw.SetFill(s.rgb[0], s.rgb[1], s.rgb[2])
+			rw.Rect(legendX, rw.y-6, 8, 6, true)
+			rw.SetFill(0, 0, 0)
+			rw.Text(legendX+11, rw.y, 8, false, s.label)
+			legendX += textWidth(s.label, 8) + 26
+		}
+	}
+	rw.y += 8
+	x0, w, y0 := reportMargin+labelW, pdfPageWidth-2*reportMargin-labelW, rw.y
+
+	lo, hi, n := math.Inf(1), math.Inf(-1), 0
+	for _, s := range series {
+		for _, p := range s.points {
+			lo, hi = math.Min(lo, p.v), math.Max(hi, p.v)
+			n++
+		}
+		if rlo, rhi, ok := referenceRange(s.code); ok && n > 0 {
+			lo, hi = math.Min(lo, rlo), math.Max(hi, rhi)
+		}
+	}
+	rw.SetStroke(0.5, 0.5, 0.5)
+	rw.SetLineWidth(0.5)
+	rw.Rect(x0, y0, w, h, false)
+	if n == 0 {
+		rw.Text(x0+w/2-30, y0+h/2, 9, false, "No readings")
+		rw.y += h + 20
+		return
+	}
+	pad := (hi - lo) * 0.08
+	if pad == 0 {
+		pad = 1
+	}
+	lo, hi = lo-pad, hi+pad
+	yOf := func(v float64) float64 { return y0 + h - (v-lo)/(hi-lo)*h }
+	xOf := func(t time.Time) float64 {
+		span := t1.Sub(t0)
+		if span <= 0 {
+			return x0 + w/2
+		}
+		return x0 + float64(t.Sub(t0))/float64(span)*w
+	}
+
+	// Grid and value labels
+	rw.SetStroke(0.88, 0.88, 0.88)
+	for i := 0; i <= 4; i++ {
+		v := lo + (hi-lo)*float64(i)/4
+		y := yOf(v)
+		if i > 0 && i < 4 {
+			rw.Line(x0, y, x0+w, y)
+		}
+		rw.TextRight(x0-4, y+3, 7, false, round1(v))
+	}
+	rw.Text(x0, y0+h+10, 7, false, reportTime(t0))
+	rw.TextRight(x0+w, y0+h+10, 7, false, reportTime(t1))
+
+	for _, s := range series {
+		r, g, b := s.rgb[0], s.rgb[1], s.rgb[2]
+		if rlo, rhi, ok := referenceRange(s.code); ok {
+			rw.SetStroke(r, g, b)
+			rw.SetDash(3, 3)
+			for _, v := range []float64{rlo, rhi} {
+				rw.Line(x0, yOf(v), x0+w, yOf(v))
+			}
+			rw.SetDash()
+		}
+		if len(s.points) == 0 {
+			continue
+		}
+		xs, ys := make([]float64, len(s.points)), make([]float64, len(s.points))
+		for i, p := range s.points {
+			xs[i], ys[i] = xOf(p.t), yOf(p.v)
+		}
+		rw.SetStroke(r, g, b)
+		rw.SetLineWidth(1)
+		if len(xs) > 1 {
+			rw.Polyline(xs, ys)
+		}
+		if len(xs) <= 60 {
+			rw.SetFill(r, g, b)
+			for i := range xs {
+				rw.Rect(xs[i]-1.5, ys[i]-1.5, 3, 3, true)
+			}
+			rw.SetFill(0, 0, 0)
+		}
+		rw.SetLineWidth(0.5)
+	}
+	rw.y += h + 24
+}
+
+// buildReport lays out the whole report.
+func buildReport(clinic, patient string, from, to time.Time, recs []Record, now time.Time) *pdfDoc {
+	rw := &reportWriter{pdfDoc: newPDF(), y: reportMargin}
+	series := reportData(recs)
+
+	rw.Text(reportMargin, rw.y+10, 18, true, "Vitals Report")
+	rw.y += 34
+	period := "All readings"
+	switch {
+	case !from.IsZero() && !to.IsZero():
+		period = reportTime(from) + " – " + reportTime(to) + " UTC"
+	case !from.IsZero():
+		period = "From " + reportTime(from) + " UTC"
+	case !to.IsZero():
+		period = "Until " + reportTime(to) + " UTC"
+	}
+	details := [][2]string{
+		{"Patient", patient},
+		{"Clinic", clinic},
+		{"Patient ID", fhirPatientID(clinic, patient)},
+		{"Period", period},
+		{"Readings", strconv.Itoa(len(recs))},
+		{"Generated", reportTime(now) + " UTC"},
+	}
+	for _, d := range details {
+		rw.Text(reportMargin, rw.y, 10, true, d[0]+":")
+		rw.Text(reportMargin+80, rw.y, 10, false, d[1])
+		rw.y += 14
+	}
+
+	// Latest vitals
+	rw.heading("Latest vitals")
+	var rows [][]string
+	for _, s := range series {
+		if len(s.points) == 0 {
+			continue
+		}
+		p := s.points[len(s.points)-1]
+		rows = append(rows, []string{s.label, formatFloat(p.v), s.unit, reportTime(p.t), abnormalFlag(s.code, p.v)})
+	}
+	if len(rows) == 0 {
+		rw.para("No readings in this period.")
+	} else {
+		rw.table([]reportCol{{"Measurement", 40, false}, {"Value", 200, true}, {"Unit", 215, false},
+			{"Taken (UTC)", 290, false}, {"Flag", 420, false}}, rows)
+	}
+
+	// Summary statistics
+	rw.heading("Summary")
+	rows = nil
+	for _, s := range series {
+		if len(s.points) == 0 {
+			continue
+		}
+		lo, hi, sum, abnormal := math.Inf(1), math.Inf(-1), 0.0, 0
+		for _, p := range s.points {
+			lo, hi, sum = math.Min(lo, p.v), math.Max(hi, p.v), sum+p.v
+			if f := abnormalFlag(s.code, p.v); f == "L" || f == "H" {
+				abnormal++
+			}
+		}
+		rows = append(rows, []string{s.label, strconv.Itoa(len(s.points)), formatFloat(lo), formatFloat(hi),
+			round1(sum / float64(len(s.points))), s.unit, strconv.Itoa(abnormal)})
+	}
+	if len(rows) == 0 {
+		rw.para("No readings in this period.")
+	} else {
+		rw.table([]reportCol{{"Measurement", 40, false}, {"Readings", 190, true}, {"Min", 250, true},
+			{"Max", 310, true}, {"Mean", 370, true}, {"Unit", 385, false}, {"Out of range", 520, true}}, rows)
+	}
+
+	// Trend charts over the period actually covered
+	rw.heading("Trends")
+	var t0, t1 time.Time
+	for _, s := range series {
+		for _, p := range s.points {
+			if t0.IsZero() || p.t.Before(t0) {
+				t0 = p.t
+			}
+			if p.t.After(t1) {
+				t1 = p.t
+			}
+		}
+	}
+	rw.chart("SpO2 (%)", t0, t1, seriesByLabel(series, "SpO2"))
+	rw.chart("Pulse (/min)", t0, t1, seriesByLabel(series, "Pulse"))
+	rw.chart("Blood pressure (mmHg)", t0, t1, seriesByLabel(series, "Systolic"), seriesByLabel(series, "Diastolic"))
+	rw.chart("Glucose (mg/dL)", t0, t1, seriesByLabel(series, "Glucose"))
+	rw.chart("Temperature (°C)", t0, t1, seriesByLabel(series, "Temperature"))
+
+	// Alerts: readings outside the configured ranges
+	rw.heading("Alerts")
+	type alert struct {
+		t   time.Time
+		row []string
+	}
+	var alerts []alert
+	for _, s := range series {
+		lo, hi, _ := referenceRange(s.code)
+		for _, p := range s.points {
+			if f := abnormalFlag(s.code, p.v); f == "L" || f == "H" {
+				alerts = append(alerts, alert{p.t, []string{reportTime(p.t), s.label,
+					formatFloat(p.v) + " " + s.unit, f, formatFloat(lo) + "–" + formatFloat(hi)}})
+			}
+		}
+	}
+	sort.SliceStable(alerts, func(i, j int) bool { return alerts[i].t.Before(alerts[j].t) })
+	if len(alerts) == 0 {
+		rw.para("No readings outside the normal ranges.")
+	} else {
+		if len(alerts) > reportMaxAlerts {
+			rw.para(fmt.Sprintf("%d readings outside the normal ranges; the latest %d are listed.", len(alerts), reportMaxAlerts))
+			alerts = alerts[len(alerts)-reportMaxAlerts:]
+		}
+		rows = nil
+		for _, a := range alerts {
+			rows = append(rows, a.row)
+		}
+		rw.table([]reportCol{{"Time (UTC)", 40, false}, {"Measurement", 140, false}, {"Value", 240, false},
+			{"Flag", 330, false}, {"Normal range", 370, false}}, rows)
+	}
+
+	// NEWS2
+	rw.heading("NEWS2")
+	rw.para("Hourly National Early Warning Score 2 from the last SpO2, pulse, systolic pressure and temperature")
+	rw.para("of each hour. Respiration rate and consciousness are not measured and room air is assumed,")
+	rw.para("so the scores are a lower bound.")
+	rw.y += 4
+	news := news2Hourly(series)
+	if len(news) == 0 {
+		rw.para("No readings to score.")
+	} else {
+		if len(news) > reportMaxNEWS2 {
+			rw.para(fmt.Sprintf("Showing the latest %d of %d hours.", reportMaxNEWS2, len(news)))
+			news = news[len(news)-reportMaxNEWS2:]
+		}
+		opt := func(v *float64) string {
+			if v == nil {
+				return "-"
+			}
+			return formatFloat(*v)
+		}
+		rows = nil
+		for _, n := range news {
+			rows = append(rows, []string{reportTime(n.hour), opt(n.spo2), opt(n.pulse), opt(n.systolic), opt(n.tmp),
+				strconv.Itoa(n.score), n.risk})
+		}
+		rw.table([]reportCol{{"Hour (UTC)", 40, false}, {"SpO2", 180, true}, {"Pulse", 230, true},
+			{"Systolic", 290, true}, {"Temp", 340, true}, {"Score", 400, true}, {"Risk", 420, false}}, rows)
+	}
+
+	// Footer on every page
+	for i, p := range rw.pages {
+		rw.cur = p
+		rw.SetFill(0.4, 0.4, 0.4)
+		rw.Text(reportMargin, pdfPageHeight-20, 8, false, patient+" – "+clinic)
+		rw.TextRight(pdfPageWidth-reportMargin, pdfPageHeight-20, 8, false, fmt.Sprintf("Page %d of %d", i+1, len(rw.pages)))
+	}
+	return rw.pdfDoc
+}
+
+func handlePatientReport(w http.ResponseWriter, r *http.Request, clinic, patient string) {
+	if preflight(w, r) {
+		return
+	}
+	from, to, err := parseRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, "from/to must be RFC 3339 timestamps or YYYY-MM-DD dates", http.StatusBadRequest)
+		return
+	}
+	recs, err := patientRecords(clinic, patient, from, to)
+	if err != nil {
+		audit(r, "report", clinic, patient, OutcomeError, err.Error())
+		http.Error(w, "Failed to read patient data", http.StatusInternalServerError)
+		return
+	}
+	doc := buildReport(clinic, patient, from, to, recs, time.Now())
+	audit(r, "report", clinic, patient, OutcomeOK, r.URL.RawQuery)
+	attachment(w, "application/pdf", safePathName(patient)+"_report.pdf")
+	if _, err := doc.WriteTo(w); err != nil {
+		logFor(r).Warn("Writing report failed", "err", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNEWS2SubScores(t *testing.T) {
+	tests := []struct {
+		name  string
+		score func(float64) int
+		cases map[float64]int
+	}{
+		{"spo2", news2SpO2, map[float64]int{85: 3, 91: 3, 92: 2, 93: 2, 94: 1, 95: 1, 96: 0, 100: 0}},
+		{"pulse", news2Pulse, map[float64]int{30: 3, 40: 3, 41: 1, 50: 1, 51: 0, 90: 0, 91: 1, 110: 1, 111: 2, 130: 2, 131: 3, 180: 3}},
+		{"systolic", news2Systolic, map[float64]int{80: 3, 90: 3, 91: 2, 100: 2, 101: 1, 110: 1, 111: 0, 219: 0, 220: 3, 250: 3}},
+		{"temperature", news2Temp, map[float64]int{34: 3, 35.0: 3, 35.1: 1, 36.0: 1, 36.1: 0, 38.0: 0, 38.1: 1, 39.0: 1, 39.1: 2, 41: 2}},
+	}
+	for _, tc := range tests {
+		for v, want := range tc.cases {
+			if got := tc.score(v); got != want {
+				t.Errorf("%s %v: score %d, want %d", tc.name, v, got, want)
+			}
+		}
+	}
+}
+
+func TestNEWS2Risk(t *testing.T) {
+	tests := []struct {
+		total    int
+		anyThree bool
+		want     string
+	}{
+		{0, false, "Low"},
+		{4, false, "Low"},
+		{3, true, "Low-medium"},
+		{4, true, "Low-medium"},
+		{5, false, "Medium"},
+		{6, true, "Medium"},
+		{7, false, "High"},
+		{12, true, "High"},
+	}
+	for _, tc := range tests {
+		if got := news2Risk(tc.total, tc.anyThree); got != tc.want {
+			t.Errorf("news2Risk(%d, %v) = %q, want %q", tc.total, tc.anyThree, got, tc.want)
+		}
+	}
+}
+
+func TestNEWS2Hourly(t *testing.T) {
+	at := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	rec := func(offset time.Duration, data map[string]interface{}) Record {
+		return Record{Timestamp: at.Add(offset), ClinicName: "North", PatientName: "Ann", RawData: data}
+	}
+	rows := news2Hourly(reportData([]Record{
+		// 09:00: the later pulse in the hour is the one scored
+		rec(5*time.Minute, map[string]interface{}{"spo2": 97.0, "pr": 140.0}),
+		rec(40*time.Minute, map[string]interface{}{"spo2": 93.0, "pr": 95.0}),
+		rec(50*time.Minute, map[string]interface{}{"temp": 36.5}),
+		// 11:00: one parameter scores 3
+		rec(2*time.Hour+10*time.Minute, map[string]interface{}{"sys": 85.0, "dia": 60.0}),
+		// 10:00, recorded out of order
+		rec(time.Hour+30*time.Minute, map[string]interface{}{"spo2": 90.0, "pr": 135.0, "sys": 95.0, "dia": 60.0, "temp": 39.5}),
+	}))
+	want := []struct {
+		hour  time.Time
+		score int
+		risk  string
+	}{
+		{at, 3, "Low"},                           // SpO2 2 + pulse 1
+		{at.Add(time.Hour), 10, "High"},          // 3 + 3 + 2 + 2
+		{at.Add(2 * time.Hour), 3, "Low-medium"}, // systolic 3
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(rows), len(want))
+	}
+	for i, w := range want {
+		r := rows[i]
+		if !r.hour.Equal(w.hour) || r.score != w.score || r.risk != w.risk {
+			t.Errorf("row %d = %v score %d %s, want %v score %d %s", i, r.hour, r.score, r.risk, w.hour, w.score, w.risk)
+		}
+	}
+	if rows[0].tmp == nil || *rows[0].tmp != 36.5 || rows[0].systolic != nil {
+		t.Errorf("first hour took the wrong readings: %+v", rows[0])
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config.Retention keeps each metric for a number of days, with per-clinic
+// overrides. A background job runs every Retention.Interval and removes
+// what is older: records from the metric files, by reading time (blood
+// pressure results by the bp limit, though they are kept in heart_rate.json),
+// and auscultation recordings, by their last write. In "archive" mode the
+// removed data is first written to data/.archive/{clinic}/{patient}/{time}.zip
+// (encrypted like any other data file, and re-keyed on rotation); in
+// "delete" mode it is gone. GET /api/admin/retention reports what a run
+// would remove without changing anything.
+
+const archiveDir = ".archive"
+
+// retentionFiles are the metric files each retention metric applies to;
+// "auscultation" is the recordings directory instead. Blood pressure
+// results also carry "pr" and are stored in heart_rate.json, so
+// recordMetric decides per record.
+var retentionFiles = map[string]string{
+	"heart_rate":  "heart_rate.json",
+	"bp":          "bp.json",
+	"glucose":     "glucose.json",
+	"temperature": "temperature.json",
+	"stethoscope": "stethoscope.json",
+	"misc":        "misc.json",
+}
+
+// recordMetric is the retention metric for a record in the metric file
+// of metric: a blood pressure result follows the bp policy wherever it is
+// stored.
+func recordMetric(metric string, rec Record) string {
+	_, sys := numField(rec.RawData, "sys")
+	_, dia := numField(rec.RawData, "dia")
+	if sys || dia {
+		return "bp"
+	}
+	return metric
+}
+
+var (
+	retentionMu     sync.Mutex // one run at a time
+	retentionCancel context.CancelFunc
+	retentionWG     sync.WaitGroup
+)
+
+// retentionDays is how long clinic keeps metric; 0 means forever.
+func retentionDays(rc RetentionConfig, clinic, metric string) int {
+	if days, ok := rc.Clinics[clinic]; ok {
+		if d, ok := days[metric]; ok {
+			return d
+		}
+	}
+	return rc.Days[metric]
+}
+
+// retentionEnabled reports whether any metric has a limit.
+func retentionEnabled(rc RetentionConfig) bool {
+	for _, d := range rc.Days {
+		if d > 0 {
+			return true
+		}
+	}
+	for _, days := range rc.Clinics {
+		for _, d := range days {
+			if d > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type retentionItem struct {
+	Clinic  string    `json:"clinic"`
+	Patient string    `json:"patient"`
+	Metric  string    `json:"metric"`
+	Cutoff  time.Time `json:"cutoff"` // older data expires
+	Records int       `json:"records,omitempty"`
+	Files   int       `json:"files,omitempty"` // recordings
+	Bytes   int64     `json:"bytes,omitempty"` // of the recordings
+	Oldest  time.Time `json:"oldest"`
+}
+
+type retentionReport struct {
+	DryRun   bool            `json:"dry_run"`
+	Mode     string          `json:"mode"`
+	Time     time.Time       `json:"time"`
+	Records  int             `json:"records"`
+	Files    int             `json:"files"`
+	Items    []retentionItem `json:"items"`
+	Archives []string        `json:"archives,omitempty"` // relative to the data directory
+	Errors   []string        `json:"errors,omitempty"`
+}
+
+// runRetention applies the policy to every patient, or with dryRun only
+// reports what it would remove. r is the admin request, nil for the
+// background job.
+func runRetention(ctx context.Context, r *http.Request, dryRun bool) retentionReport {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+
+	rc := config.Retention
+	rep := retentionReport{DryRun: dryRun, Mode: rc.Mode, Time: time.Now().UTC(), Items: []retentionItem{}}
+	fail := func(format string, args ...interface{}) {
+		rep.Errors = append(rep.Errors, fmt.Sprintf(format, args...))
+	}
+	clinics, err := listClinics()
+	if err != nil {
+		fail("%v", err)
+		return rep
+	}
+	for _, clinic := range clinics {
+		patients, err := listPatients(clinic)
+		if err != nil {
+			fail("%s: %v", clinic, err)
+			continue
+		}
+		for _, patient := range patients {
+			if ctx.Err() != nil {
+				fail("stopped before %s/%s", clinic, patient)
+				return rep
+			}
+			if err := purgePatient(r, &rep, clinic, patient); err != nil {
+				fail("%s/%s: %v", clinic, patient, err)
+			}
+		}
+	}
+	return rep
+}
+
+// expiredFile holds the expired records of one metric file.
+type expiredFile struct {
+	name string
+	drop []Record
+}
+
+// purgePatient removes (or reports) one patient's expired data. fileMutex
+// is held only while a single file is read or rewritten, so ingests carry
+// on during a run. In archive mode the archive is complete before anything
+// is removed, and only what went into it is removed.
+func purgePatient(r *http.Request, rep *retentionReport, clinic, patient string) error {
+	dir, err := patientDir(clinic, patient)
+	if err != nil {
+		return err
+	}
+	rc := config.Retention
+	cutoffs := map[string]time.Time{}
+	for m := range retentionMetrics {
+		if days := retentionDays(rc, clinic, m); days > 0 {
+			cutoffs[m] = rep.Time.AddDate(0, 0, -days)
+		}
+	}
+	byMetric := map[string]*retentionItem{}
+	expire := func(metric string, t time.Time) *retentionItem {
+		it := byMetric[metric]
+		if it == nil {
+			it = &retentionItem{Clinic: clinic, Patient: patient, Metric: metric, Cutoff: cutoffs[metric]}
+			byMetric[metric] = it
+		}
+		if it.Oldest.IsZero() || t.Before(it.Oldest) {
+			it.Oldest = t
+		}
+		return it
+	}
+
+	var (
+		files      []expiredFile
+		recordings []string
+		errs       []error
+	)
+	fileMetrics := make([]string, 0, len(retentionFiles))
+	for m := range retentionFiles {
+		fileMetrics = append(fileMetrics, m)
+	}
+	sort.Strings(fileMetrics)
+	for _, metric := range fileMetrics {
+		name := retentionFiles[metric]
+		fileMutex.Lock()
+		recs, err := readRecords(clinic, patient, name)
+		fileMutex.Unlock()
+		if err != nil {
+			errs = append(errs, err) // e.g. corrupt; leave it to the integrity check
+			continue
+		}
+		f := expiredFile{name: name}
+		for _, rec := range recs {
+			m := recordMetric(metric, rec)
+			if cutoff, ok := cutoffs[m]; ok && rec.Timestamp.Before(cutoff) {
+				f.drop = append(f.drop, rec)
+				expire(m, rec.Timestamp).Records++
+			}
+		}
+		if len(f.drop) > 0 {
+			files = append(files, f)
+		}
+	}
+	if cutoff, ok := cutoffs[auscultationDir]; ok {
+		entries, _ := os.ReadDir(filepath.Join(dir, auscultationDir)) // none is fine
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || e.IsDir() || !strings.HasSuffix(e.Name(), ".wav") || !info.ModTime().Before(cutoff) {
+				continue
+			}
+			it := expire(auscultationDir, info.ModTime().UTC())
+			it.Files++
+			it.Bytes += info.Size()
+			recordings = append(recordings, e.Name())
+		}
+	}
+
+	items := make([]retentionItem, 0, len(byMetric))
+	for _, it := range byMetric {
+		items = append(items, *it)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Metric < items[j].Metric })
+	if len(items) == 0 || rep.DryRun {
+		rep.add(items)
+		return errors.Join(errs...)
+	}
+
+	if rep.Mode == "archive" {
+		path, archived, err := writeArchive(dir, rep.Time, items, files, recordings, cutoffs[auscultationDir])
+		if err != nil {
+			// Nothing is removed without its archive
+			audit(r, "retention_purge", clinic, patient, OutcomeError, err.Error())
+			return errors.Join(append(errs, fmt.Errorf("archive: %w", err))...)
+		}
+		recordings = archived
+		rel, _ := filepath.Rel(dataDir, path)
+		rep.Archives = append(rep.Archives, filepath.ToSlash(rel))
+	}
+	for _, f := range files {
+		if err := dropRecords(dir, f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, name := range recordings {
+		if err := removeRecording(dir, name, cutoffs[auscultationDir]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var detail []string
+	for _, it := range items {
+		retentionRemoved.add(float64(it.Records+it.Files), it.Metric, rep.Mode)
+		detail = append(detail, fmt.Sprintf("%s: %d records, %d files", it.Metric, it.Records, it.Files))
+	}
+	err = errors.Join(errs...)
+	audit(r, "retention_purge", clinic, patient, outcomeFor(err), rep.Mode+" "+strings.Join(detail, "; "))
+	rep.add(items)
+	return err
+}
+
+// dropRecords rewrites a metric file without f's expired records. The file
+// is read again under fileMutex, so readings stored since it was scanned
+// are kept, even ones old enough to expire: they were not archived.
+func dropRecords(dir string, f expiredFile) error {
+	drop := map[string]int{}
+	for _, rec := range f.drop {
+		b, _ := json.Marshal(rec)
+		drop[string(b)]++
+	}
+
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+	path := filepath.Join(dir, f.name)
+	b, err := readDataFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var recs []Record
+	if err := json.Unmarshal(b, &recs); err != nil {
+		return fmt.Errorf("%s: %w: %v", f.name, errCorrupt, err)
+	}
+	keep := recs[:0]
+	for _, rec := range recs {
+		b, _ := json.Marshal(rec)
+		if drop[string(b)] > 0 {
+			drop[string(b)]--
+			continue
+		}
+		keep = append(keep, rec)
+	}
+	if len(keep) == 0 {
+		return os.Remove(path)
+	}
+	if b, err = json.MarshalIndent(keep, "", "  "); err != nil {
+		return err
+	}
+	return writeDataFile(path, b)
+}
+
+// removeRecording deletes an expired recording and its .seq file unless
+// audio was appended to it after the scan.
+func removeRecording(dir, name string, cutoff time.Time) error {
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+	path := filepath.Join(dir, auscultationDir, name)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) || (err == nil && !info.ModTime().Before(cutoff)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	delete(audioStates, path)
+	if err := os.Remove(path + seqSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (rep *retentionReport) add(items []retentionItem) {
+	for _, it := range items {
+		rep.Records += it.Records
+		rep.Files += it.Files
+	}
+	rep.Items = append(rep.Items, items...)
+}
+
+// writeArchive zips a patient's expired data: {metric file}.json with the
+// removed records, auscultation/{session}.wav, and manifest.json with the
+// patient's names and what was removed. The zip is streamed to a temp file
+// (sealed segment by segment when encryption is on) and renamed into place.
+// It returns the recordings it holds; one written to since recCutoff is
+// left out and kept.
+func writeArchive(dir string, now time.Time, items []retentionItem, files []expiredFile, recordings []string, recCutoff time.Time) (path string, archived []string, err error) {
+	rel, err := filepath.Rel(dataDir, dir)
+	if err != nil {
+		return "", nil, err
+	}
+	path = filepath.Join(dataDir, archiveDir, rel, now.Format("20060102T150405.000Z")+".zip")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", nil, err
+	}
+	kr, err := loadKeyring()
+	if err != nil {
+		return "", nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+tmpMarker+"*")
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	var out io.Writer = tmp
+	var sealer *segmentWriter
+	if kr != nil {
+		if sealer, err = newSegmentWriter(kr, tmp, path); err != nil {
+			return "", nil, err
+		}
+		out = sealer
+	}
+
+	zw := zip.NewWriter(out)
+	create := func(name string) (io.Writer, error) {
+		return zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+	}
+	manifest, _ := json.MarshalIndent(items, "", "  ")
+	var w io.Writer
+	if w, err = create("manifest.json"); err == nil {
+		_, err = w.Write(manifest)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	for _, f := range files {
+		b, err := json.MarshalIndent(f.drop, "", "  ")
+		if err == nil {
+			if w, err = create(f.name); err == nil {
+				_, err = w.Write(b)
+			}
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	for _, name := range recordings {
+		ok, err := archiveRecording(filepath.Join(dir, auscultationDir, name), recCutoff, func() (io.Writer, error) {
+			return create(auscultationDir + "/" + name)
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		if ok {
+			archived = append(archived, name)
+		}
+	}
+	if err = zw.Close(); err != nil {
+		return "", nil, err
+	}
+	if sealer != nil {
+		if err = sealer.Close(); err != nil {
+			return "", nil, err
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		return "", nil, err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", nil, err
+	}
+	perm := os.FileMode(0644)
+	if kr != nil {
+		perm = 0600
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return "", nil, err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return "", nil, err
+	}
+	syncDir(filepath.Dir(path))
+	return path, archived, nil
+}
+
+// archiveRecording copies one recording into the archive under fileMutex,
+// unless it has been written to since cutoff (ok is false).
+func archiveRecording(path string, cutoff time.Time, create func() (io.Writer, error)) (ok bool, err error) {
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+	f, _, modTime, err := openDataFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if !modTime.Before(cutoff) {
+		return false, nil
+	}
+	w, err := create()
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(w, f)
+	return err == nil, err
+}
+
+func logRetention(rep retentionReport) {
+	for _, e := range rep.Errors {
+		slog.Error("Retention problem", "err", e)
+	}
+	slog.Info("Retention run finished", "mode", rep.Mode, "records", rep.Records, "files", rep.Files,
+		"archives", len(rep.Archives), "errors", len(rep.Errors), "duration", time.Since(rep.Time).Round(time.Millisecond))
+}
+
+// --- Background job ---
+
+// startRetention runs the purge a minute after startup, then every
+// Retention.Interval. Nothing runs while no metric has a limit.
+func startRetention() {
+	if !retentionEnabled(config.Retention) {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	retentionCancel = cancel
+	retentionWG.Add(1)
+	go func() {
+		defer retentionWG.Done()
+		wait := time.Minute
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			logRetention(runRetention(ctx, nil, false))
+			wait = time.Duration(config.Retention.Interval)
+		}
+	}()
+}
+
+// stopRetention waits for a running purge to finish its current patient.
+func stopRetention() {
+	if retentionCancel == nil {
+		return
+	}
+	retentionCancel()
+	retentionWG.Wait()
+}
+
+// --- Admin API ---
+
+// handleAdminRetention reports what the policy would remove now, along
+// with the policy itself.
+func handleAdminRetention(w http.ResponseWriter, r *http.Request) {
+	if preflight(w, r) {
+		return
+	}
+	if !authorize(w, r, PermAdmin, "") {
+		return
+	}
+	rep := runRetention(r.Context(), r, true)
+	audit(r, "retention_report", "", "", OutcomeOK, fmt.Sprintf("%d records, %d files", rep.Records, rep.Files))
+	writeJSON(w, map[string]interface{}{
+		"policy": config.Retention,
+		"report": rep,
+	})
+}
+
+// handleAdminRetentionRun purges now instead of waiting for the next run.
+func handleAdminRetentionRun(w http.ResponseWriter, r *http.Request) {
+	if preflight(w, r) {
+		return
+	}
+	if !authorize(w, r, PermAdmin, "") {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !retentionEnabled(config.Retention) {
+		http.Error(w, "No retention limits are configured", http.StatusConflict)
+		return
+	}
+	rep := runRetention(r.Context(), r, false)
+	logRetention(rep)
+	writeJSON(w, rep)
+}
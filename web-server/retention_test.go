@@ -0,0 +1,170 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useStorageKey turns encryption on with a fixed key for the test.
+func useStorageKey(t *testing.T) {
+	t.Helper()
+	t.Setenv("MEDICART_STORAGE_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	keyringMu.Lock()
+	keyringCache = nil
+	keyringMu.Unlock()
+	t.Cleanup(func() {
+		keyringMu.Lock()
+		keyringCache = nil
+		keyringMu.Unlock()
+	})
+}
+
+func storeReading(t *testing.T, age time.Duration, data map[string]interface{}) {
+	t.Helper()
+	rec := Record{Timestamp: time.Now().Add(-age).UTC(), ClinicName: "North", PatientName: "Ann", RawData: data}
+	if err := saveRecord(rec); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const day = 24 * time.Hour
+
+func TestRetentionBloodPressureFollowsBPLimit(t *testing.T) {
+	setupIngestTest(t)
+	config.Retention.Mode = "delete"
+	config.Retention.Days = map[string]int{"heart_rate": 30, "bp": 365}
+
+	storeReading(t, 100*day, map[string]interface{}{"spo2": 97.0, "pr": 70.0})              // expired pulse
+	storeReading(t, 10*day, map[string]interface{}{"spo2": 98.0, "pr": 71.0})               // recent pulse
+	storeReading(t, 100*day, map[string]interface{}{"sys": 120.0, "dia": 80.0, "pr": 72.0}) // BP within a year
+	storeReading(t, 400*day, map[string]interface{}{"sys": 130.0, "dia": 85.0, "pr": 73.0}) // expired BP
+
+	dry := runRetention(context.Background(), nil, true)
+	if dry.Records != 2 || len(dry.Errors) > 0 {
+		t.Fatalf("dry run: %d records, errors %v; want 2", dry.Records, dry.Errors)
+	}
+	if recs, _ := readRecords("North", "Ann", "heart_rate.json"); len(recs) != 4 {
+		t.Fatalf("dry run removed records: %d left", len(recs))
+	}
+
+	rep := runRetention(context.Background(), nil, false)
+	if len(rep.Errors) > 0 {
+		t.Fatal(rep.Errors)
+	}
+	got := map[string]int{}
+	for _, it := range rep.Items {
+		got[it.Metric] = it.Records
+	}
+	if got["heart_rate"] != 1 || got["bp"] != 1 || len(got) != 2 {
+		t.Fatalf("removed per metric = %v, want heart_rate 1 and bp 1", got)
+	}
+	recs, err := readRecords("North", "Ann", "heart_rate.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pulses []float64
+	for _, rec := range recs {
+		pulses = append(pulses, rec.RawData["pr"].(float64))
+	}
+	if len(pulses) != 2 || pulses[0] != 71 || pulses[1] != 72 {
+		t.Fatalf("kept pulses %v, want [71 72]", pulses)
+	}
+}
+
+func TestRetentionArchiveEncrypted(t *testing.T) {
+	setupIngestTest(t)
+	useStorageKey(t)
+	config.Retention.Mode = "archive"
+	config.Retention.Days = map[string]int{"temperature": 30, "auscultation": 30}
+
+	storeReading(t, 60*day, map[string]interface{}{"temp": 38.5})
+	storeReading(t, 1*day, map[string]interface{}{"temp": 36.6})
+	samples := []int16{1, -1, 2, -2}
+	for _, session := range []string{"old", "new"} {
+		if err := appendAudio("North", "Ann", session, 0, false, 8000, samples); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pdir, err := patientDir("North", "Ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldWAV := filepath.Join(pdir, auscultationDir, "old.wav")
+	wantWAV, err := readDataFile(oldWAV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-60 * day)
+	if err := os.Chtimes(oldWAV, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	rep := runRetention(context.Background(), nil, false)
+	if len(rep.Errors) > 0 || len(rep.Archives) != 1 {
+		t.Fatalf("errors %v, archives %v", rep.Errors, rep.Archives)
+	}
+	if rep.Records != 1 || rep.Files != 1 {
+		t.Fatalf("removed %d records and %d files, want 1 and 1", rep.Records, rep.Files)
+	}
+	if _, err := os.Stat(oldWAV); !os.IsNotExist(err) {
+		t.Fatalf("expired recording still present: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(pdir, auscultationDir, "new.wav")); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dataDir, filepath.FromSlash(rep.Archives[0]))
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncrypted(raw) {
+		t.Fatal("archive is not encrypted")
+	}
+	b, err := readDataFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+	if len(entries) != 3 || entries["manifest.json"] == nil || !bytes.Contains(entries["temperature.json"], []byte("38.5")) {
+		t.Fatalf("archive entries %v", keys(entries))
+	}
+	if !bytes.Equal(entries[auscultationDir+"/old.wav"], wantWAV) {
+		t.Fatal("archived recording differs from the original")
+	}
+
+	recs, err := readRecords("North", "Ann", "temperature.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].RawData["temp"] != 36.6 {
+		t.Fatalf("kept %v, want the recent reading only", recs)
+	}
+}
+
+func keys(m map[string][]byte) []string {
+	var out []string
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// --- Graceful shutdown ---
+//
+// On SIGINT/SIGTERM the server stops accepting connections, sends a close
+// frame to the desktop feed, ingest connections and every stream
+// subscriber, waits for in-flight requests (ingests) and WebSocket
+// handlers to finish, stops outbound deliveries and the retention job,
+// then flushes storage and the audit log.
+// Whatever is still running when Config.ShutdownTimeout expires is cut off.
+
+var (
+	shuttingDown atomic.Bool
+	wsHandlers   sync.WaitGroup // hijacked connections are invisible to http.Server.Shutdown
+)
+
+// trackWS wraps a WebSocket handler so shutdown can wait for it.
+func trackWS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if shuttingDown.Load() {
+			http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		wsHandlers.Add(1)
+		defer wsHandlers.Done()
+		next(w, r)
+	}
+}
+
+// sendCloseFrames asks every WebSocket peer to go away. Their read loops end
+// when the peer answers (or the connection is force-closed later).
+func sendCloseFrames() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	deadline := time.Now().Add(time.Second)
+
+	wsMutex.Lock()
+	if feedConn != nil {
+		_ = feedConn.WriteControl(websocket.CloseMessage, msg, deadline)
+	}
+	wsMutex.Unlock()
+
+	ingestConnsMu.Lock()
+	for conn := range ingestConns {
+		_ = conn.WriteControl(websocket.CloseMessage, msg, deadline)
+	}
+	ingestConnsMu.Unlock()
+
+	streamsMu.Lock()
+	for _, subs := range streams {
+		for s := range subs {
+			_ = s.conn.WriteControl(websocket.CloseMessage, msg, deadline)
+		}
+	}
+	streamsMu.Unlock()
+}
+
+// closeWebSockets force-closes connections that ignored the close frame.
+func closeWebSockets() {
+	wsMutex.Lock()
+	if feedConn != nil {
+		feedConn.Close()
+	}
+	wsMutex.Unlock()
+
+	ingestConnsMu.Lock()
+	for conn := range ingestConns {
+		conn.Close()
+	}
+	ingestConnsMu.Unlock()
+
+	streamsMu.Lock()
+	for _, subs := range streams {
+		for s := range subs {
+			s.conn.Close()
+		}
+	}
+	streamsMu.Unlock()
+}
+
+// flushStorage waits for any write in progress and closes the audit log.
+// fileMutex stays held so nothing can start a new write afterwards.
+func flushStorage() {
+	fileMutex.Lock()
+	closeAuditLog()
+}
+
+func shutdown(srv *http.Server, timeout time.Duration) {
+	shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	sendCloseFrames()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("HTTP requests still running at shutdown deadline", "timeout", timeout, "err", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wsHandlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("Closing WebSocket connections that did not finish")
+		closeWebSockets()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+	}
+
+	stopOutbox()
+	stopRetention()
+	flushStorage()
+	slog.Info("Shutdown complete")
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Aggregates for dashboards, so charts need not download every reading:
+//
+//	/api/clinic/{clinic}/patient/{patient}/stats?metric=&from=&to=&percentiles=
+//	/api/clinic/{clinic}/patient/{patient}/series?metric=&from=&to=&points=&method=
+//
+// Metrics are those of the CSV export; blood pressure has a systolic and a
+// diastolic column, the others one column each. /series downsamples to at
+// most ?points per column, either with LTTB (largest triangle three
+// buckets, the default), which keeps actual readings and the shape of the
+// curve, or with fixed time buckets carrying count/min/max/mean.
+
+const (
+	defaultSeriesPoints = 500
+	maxSeriesPoints     = 5000
+)
+
+var defaultPercentiles = []float64{5, 25, 50, 75, 95}
+
+// metricPoints returns the readings of each of m's columns, oldest first.
+func metricPoints(recs []Record, m exportMetric) [][]reportPoint {
+	out := make([][]reportPoint, len(m.columns))
+	for _, rec := range recs {
+		for _, o := range observationsFor("", rec) {
+			if obsKind(o) != m.kind {
+				continue
+			}
+			qs, _ := obsValues(o)
+			for i := range out {
+				if i < len(qs) {
+					out[i] = append(out[i], reportPoint{rec.Timestamp, qs[i].Value})
+				}
+			}
+		}
+	}
+	return out
+}
+
+// --- Stats ---
+
+type columnStats struct {
+	Count       int                `json:"count"`
+	Min         float64            `json:"min"`
+	Max         float64            `json:"max"`
+	Mean        float64            `json:"mean"`
+	StdDev      float64            `json:"stddev"`
+	First       time.Time          `json:"first"`
+	Last        time.Time          `json:"last"`
+	Percentiles map[string]float64 `json:"percentiles"`
+}
+
+// percentile interpolates linearly between the closest ranks of sorted.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	i := int(rank)
+	if i >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (rank-float64(i))*(sorted[i+1]-sorted[i])
+}
+
+// computeStats summarises points; nil when there are none.
+func computeStats(points []reportPoint, pcts []float64) *columnStats {
+	if len(points) == 0 {
+		return nil
+	}
+	vals := make([]float64, len(points))
+	s := &columnStats{Count: len(points), Min: math.Inf(1), Max: math.Inf(-1),
+		First: points[0].t, Last: points[len(points)-1].t, Percentiles: map[string]float64{}}
+	sum := 0.0
+	for i, p := range points {
+		vals[i] = p.v
+		s.Min, s.Max = math.Min(s.Min, p.v), math.Max(s.Max, p.v)
+		sum += p.v
+	}
+	s.Mean = sum / float64(len(vals))
+	ss := 0.0
+	for _, v := range vals {
+		ss += (v - s.Mean) * (v - s.Mean)
+	}
+	s.StdDev = math.Sqrt(ss / float64(len(vals)))
+	sort.Float64s(vals)
+	for _, p := range pcts {
+		s.Percentiles["p"+formatFloat(p)] = percentile(vals, p)
+	}
+	return s
+}
+
+// parsePercentiles reads ?percentiles=50,90,99 (each 0-100).
+func parsePercentiles(s string) ([]float64, bool) {
+	if s == "" {
+		return defaultPercentiles, true
+	}
+	var out []float64
+	for _, f := range strings.Split(s, ",") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, false
+		}
+		out = append(out, p)
+	}
+	return out, true
+}
+
+type metricStats struct {
+	Unit    string                  `json:"unit"`
+	Columns map[string]*columnStats `json:"columns"` // null when no readings
+}
+
+func handlePatientStats(w http.ResponseWriter, r *http.Request, clinic, patient string) {
+	if preflight(w, r) {
+		return
+	}
+	metrics, from, to, ok := metricParams(w, r)
+	if !ok {
+		return
+	}
+	pcts, ok := parsePercentiles(r.URL.Query().Get("percentiles"))
+	if !ok {
+		http.Error(w, "percentiles must be numbers between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	recs, err := patientRecords(clinic, patient, from, to)
+	if err != nil {
+		audit(r, "read_stats", clinic, patient, OutcomeError, err.Error())
+		http.Error(w, "Failed to read patient data", http.StatusInternalServerError)
+		return
+	}
+	out := map[string]metricStats{}
+	for _, m := range metrics {
+		ms := metricStats{Unit: m.unit, Columns: map[string]*columnStats{}}
+		for i, pts := range metricPoints(recs, m) {
+			ms.Columns[m.columns[i]] = computeStats(pts, pcts)
+		}
+		out[m.name] = ms
+	}
+	audit(r, "read_stats", clinic, patient, OutcomeOK, r.URL.RawQuery)
+	writeJSON(w, out)
+}
+
+// --- Series ---
+
+type seriesPoint struct {
+	T time.Time `json:"t"`
+	V float64   `json:"v"`
+}
+
+type seriesBucket struct {
+	T     time.Time `json:"t"` // bucket start
+	Count int       `json:"count"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Mean  float64   `json:"mean"`
+}
+
+// lttb picks n of points (n >= 3) keeping the first and last: each bucket
+// contributes the point forming the largest triangle with the point chosen
+// before it and the average of the next bucket.
+func lttb(points []reportPoint, n int) []seriesPoint {
+	if n >= len(points) || n < 3 {
+		out := make([]seriesPoint, len(points))
+		for i, p := range points {
+			out[i] = seriesPoint{p.t, p.v}
+		}
+		return out
+	}
+	x := func(i int) float64 { return float64(points[i].t.Sub(points[0].t)) }
+	out := make([]seriesPoint, 0, n)
+	out = append(out, seriesPoint{points[0].t, points[0].v})
+	every := float64(len(points)-2) / float64(n-2)
+	a := 0
+	for i := 0; i < n-2; i++ {
+		// Average of the next bucket
+		nextStart, nextEnd := int(float64(i+1)*every)+1, int(float64(i+2)*every)+1
+		if nextEnd > len(points) {
+			nextEnd = len(points)
+		}
+		avgX, avgY := 0.0, 0.0
+		for j := nextStart; j < nextEnd; j++ {
+			avgX += x(j)
+			avgY += points[j].v
+		}
+		if cnt := float64(nextEnd - nextStart); cnt > 0 {
+			avgX, avgY = avgX/cnt, avgY/cnt
+		}
+
+		start, end := int(float64(i)*every)+1, int(float64(i+1)*every)+1
+		best, bestArea := start, -1.0
+		for j := start; j < end; j++ {
+			area := math.Abs((x(a)-avgX)*(points[j].v-points[a].v) - (x(a)-x(j))*(avgY-points[a].v))
+			if area > bestArea {
+				best, bestArea = j, area
+			}
+		}
+		out = append(out, seriesPoint{points[best].t, points[best].v})
+		a = best
+	}
+	last := points[len(points)-1]
+	return append(out, seriesPoint{last.t, last.v})
+}
+
+// buckets splits [from, to] into n equal spans and summarises the points in
+// each; empty spans are left out.
+func buckets(points []reportPoint, from, to time.Time, n int) []seriesBucket {
+	out := []seriesBucket{}
+	if len(points) == 0 {
+		return out
+	}
+	span := to.Sub(from)
+	width := span / time.Duration(n)
+	if width <= 0 {
+		width = 1
+	}
+	var cur *seriesBucket
+	sum := 0.0
+	flush := func() {
+		if cur != nil {
+			cur.Mean = sum / float64(cur.Count)
+			out = append(out, *cur)
+		}
+	}
+	for _, p := range points {
+		i := int(p.t.Sub(from) / width)
+		if i >= n {
+			i = n - 1
+		}
+		start := from.Add(time.Duration(i) * width)
+		if cur == nil || !cur.T.Equal(start) {
+			flush()
+			cur, sum = &seriesBucket{T: start, Min: p.v, Max: p.v}, 0
+		}
+		cur.Count++
+		cur.Min, cur.Max = math.Min(cur.Min, p.v), math.Max(cur.Max, p.v)
+		sum += p.v
+	}
+	flush()
+	return out
+}
+
+func handlePatientSeries(w http.ResponseWriter, r *http.Request, clinic, patient string) {
+	if preflight(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("metric") == "" {
+		http.Error(w, "metric is required (spo2, pulse, bp, glucose, temperature)", http.StatusBadRequest)
+		return
+	}
+	metrics, from, to, ok := metricParams(w, r)
+	if !ok {
+		return
+	}
+	m := metrics[0]
+	points := defaultSeriesPoints
+	if s := q.Get("points"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 3 || n > maxSeriesPoints {
+			http.Error(w, "points must be between 3 and "+strconv.Itoa(maxSeriesPoints), http.StatusBadRequest)
+			return
+		}
+		points = n
+	}
+	method := q.Get("method")
+	if method == "" {
+		method = "lttb"
+	}
+	if method != "lttb" && method != "bucket" {
+		http.Error(w, "method must be lttb or bucket", http.StatusBadRequest)
+		return
+	}
+
+	recs, err := patientRecords(clinic, patient, from, to)
+	if err != nil {
+		audit(r, "read_series", clinic, patient, OutcomeError, err.Error())
+		http.Error(w, "Failed to read patient data", http.StatusInternalServerError)
+		return
+	}
+	cols := metricPoints(recs, m)
+
+	// Buckets span the requested range, or the data where it is open
+	lo, hi := from, to
+	for _, pts := range cols {
+		if len(pts) == 0 {
+			continue
+		}
+		if from.IsZero() && (lo.IsZero() || pts[0].t.Before(lo)) {
+			lo = pts[0].t
+		}
+		if to.IsZero() && pts[len(pts)-1].t.After(hi) {
+			hi = pts[len(pts)-1].t
+		}
+	}
+
+	out := map[string]interface{}{
+		"metric": m.name,
+		"unit":   m.unit,
+		"method": method,
+	}
+	raw := map[string]int{}
+	series := map[string]interface{}{}
+	for i, pts := range cols {
+		raw[m.columns[i]] = len(pts)
+		if method == "bucket" {
+			series[m.columns[i]] = buckets(pts, lo, hi, points)
+		} else {
+			series[m.columns[i]] = lttb(pts, points)
+		}
+	}
+	out["raw_points"] = raw
+	out["series"] = series
+	if method == "bucket" && !lo.IsZero() {
+		out["bucket_seconds"] = hi.Sub(lo).Seconds() / float64(points)
+	}
+	audit(r, "read_series", clinic, patient, OutcomeOK, r.URL.RawQuery)
+	writeJSON(w, out)
+}
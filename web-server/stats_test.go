@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var seriesStart = time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+
+func minutePoints(vals ...float64) []reportPoint {
+	pts := make([]reportPoint, len(vals))
+	for i, v := range vals {
+		pts[i] = reportPoint{seriesStart.Add(time.Duration(i) * time.Minute), v}
+	}
+	return pts
+}
+
+func TestLTTBKeepsEndsAndSpikes(t *testing.T) {
+	pts := minutePoints(0, 0, 0, 0, 100, 0, 0, 0, 0, 0)
+	got := lttb(pts, 4)
+	// Ends, the spike in the first bucket, and in the second bucket the
+	// point farthest along from the spike
+	want := []int{0, 4, 5, 9}
+	if len(got) != len(want) {
+		t.Fatalf("got %d points, want %d", len(got), len(want))
+	}
+	for i, idx := range want {
+		if p := pts[idx]; !got[i].T.Equal(p.t) || got[i].V != p.v {
+			t.Fatalf("point %d = %v, want reading %d %v", i, got[i], idx, p)
+		}
+	}
+
+	// Fewer readings than asked for come back as they are
+	if got := lttb(pts[:3], 4); len(got) != 3 || got[2].V != 0 || !got[2].T.Equal(pts[2].t) {
+		t.Fatalf("short series = %v", got)
+	}
+	if got := lttb(nil, 10); len(got) != 0 {
+		t.Fatalf("empty series = %v", got)
+	}
+}
+
+func TestLTTBReturnsActualReadingsInOrder(t *testing.T) {
+	vals := make([]float64, 1000)
+	for i := range vals {
+		vals[i] = 60 + 20*math.Sin(float64(i)/25)
+	}
+	pts := minutePoints(vals...)
+	got := lttb(pts, 50)
+	if len(got) != 50 {
+		t.Fatalf("got %d points, want 50", len(got))
+	}
+	for i, p := range got {
+		idx := int(p.T.Sub(seriesStart) / time.Minute)
+		if idx < 0 || idx >= len(pts) || pts[idx].v != p.V {
+			t.Fatalf("point %d %v is not a reading", i, p)
+		}
+		if i > 0 && !p.T.After(got[i-1].T) {
+			t.Fatalf("point %d is not after point %d", i, i-1)
+		}
+	}
+	if !got[0].T.Equal(pts[0].t) || !got[49].T.Equal(pts[999].t) {
+		t.Fatal("first or last reading dropped")
+	}
+}
+
+func TestComputeStats(t *testing.T) {
+	s := computeStats(minutePoints(4, 1, 3, 2), []float64{0, 50, 100})
+	if s.Count != 4 || s.Min != 1 || s.Max != 4 || s.Mean != 2.5 {
+		t.Fatalf("stats = %+v", s)
+	}
+	if want := math.Sqrt(1.25); math.Abs(s.StdDev-want) > 1e-9 {
+		t.Fatalf("stddev = %v, want %v", s.StdDev, want)
+	}
+	if s.Percentiles["p0"] != 1 || s.Percentiles["p50"] != 2.5 || s.Percentiles["p100"] != 4 {
+		t.Fatalf("percentiles = %v", s.Percentiles)
+	}
+	if computeStats(nil, defaultPercentiles) != nil {
+		t.Fatal("stats of no readings are not nil")
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	// Two readings in the first ten minutes, none in the second, one at the end
+	pts := minutePoints(1, 3)
+	pts = append(pts, reportPoint{seriesStart.Add(30 * time.Minute), 7})
+	got := buckets(pts, seriesStart, seriesStart.Add(30*time.Minute), 3)
+	if len(got) != 2 {
+		t.Fatalf("got %d buckets, want 2: %+v", len(got), got)
+	}
+	if b := got[0]; !b.T.Equal(seriesStart) || b.Count != 2 || b.Min != 1 || b.Max != 3 || b.Mean != 2 {
+		t.Fatalf("first bucket = %+v", b)
+	}
+	// The reading at the end of the range falls into the last bucket
+	if b := got[1]; !b.T.Equal(seriesStart.Add(20*time.Minute)) || b.Count != 1 || b.Mean != 7 {
+		t.Fatalf("last bucket = %+v", b)
+	}
+}
+
+func TestStatsAndSeriesIgnoreExportFormat(t *testing.T) {
+	setupIngestTest(t)
+	for i, pr := range []float64{60, 70, 80} {
+		rec := Record{Timestamp: seriesStart.Add(time.Duration(i) * time.Minute), ClinicName: "North", PatientName: "Ann",
+			RawData: map[string]interface{}{"pr": pr}}
+		if err := saveRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(h func(http.ResponseWriter, *http.Request, string, string), target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, target, nil), "North", "Ann")
+		return w
+	}
+
+	w := get(handlePatientStats, "/stats?metric=pulse&format=json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("stats with format: %d %s", w.Code, w.Body)
+	}
+	var stats map[string]metricStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if c := stats["pulse"].Columns["pulse"]; c == nil || c.Count != 3 || c.Mean != 70 {
+		t.Fatalf("pulse stats = %+v", c)
+	}
+
+	if w := get(handlePatientSeries, "/series?metric=pulse&format=json&points=3"); w.Code != http.StatusOK {
+		t.Fatalf("series with format: %d %s", w.Code, w.Body)
+	}
+	if w := get(handlePatientSeries, "/series?metric=weight"); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown metric: status %d, want 400", w.Code)
+	}
+	if w := get(handlePatientStats, "/stats?from=yesterday"); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad from: status %d, want 400", w.Code)
+	}
+	// The export still only speaks CSV
+	if w := get(handlePatientExport, "/export?format=json"); w.Code != http.StatusBadRequest {
+		t.Fatalf("export format=json: status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// All patient data lives under dataDir as data/{clinic}/{patient}/{file}.
+// With encryption enabled the clinic and patient directories are opaque
+// ids (see keyring.opaqueID) holding an encrypted ".name" file with the
+// real name, and every file is sealed with AES-GCM.
+
+var dataDir string // Config.Storage.Path
+
+const nameFile = ".name"
+
+// safePathName keeps a name usable as a single path element.
+func safePathName(s string) string {
+	s = strings.NewReplacer("/", "_", "\\", "_").Replace(safe(s))
+	if s == "." || s == ".." {
+		s = "_"
+	}
+	return s
+}
+
+func clinicDir(clinic string) (string, error) {
+	kr, err := loadKeyring()
+	if err != nil {
+		return "", err
+	}
+	if kr == nil {
+		return filepath.Join(dataDir, safePathName(clinic)), nil
+	}
+	return filepath.Join(dataDir, kr.opaqueID("clinic", safe(clinic))), nil
+}
+
+func patientDir(clinic, patient string) (string, error) {
+	kr, err := loadKeyring()
+	if err != nil {
+		return "", err
+	}
+	if kr == nil {
+		return filepath.Join(dataDir, safePathName(clinic), safePathName(patient)), nil
+	}
+	return filepath.Join(dataDir,
+		kr.opaqueID("clinic", safe(clinic)),
+		kr.opaqueID("patient", safe(clinic)+"/"+safe(patient))), nil
+}
+
+// ensurePatientDir creates the clinic and patient directories, recording
+// their names when the ids are opaque.
+func ensurePatientDir(clinic, patient string) (string, error) {
+	dir, err := patientDir(clinic, patient)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if !encryptionEnabled() {
+		return dir, nil
+	}
+	for d, name := range map[string]string{filepath.Dir(dir): safe(clinic), dir: safe(patient)} {
+		p := filepath.Join(d, nameFile)
+		if _, err := os.Stat(p); err == nil {
+			continue
+		}
+		if err := writeDataFile(p, []byte(name)); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// dirName returns the display name of a clinic or patient directory.
+func dirName(dir string) string {
+	if b, err := readDataFile(filepath.Join(dir, nameFile)); err == nil {
+		return string(b)
+	}
+	return filepath.Base(dir)
+}
+
+func listDirNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, dirName(filepath.Join(dir, e.Name())))
+		}
+	}
+	return names, nil
+}
+
+func listClinics() ([]string, error) {
+	return listDirNames(dataDir)
+}
+
+func listPatients(clinic string) ([]string, error) {
+	dir, err := clinicDir(clinic)
+	if err != nil {
+		return nil, err
+	}
+	return listDirNames(dir)
+}
+
+// readRecords returns the records in one metric file of a patient, oldest
+// first. A missing file yields no records.
+func readRecords(clinic, patient, file string) ([]Record, error) {
+	dir, err := patientDir(clinic, patient)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readDataFile(filepath.Join(dir, file))
+	if os.IsNotExist(err) || (err == nil && len(b) == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var recs []Record
+	if err := json.Unmarshal(b, &recs); err != nil {
+		return nil, fmt.Errorf("%s: %w: %v", file, errCorrupt, err)
+	}
+	return recs, nil
+}
+
+// aadFor binds ciphertext to its location under dataDir.
+func aadFor(path string) string {
+	rel, err := filepath.Rel(dataDir, path)
+	if err != nil {
+		rel = path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// readDataFile returns a file's plaintext. Unencrypted files are returned
+// as-is, so data written before encryption was enabled stays readable.
+func readDataFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil || !isEncrypted(b) {
+		return b, err
+	}
+	kr, err := loadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	if kr == nil {
+		return nil, fmt.Errorf("%s is encrypted but no key is configured", path)
+	}
+	if bytes.HasPrefix(b, segMagic) {
+		wav, _, err := kr.openSegments(b, path)
+		if err != nil {
+			return nil, err
+		}
+		return setWAVSizes(wav), nil
+	}
+	return kr.decrypt(b, aadFor(path))
+}
+
+func writeDataFile(path string, plaintext []byte) error {
+	kr, err := loadKeyring()
+	if err != nil {
+		return err
+	}
+	if kr == nil {
+		return writeFileAtomic(path, plaintext, 0644)
+	}
+	sealed, err := kr.encrypt(plaintext, aadFor(path))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, sealed, 0600)
+}
+
+// --- Data directory lock ---
+
+// lockName is an empty file in dataDir that a running server keeps locked.
+// Admin commands that rewrite the whole tree take the same lock, so they
+// refuse to run next to a server (or each other) instead of racing its
+// writes. Tree walks skip the file.
+const lockName = ".lock"
+
+var dataLock *os.File // held until the process exits
+
+func lockDataDir() error {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dataDir, lockName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("%s is in use by a running server or another admin command; stop it first", dataDir)
+	}
+	dataLock = f
+	return nil
+}
+
+// --- Atomic writes ---
+
+// tmpMarker appears in the names of in-progress writes (".<name>.tmp-123").
+const tmpMarker = ".tmp-"
+
+// writeFileAtomic replaces path in one step: the data goes to a temp file in
+// the same directory, is synced, and renamed over the original, so a crash
+// leaves either the old or the new contents, never a mix.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+tmpMarker+"*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir makes a rename durable. Not every platform can sync a directory,
+// so failures are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+}
+
+type dataFile interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+}
+
+type memFile struct{ *bytes.Reader }
+
+func (memFile) Close() error { return nil }
+
+// openDataFile opens a file for ServeContent-style access. Encrypted files
+// are decrypted into memory.
+func openDataFile(path string) (f dataFile, size int64, modTime time.Time, err error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	if !encryptionEnabled() {
+		osf, err := os.Open(path)
+		if err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		return osf, st.Size(), st.ModTime(), nil
+	}
+	b, err := readDataFile(path)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	return memFile{bytes.NewReader(b)}, int64(len(b)), st.ModTime(), nil
+}
+
+// --- Key management (admin CLI) ---
+
+// initKeyring writes a new keyfile with a fresh data key and id key.
+func initKeyring() error {
+	if keyFile == "" {
+		return fmt.Errorf("set storage.key_file (or MEDICART_KEYFILE) to the keyfile path")
+	}
+	if _, err := os.Stat(keyFile); err == nil {
+		return fmt.Errorf("%s already exists", keyFile)
+	}
+	idKey, err := randomKey()
+	if err != nil {
+		return err
+	}
+	k, err := randomKey()
+	if err != nil {
+		return err
+	}
+	id, err := newKeyID()
+	if err != nil {
+		return err
+	}
+	return saveKeyring(&keyring{Active: id, IDKey: idKey, Keys: map[string]string{id: k}})
+}
+
+// rotateStorageKey adds a new active key and re-encrypts every file under
+// dataDir with it. Retired keys are dropped only with prune, and only when
+// every file was re-encrypted; keys that quarantined files were sealed with
+// are kept, since those files are never re-encrypted.
+func rotateStorageKey(prune bool) (int, error) {
+	kr, err := loadKeyring()
+	if err != nil {
+		return 0, err
+	}
+	if kr == nil || keyFile == "" {
+		return 0, fmt.Errorf("key rotation needs a keyfile (storage.key_file)")
+	}
+	k, err := randomKey()
+	if err != nil {
+		return 0, err
+	}
+	id, err := newKeyID()
+	if err != nil {
+		return 0, err
+	}
+	// Files may still be sealed with any existing key; never replace one
+	if _, exists := kr.Keys[id]; exists {
+		return 0, fmt.Errorf("key id %s already exists in %s", id, keyFile)
+	}
+	next := &keyring{Active: id, IDKey: kr.IDKey, Keys: map[string]string{}}
+	for id, v := range kr.Keys {
+		next.Keys[id] = v
+	}
+	next.Keys[next.Active] = k
+	if err := saveKeyring(next); err != nil {
+		return 0, err
+	}
+
+	n, err := resealTree(dataDir)
+	if err != nil {
+		return n, err
+	}
+	if prune {
+		keep, err := quarantineKeyIDs()
+		if err != nil {
+			return n, err
+		}
+		keep[next.Active] = true
+		for id := range next.Keys {
+			if !keep[id] {
+				delete(next.Keys, id)
+			}
+		}
+		return n, saveKeyring(next)
+	}
+	return n, nil
+}
+
+// quarantineKeyIDs returns the ids of the keys files under .quarantine
+// were sealed with.
+func quarantineKeyIDs() (map[string]bool, error) {
+	ids := map[string]bool{}
+	err := filepath.WalkDir(filepath.Join(dataDir, quarantineDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, id := range sealedKeyIDs(b) {
+			ids[id] = true
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// resealTree re-encrypts every file under root with the active key.
+// Quarantined files keep their original key; see quarantine.
+func resealTree(root string) (int, error) {
+	n := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == quarantineDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path == filepath.Join(dataDir, lockName) {
+			return nil
+		}
+		b, err := readDataFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := writeDataFile(path, b); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// migrateToEncrypted moves plaintext clinic/patient directories to their
+// opaque ids, encrypting every file on the way. Only patient directories
+// are migrated, so it refuses to start while a clinic directory holds
+// anything else, and it removes a source directory only once it is empty.
+func migrateToEncrypted() (int, error) {
+	kr, err := loadKeyring()
+	if err != nil {
+		return 0, err
+	}
+	if kr == nil {
+		return 0, fmt.Errorf("encryption is not configured")
+	}
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return 0, err
+	}
+	var clinics []string
+	for _, c := range entries {
+		dir := filepath.Join(dataDir, c.Name())
+		if !c.IsDir() || strings.HasPrefix(c.Name(), ".") || hasNameFile(dir) {
+			continue
+		}
+		patients, err := os.ReadDir(dir)
+		if err != nil {
+			return 0, err
+		}
+		for _, p := range patients {
+			if !p.IsDir() {
+				return 0, fmt.Errorf("%s is not a patient directory; move it out of the clinic directory first", filepath.Join(dir, p.Name()))
+			}
+		}
+		clinics = append(clinics, c.Name())
+	}
+
+	n := 0
+	for _, c := range clinics {
+		oldClinic := filepath.Join(dataDir, c)
+		patients, err := os.ReadDir(oldClinic)
+		if err != nil {
+			return n, err
+		}
+		for _, p := range patients {
+			if !p.IsDir() {
+				return n, fmt.Errorf("%s appeared during the migration", filepath.Join(oldClinic, p.Name()))
+			}
+			oldDir := filepath.Join(oldClinic, p.Name())
+			newDir, err := ensurePatientDir(c, p.Name())
+			if err != nil {
+				return n, err
+			}
+			moved, err := moveSealed(oldDir, newDir)
+			n += moved
+			if err != nil {
+				return n, err
+			}
+		}
+		if err := removeEmptyDirs(oldClinic); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// removeEmptyDirs removes root and the directories under it, deepest first.
+// It fails rather than delete a directory that still holds a file.
+func removeEmptyDirs(root string) error {
+	var dirs []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Remove(dirs[i]); err != nil {
+			return fmt.Errorf("%s was not fully migrated: %w", dirs[i], err)
+		}
+	}
+	return nil
+}
+
+func hasNameFile(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, nameFile))
+	return err == nil
+}
+
+// moveSealed copies every file from src into dst (encrypting it for its new
+// path) and removes the originals.
+func moveSealed(src, dst string) (int, error) {
+	n := 0
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		if _, err := os.Stat(target); err == nil {
+			return fmt.Errorf("%s already exists; merge it by hand", target)
+		}
+		b, err := readDataFile(path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := writeDataFile(target, b); err != nil {
+			return err
+		}
+		n++
+		return os.Remove(path)
+	})
+	return n, err
+}
+
+// warnPlaintextData logs clinic directories that predate encryption; they
+// stay readable but are invisible to listings until migrated.
+func warnPlaintextData() {
+	if !encryptionEnabled() {
+		return
+	}
+	entries, _ := os.ReadDir(dataDir)
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") && !hasNameFile(filepath.Join(dataDir, e.Name())) {
+			slog.Warn("Directory is not encrypted; run `web-server storage migrate`", "dir", filepath.Join(dataDir, e.Name()))
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLS is enabled when a certificate and key are configured. Setting a client
+// CA turns on mutual TLS for desktops: browsers still connect without a
+// certificate, but desktop endpoints reject requests that did not present
+// one signed by that CA.
+var tlsCertFile, tlsKeyFile, tlsClientCAFile string // Config.TLS
+
+// certReloader serves the configured certificate and picks up renewed files
+// without a restart.
+type certReloader struct {
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	st, err := os.Stat(tlsCertFile)
+	if err != nil {
+		if cr.cert != nil {
+			return cr.cert, nil
+		}
+		return nil, err
+	}
+	if cr.cert != nil && !st.ModTime().After(cr.modTime) {
+		return cr.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		if cr.cert != nil {
+			return cr.cert, nil // keep serving the old pair mid-renewal
+		}
+		return nil, err
+	}
+	cr.cert, cr.modTime = &cert, st.ModTime()
+	return cr.cert, nil
+}
+
+// serverTLSConfig returns nil when TLS is not configured.
+func serverTLSConfig() (*tls.Config, error) {
+	if tlsCertFile == "" {
+		return nil, nil // Config.validate checks the combinations
+	}
+	cr := &certReloader{}
+	if _, err := cr.getCertificate(nil); err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+	}
+	if tlsClientCAFile != "" {
+		pem, err := os.ReadFile(tlsClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("client CA file contains no certificates")
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// requireClientCert enforces mutual TLS for desktop requests when a client
+// CA is configured. The handshake has already verified the chain.
+func requireClientCert(r *http.Request) error {
+	if tlsClientCAFile == "" {
+		return nil
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return errors.New("client certificate required")
+	}
+	return nil
+}
+
+// clientTLSConfig is used for outbound integrations. caFile adds a private
+// CA to the trusted roots; empty means the system roots.
+func clientTLSConfig(caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s contains no certificates", caFile)
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}